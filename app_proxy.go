@@ -1,35 +1,69 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
 
 // AppProxy acts like an HDHomeRun app
 type AppProxy struct {
-	codec        *MessageCodec
-	tcpTransport net.Conn
-	tcpMutex     sync.Mutex
-	hdhrServer   *HDHREndpointServer
-	httpServer   *http.Server
+	sessions      map[int]*tunerProxySession
+	sessionsMutex sync.Mutex
+	nextSessionID int
+	hdhrServer    *HDHREndpointServer
+	httpServer    *http.Server
+	seenDevices   map[string]bool                 // devices that answered a broadcast query; guarded by sessionsMutex
+	discovered    map[string]DiscoveredTunerStats // by DeviceID; guarded by sessionsMutex
+	tunnelTLS     *tls.Config                     // requires tuner proxies to connect over mutual TLS; nil for plain TCP
 	backendRouter
 }
 
+// tunerProxySession is a single connected TunerProxy. Replies to a query are
+// written back to the session the query arrived on.
+type tunerProxySession struct {
+	id          int
+	conn        net.Conn
+	link        *tunnelLink
+	connectedAt time.Time
+	queries     int // guarded by AppProxy.sessionsMutex
+	replies     int // guarded by AppProxy.sessionsMutex
+	controls    *controlRelay
+	streams     *streamRelay
+}
+
+// TunerProxySessionStats is a point-in-time snapshot of one TunerProxy connection
+type TunerProxySessionStats struct {
+	ID          int
+	RemoteAddr  string
+	ConnectedAt time.Time
+	Queries     int
+	Replies     int
+	Controls    int // relayed control-protocol sessions currently open
+	Streams     int // relayed HTTP requests and streams currently open
+	Protocol    int // tunnel protocol version; 0 until the handshake settles
+}
+
 // NewAppProxy creates a new AppProxy
 func NewAppProxy(store *configStore) *AppProxy {
 	return &AppProxy{
-		codec: NewMessageCodec(),
+		sessions: make(map[int]*tunerProxySession),
 		backendRouter: backendRouter{
 			name:  "AppProxy",
 			store: store,
 			resolveLocalIP: func(appAddr *net.UDPAddr) string {
-				ip, err := GetLocalIPForConnection(appAddr.IP.String() + ":65001")
+				ip, err := localIPForApp(appAddr)
 				if err != nil {
 					return "127.0.0.1"
 				}
@@ -41,24 +75,18 @@ func NewAppProxy(store *configStore) *AppProxy {
 
 // Run starts the app proxy server
 // bindAddr: address to listen on (e.g., "0.0.0.0" or "192.168.1.5")
-// directIP: if provided, listen for UDP broadcasts and proxy directly to this HDHomeRun IP
+// directIPs: if provided, listen for UDP broadcasts and proxy directly to these HDHomeRun IPs
 // cfg: configuration object for tuning parameters
-func (ap *AppProxy) Run(ctx context.Context, bindAddr, directIP string, store *configStore) error {
+func (ap *AppProxy) Run(ctx context.Context, bindAddr string, directIPs []string, store *configStore) error {
 	cfg := store.Get()
-	ap.directHDHRIP = directIP
-	ap.useTunarrOnly = cfg.Tunarr.UseTunarrOnly
-
-	// Initialize Tunarr backend if enabled
-	if cfg.Tunarr.Enabled {
-		ap.tunarr = NewTunarrBackend(cfg.Tunarr.Host, cfg.Tunarr.Port, cfg.Tunarr.HttpTimeout)
-		if ap.tunarr.IsAvailable(ctx) {
-			slog.Info("Tunarr backend available", "host", cfg.Tunarr.Host, "port", cfg.Tunarr.Port)
-		} else {
-			slog.Warn("Tunarr backend not available", "host", cfg.Tunarr.Host, "port", cfg.Tunarr.Port)
-			if cfg.Tunarr.UseTunarrOnly {
-				return fmt.Errorf("tunarr backend required but not available")
-			}
-		}
+	if len(cfg.Backends) > 0 && len(directIPs) > 0 {
+		slog.Warn("Direct HDHomeRun IPs ignored: backends are configured", "direct_hdhomerun_ips", directIPs)
+	}
+	if err := ap.useBackends(cfg.BackendConfigs(directIPs, cfg.Device.VirtualDevice)); err != nil {
+		return err
+	}
+	if err := ap.startBackends(ctx); err != nil {
+		return err
 	}
 
 	// Initialize HDHR endpoint server for discovery endpoints
@@ -71,8 +99,31 @@ func (ap *AppProxy) Run(ctx context.Context, bindAddr, directIP string, store *c
 		go ap.logActiveConnections(ctx, store)
 	}
 
-	if directIP != "" || (ap.tunarr != nil && ap.useTunarrOnly) {
-		// Direct mode: listen for UDP broadcasts and proxy to the HDHomeRun/Tunarr directly
+	// Configured backends, direct HDHomeRuns or Tunarr alone answer broadcasts
+	// here; otherwise they are relayed from a tuner proxy
+	if len(cfg.Backends) > 0 || len(directIPs) > 0 || (cfg.Tunarr.Enabled && cfg.Tunarr.UseTunarrOnly) {
+		// Direct mode: listen for UDP broadcasts and route them to the backends
+		go ap.startControlServer(ctx, bindAddr)
+		// Only the emulated device is advertised, over mDNS or SSDP; relayed
+		// HDHomeRuns advertise themselves, and it would have no lineup of its own
+		if cfg.Device.MDNS && !ap.emulatesDevice() {
+			slog.Warn("mDNS advertisement not started", "err", "no backend answers discovery as the emulated device")
+		} else if cfg.Device.MDNS {
+			mdns := newMDNSResponder(&ap.backendRouter, cfg.Device.MDNSInterfaces)
+			if err := mdns.start(); err != nil {
+				slog.Warn("mDNS advertisement not started", "err", err)
+			}
+			defer mdns.stop()
+		}
+		if cfg.Device.SSDP && !ap.emulatesDevice() {
+			slog.Warn("SSDP advertisement not started", "err", "no backend answers discovery as the emulated device")
+		} else if cfg.Device.SSDP {
+			ssdp := newSSDPResponder(&ap.backendRouter, cfg.Device.SSDPInterfaces)
+			if err := ssdp.start(); err != nil {
+				slog.Warn("SSDP advertisement not started", "err", err)
+			}
+			defer ssdp.stop()
+		}
 		return ap.runDirectMode(ctx, bindAddr, cfg)
 	} else {
 		// Tuner proxy mode: listen for TCP connections from the tuner proxy
@@ -86,19 +137,38 @@ func (ap *AppProxy) runDirectMode(ctx context.Context, bindAddr string, cfg *Con
 		bindAddr = "0.0.0.0"
 	}
 
+	// Bound to every address, IPv6 is left to the discovery group socket,
+	// which takes the port's IPv6 unicast queries as well
+	network := "udp"
+	ip := net.ParseIP(bindAddr)
+	anyAddr := ip != nil && ip.IsUnspecified()
+	if anyAddr {
+		network = "udp4"
+		bindAddr = "0.0.0.0"
+	}
+
 	addr := net.JoinHostPort(bindAddr, fmt.Sprintf("%d", HDHomeRunDiscoveryUDPPort))
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
 	if err != nil {
 		return err
 	}
 
-	conn, err := net.ListenUDP("udp", udpAddr)
+	conn, err := net.ListenUDP(network, udpAddr)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
-	slog.Info("App proxy listening for UDP broadcasts", "addr", addr, "direct_hdhomerun_ip", ap.directHDHRIP)
+	slog.Info("App proxy listening for UDP broadcasts", "addr", addr, "backends", ap.backendNames())
+
+	if anyAddr {
+		if err := listenDiscoveryIPv6(ctx, func(data []byte, from *net.UDPAddr, conn *net.UDPConn) {
+			slog.Debug("Request received from app", "bytes", len(data), "source", from.String())
+			go ap.forwardToBackend(data, from, conn, ctx)
+		}); err != nil {
+			slog.Warn("IPv6 discovery not started", "err", err)
+		}
+	}
 
 	buf := make([]byte, UDPReadBufferSize)
 
@@ -128,7 +198,7 @@ func (ap *AppProxy) runDirectMode(ctx context.Context, bindAddr string, cfg *Con
 			slog.Debug("Request received from app", "bytes", n, "source", remoteAddr.String())
 
 			// Forward the query to HDHR/Tunarr backend
-			go ap.forwardToBackend(buf[:n], remoteAddr, conn, ctx)
+			go ap.forwardToBackend(append([]byte(nil), buf[:n]...), remoteAddr, conn, ctx)
 		}
 	}
 }
@@ -139,14 +209,20 @@ func (ap *AppProxy) runTunerProxyMode(ctx context.Context, bindAddr string, cfg
 		bindAddr = "0.0.0.0"
 	}
 
-	addr := fmt.Sprintf("%s:%d", bindAddr, TCPPort)
+	tlsCfg, err := loadTunnelTLS(cfg, true)
+	if err != nil {
+		return err
+	}
+	ap.tunnelTLS = tlsCfg
+
+	addr := net.JoinHostPort(bindAddr, strconv.Itoa(TCPPort))
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 	defer listener.Close()
 
-	slog.Info("App proxy listening for tuner proxy", "addr", addr)
+	slog.Info("App proxy listening for tuner proxy", "addr", addr, "tls", tlsCfg != nil, "psk", cfg.Tunnel.PSK != "")
 
 	// Accept connections in a goroutine
 	go func() {
@@ -169,7 +245,7 @@ func (ap *AppProxy) runTunerProxyMode(ctx context.Context, bindAddr string, cfg
 				continue
 			}
 
-			go ap.handleTunerProxyConnection(ctx, conn)
+			go ap.handleTCPConnection(ctx, conn)
 		}
 	}()
 
@@ -177,16 +253,77 @@ func (ap *AppProxy) runTunerProxyMode(ctx context.Context, bindAddr string, cfg
 	return nil
 }
 
-// handleTunerProxyConnection handles a connection from the tuner proxy
+// handleTCPConnection dispatches a connection accepted on the tuner proxy
+// port. Apps talk the HDHomeRun control protocol on the same port, so a
+// connection whose first packet is a get/set request is answered as the
+// emulated device instead of being treated as a tuner proxy. When the tunnel
+// requires TLS, anything else must open with a TLS handshake.
+func (ap *AppProxy) handleTCPConnection(ctx context.Context, conn net.Conn) {
+	br := bufio.NewReader(conn)
+	header, err := br.Peek(2)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn = &peekedConn{Conn: conn, r: br}
+
+	if binary.BigEndian.Uint16(header) == HDHRTypeGetSetReq && ap.hdhrServer != nil {
+		ap.hdhrServer.HandleControlConn(ctx, conn)
+		return
+	}
+
+	if ap.tunnelTLS != nil {
+		if header[0] != tlsRecordHandshake {
+			slog.Warn("Refused unauthenticated tuner proxy: TLS is required", "addr", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		tlsConn := tls.Server(conn, ap.tunnelTLS)
+		tlsConn.SetDeadline(time.Now().Add(tunnelHelloTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			slog.Warn("Refused tuner proxy: TLS handshake failed", "addr", conn.RemoteAddr(), "err", err)
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		slog.Debug("Tuner proxy presented certificate", "addr", conn.RemoteAddr(), "name", tlsPeerName(tlsConn))
+		conn = tlsConn
+	}
+	ap.handleTunerProxyConnection(ctx, conn)
+}
+
+// tlsRecordHandshake is the first byte of a TLS ClientHello
+const tlsRecordHandshake = 0x16
+
+// peekedConn is a net.Conn whose first bytes were already buffered by a bufio.Reader
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (pc *peekedConn) Read(b []byte) (int, error) {
+	return pc.r.Read(b)
+}
+
+// handleTunerProxyConnection handles a connection from a tuner proxy
 func (ap *AppProxy) handleTunerProxyConnection(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
 
+	sess := ap.addSession(conn)
+	defer ap.removeSession(sess)
+
 	peername := conn.RemoteAddr()
-	slog.Info("Tuner proxy connected", "addr", peername)
+	slog.Info("Tuner proxy connected", "addr", peername, "session", sess.id)
+
+	interval := time.Duration(ap.store.Get().GetTunnelKeepaliveSeconds()) * time.Second
+	done := make(chan struct{})
+	defer close(done)
+	go sess.link.runKeepalive(interval, done)
 
-	ap.tcpMutex.Lock()
-	ap.tcpTransport = conn
-	ap.tcpMutex.Unlock()
+	// A peer that must prove the pre-shared key gets a bounded time to do so
+	if sess.link.requiresAuth() {
+		conn.SetReadDeadline(time.Now().Add(tunnelHelloTimeout))
+	}
 
 	codec := NewMessageCodec()
 	buf := make([]byte, UDPReadBufferSize)
@@ -198,108 +335,432 @@ func (ap *AppProxy) handleTunerProxyConnection(ctx context.Context, conn net.Con
 		default:
 		}
 
+		if sess.link.isSettled() {
+			sess.link.extendDeadline(keepaliveTimeout(interval))
+		}
 		n, err := conn.Read(buf)
 		if err != nil {
-			slog.Info("Tuner proxy disconnected", "addr", peername)
-			ap.tcpMutex.Lock()
-			ap.tcpTransport = nil
-			ap.tcpMutex.Unlock()
+			slog.Info("Tuner proxy disconnected", "addr", peername, "session", sess.id, "err", err)
 			return
 		}
 
 		if n > 0 {
-			slog.Debug("Request received from tuner proxy", "bytes", n)
-			codec.Decode(buf[:n], ap.onReceivedMessage)
+			slog.Debug("Request received from tuner proxy", "bytes", n, "session", sess.id)
+			codec.Decode(buf[:n], func(msg []byte) {
+				ap.onReceivedMessage(sess, msg)
+			})
+		}
+	}
+}
+
+// addSession registers a newly connected tuner proxy
+func (ap *AppProxy) addSession(conn net.Conn) *tunerProxySession {
+	ap.sessionsMutex.Lock()
+	defer ap.sessionsMutex.Unlock()
+
+	ap.nextSessionID++
+	sess := &tunerProxySession{
+		id:          ap.nextSessionID,
+		conn:        conn,
+		link:        newTunnelLink(conn, ap.store.Get().Tunnel.PSK),
+		connectedAt: time.Now(),
+	}
+	sess.controls = newControlRelay(
+		func(id uint16, op byte, data []byte) error {
+			return ap.sendToSession(sess, tunnelMsgControl, uint32(id), encodeOpPayload(op, data))
+		},
+		ap.dialControlTarget,
+	)
+	sess.streams = newStreamRelay(
+		func(id uint32, op byte, data []byte) error {
+			return ap.sendToSession(sess, tunnelMsgStream, id, encodeOpPayload(op, data))
+		},
+		ap.fetchRelayedStream,
+	)
+	ap.sessions[sess.id] = sess
+	return sess
+}
+
+// removeSession forgets a disconnected tuner proxy
+func (ap *AppProxy) removeSession(sess *tunerProxySession) {
+	ap.sessionsMutex.Lock()
+	delete(ap.sessions, sess.id)
+	ap.sessionsMutex.Unlock()
+
+	sess.controls.closeAll()
+	sess.streams.closeAll()
+}
+
+// sessionStats returns a snapshot of every connected tuner proxy, ordered by session ID
+func (ap *AppProxy) sessionStats() []TunerProxySessionStats {
+	ap.sessionsMutex.Lock()
+	defer ap.sessionsMutex.Unlock()
+
+	out := make([]TunerProxySessionStats, 0, len(ap.sessions))
+	for _, sess := range ap.sessions {
+		protocol := 0
+		if sess.link.isSettled() {
+			protocol = sess.link.protocolVersion()
+		}
+		out = append(out, TunerProxySessionStats{
+			ID:          sess.id,
+			RemoteAddr:  sess.conn.RemoteAddr().String(),
+			ConnectedAt: sess.connectedAt,
+			Queries:     sess.queries,
+			Replies:     sess.replies,
+			Controls:    sess.controls.count(),
+			Streams:     sess.streams.count(),
+			Protocol:    protocol,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Stats extends the backendRouter stats with the connected tuner proxies
+func (ap *AppProxy) Stats() ProxyStats {
+	s := ap.backendRouter.Stats()
+	s.TunerProxies = ap.sessionStats()
+	s.Discovered = ap.discoveredStats()
+	return s
+}
+
+// onReceivedMessage handles a message from a tuner proxy
+func (ap *AppProxy) onReceivedMessage(sess *tunerProxySession, msg []byte) {
+	wasSettled := sess.link.isSettled()
+	f, err := sess.link.receive(msg)
+	if err != nil {
+		if errors.Is(err, errTunnelUnauthenticated) {
+			slog.Warn("Refused unauthenticated tuner proxy", "addr", sess.conn.RemoteAddr(), "session", sess.id, "err", err)
+		} else {
+			slog.Error("Dropping tuner proxy", "session", sess.id, "err", err)
 		}
+		sess.conn.Close()
+		return
+	}
+	if !wasSettled && sess.link.isLegacy() {
+		slog.Warn("Tuner proxy speaks the legacy tunnel protocol; relaying discovery only", "session", sess.id, "protocol", tunnelLegacyVersion)
+	}
+
+	switch f.Type {
+	case tunnelMsgHello:
+		if err := sess.link.sendHello("AppProxy"); err != nil {
+			sess.conn.Close()
+			return
+		}
+		if sess.link.isSettled() {
+			slog.Info("Tuner proxy handshake complete", "session", sess.id, "protocol", tunnelProtocolVersion)
+		}
+	case tunnelMsgAuth:
+		slog.Info("Tuner proxy handshake complete", "session", sess.id, "protocol", tunnelProtocolVersion, "psk", true)
+	case tunnelMsgDiscover, tunnelMsgDiscover6:
+		ap.onDiscoverQuery(sess, f.Type, f.Payload)
+	case tunnelMsgControl:
+		if op, data, ok := decodeOpPayload(f.Payload); ok {
+			sess.controls.handle(uint16(f.Channel), op, data)
+		}
+	case tunnelMsgStream:
+		if op, data, ok := decodeOpPayload(f.Payload); ok {
+			sess.streams.handle(f.Channel, op, data)
+		}
+	case tunnelMsgPing:
+		ap.sendToSession(sess, tunnelMsgPong, f.Channel, nil) //nolint:errcheck
+	case tunnelMsgPong:
+	default:
+		slog.Debug("Ignoring unknown tunnel message", "type", f.Type, "session", sess.id)
 	}
 }
 
-// onReceivedMessage handles a message from the tuner proxy
-func (ap *AppProxy) onReceivedMessage(msg []byte) {
-	if len(msg) < 6 {
-		slog.Warn("Invalid message: too short", "len", len(msg))
+// onDiscoverQuery sends a discovery query relayed by a tuner proxy to the
+// tuners on this network, over the same IP version the app used
+func (ap *AppProxy) onDiscoverQuery(sess *tunerProxySession, typ byte, msg []byte) {
+	appAddr, queryData, err := decodeDiscoverPayload(typ, msg)
+	if err != nil {
+		slog.Warn("Invalid discovery query", "len", len(msg), "session", sess.id, "err", err)
 		return
 	}
 
-	// Unpack the message
-	sourceAddr := msg[0:4]
-	sourcePort := binary.BigEndian.Uint16(msg[4:6])
-	queryData := msg[6:]
+	ap.sessionsMutex.Lock()
+	sess.queries++
+	ap.sessionsMutex.Unlock()
+
+	network := "udp4"
+	if typ == tunnelMsgDiscover6 {
+		network = "udp6"
+	}
 
 	// Perform the query
-	ap.queryTuner(queryData, func(replyData []byte) {
-		ap.reply(sourceAddr, sourcePort, replyData)
+	ap.queryTuner(network, queryData, func(replyData []byte) {
+		ap.reply(sess, appAddr, replyData)
 	})
 }
 
-// queryTuner sends a broadcast query to tuners
-func (ap *AppProxy) queryTuner(queryData []byte, callback func([]byte)) {
-	go func() {
-		broadcastAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("255.255.255.255:%d", HDHomeRunDiscoveryUDPPort))
-		if err != nil {
-			slog.Error("Error resolving broadcast address", "err", err)
+// queryTuner sends a discovery query to tuners on app.discovery_interfaces
+// in the background; see queryTunersOn
+func (ap *AppProxy) queryTuner(network string, queryData []byte, callback func([]byte)) {
+	go ap.queryTunersOn(network, ap.store.Get().App.DiscoveryInterfaces, queryData, callback)
+}
+
+// queryTunersOn sends a discovery query to tuners: for network "udp4" a
+// directed broadcast on each named interface (every interface if names is
+// empty), or for "udp6" a multicast to the IPv6 discovery group on them.
+// callback is called with each device's reply received before the UDP read
+// timeout.
+func (ap *AppProxy) queryTunersOn(network string, names []string, queryData []byte, callback func([]byte)) {
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		slog.Error("Error creating UDP socket", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	var targets []discoveryTarget
+	if network == "udp6" {
+		if sendDiscoveryIPv6(conn, queryData, names) == 0 {
+			slog.Error("Error sending IPv6 discovery query: no multicast interface")
 			return
 		}
-
-		localAddr, err := net.ResolveUDPAddr("udp", "0.0.0.0:0")
-		if err != nil {
-			slog.Error("Error resolving local address", "err", err)
+	} else {
+		targets = discoveryTargets(names)
+		if len(targets) == 0 {
+			// No usable interface found; leave it to the routing table
+			targets = []discoveryTarget{{broadcast: net.IPv4bcast}}
+		}
+		sent := 0
+		for _, t := range targets {
+			if _, err := conn.WriteToUDP(queryData, &net.UDPAddr{IP: t.broadcast, Port: HDHomeRunDiscoveryUDPPort}); err != nil {
+				slog.Warn("Error sending broadcast query", "interface", t.iface, "broadcast", t.broadcast, "err", err)
+				continue
+			}
+			sent++
+		}
+		if sent == 0 {
 			return
 		}
+	}
+
+	ap.collectTunerReplies(conn, targets, callback)
+}
 
-		conn, err := net.ListenUDP("udp", localAddr)
+// collectTunerReplies reads discovery replies from conn until the UDP read
+// timeout and passes each device's first reply to callback, so a device
+// reached on several interfaces is relayed once. Devices are told apart by
+// DeviceID, or by address for replies without one.
+func (ap *AppProxy) collectTunerReplies(conn *net.UDPConn, targets []discoveryTarget, callback func([]byte)) {
+	conn.SetReadDeadline(time.Now().Add(time.Duration(UDPReadTimeout) * time.Millisecond))
+	seen := make(map[string]bool)
+	buf := make([]byte, UDPReadBufferSize)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			slog.Error("Error creating UDP socket", "err", err)
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				slog.Error("Error reading UDP response", "err", err)
+			}
 			return
 		}
-		defer conn.Close()
+		if n == 0 {
+			continue
+		}
 
-		_, err = conn.WriteTo(queryData, broadcastAddr)
-		if err != nil {
-			slog.Error("Error sending broadcast query", "err", err)
-			return
+		deviceID := discoveryReplyDeviceID(buf[:n])
+		key := deviceID
+		if key == "" {
+			key = from.String()
+		}
+		if seen[key] {
+			slog.Debug("Ignoring duplicate reply from tuner", "from", from, "device_id", deviceID)
+			continue
 		}
+		seen[key] = true
 
-		conn.SetReadDeadline(time.Now().Add(time.Duration(UDPReadTimeout) * time.Millisecond))
-		buf := make([]byte, UDPReadBufferSize)
-		for {
-			n, _, err := conn.ReadFromUDP(buf)
-			if err != nil {
-				if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
-					slog.Error("Error reading UDP response", "err", err)
-				}
-				return
-			}
-			if n > 0 {
-				slog.Debug("Reply received from tuner", "bytes", n)
-				callback(buf[:n])
-			}
+		iface := from.Zone
+		if iface == "" {
+			iface = interfaceFor(targets, from.IP)
 		}
-	}()
+		slog.Debug("Reply received from tuner", "bytes", n, "from", from, "device_id", deviceID, "interface", iface)
+		ap.recordTuner(deviceID, from, iface)
+		callback(buf[:n])
+	}
 }
 
-// reply sends a reply message back to the tuner proxy
-func (ap *AppProxy) reply(sourceAddr []byte, sourcePort uint16, replyData []byte) {
-	ap.tcpMutex.Lock()
-	defer ap.tcpMutex.Unlock()
+// recordTuner remembers a device that answered discovery, and the interface
+// its reply arrived on
+func (ap *AppProxy) recordTuner(deviceID string, from *net.UDPAddr, iface string) {
+	ap.sessionsMutex.Lock()
+	defer ap.sessionsMutex.Unlock()
 
-	if ap.tcpTransport == nil {
+	ip := udpAddrHost(from)
+	if ap.seenDevices == nil {
+		ap.seenDevices = make(map[string]bool)
+	}
+	ap.seenDevices[ip] = true
+
+	if deviceID == "" {
 		return
 	}
+	if ap.discovered == nil {
+		ap.discovered = make(map[string]DiscoveredTunerStats)
+	}
+	ap.discovered[deviceID] = DiscoveredTunerStats{
+		DeviceID:  deviceID,
+		IP:        ip,
+		Interface: iface,
+		LastSeen:  time.Now(),
+	}
+}
+
+// discoveredStats returns the devices that answered discovery, ordered by DeviceID
+func (ap *AppProxy) discoveredStats() []DiscoveredTunerStats {
+	ap.sessionsMutex.Lock()
+	defer ap.sessionsMutex.Unlock()
+
+	out := make([]DiscoveredTunerStats, 0, len(ap.discovered))
+	for _, d := range ap.discovered {
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DeviceID < out[j].DeviceID })
+	return out
+}
+
+// reply sends a reply message back to the tuner proxy that sent the query
+func (ap *AppProxy) reply(sess *tunerProxySession, appAddr *net.UDPAddr, replyData []byte) {
+	if origin := ap.store.Get().App.RewriteBaseURL; origin != "" {
+		replyData = rewriteDiscoveryOrigin(replyData, origin)
+	}
 
 	// Pack up the reply
-	replyMsg := make([]byte, 6+len(replyData))
-	copy(replyMsg[0:4], sourceAddr)
-	binary.BigEndian.PutUint16(replyMsg[4:6], sourcePort)
-	copy(replyMsg[6:], replyData)
-
-	// Encode and send
-	encoded := ap.codec.Encode(replyMsg)
-	_, err := ap.tcpTransport.Write(encoded)
+	typ, replyMsg := encodeDiscoverPayload(appAddr, replyData)
+	if err := ap.sendToSession(sess, typ, 0, replyMsg); err != nil {
+		slog.Error("Error sending reply", "err", err, "session", sess.id)
+		return
+	}
+
+	ap.sessionsMutex.Lock()
+	sess.replies++
+	ap.sessionsMutex.Unlock()
+}
+
+// sendToSession writes a frame to a tuner proxy, closing the connection if
+// the write fails
+func (ap *AppProxy) sendToSession(sess *tunerProxySession, typ byte, channel uint32, payload []byte) error {
+	err := sess.link.send(typ, channel, payload)
+	if err != nil && err != errTunnelLegacyPeer {
+		sess.conn.Close()
+	}
+	return err
+}
+
+// controlTarget returns the device relayed control sessions are opened to:
+// app.control_hdhomerun_ip if set, otherwise the only HDHomeRun known from
+// discovery replies and the direct devices. A control session doesn't say
+// which device the app meant, so with several known it is refused rather
+// than sent to an arbitrary one.
+func (ap *AppProxy) controlTarget() (string, error) {
+	if ip := ap.store.Get().App.ControlHDHRIP; ip != "" {
+		return ip, nil
+	}
+	known := make(map[string]bool)
+	ap.sessionsMutex.Lock()
+	for ip := range ap.seenDevices {
+		known[ip] = true
+	}
+	ap.sessionsMutex.Unlock()
+	for _, hb := range ap.hdhrBackends() {
+		for _, ip := range hb.devices {
+			known[ip] = true
+		}
+	}
+	if len(known) > 1 {
+		return "", fmt.Errorf("%d HDHomeRuns known, set app.control_hdhomerun_ip to the one control sessions go to", len(known))
+	}
+	for ip := range known {
+		return ip, nil
+	}
+	return "", fmt.Errorf("no HDHomeRun known to relay control session to")
+}
+
+// hdhrBackends returns the router's HDHomeRun backends, in priority order
+func (ap *AppProxy) hdhrBackends() []*hdhrBackend {
+	var out []*hdhrBackend
+	for _, b := range ap.backends {
+		if hb, ok := b.Backend.(*hdhrBackend); ok {
+			out = append(out, hb)
+		}
+	}
+	return out
+}
+
+// dialControlTarget opens a control-protocol connection to the target device
+func (ap *AppProxy) dialControlTarget() (net.Conn, error) {
+	ip, err := ap.controlTarget()
+	if err != nil {
+		slog.Error("Not relaying control session", "err", err)
+		return nil, err
+	}
+	addr := net.JoinHostPort(ip, strconv.Itoa(HDHomeRunControlTCPPort))
+	slog.Debug("Opening relayed control session", "device", addr)
+	return net.DialTimeout("tcp", addr, time.Duration(ReconnectInterval)*time.Second)
+}
+
+// fetchRelayedStream fetches a URL a tuner proxy asked to relay. Only devices
+// that answered discovery, or are configured, may be fetched from, so the
+// tunnel can't be used to reach anything else on this network.
+func (ap *AppProxy) fetchRelayedStream(ctx context.Context, rawURL string) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid relay URL %q", rawURL)
+	}
+	if !ap.isKnownDevice(u.Hostname()) {
+		return nil, fmt.Errorf("%s is not a known HDHomeRun", u.Hostname())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
 	if err != nil {
-		slog.Error("Error sending reply", "err", err)
-		ap.tcpTransport = nil
+		return nil, err
+	}
+	return relayHTTPClient.Do(req)
+}
+
+// relayHTTPClient fetches relayed requests; streams run indefinitely, so only
+// the wait for response headers is bounded
+var relayHTTPClient = &http.Client{
+	Transport: &http.Transport{ResponseHeaderTimeout: relayHeaderTimeout},
+}
+
+// isKnownDevice reports whether ip answered discovery or is a configured device
+func (ap *AppProxy) isKnownDevice(ip string) bool {
+	ap.sessionsMutex.Lock()
+	seen := ap.seenDevices[ip]
+	ap.sessionsMutex.Unlock()
+	if seen || (ip != "" && ip == ap.store.Get().App.ControlHDHRIP) {
+		return true
+	}
+	for _, hb := range ap.hdhrBackends() {
+		for _, device := range hb.devices {
+			if device == ip {
+				return true
+			}
+		}
 	}
+	return false
+}
+
+// startControlServer answers the HDHomeRun control protocol on TCP 65001 for
+// the emulated device. In tuner proxy mode that port is shared with the tuner
+// proxy listener instead (see handleTCPConnection).
+func (ap *AppProxy) startControlServer(ctx context.Context, bindAddr string) {
+	if ap.hdhrServer == nil {
+		return
+	}
+
+	addr := net.JoinHostPort(bindAddr, strconv.Itoa(HDHomeRunControlTCPPort))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Warn("HDHomeRun control server not started", "addr", addr, "err", err)
+		return
+	}
+
+	slog.Info("HDHomeRun control server listening", "addr", addr)
+	ap.hdhrServer.ServeControl(ctx, listener)
 }
 
 // startHDHRHTTPServer starts the HTTP server for HDHR endpoints on port 5004
@@ -308,7 +769,7 @@ if ap.hdhrServer == nil {
 return
 }
 
-addr := net.JoinHostPort(bindAddr, "5004")
+addr := net.JoinHostPort(bindAddr, strconv.Itoa(HDHRHTTPPort))
 ap.httpServer = &http.Server{
 Addr:    addr,
 Handler: ap.hdhrServer.Handler(),
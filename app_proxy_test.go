@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeSession registers one end of a net.Pipe as a tuner proxy session and
+// returns the other end, which plays the part of the TunerProxy
+func pipeSession(t *testing.T, ap *AppProxy) (*tunerProxySession, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return ap.addSession(server), client
+}
+
+func TestAppProxyReplyRoutesToQueryingSession(t *testing.T) {
+	ap := NewAppProxy(newConfigStore(DefaultConfig(), ""))
+	first, firstPeer := pipeSession(t, ap)
+	second, secondPeer := pipeSession(t, ap)
+	if first.id == second.id {
+		t.Fatalf("sessions share ID %d", first.id)
+	}
+
+	received := make(chan []byte, 1)
+	go func() {
+		codec := NewMessageCodec()
+		buf := make([]byte, UDPReadBufferSize)
+		n, err := secondPeer.Read(buf)
+		if err != nil {
+			return
+		}
+		codec.Decode(buf[:n], func(msg []byte) { received <- msg })
+	}()
+
+	go ap.reply(second, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 7), Port: 5000}, []byte("reply"))
+
+	select {
+	case msg := <-received:
+		f, err := parseTunnelFrame(msg)
+		if err != nil || f.Type != tunnelMsgDiscover {
+			t.Fatalf("Expected a discover frame, got % x (%v)", msg, err)
+		}
+		if string(f.Payload[6:]) != "reply" {
+			t.Errorf("unexpected reply payload %q", f.Payload[6:])
+		}
+		if net.IP(f.Payload[0:4]).String() != "192.168.1.7" {
+			t.Errorf("unexpected source address %v", net.IP(f.Payload[0:4]))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reply not delivered to the querying session")
+	}
+
+	// Nothing should have been written to the other session
+	firstPeer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, _ := firstPeer.Read(make([]byte, 16)); n != 0 {
+		t.Errorf("reply leaked to session %d", first.id)
+	}
+}
+
+func TestAppProxyReplyToIPv6App(t *testing.T) {
+	ap := NewAppProxy(newConfigStore(DefaultConfig(), ""))
+	sess, peer := pipeSession(t, ap)
+
+	app := &net.UDPAddr{IP: net.ParseIP("fe80::7"), Port: 5000, Zone: "eth1"}
+	go ap.reply(sess, app, []byte("reply"))
+
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	f, err := parseTunnelFrame(readTunnelMessage(t, peer))
+	if err != nil || f.Type != tunnelMsgDiscover6 {
+		t.Fatalf("Expected an IPv6 discover frame, got %+v, %v", f, err)
+	}
+	got, data, err := decodeDiscoverPayload(f.Type, f.Payload)
+	if err != nil || got.String() != app.String() || string(data) != "reply" {
+		t.Errorf("Expected the reply addressed to %v, got %v %q, %v", app, got, data, err)
+	}
+}
+
+func TestAppProxyStatsListsSessions(t *testing.T) {
+	ap := NewAppProxy(newConfigStore(DefaultConfig(), ""))
+	first, _ := pipeSession(t, ap)
+	second, _ := pipeSession(t, ap)
+
+	s := ap.Stats()
+	if len(s.TunerProxies) != 2 {
+		t.Fatalf("expected 2 tuner proxy sessions, got %d", len(s.TunerProxies))
+	}
+	if s.TunerProxies[0].ID != first.id || s.TunerProxies[1].ID != second.id {
+		t.Errorf("sessions not ordered by ID: %+v", s.TunerProxies)
+	}
+
+	ap.removeSession(first)
+	s = ap.Stats()
+	if len(s.TunerProxies) != 1 || s.TunerProxies[0].ID != second.id {
+		t.Errorf("expected only session %d after removal, got %+v", second.id, s.TunerProxies)
+	}
+}
+
+func TestAppProxyDispatchesControlProtocol(t *testing.T) {
+	ap := NewAppProxy(newConfigStore(DefaultConfig(), ""))
+	ap.hdhrServer = NewHDHREndpointServer(ap.store, ap)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ap.handleTCPConnection(ctx, server)
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	if _, err := client.Write((&ControlRequest{Name: "/sys/hwmodel"}).Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := ReadHDHRPacket(client)
+	if err != nil {
+		t.Fatalf("no control reply: %v", err)
+	}
+	reply, err := ParseControlReply(pkt)
+	if err != nil || reply.Value != "HDFX-4K" {
+		t.Errorf("Expected /sys/hwmodel HDFX-4K, got %+v, %v", reply, err)
+	}
+	if s := ap.Stats(); len(s.TunerProxies) != 0 {
+		t.Errorf("control session registered as a tuner proxy: %+v", s.TunerProxies)
+	}
+}
+
+func TestAppProxyAnswersTunnelHandshake(t *testing.T) {
+	ap := NewAppProxy(newConfigStore(DefaultConfig(), ""))
+
+	server, client := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ap.handleTCPConnection(ctx, server)
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	peer := newTunnelLink(client, "")
+	if err := peer.sendHello("TunerProxy"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readTunnelMessage(t, client); msg != nil {
+		if hello, err := parseTunnelHello(msg); err != nil || hello.Role != "AppProxy" || hello.Version != tunnelProtocolVersion {
+			t.Errorf("Expected AppProxy hello, got %+v, %v", hello, err)
+		}
+	}
+
+	if err := peer.write(tunnelFrame{Version: tunnelProtocolVersion, Type: tunnelMsgPing, Channel: 9}.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readTunnelMessage(t, client); msg != nil {
+		if f, err := parseTunnelFrame(msg); err != nil || f.Type != tunnelMsgPong || f.Channel != 9 {
+			t.Errorf("Expected pong on channel 9, got % x", msg)
+		}
+	}
+
+	s := ap.Stats()
+	if len(s.TunerProxies) != 1 || s.TunerProxies[0].Protocol != tunnelProtocolVersion {
+		t.Errorf("Expected one v%d tuner proxy, got %+v", tunnelProtocolVersion, s.TunerProxies)
+	}
+}
+
+func TestAppProxyRejectsMismatchedTunnelVersion(t *testing.T) {
+	ap := NewAppProxy(newConfigStore(DefaultConfig(), ""))
+
+	server, client := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ap.handleTCPConnection(ctx, server)
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	payload := []byte(`{"magic":"hdhomerun_proxy","version":3,"role":"TunerProxy"}`)
+	if _, err := client.Write(NewMessageCodec().Encode(tunnelFrame{Version: 3, Type: tunnelMsgHello, Payload: payload}.marshal())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Read(make([]byte, 16)); err == nil {
+		t.Error("Expected the app proxy to close a connection speaking another protocol version")
+	}
+}
+
+// readTunnelMessage reads one length-prefixed message from conn
+func readTunnelMessage(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	codec := NewMessageCodec()
+	buf := make([]byte, UDPReadBufferSize)
+	var out []byte
+	for out == nil {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Errorf("reading tunnel message: %v", err)
+			return nil
+		}
+		codec.Decode(buf[:n], func(msg []byte) {
+			if out == nil {
+				out = append([]byte(nil), msg...)
+			}
+		})
+	}
+	return out
+}
+
+func TestAppProxyRelaysOnlyKnownDevices(t *testing.T) {
+	ap := NewAppProxy(newConfigStore(DefaultConfig(), ""))
+	if err := ap.useBackends([]BackendConfig{{Type: backendTypeHDHR, Devices: []string{"127.0.0.1"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ap.fetchRelayedStream(context.Background(), "http://10.9.9.9/discover.json"); err == nil {
+		t.Error("Expected a relay request to an unknown host to be refused")
+	}
+	if _, err := ap.fetchRelayedStream(context.Background(), "file:///etc/passwd"); err == nil {
+		t.Error("Expected a non-HTTP relay request to be refused")
+	}
+	if !ap.isKnownDevice("127.0.0.1") || ap.isKnownDevice("") {
+		t.Error("Expected only configured devices to be known")
+	}
+}
+
+func TestAppProxyControlTarget(t *testing.T) {
+	ap := NewAppProxy(newConfigStore(DefaultConfig(), ""))
+	if _, err := ap.controlTarget(); err == nil {
+		t.Error("Expected no control target without a known device")
+	}
+
+	ap.seenDevices = map[string]bool{"192.168.1.50": true}
+	if ip, err := ap.controlTarget(); err != nil || ip != "192.168.1.50" {
+		t.Errorf("Expected the only known device, got %q (%v)", ip, err)
+	}
+
+	ap.seenDevices["192.168.1.51"] = true
+	if ip, err := ap.controlTarget(); err == nil {
+		t.Errorf("Expected control sessions refused with two devices known, got %q", ip)
+	}
+
+	cfg := DefaultConfig()
+	cfg.App.ControlHDHRIP = "192.168.1.51"
+	ap.store = newConfigStore(cfg, "")
+	if ip, err := ap.controlTarget(); err != nil || ip != "192.168.1.51" {
+		t.Errorf("Expected control_hdhomerun_ip, got %q (%v)", ip, err)
+	}
+}
+
+func TestAppProxyReplyRewritesBaseURL(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.App.RewriteBaseURL = "http://198.51.100.7:5004"
+	ap := NewAppProxy(newConfigStore(cfg, ""))
+	sess, peer := pipeSession(t, ap)
+
+	reply := (&DiscoverReply{DeviceType: HDHRDeviceTypeTuner, DeviceID: 0x10101010, BaseURL: "http://10.0.0.5:80", LineupURL: "http://10.0.0.5:80/lineup.json"}).Marshal()
+	go ap.reply(sess, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 7), Port: 5000}, reply)
+
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	f, err := parseTunnelFrame(readTunnelMessage(t, peer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseDiscoverReply(f.Payload[6:])
+	if err != nil || got.BaseURL != "http://198.51.100.7:5004" || got.LineupURL != "http://198.51.100.7:5004/lineup.json" {
+		t.Errorf("Expected rewritten URLs, got %+v, %v", got, err)
+	}
+}
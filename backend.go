@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"time"
+)
+
+// Backend is a source of channels and tuners. backendRouter consults its
+// backends in priority order for discovery, lineups and streams, so a new
+// kind of source only needs a Backend implementation and an entry in newBackend.
+type Backend interface {
+	// Name identifies the backend in logs and stats
+	Name() string
+	// Start prepares the backend before it is first used
+	Start(ctx context.Context) error
+	// Discover answers an app's discovery query, reporting whether it did
+	Discover(ctx context.Context, q *discoveryQuery) bool
+	// Lineup returns the channels the backend serves, or nil if it publishes no lineup
+	Lineup(ctx context.Context) ([]TunarrLineupItem, error)
+	// TunerCount is the number of tuners the backend offers; 0 if unknown
+	TunerCount() int
+	// OpenStream reserves a tuner for channel and returns the URL its stream
+	// is fetched from and a func that frees the tuner. errChannelNotCarried
+	// and ErrNoTunerAvailable let the router try the next backend.
+	OpenStream(channel string) (string, func(), error)
+	// Healthy reports whether the backend answered its most recent request
+	Healthy() bool
+	// Stats returns a snapshot of the backend for display
+	Stats() BackendStats
+}
+
+// Backend types accepted in the backends config list
+const (
+	backendTypeHDHR     = "hdhr"
+	backendTypeTunarr   = "tunarr"
+	backendTypeIPTV     = "iptv"
+	backendTypeHDHRHTTP = "hdhr_http"
+)
+
+// Fallback rules for a backend: what the router does with a request the
+// backend can't serve
+const (
+	backendFallbackNext = "next" // try the next backend (default)
+	backendFallbackNone = "none" // stop; later backends are never consulted
+)
+
+// errChannelNotCarried is returned by Backend.OpenStream when the backend
+// doesn't carry the channel at all
+var errChannelNotCarried = errors.New("channel not carried by backend")
+
+// BackendStats is a point-in-time snapshot of one backend. Priority and
+// Fallback are filled in by the router.
+type BackendStats struct {
+	Name       string
+	Type       string
+	Priority   int
+	Fallback   string
+	Healthy    bool
+	TunerCount int
+	Detail     string              // backend-specific summary, e.g. its address
+	Devices    []DirectDeviceStats // hdhr: per-device health, in configured order
+	Sync       *LineupSyncStats    // nil if the lineup isn't synced in the background
+}
+
+// discoveryQuery is one app discovery query being routed to the backends
+type discoveryQuery struct {
+	data    []byte
+	appAddr *net.UDPAddr
+	conn    *net.UDPConn
+	router  *backendRouter
+}
+
+// reply sends a discovery response to the app that asked
+func (q *discoveryQuery) reply(data []byte) error {
+	_, err := q.conn.WriteToUDP(data, q.appAddr)
+	return err
+}
+
+// discoveryRelayer is implemented by backends that may pass discovery on to
+// real devices rather than answer as the emulated device
+type discoveryRelayer interface {
+	relaysDiscovery() bool
+}
+
+// answerAsEmulatedDevice answers the query as the device this proxy emulates,
+// for backends that are served from our own HTTP endpoints
+func (q *discoveryQuery) answerAsEmulatedDevice() bool {
+	return q.router.answerDiscovery(q.data, q.appAddr, q.conn)
+}
+
+// newBackend creates the backend described by bc
+func newBackend(bc BackendConfig, store *configStore) (Backend, error) {
+	switch bc.Type {
+	case backendTypeHDHR:
+		if len(bc.Devices) == 0 {
+			return nil, fmt.Errorf("backend %q: hdhr backend needs at least one device", bc.displayName())
+		}
+		return newHDHRBackend(bc.displayName(), bc.Devices, bc.VirtualDevice, store), nil
+	case backendTypeTunarr:
+		if bc.Host == "" {
+			return nil, fmt.Errorf("backend %q: tunarr backend needs a host", bc.displayName())
+		}
+		tb := NewTunarrBackend(bc.Host, bc.Port, bc.HttpTimeout)
+		tb.name = bc.displayName()
+		return tb, nil
+	case backendTypeHDHRHTTP:
+		if bc.URL == "" {
+			return nil, fmt.Errorf("backend %q: hdhr_http backend needs a url", bc.displayName())
+		}
+		return newHDHRHTTPBackend(bc.displayName(), bc.URL, bc.HttpTimeout), nil
+	case backendTypeIPTV:
+		if bc.Playlist == "" {
+			return nil, fmt.Errorf("backend %q: iptv backend needs a playlist", bc.displayName())
+		}
+		return newIPTVBackend(bc.displayName(), bc.Playlist, bc.XMLTV, bc.MaxStreams, bc.HttpTimeout), nil
+	default:
+		return nil, fmt.Errorf("backend %q: unknown type %q", bc.displayName(), bc.Type)
+	}
+}
+
+// routedBackend is a backend with the routing rules it was configured with
+type routedBackend struct {
+	Backend
+	priority int
+	fallback string
+	syncer   *lineupSyncer // nil if lineup_sync_seconds disables syncing
+}
+
+// buildBackendChain creates the configured backends, ordered by priority
+// (ties keep their configured order) and cut off after the first backend
+// that doesn't fall back
+func buildBackendChain(configs []BackendConfig, store *configStore) ([]routedBackend, error) {
+	var chain []routedBackend
+	for _, bc := range configs {
+		if bc.Fallback != "" && bc.Fallback != backendFallbackNext && bc.Fallback != backendFallbackNone {
+			return nil, fmt.Errorf("backend %q: unknown fallback %q", bc.displayName(), bc.Fallback)
+		}
+		b, err := newBackend(bc, store)
+		if err != nil {
+			return nil, err
+		}
+		fallback := bc.Fallback
+		if fallback == "" {
+			fallback = backendFallbackNext
+		}
+		rb := routedBackend{Backend: b, priority: bc.Priority, fallback: fallback}
+		if bc.LineupSync >= 0 {
+			interval := bc.LineupSync
+			if interval == 0 {
+				interval = DefaultLineupSyncSeconds
+			}
+			rb.syncer = newLineupSyncer(b, time.Duration(interval)*time.Second)
+		}
+		chain = append(chain, rb)
+	}
+
+	sort.SliceStable(chain, func(i, j int) bool { return chain[i].priority < chain[j].priority })
+	for i, b := range chain {
+		if b.fallback == backendFallbackNone {
+			for _, skipped := range chain[i+1:] {
+				slog.Warn("Backend is never consulted: an earlier backend does not fall back", "backend", skipped.Name(), "after", b.Name())
+			}
+			return chain[:i+1], nil
+		}
+	}
+	return chain, nil
+}
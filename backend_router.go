@@ -2,191 +2,513 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// backendRouter answers discovery, lineup and stream requests from an
+// ordered chain of backends; see Config.Backends for the routing rules
 type backendRouter struct {
-	tunarr                 *TunarrBackend
-	useTunarrOnly          bool
-	directHDHRIP           string
+	backends               []routedBackend // in priority order
 	store                  *configStore
 	activeConnectionsMutex sync.Mutex
 	activeUDPConnections   int
 	activeDialConnections  int
 	name                   string
 	resolveLocalIP         func(*net.UDPAddr) string
+
+	routesMu      sync.Mutex
+	lineups       map[Backend]backendLineup     // per backend: its last lineup after channel rules; set once it returns one
+	lineupVersion uint64                        // bumped whenever a refresh changes a backend's lineup
+	routes        map[Backend]map[string]string // per backend: listed GuideNumber -> GuideNumber it published; set once it returns a lineup
+	guides        map[Backend]guideIndex        // per backend: how its XMLTV guide may identify each listed channel
+	tunersChanged func()                        // set by watchTunerCount
+}
+
+// backendLineup is a backend's lineup as last fetched, after channel rules
+type backendLineup struct {
+	items     []TunarrLineupItem
+	fetchedAt time.Time
 }
 
 // ProxyStats is a point-in-time snapshot of backendRouter state for display.
 type ProxyStats struct {
-	Name             string
-	DirectHDHRIP     string
-	TunarrPort       int
-	TunarrConfigured bool // true if tunarr != nil (configured at startup)
-	ActiveUDP        int
-	ActiveDial       int
+	Name         string
+	Backends     []BackendStats // in priority order
+	ActiveUDP    int
+	ActiveDial   int
+	TunerProxies []TunerProxySessionStats // AppProxy only: connected TunerProxy sessions
+	Discovered   []DiscoveredTunerStats   // AppProxy only: devices that answered relayed discovery
 }
 
 func (br *backendRouter) Stats() ProxyStats {
 	br.activeConnectionsMutex.Lock()
-	defer br.activeConnectionsMutex.Unlock()
 	s := ProxyStats{
-		Name:         br.name,
-		DirectHDHRIP: br.directHDHRIP,
-		ActiveUDP:    br.activeUDPConnections,
-		ActiveDial:   br.activeDialConnections,
+		Name:       br.name,
+		ActiveUDP:  br.activeUDPConnections,
+		ActiveDial: br.activeDialConnections,
 	}
-	if br.tunarr != nil {
-		s.TunarrPort = br.tunarr.port
-		s.TunarrConfigured = true
+	br.activeConnectionsMutex.Unlock()
+
+	for _, b := range br.backends {
+		bs := b.Stats()
+		bs.Priority = b.priority
+		bs.Fallback = b.fallback
+		if b.syncer != nil {
+			if sync, ok := b.syncer.Stats(); ok {
+				bs.Sync = &sync
+			}
+		}
+		s.Backends = append(s.Backends, bs)
 	}
 	return s
 }
 
-func (br *backendRouter) buildDiscoveryPacket(srcIP string) []byte {
-	cfg := br.store.Get()
+// useBackends builds the backend chain from configs
+func (br *backendRouter) useBackends(configs []BackendConfig) error {
+	chain, err := buildBackendChain(configs, br.store)
+	if err != nil {
+		return err
+	}
+	br.backends = chain
+	return nil
+}
 
-	// Get device model info
-	modelType := cfg.Device.ModelType
-	if modelType == "" {
-		modelType = "HDFX-4K"
+// startBackends starts every backend and its lineup syncer, which runs until
+// ctx is done. A backend that fails to start is still routed to (it may
+// recover) unless nothing can fall back from it.
+func (br *backendRouter) startBackends(ctx context.Context) error {
+	for _, b := range br.backends {
+		if err := b.Start(ctx); err != nil {
+			if b.fallback == backendFallbackNone {
+				return fmt.Errorf("backend %s is required but failed to start: %w", b.Name(), err)
+			}
+			slog.Warn("Backend failed to start", "backend", b.Name(), "err", err)
+		}
+	}
+	br.notifyTunerCount()
+	for _, b := range br.backends {
+		if b.syncer != nil {
+			go b.syncer.run(ctx, br)
+		}
 	}
+	return nil
+}
 
-	modelInfo, err := GetModelInfo(modelType)
-	if err != nil {
-		modelInfo, _ = GetModelInfo("HDFX-4K")
+// emulatesDevice reports whether some backend answers discovery as the
+// emulated device, rather than relaying it to devices that answer for
+// themselves
+func (br *backendRouter) emulatesDevice() bool {
+	for _, b := range br.backends {
+		if r, ok := b.Backend.(discoveryRelayer); !ok || !r.relaysDiscovery() {
+			return true
+		}
+	}
+	return false
+}
+
+// LineupSyncing reports whether any backend's lineup is being synced
+func (br *backendRouter) LineupSyncing() bool {
+	for _, b := range br.backends {
+		if b.syncer != nil && b.syncer.syncing() {
+			return true
+		}
+	}
+	return false
+}
+
+// consultOrder returns the backends in the order a request should try them:
+// healthy ones by priority, then unhealthy ones as a last resort. A backend
+// that doesn't fall back always ends the chain, since it gets the final say.
+func (br *backendRouter) consultOrder() []routedBackend {
+	chain := br.backends
+	var last []routedBackend
+	if n := len(chain); n > 0 && chain[n-1].fallback == backendFallbackNone {
+		chain, last = chain[:n-1], chain[n-1:]
+	}
+
+	ordered := make([]routedBackend, 0, len(br.backends))
+	var unhealthy []routedBackend
+	for _, b := range chain {
+		if b.Healthy() {
+			ordered = append(ordered, b)
+		} else {
+			unhealthy = append(unhealthy, b)
+		}
 	}
+	return append(append(ordered, unhealthy...), last...)
+}
 
-	// Get or generate Device ID
-	deviceID := cfg.Device.DeviceID
-	if deviceID == "" {
-		deviceID = GenerateRealisticDeviceID(modelType)
+// backendNames lists the backends in priority order, for logging
+func (br *backendRouter) backendNames() []string {
+	names := make([]string, 0, len(br.backends))
+	for _, b := range br.backends {
+		names = append(names, b.Name())
 	}
+	return names
+}
 
-	// Get device auth
-	deviceAuth := cfg.Device.DeviceAuth
-	if deviceAuth == "" {
-		deviceAuth = "00000000"
+// beginDial counts an outstanding backend query for the active connection
+// stats; call the returned func when it completes
+func (br *backendRouter) beginDial() func() {
+	br.activeConnectionsMutex.Lock()
+	br.activeDialConnections++
+	br.activeConnectionsMutex.Unlock()
+	return func() {
+		br.activeConnectionsMutex.Lock()
+		br.activeDialConnections--
+		br.activeConnectionsMutex.Unlock()
 	}
+}
 
-	// Get friendly name
-	friendlyName := cfg.Device.FriendlyName
-	if friendlyName == "" {
-		friendlyName = modelInfo.FriendlyName
+// buildDiscoveryReply describes the emulated device as a discover reply whose
+// BaseURL and LineupURL point at srcIP
+func (br *backendRouter) buildDiscoveryReply(srcIP string) *DiscoverReply {
+	cfg := br.store.Get()
+	id := ResolveDeviceIdentity(cfg)
+
+	deviceID, err := parseDeviceIDHex(id.DeviceID)
+	if err != nil {
+		slog.Warn("Invalid device ID in config, advertising auto-generated ID", "device_id", id.DeviceID)
+		deviceID, _ = parseDeviceIDHex(GenerateRealisticDeviceID(id.Model.ModelNumber))
 	}
 
-	// Get firmware version
-	firmwareVersion := cfg.Device.FirmwareVersion
-	if firmwareVersion == "" {
-		firmwareVersion = "20250825"
+	baseURL := advertisedBaseURL(cfg, "http", net.JoinHostPort(srcIP, strconv.Itoa(HDHRHTTPPort)))
+	return &DiscoverReply{
+		DeviceType: HDHRDeviceTypeTuner,
+		DeviceID:   deviceID,
+		TunerCount: br.tunerCount(id),
+		DeviceAuth: id.DeviceAuth,
+		BaseURL:    baseURL,
+		LineupURL:  baseURL + "/lineup.json",
 	}
+}
+
+// buildDiscoveryPacket builds a binary discover reply packet for the emulated device
+func (br *backendRouter) buildDiscoveryPacket(srcIP string) []byte {
+	return br.buildDiscoveryReply(srcIP).Marshal()
+}
+
+// buildDiscoveryText builds the legacy CRLF text reply sent to plain-text
+// "discover" queries
+func (br *backendRouter) buildDiscoveryText(srcIP string) []byte {
+	cfg := br.store.Get()
+	id := ResolveDeviceIdentity(cfg)
+	baseURL := advertisedBaseURL(cfg, "http", net.JoinHostPort(srcIP, strconv.Itoa(HDHRHTTPPort)))
 
-	// Build the discovery response packet
-	response := fmt.Sprintf("Device: %s\r\n", modelInfo.ModelNumber)
-	response += fmt.Sprintf("DeviceID: %s\r\n", deviceID)
-	response += fmt.Sprintf("DeviceAuth: %s\r\n", deviceAuth)
-	response += fmt.Sprintf("BaseURL: http://%s:5004\r\n", srcIP)
-	response += fmt.Sprintf("LineupURL: http://%s:5004/lineup.json\r\n", srcIP)
-	response += fmt.Sprintf("TunerCount: %d\r\n", modelInfo.TunerCount)
-	response += fmt.Sprintf("FirmwareName: %s\r\n", modelInfo.FirmwareName)
-	response += fmt.Sprintf("FirmwareVersion: %s\r\n", firmwareVersion)
-	response += fmt.Sprintf("FriendlyName: %s\r\n", friendlyName)
+	response := fmt.Sprintf("Device: %s\r\n", id.Model.ModelNumber)
+	response += fmt.Sprintf("DeviceID: %s\r\n", id.DeviceID)
+	response += fmt.Sprintf("DeviceAuth: %s\r\n", id.DeviceAuth)
+	response += fmt.Sprintf("BaseURL: %s\r\n", baseURL)
+	response += fmt.Sprintf("LineupURL: %s/lineup.json\r\n", baseURL)
+	response += fmt.Sprintf("TunerCount: %d\r\n", br.tunerCount(id))
+	response += fmt.Sprintf("FirmwareName: %s\r\n", id.Model.FirmwareName)
+	response += fmt.Sprintf("FirmwareVersion: %s\r\n", id.FirmwareVersion)
+	response += fmt.Sprintf("FriendlyName: %s\r\n", id.FriendlyName)
 
 	return []byte(response)
 }
 
-func (br *backendRouter) forwardToBackend(queryData []byte, appAddr *net.UDPAddr, replyConn *net.UDPConn, ctx context.Context) {
-	if br.tunarr != nil {
-		if br.forwardToTunarr(queryData, appAddr, replyConn, ctx) {
-			return
+// tunerCount is the number of tuners to advertise: the total across the
+// backends that know theirs, otherwise the emulated model's tuner count
+func (br *backendRouter) tunerCount(id DeviceIdentity) int {
+	if n := br.TunerCount(); n > 0 {
+		return n
+	}
+	return id.Model.TunerCount
+}
+
+// watchTunerCount calls fn whenever a backend has started or been
+// refreshed, since either may change TunerCount
+func (br *backendRouter) watchTunerCount(fn func()) {
+	br.routesMu.Lock()
+	defer br.routesMu.Unlock()
+	br.tunersChanged = fn
+}
+
+// notifyTunerCount calls the watchTunerCount func, if any
+func (br *backendRouter) notifyTunerCount() {
+	br.routesMu.Lock()
+	fn := br.tunersChanged
+	br.routesMu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// TunerCount returns the total tuners across the backends that know theirs
+func (br *backendRouter) TunerCount() int {
+	total := 0
+	for _, b := range br.backends {
+		total += b.TunerCount()
+	}
+	return total
+}
+
+// OpenStream reserves a tuner for channel (a GuideNumber) on the first
+// backend that carries it and has one free, returning the upstream URL and
+// a func that releases the tuner. ErrNoTunerAvailable is returned if some
+// backend carries the channel but every such backend is busy.
+func (br *backendRouter) OpenStream(channel string) (string, func(), error) {
+	var errs []error
+	busy := false
+	for _, b := range br.consultOrder() {
+		published, ok := br.publishedChannel(b.Backend, channel)
+		if !ok {
+			continue
 		}
-		if br.useTunarrOnly {
-			slog.Warn("Tunarr-only mode but Tunarr request failed")
-			return
+		url, release, err := b.OpenStream(published)
+		if err == nil {
+			slog.Debug("Stream routed", "backend", b.Name(), "channel", channel, "backend_channel", published)
+			return url, release, nil
 		}
+		if errors.Is(err, ErrNoTunerAvailable) {
+			busy = true
+		} else if !errors.Is(err, errChannelNotCarried) {
+			errs = append(errs, fmt.Errorf("%s: %w", b.Name(), err))
+		}
+	}
+
+	if busy {
+		return "", nil, ErrNoTunerAvailable
+	}
+	if len(errs) > 0 {
+		return "", nil, errors.Join(errs...)
+	}
+	if len(br.backends) == 0 {
+		return "", nil, fmt.Errorf("no stream backend configured")
 	}
+	return "", nil, errChannelNotCarried
+}
 
-	if br.directHDHRIP != "" {
-		br.forwardToDirectHDHR(queryData, appAddr, replyConn)
+// publishedChannel maps a channel number from our lineup to the number b
+// published it as, reporting false if b's last lineup didn't list it.
+// Backends that haven't returned a lineup are asked for the number as-is.
+func (br *backendRouter) publishedChannel(b Backend, channel string) (string, bool) {
+	br.routesMu.Lock()
+	defer br.routesMu.Unlock()
+	published, ok := br.routes[b]
+	if !ok {
+		return channel, true
 	}
+	n, ok := published[channel]
+	return n, ok
 }
 
-func (br *backendRouter) forwardToTunarr(queryData []byte, appAddr *net.UDPAddr, replyConn *net.UDPConn, ctx context.Context) bool {
-	queryStr := string(queryData)
-	if queryStr == "TYPE: discover\r\n" || queryStr == "discover" {
-		var localIP string
-		if br.resolveLocalIP != nil {
-			localIP = br.resolveLocalIP(appAddr)
-		} else {
-			localIP = appAddr.IP.String()
-		}
+// channelRules compiles the configured channel rules. Invalid rules are
+// rejected when the config is saved, so one here is logged and all are skipped.
+func (br *backendRouter) channelRules() channelRules {
+	if br.store == nil {
+		return nil
+	}
+	rules, err := compileChannelRules(br.store.Get().ChannelRules)
+	if err != nil {
+		slog.Warn("Ignoring channel rules", "err", err)
+		return nil
+	}
+	return rules
+}
 
-		// Use the new discovery packet builder that includes Device ID
-		response := br.buildDiscoveryPacket(localIP)
-		_, err := replyConn.WriteToUDP(response, appAddr)
-		if err != nil {
-			slog.Error("Error sending discovery response to app", "err", err)
-			return false
+// Lineup merges the backends' lineups in priority order, after rewriting
+// each with the channel rules. When several carry the same GuideNumber the
+// first backend's entry is listed. Channels hidden by a rule follow the
+// visible ones, unless a visible channel has their number. A router whose
+// backends publish no lineup returns an empty list; an error is returned
+// only if every backend that publishes one failed. A backend refreshed
+// within lineup_cache_seconds, usually by its background sync, isn't
+// fetched again.
+func (br *backendRouter) Lineup(ctx context.Context) ([]TunarrLineupItem, error) {
+	ttl := time.Duration(br.store.Get().GetLineupCacheSeconds()) * time.Second
+	var errs []error
+	answered := false
+	failed := make(map[Backend]bool)
+	for _, b := range br.backends {
+		if br.lineupFresh(b.Backend, ttl) {
+			answered = true
+			continue
+		}
+		if _, err := br.refreshLineup(ctx, b.Backend, b.syncer); err != nil {
+			slog.Warn("Backend lineup unavailable", "backend", b.Name(), "err", err)
+			errs = append(errs, fmt.Errorf("%s: %w", b.Name(), err))
+			failed[b.Backend] = true
+			continue
 		}
+		answered = true
+	}
+	if !answered && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
 
-		slog.Debug("Discovery response sent", "bytes", len(response), "device_id", br.store.Get().Device.DeviceID)
-		return true
+	var merged, hidden []TunarrLineupItem
+	seen := make(map[string]bool)
+	br.routesMu.Lock()
+	defer br.routesMu.Unlock()
+	for _, b := range br.backends {
+		if failed[b.Backend] {
+			continue
+		}
+		for _, item := range br.lineups[b.Backend].items {
+			if item.Hidden {
+				hidden = append(hidden, item)
+				continue
+			}
+			if seen[item.GuideNumber] {
+				continue
+			}
+			seen[item.GuideNumber] = true
+			merged = append(merged, item)
+		}
 	}
+	for _, item := range hidden {
+		if !seen[item.GuideNumber] {
+			seen[item.GuideNumber] = true
+			merged = append(merged, item)
+		}
+	}
+	return merged, nil
+}
 
-	return false
+// lineupFresh reports whether b's lineup was fetched less than ttl ago
+func (br *backendRouter) lineupFresh(b Backend, ttl time.Duration) bool {
+	br.routesMu.Lock()
+	defer br.routesMu.Unlock()
+	l, ok := br.lineups[b]
+	return ok && time.Since(l.fetchedAt) < ttl
 }
 
-func (br *backendRouter) forwardToDirectHDHR(queryData []byte, appAddr *net.UDPAddr, replyConn *net.UDPConn) {
-	br.activeConnectionsMutex.Lock()
-	br.activeDialConnections++
-	br.activeConnectionsMutex.Unlock()
-	defer func() {
-		br.activeConnectionsMutex.Lock()
-		br.activeDialConnections--
-		br.activeConnectionsMutex.Unlock()
-	}()
+// refreshLineup fetches b's lineup, applies the channel rules and stores it
+// with its routes and guide index for Lineup, OpenStream and XMLTV to use.
+// A change from the stored lineup is logged and recorded on the backend's
+// syncer, if it has one. A backend that publishes no lineup returns nil.
+func (br *backendRouter) refreshLineup(ctx context.Context, b Backend, syncer *lineupSyncer) ([]TunarrLineupItem, error) {
+	items, err := b.Lineup(ctx)
+	br.notifyTunerCount()
+	if err != nil || items == nil {
+		return nil, err
+	}
 
-	hdhrAddr := net.JoinHostPort(br.directHDHRIP, fmt.Sprintf("%d", HDHomeRunDiscoveryUDPPort))
-	hdhrUDPAddr, err := net.ResolveUDPAddr("udp", hdhrAddr)
-	if err != nil {
-		slog.Error("Error resolving HDHomeRun address", "addr", hdhrAddr, "err", err)
-		return
+	items, route := br.channelRules().apply(b.Name(), items)
+	guide := make(guideIndex)
+	for n, published := range route {
+		guide.add("num:"+published, n)
+	}
+	for _, item := range items {
+		if item.Hidden {
+			continue
+		}
+		if item.GuideID != "" {
+			guide.add("id:"+item.GuideID, item.GuideNumber)
+		}
+		guide.add("name:"+strings.ToLower(item.GuideName), item.GuideNumber)
 	}
 
-	conn, err := net.DialUDP("udp", nil, hdhrUDPAddr)
-	if err != nil {
-		slog.Error("Error connecting to HDHomeRun", "addr", hdhrAddr, "err", err)
-		return
+	br.routesMu.Lock()
+	prev, hadLineup := br.lineups[b]
+	var d LineupDiff
+	if hadLineup {
+		d = diffLineups(prev.items, items)
+	}
+	if !d.empty() {
+		br.lineupVersion++
 	}
-	defer conn.Close()
+	if br.lineups == nil {
+		br.lineups = make(map[Backend]backendLineup)
+		br.routes = make(map[Backend]map[string]string)
+		br.guides = make(map[Backend]guideIndex)
+	}
+	br.lineups[b] = backendLineup{items: items, fetchedAt: time.Now()}
+	br.routes[b] = route
+	br.guides[b] = guide
+	br.routesMu.Unlock()
 
-	_, err = conn.Write(queryData)
-	if err != nil {
-		slog.Error("Error sending query to HDHomeRun", "err", err)
-		return
+	if !d.empty() {
+		logLineupDiff(b.Name(), d)
+		syncer.recordChange(d)
 	}
+	return items, nil
+}
 
-	conn.SetReadDeadline(time.Now().Add(time.Duration(UDPReadTimeout) * time.Millisecond))
-	respBuf := make([]byte, UDPReadBufferSize)
-	n, err := conn.Read(respBuf)
-	if err != nil {
-		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
-			slog.Error("Error reading response from HDHomeRun", "err", err)
+// InvalidateLineups marks every stored lineup stale, so each backend is
+// fetched again, with the channel rules then configured, at the next Lineup.
+// The stale lineups stay in place, with their routes, until then.
+func (br *backendRouter) InvalidateLineups() {
+	br.routesMu.Lock()
+	defer br.routesMu.Unlock()
+	for b, l := range br.lineups {
+		l.fetchedAt = time.Time{}
+		br.lineups[b] = l
+	}
+	br.lineupVersion++
+}
+
+// LineupVersion changes whenever a backend's lineup does, so a cached merged
+// lineup can be replaced as soon as a background sync finds a change
+func (br *backendRouter) LineupVersion() uint64 {
+	br.routesMu.Lock()
+	defer br.routesMu.Unlock()
+	return br.lineupVersion
+}
+
+// forwardToBackend routes an app's discovery query through the backends
+// until one answers
+func (br *backendRouter) forwardToBackend(queryData []byte, appAddr *net.UDPAddr, replyConn *net.UDPConn, ctx context.Context) {
+	q := &discoveryQuery{data: queryData, appAddr: appAddr, conn: replyConn, router: br}
+	for _, b := range br.consultOrder() {
+		if b.Discover(ctx, q) {
+			return
+		}
+		if b.fallback == backendFallbackNone {
+			slog.Warn("Backend did not answer discovery and does not fall back", "backend", b.Name())
+			return
 		}
-		return
 	}
+}
 
-	if n > 0 {
-		slog.Debug("Response received from HDHomeRun", "bytes", n)
-		_, err := replyConn.WriteToUDP(respBuf[:n], appAddr)
+// answerDiscovery answers a discovery query as the emulated device, reporting
+// whether a reply was sent
+func (br *backendRouter) answerDiscovery(queryData []byte, appAddr *net.UDPAddr, replyConn *net.UDPConn) bool {
+	var response []byte
+
+	queryStr := string(queryData)
+	if queryStr == "TYPE: discover\r\n" || queryStr == "discover" {
+		response = br.buildDiscoveryText(br.localIPFor(appAddr))
+	} else {
+		req, err := ParseDiscoverRequest(queryData)
 		if err != nil {
-			slog.Error("Error sending response to app", "err", err)
+			slog.Debug("Ignoring non-discover packet", "bytes", len(queryData), "err", err)
+			return false
+		}
+
+		reply := br.buildDiscoveryReply(br.localIPFor(appAddr))
+		if !req.Matches(reply.DeviceType, reply.DeviceID) {
+			slog.Debug("Discover request does not match emulated device", "device_id", fmt.Sprintf("%08X", req.DeviceID))
+			return false
 		}
+		response = reply.Marshal()
+	}
+
+	_, err := replyConn.WriteToUDP(response, appAddr)
+	if err != nil {
+		slog.Error("Error sending discovery response to app", "err", err)
+		return false
+	}
+
+	slog.Debug("Discovery response sent", "bytes", len(response), "device_id", br.store.Get().Device.DeviceID)
+	return true
+}
+
+// localIPFor returns the IP the app should use to reach this proxy
+func (br *backendRouter) localIPFor(appAddr *net.UDPAddr) string {
+	if br.resolveLocalIP != nil {
+		return br.resolveLocalIP(appAddr)
 	}
+	return appAddr.IP.String()
 }
 
 func (br *backendRouter) logActiveConnections(ctx context.Context, store *configStore) {
@@ -1,40 +1,89 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"net"
 	"testing"
+	"time"
 )
 
-func TestBackendRouterStatsBasic(t *testing.T) {
-	br := backendRouter{
-		name:         "AppProxy",
-		directHDHRIP: "192.168.1.50",
+// fakeBackend is a Backend with canned answers that records what it was asked
+type fakeBackend struct {
+	name      string
+	answers   bool
+	healthy   bool
+	lineup    []TunarrLineupItem
+	lineupErr error
+	fetches   int // Lineup calls
+	tuners    int
+	streamErr error
+	asked     int
+}
+
+func (f *fakeBackend) Name() string                    { return f.name }
+func (f *fakeBackend) Start(ctx context.Context) error { return nil }
+func (f *fakeBackend) TunerCount() int                 { return f.tuners }
+func (f *fakeBackend) Healthy() bool                   { return f.healthy }
+func (f *fakeBackend) Stats() BackendStats {
+	return BackendStats{Name: f.name, Type: "fake", Healthy: f.healthy}
+}
+
+func (f *fakeBackend) Discover(ctx context.Context, q *discoveryQuery) bool {
+	f.asked++
+	return f.answers
+}
+
+func (f *fakeBackend) Lineup(ctx context.Context) ([]TunarrLineupItem, error) {
+	f.fetches++
+	return f.lineup, f.lineupErr
+}
+
+func (f *fakeBackend) OpenStream(channel string) (string, func(), error) {
+	if f.streamErr != nil {
+		return "", nil, f.streamErr
 	}
+	return "http://" + f.name + "/" + channel, func() {}, nil
+}
+
+// fakeChain builds a router over backends in the given order with the given fallbacks
+func fakeChain(backends []*fakeBackend, fallbacks ...string) *backendRouter {
+	br := &backendRouter{name: "AppProxy", store: newConfigStore(DefaultConfig(), "")}
+	for i, b := range backends {
+		fallback := backendFallbackNext
+		if i < len(fallbacks) {
+			fallback = fallbacks[i]
+		}
+		br.backends = append(br.backends, routedBackend{Backend: b, priority: i, fallback: fallback})
+	}
+	return br
+}
+
+func TestBackendRouterStatsBasic(t *testing.T) {
+	br := fakeChain([]*fakeBackend{{name: "one", healthy: true}, {name: "two"}}, backendFallbackNext, backendFallbackNone)
 	s := br.Stats()
 	if s.Name != "AppProxy" {
 		t.Errorf("expected Name=AppProxy, got %q", s.Name)
 	}
-	if s.DirectHDHRIP != "192.168.1.50" {
-		t.Errorf("expected DirectHDHRIP=192.168.1.50, got %q", s.DirectHDHRIP)
+	if len(s.Backends) != 2 {
+		t.Fatalf("expected 2 backends, got %d", len(s.Backends))
 	}
-	if s.TunarrConfigured {
-		t.Error("expected TunarrConfigured=false when tunarr is nil")
+	if s.Backends[0].Name != "one" || !s.Backends[0].Healthy || s.Backends[0].Fallback != backendFallbackNext {
+		t.Errorf("unexpected first backend %+v", s.Backends[0])
 	}
-	if s.TunarrPort != 0 {
-		t.Errorf("expected TunarrPort=0, got %d", s.TunarrPort)
+	if s.Backends[1].Priority != 1 || s.Backends[1].Healthy || s.Backends[1].Fallback != backendFallbackNone {
+		t.Errorf("unexpected second backend %+v", s.Backends[1])
 	}
 }
 
 func TestBackendRouterStatsTunarr(t *testing.T) {
-	br := backendRouter{
-		name:   "TunerProxy",
-		tunarr: &TunarrBackend{port: 8000},
+	br := &backendRouter{name: "TunerProxy"}
+	if err := br.useBackends([]BackendConfig{{Type: backendTypeTunarr, Host: "tunarr.local", Port: 8000}}); err != nil {
+		t.Fatal(err)
 	}
 	s := br.Stats()
-	if !s.TunarrConfigured {
-		t.Error("expected TunarrConfigured=true when tunarr != nil")
-	}
-	if s.TunarrPort != 8000 {
-		t.Errorf("expected TunarrPort=8000, got %d", s.TunarrPort)
+	if len(s.Backends) != 1 || s.Backends[0].Type != backendTypeTunarr || s.Backends[0].Detail != "tunarr.local:8000" {
+		t.Errorf("unexpected Tunarr stats %+v", s.Backends)
 	}
 }
 
@@ -52,3 +101,220 @@ func TestBackendRouterStatsConnectionCounts(t *testing.T) {
 		t.Errorf("expected ActiveDial=1, got %d", s.ActiveDial)
 	}
 }
+
+// discoverOverLoopback sends query through answerDiscovery and returns whatever
+// reply arrives at the fake app socket (nil on timeout)
+func discoverOverLoopback(t *testing.T, br *backendRouter, query []byte) (bool, []byte) {
+	t.Helper()
+	app, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	proxy, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	handled := br.answerDiscovery(query, app.LocalAddr().(*net.UDPAddr), proxy)
+	if !handled {
+		return false, nil
+	}
+
+	app.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, UDPReadBufferSize)
+	n, _, err := app.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no reply received: %v", err)
+	}
+	return true, buf[:n]
+}
+
+func TestAnswerDiscoveryBinary(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Device.DeviceID = "1072ABCD"
+	br := &backendRouter{name: "AppProxy", store: newConfigStore(cfg, "")}
+
+	handled, data := discoverOverLoopback(t, br, (&DiscoverRequest{DeviceID: HDHRDeviceIDWildcard}).Marshal())
+	if !handled {
+		t.Fatal("expected binary discover request to be answered")
+	}
+	reply, err := ParseDiscoverReply(data)
+	if err != nil {
+		t.Fatalf("reply is not a binary discover reply: %v", err)
+	}
+	if reply.DeviceID != 0x1072ABCD {
+		t.Errorf("expected DeviceID 1072ABCD, got %08X", reply.DeviceID)
+	}
+	if reply.TunerCount != 4 {
+		t.Errorf("expected TunerCount 4, got %d", reply.TunerCount)
+	}
+	if reply.BaseURL != "http://127.0.0.1:5004" {
+		t.Errorf("unexpected BaseURL %q", reply.BaseURL)
+	}
+	if reply.LineupURL != "http://127.0.0.1:5004/lineup.json" {
+		t.Errorf("unexpected LineupURL %q", reply.LineupURL)
+	}
+	if reply.DeviceAuth != "00000000" {
+		t.Errorf("unexpected DeviceAuth %q", reply.DeviceAuth)
+	}
+}
+
+func TestAnswerDiscoveryDeviceIDFilter(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Device.DeviceID = "1072ABCD"
+	br := &backendRouter{name: "AppProxy", store: newConfigStore(cfg, "")}
+
+	handled, _ := discoverOverLoopback(t, br, (&DiscoverRequest{DeviceID: 0x10123456}).Marshal())
+	if handled {
+		t.Error("expected discover request for another device ID to be ignored")
+	}
+}
+
+func TestAnswerDiscoveryText(t *testing.T) {
+	br := &backendRouter{name: "AppProxy", store: newConfigStore(DefaultConfig(), "")}
+
+	handled, data := discoverOverLoopback(t, br, []byte("discover"))
+	if !handled {
+		t.Fatal("expected text discover query to be answered")
+	}
+	if !contains(string(data), "BaseURL: http://127.0.0.1:5004\r\n") {
+		t.Errorf("unexpected text reply %q", data)
+	}
+}
+
+func TestBuildDiscoveryReplyIPv6(t *testing.T) {
+	br := &backendRouter{name: "AppProxy", store: newConfigStore(DefaultConfig(), "")}
+
+	if reply := br.buildDiscoveryReply("fd00::2"); reply.BaseURL != "http://[fd00::2]:5004" || reply.LineupURL != "http://[fd00::2]:5004/lineup.json" {
+		t.Errorf("Expected bracketed IPv6 URLs, got %q and %q", reply.BaseURL, reply.LineupURL)
+	}
+	if data := string(br.buildDiscoveryText("fd00::2")); !contains(data, "BaseURL: http://[fd00::2]:5004\r\n") {
+		t.Errorf("Expected a bracketed IPv6 BaseURL, got %q", data)
+	}
+}
+
+func TestBuildDiscoveryReplyBaseURLOverride(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Device.BaseURL = "https://hdhr.example.net"
+	br := &backendRouter{name: "AppProxy", store: newConfigStore(cfg, "")}
+
+	reply := br.buildDiscoveryReply("10.0.0.5")
+	if reply.BaseURL != "https://hdhr.example.net" {
+		t.Errorf("expected override BaseURL, got %q", reply.BaseURL)
+	}
+	if reply.LineupURL != "https://hdhr.example.net/lineup.json" {
+		t.Errorf("expected override LineupURL, got %q", reply.LineupURL)
+	}
+}
+
+func TestForwardToBackendPriorityAndFallback(t *testing.T) {
+	first := &fakeBackend{name: "first", healthy: true}
+	second := &fakeBackend{name: "second", healthy: true, answers: true}
+	third := &fakeBackend{name: "third", healthy: true, answers: true}
+	br := fakeChain([]*fakeBackend{first, second, third})
+
+	br.forwardToBackend([]byte("discover"), &net.UDPAddr{}, nil, context.Background())
+	if first.asked != 1 || second.asked != 1 || third.asked != 0 {
+		t.Errorf("expected discovery to stop at the first backend that answers, asked %d/%d/%d", first.asked, second.asked, third.asked)
+	}
+
+	// An unhealthy backend is only tried once the healthy ones have been
+	first.asked, second.asked = 0, 0
+	second.healthy = false
+	br.forwardToBackend([]byte("discover"), &net.UDPAddr{}, nil, context.Background())
+	if second.asked != 0 || third.asked != 1 {
+		t.Errorf("expected the healthy backend to answer first, asked %d/%d/%d", first.asked, second.asked, third.asked)
+	}
+}
+
+func TestForwardToBackendNoFallback(t *testing.T) {
+	exclusive := &fakeBackend{name: "exclusive"}
+	earlier := &fakeBackend{name: "earlier"}
+	br := fakeChain([]*fakeBackend{earlier, exclusive}, backendFallbackNext, backendFallbackNone)
+
+	// Even when unhealthy, a backend that doesn't fall back has the final say
+	earlier.healthy = false
+	exclusive.healthy = true
+	br.forwardToBackend([]byte("discover"), &net.UDPAddr{}, nil, context.Background())
+	if earlier.asked != 1 || exclusive.asked != 1 {
+		t.Errorf("expected both backends asked, earlier first, got %d/%d", earlier.asked, exclusive.asked)
+	}
+	if order := br.consultOrder(); order[len(order)-1].Name() != "exclusive" {
+		t.Errorf("expected the non-falling-back backend last, got %s", order[len(order)-1].Name())
+	}
+}
+
+func TestBackendRouterLineupMerge(t *testing.T) {
+	br := fakeChain([]*fakeBackend{
+		{name: "down", lineupErr: errors.New("unreachable")},
+		{name: "a", lineup: []TunarrLineupItem{{GuideNumber: "2.1", GuideName: "A"}, {GuideNumber: "4.1", GuideName: "A4"}}},
+		{name: "b", lineup: []TunarrLineupItem{{GuideNumber: "4.1", GuideName: "B4"}, {GuideNumber: "7.1", GuideName: "B7"}}},
+	})
+	lineup, err := br.Lineup(context.Background())
+	if err != nil {
+		t.Fatalf("expected a partial lineup, got %v", err)
+	}
+	if len(lineup) != 3 || lineup[1].GuideName != "A4" || lineup[2].GuideNumber != "7.1" {
+		t.Errorf("unexpected merged lineup %+v", lineup)
+	}
+
+	down := fakeChain([]*fakeBackend{{name: "down", lineupErr: errors.New("unreachable")}})
+	if _, err := down.Lineup(context.Background()); err == nil {
+		t.Error("expected an error when no backend returns a lineup")
+	}
+}
+
+func TestBackendRouterOpenStream(t *testing.T) {
+	busy := &fakeBackend{name: "busy", healthy: true, streamErr: ErrNoTunerAvailable}
+	other := &fakeBackend{name: "other", healthy: true, streamErr: errChannelNotCarried}
+	br := fakeChain([]*fakeBackend{busy, other})
+	if _, _, err := br.OpenStream("5.1"); !errors.Is(err, ErrNoTunerAvailable) {
+		t.Errorf("expected all tuners in use, got %v", err)
+	}
+
+	free := &fakeBackend{name: "free", healthy: true}
+	br = fakeChain([]*fakeBackend{other, busy, free})
+	url, release, err := br.OpenStream("5.1")
+	if err != nil || url != "http://free/5.1" {
+		t.Errorf("expected the stream from the backend with a free tuner, got %q, %v", url, err)
+	} else {
+		release()
+	}
+
+	if _, _, err := (&backendRouter{}).OpenStream("5.1"); err == nil {
+		t.Error("expected an error with no backends")
+	}
+}
+
+func TestBackendRouterTunerCount(t *testing.T) {
+	br := fakeChain([]*fakeBackend{{name: "a", tuners: 2}, {name: "b"}, {name: "c", tuners: 4}})
+	if n := br.tunerCount(DeviceIdentity{Model: DeviceIDModel{TunerCount: 3}}); n != 6 {
+		t.Errorf("expected the backends' tuner total 6, got %d", n)
+	}
+	empty := fakeChain([]*fakeBackend{{name: "a"}})
+	if n := empty.tunerCount(DeviceIdentity{Model: DeviceIDModel{TunerCount: 3}}); n != 3 {
+		t.Errorf("expected the model's tuner count 3, got %d", n)
+	}
+}
+
+func TestBackendRouterEmulatesDevice(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		configs []BackendConfig
+		want    bool
+	}{
+		{"relayed hdhr", []BackendConfig{{Type: backendTypeHDHR, Devices: []string{"192.168.1.50"}}}, false},
+		{"virtual device", []BackendConfig{{Type: backendTypeHDHR, Devices: []string{"192.168.1.50"}, VirtualDevice: true}}, true},
+		{"hdhr and tunarr", []BackendConfig{{Type: backendTypeHDHR, Devices: []string{"192.168.1.50"}}, {Type: backendTypeTunarr, Host: "tunarr"}}, true},
+	} {
+		br := &backendRouter{store: newConfigStore(DefaultConfig(), "")}
+		if err := br.useBackends(tc.configs); err != nil {
+			t.Fatal(err)
+		}
+		if got := br.emulatesDevice(); got != tc.want {
+			t.Errorf("%s: expected emulatesDevice %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
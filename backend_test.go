@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildBackendChainOrdering(t *testing.T) {
+	chain, err := buildBackendChain([]BackendConfig{
+		{Type: backendTypeTunarr, Name: "late", Host: "a", Priority: 5},
+		{Type: backendTypeHDHR, Name: "early", Devices: []string{"10.0.0.2"}, Priority: 1},
+		{Type: backendTypeTunarr, Name: "tie", Host: "b", Priority: 1, Fallback: backendFallbackNone},
+		{Type: backendTypeTunarr, Name: "never", Host: "c", Priority: 9},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, b := range chain {
+		names = append(names, b.Name())
+	}
+	if strings.Join(names, ",") != "early,tie" {
+		t.Errorf("expected priority order cut off after the non-falling-back backend, got %v", names)
+	}
+
+	if _, err := buildBackendChain([]BackendConfig{{Type: backendTypeHDHR, Devices: []string{"x"}, Fallback: "sometimes"}}, nil); err == nil {
+		t.Error("expected an unknown fallback rule to be rejected")
+	}
+}
+
+func TestBuildBackendChainLineupSync(t *testing.T) {
+	chain, err := buildBackendChain([]BackendConfig{
+		{Type: backendTypeTunarr, Name: "default", Host: "a"},
+		{Type: backendTypeTunarr, Name: "fast", Host: "b", LineupSync: 30},
+		{Type: backendTypeTunarr, Name: "off", Host: "c", LineupSync: -1},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain[0].syncer == nil || chain[0].syncer.interval != DefaultLineupSyncSeconds*time.Second {
+		t.Errorf("expected the default sync interval, got %+v", chain[0].syncer)
+	}
+	if chain[1].syncer == nil || chain[1].syncer.interval != 30*time.Second {
+		t.Errorf("expected a 30s sync interval, got %+v", chain[1].syncer)
+	}
+	if chain[2].syncer != nil {
+		t.Error("expected lineup_sync_seconds -1 to disable syncing")
+	}
+}
+
+func TestNewBackendValidation(t *testing.T) {
+	for _, bc := range []BackendConfig{
+		{Type: backendTypeHDHR},
+		{Type: backendTypeTunarr},
+		{Type: backendTypeIPTV},
+		{Type: backendTypeHDHRHTTP},
+		{Type: "carrier-pigeon"},
+	} {
+		if _, err := newBackend(bc, nil); err == nil {
+			t.Errorf("Expected %+v to be rejected", bc)
+		}
+	}
+
+	b, err := newBackend(BackendConfig{Type: backendTypeTunarr, Name: "movies", Host: "tunarr.local"}, nil)
+	if err != nil || b.Name() != "movies" {
+		t.Errorf("Expected a Tunarr backend named movies, got %v, %v", b, err)
+	}
+	b, err = newBackend(BackendConfig{Type: backendTypeHDHR, Devices: []string{"10.0.0.5"}}, nil)
+	if err != nil || b.Name() != backendTypeHDHR {
+		t.Errorf("Expected an unnamed backend to be named after its type, got %v, %v", b, err)
+	}
+}
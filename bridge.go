@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// BridgeProxy relays discovery between two interfaces of one host, for a
+// router or NAS with a leg on both the apps' and the tuners' networks: a
+// query an app broadcasts on the app interface is re-broadcast on the tuner
+// interface, and each device's reply is sent back to the app. It reuses the
+// app proxy's tuner queries, so discovered devices show in its stats.
+type BridgeProxy struct {
+	AppProxy
+	appIface   string
+	tunerIface string
+	appTargets []discoveryTarget // the app interface's IPv4 subnets
+}
+
+// NewBridgeProxy creates a new BridgeProxy
+func NewBridgeProxy(store *configStore) *BridgeProxy {
+	return &BridgeProxy{
+		AppProxy: AppProxy{
+			sessions: make(map[int]*tunerProxySession),
+			backendRouter: backendRouter{
+				name:  "Bridge",
+				store: store,
+			},
+		},
+	}
+}
+
+// Run relays discovery from appIface to tunerIface until ctx is done
+func (bp *BridgeProxy) Run(ctx context.Context, appIface, tunerIface string) error {
+	if appIface == "" || tunerIface == "" {
+		return fmt.Errorf("bridge mode needs an app interface and a tuner interface")
+	}
+	if appIface == tunerIface {
+		return fmt.Errorf("bridge app and tuner interfaces are both %s", appIface)
+	}
+	bp.appIface, bp.tunerIface = appIface, tunerIface
+
+	bp.appTargets = discoveryTargets([]string{appIface})
+	if len(bp.appTargets) == 0 {
+		return fmt.Errorf("no IPv4 address on app interface %s", appIface)
+	}
+	tunerTargets := discoveryTargets([]string{tunerIface})
+	if len(tunerTargets) == 0 {
+		return fmt.Errorf("no IPv4 address on tuner interface %s", tunerIface)
+	}
+	for _, t := range tunerTargets {
+		if interfaceFor(bp.appTargets, t.subnet.IP) != "" {
+			return fmt.Errorf("app interface %s and tuner interface %s share subnet %s", appIface, tunerIface, t.subnet)
+		}
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: HDHomeRunDiscoveryUDPPort})
+	if err != nil {
+		return fmt.Errorf("failed to listen on UDP: %w", err)
+	}
+	defer conn.Close()
+
+	slog.Info("Bridge relaying discovery", "app_interface", appIface, "tuner_interface", tunerIface, "port", HDHomeRunDiscoveryUDPPort)
+
+	if err := listenDiscoveryIPv6(ctx, func(data []byte, from *net.UDPAddr, conn *net.UDPConn) {
+		if bp.fromAppSide(from) {
+			go bp.relay("udp6", data, from, conn)
+		}
+	}); err != nil {
+		slog.Warn("IPv6 discovery not started", "err", err)
+	}
+
+	if bp.store.Get().LogActiveConnectionsInterval > 0 {
+		go bp.logActiveConnections(ctx, bp.store)
+	}
+
+	buf := make([]byte, UDPReadBufferSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+				slog.Error("Error reading UDP", "err", err)
+				continue
+			}
+		}
+
+		// Our own re-broadcasts, and anything else heard on the tuner side, are not relayed
+		if n == 0 || !bp.fromAppSide(from) {
+			continue
+		}
+		go bp.relay("udp4", append([]byte(nil), buf[:n]...), from, conn)
+	}
+}
+
+// fromAppSide reports whether a datagram came from the app interface: an
+// IPv6 link-local sender carries the interface as its zone, anything else
+// must be on one of the interface's IPv4 subnets
+func (bp *BridgeProxy) fromAppSide(from *net.UDPAddr) bool {
+	if from.IP.To4() == nil {
+		return from.Zone == bp.appIface
+	}
+	return interfaceFor(bp.appTargets, from.IP) != ""
+}
+
+// relay re-broadcasts an app's query on the tuner interface and sends each
+// device's reply back to the app from the discovery port
+func (bp *BridgeProxy) relay(network string, query []byte, app *net.UDPAddr, conn *net.UDPConn) {
+	done := bp.beginDial()
+	defer done()
+
+	slog.Debug("Relaying query from app", "bytes", len(query), "source", app.String(), "interface", bp.tunerIface)
+	bp.queryTunersOn(network, []string{bp.tunerIface}, query, func(reply []byte) {
+		if _, err := conn.WriteToUDP(reply, app); err != nil {
+			slog.Error("Error sending reply to app", "err", err)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBridgeRunRejectsInterfaces(t *testing.T) {
+	bp := NewBridgeProxy(newConfigStore(DefaultConfig(), ""))
+	for _, tc := range []struct{ app, tuner, want string }{
+		{"", "eth1", "needs an app interface"},
+		{"eth0", "eth0", "both eth0"},
+		{"no-such-interface", "eth1", "no IPv4 address on app interface"},
+	} {
+		err := bp.Run(context.Background(), tc.app, tc.tuner)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Run(%q, %q): expected an error containing %q, got %v", tc.app, tc.tuner, tc.want, err)
+		}
+	}
+}
+
+func TestBridgeFromAppSide(t *testing.T) {
+	_, appNet, _ := net.ParseCIDR("192.168.1.0/24")
+	bp := NewBridgeProxy(newConfigStore(DefaultConfig(), ""))
+	bp.appIface = "eth0"
+	bp.appTargets = []discoveryTarget{{iface: "eth0", subnet: appNet}}
+
+	for _, tc := range []struct {
+		from *net.UDPAddr
+		want bool
+	}{
+		{&net.UDPAddr{IP: net.IPv4(192, 168, 1, 20)}, true},
+		{&net.UDPAddr{IP: net.IPv4(10, 0, 20, 5)}, false},
+		{&net.UDPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}, true},
+		{&net.UDPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth1"}, false},
+	} {
+		if got := bp.fromAppSide(tc.from); got != tc.want {
+			t.Errorf("fromAppSide(%s) = %v, want %v", tc.from, got, tc.want)
+		}
+	}
+}
+
+func TestBridgeStatsName(t *testing.T) {
+	bp := NewBridgeProxy(newConfigStore(DefaultConfig(), ""))
+	if got := bp.Stats().Name; got != "Bridge" {
+		t.Errorf("Expected Bridge stats, got %q", got)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ChannelRule rewrites the channels it selects as the backend lineups are
+// merged. A rule selects the channels matching every selector that is set;
+// selectors always see the channel as its backend published it, so earlier
+// rules don't change what later ones select.
+type ChannelRule struct {
+	// Selectors
+	Backend  string   `json:"backend,omitempty"`  // Backend name
+	Channels []string `json:"channels,omitempty"` // GuideNumbers as the backend publishes them
+	Match    string   `json:"match,omitempty"`    // Regular expression on the GuideName
+	Invert   bool     `json:"invert,omitempty"`   // Select channels match does NOT match
+
+	// Actions
+	Hide     bool              `json:"hide,omitempty"`     // Leave the channel out of the lineup unless ?show=all
+	Offset   int               `json:"offset,omitempty"`   // Added to the GuideNumber's major part: 5.1 + 1000 = 1005.1
+	Renumber map[string]string `json:"renumber,omitempty"` // Published GuideNumber -> new GuideNumber; wins over offset
+	Rename   string            `json:"rename,omitempty"`   // New GuideName; with match, a replacement that may use $1
+	HD       *bool             `json:"hd,omitempty"`       // Set or clear the HD flag
+	Favorite *bool             `json:"favorite,omitempty"` // Set or clear the Favorite flag
+}
+
+// compiledChannelRule is a ChannelRule with its selectors prepared for matching
+type compiledChannelRule struct {
+	ChannelRule
+	channels map[string]bool
+	match    *regexp.Regexp
+}
+
+// channelRules is the compiled channel_rules list, applied in order
+type channelRules []compiledChannelRule
+
+// compileChannelRules checks and prepares rules for apply
+func compileChannelRules(rules []ChannelRule) (channelRules, error) {
+	compiled := make(channelRules, 0, len(rules))
+	for i, r := range rules {
+		cr := compiledChannelRule{ChannelRule: r}
+		if len(r.Channels) > 0 {
+			cr.channels = make(map[string]bool, len(r.Channels))
+			for _, ch := range r.Channels {
+				cr.channels[ch] = true
+			}
+		}
+		if r.Match != "" {
+			re, err := regexp.Compile(r.Match)
+			if err != nil {
+				return nil, fmt.Errorf("channel rule %d: invalid match: %w", i+1, err)
+			}
+			cr.match = re
+		} else if r.Invert {
+			return nil, fmt.Errorf("channel rule %d: invert needs a match", i+1)
+		}
+		compiled = append(compiled, cr)
+	}
+	return compiled, nil
+}
+
+// selects reports whether the rule applies to a channel from backend
+func (r *compiledChannelRule) selects(backend string, item TunarrLineupItem) bool {
+	if r.Backend != "" && r.Backend != backend {
+		return false
+	}
+	if r.channels != nil && !r.channels[item.GuideNumber] {
+		return false
+	}
+	if r.match != nil && r.match.MatchString(item.GuideName) == r.Invert {
+		return false
+	}
+	return true
+}
+
+// apply rewrites a backend's lineup, marking hidden channels. It also
+// returns each visible GuideNumber's number as the backend published it, so
+// streams for the rewritten number can be opened on the backend.
+func (rules channelRules) apply(backend string, items []TunarrLineupItem) ([]TunarrLineupItem, map[string]string) {
+	out := make([]TunarrLineupItem, 0, len(items))
+	published := make(map[string]string, len(items))
+	hidden := make(map[string]bool)
+	for _, item := range items {
+		if item.GuideNumber == "" {
+			continue
+		}
+		ch := item
+		for i := range rules {
+			r := &rules[i]
+			if !r.selects(backend, item) {
+				continue
+			}
+			if r.Hide {
+				ch.Hidden = true
+			}
+			if r.Offset != 0 {
+				ch.GuideNumber = offsetGuideNumber(ch.GuideNumber, r.Offset)
+			}
+			if n, ok := r.Renumber[item.GuideNumber]; ok {
+				ch.GuideNumber = n
+			}
+			if r.Rename != "" {
+				if r.match != nil {
+					ch.GuideName = r.match.ReplaceAllString(item.GuideName, r.Rename)
+				} else {
+					ch.GuideName = r.Rename
+				}
+			}
+			if r.HD != nil {
+				ch.HD = boolFlag(*r.HD)
+			}
+			if r.Favorite != nil {
+				ch.Favorite = boolFlag(*r.Favorite)
+			}
+		}
+		if ch.Hidden {
+			if !hidden[ch.GuideNumber] {
+				hidden[ch.GuideNumber] = true
+				out = append(out, ch)
+			}
+			continue
+		}
+		if _, dup := published[ch.GuideNumber]; dup {
+			continue
+		}
+		published[ch.GuideNumber] = item.GuideNumber
+		out = append(out, ch)
+	}
+	return out, published
+}
+
+// offsetGuideNumber adds offset to the major part of a GuideNumber such as
+// "5" or "5.1", leaving numbers it can't parse unchanged
+func offsetGuideNumber(number string, offset int) string {
+	major, minor, hasMinor := strings.Cut(number, ".")
+	n, err := strconv.Atoi(major)
+	if err != nil {
+		return number
+	}
+	major = strconv.Itoa(n + offset)
+	if hasMinor {
+		return major + "." + minor
+	}
+	return major
+}
+
+// boolFlag encodes a lineup.json flag, which real devices send as 1 or omit
+func boolFlag(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
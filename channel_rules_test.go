@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestChannelRulesApply(t *testing.T) {
+	yes := true
+	rules, err := compileChannelRules([]ChannelRule{
+		{Backend: "tunarr", Offset: 1000},
+		{Backend: "tunarr", Renumber: map[string]string{"7": "77"}},
+		{Match: `^Shopping`, Hide: true},
+		{Match: `^(.*) East$`, Rename: "$1", HD: &yes},
+		{Channels: []string{"5.1"}, Rename: "Local News", Favorite: &yes},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, published := rules.apply("tunarr", []TunarrLineupItem{
+		{GuideNumber: "5", GuideName: "Movies East"},
+		{GuideNumber: "7", GuideName: "Cartoons"},
+		{GuideNumber: "9", GuideName: "Shopping Now"},
+	})
+	want := []TunarrLineupItem{
+		{GuideNumber: "1005", GuideName: "Movies", HD: 1},
+		{GuideNumber: "77", GuideName: "Cartoons"},
+		{GuideNumber: "1009", GuideName: "Shopping Now", Hidden: true},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Errorf("Expected %+v, got %+v", want, items)
+	}
+	if !reflect.DeepEqual(published, map[string]string{"1005": "5", "77": "7"}) {
+		t.Errorf("Expected visible rewritten numbers to map back to the published ones, got %v", published)
+	}
+
+	items, _ = rules.apply("antenna", []TunarrLineupItem{{GuideNumber: "5.1", GuideName: "WXYZ"}})
+	if len(items) != 1 || items[0].GuideNumber != "5.1" || items[0].GuideName != "Local News" || items[0].Favorite != 1 {
+		t.Errorf("Expected backend-scoped rules to leave other backends alone, got %+v", items)
+	}
+}
+
+func TestChannelRulesInvertedMatch(t *testing.T) {
+	rules, err := compileChannelRules([]ChannelRule{{Match: `(?i)news`, Invert: true, Hide: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, _ := rules.apply("any", []TunarrLineupItem{{GuideNumber: "1", GuideName: "News"}, {GuideNumber: "2", GuideName: "Movies"}})
+	if len(items) != 2 || items[0].Hidden || !items[1].Hidden {
+		t.Errorf("Expected only channels matching the filter to stay visible, got %+v", items)
+	}
+}
+
+func TestCompileChannelRulesRejectsInvalid(t *testing.T) {
+	for _, r := range []ChannelRule{{Match: "("}, {Invert: true}} {
+		if _, err := compileChannelRules([]ChannelRule{r}); err == nil {
+			t.Errorf("Expected %+v to be rejected", r)
+		}
+	}
+}
+
+func TestOffsetGuideNumber(t *testing.T) {
+	for in, want := range map[string]string{"5": "1005", "5.1": "1005.1", "abc": "abc"} {
+		if got := offsetGuideNumber(in, 1000); got != want {
+			t.Errorf("offsetGuideNumber(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestBackendRouterStreamsRenumberedChannel(t *testing.T) {
+	ota := &fakeBackend{name: "antenna", healthy: true, lineup: []TunarrLineupItem{{GuideNumber: "5", GuideName: "WXYZ"}}}
+	tunarr := &fakeBackend{name: "tunarr", healthy: true, lineup: []TunarrLineupItem{{GuideNumber: "5", GuideName: "Movies"}}}
+	br := fakeChain([]*fakeBackend{ota, tunarr})
+	cfg := DefaultConfig()
+	cfg.ChannelRules = []ChannelRule{{Backend: "tunarr", Offset: 1000}, {Backend: "antenna", Hide: true}}
+	br.store = newConfigStore(cfg, "")
+
+	items, err := br.Lineup(context.Background())
+	if err != nil || len(items) != 2 || items[0].GuideNumber != "1005" || !items[1].Hidden {
+		t.Fatalf("Expected the colliding Tunarr channel to be renumbered ahead of the hidden one, got %+v, %v", items, err)
+	}
+
+	if url, _, err := br.OpenStream("1005"); err != nil || url != "http://tunarr/5" {
+		t.Errorf("Expected 1005 to stream Tunarr's channel 5, got %q, %v", url, err)
+	}
+	if _, _, err := br.OpenStream("5"); !errors.Is(err, errChannelNotCarried) {
+		t.Errorf("Expected the hidden channel 5 not to be streamable, got %v", err)
+	}
+}
+
+func TestInvalidateLineupsAppliesNewRules(t *testing.T) {
+	tunarr := &fakeBackend{name: "tunarr", healthy: true, lineup: []TunarrLineupItem{{GuideNumber: "5", GuideName: "Movies"}}}
+	br := fakeChain([]*fakeBackend{tunarr})
+	cfg := DefaultConfig()
+	cfg.Device.LineupCacheSeconds = 3600
+	br.store = newConfigStore(cfg, "")
+	br.Lineup(context.Background()) //nolint:errcheck
+	version := br.LineupVersion()
+
+	ruled := *cfg
+	ruled.ChannelRules = []ChannelRule{{Offset: 1000}}
+	br.store = newConfigStore(&ruled, "")
+	br.InvalidateLineups()
+	if br.LineupVersion() == version {
+		t.Error("Expected the lineup version to move on")
+	}
+	items, err := br.Lineup(context.Background())
+	if err != nil || len(items) != 1 || items[0].GuideNumber != "1005" {
+		t.Errorf("Expected the new rule applied without waiting for the cache, got %+v, %v", items, err)
+	}
+}
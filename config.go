@@ -5,9 +5,18 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"strings"
 	"sync"
 )
 
+// DefaultLineupCacheSeconds is how long a backend lineup is cached when
+// device.lineup_cache_seconds is unset
+const DefaultLineupCacheSeconds = 60
+
+// DefaultTunnelKeepaliveSeconds is how often AppProxy and TunerProxy ping each
+// other when tunnel_keepalive_seconds is unset
+const DefaultTunnelKeepaliveSeconds = 10
+
 // Config holds the configuration for the proxy
 type Config struct {
 	// Network settings
@@ -16,6 +25,7 @@ type Config struct {
 	UDPReadTimeout    int `json:"udp_read_timeout_ms"` // milliseconds
 	UDPReadBuffSize   int `json:"udp_read_buffer_size"`
 	ReconnectInterval int `json:"reconnect_interval_seconds"`
+	TunnelKeepalive   int `json:"tunnel_keepalive_seconds"` // ping interval between proxies; a peer silent for 3 intervals is dropped
 
 	// Logging
 	Debug                        bool `json:"debug"`
@@ -33,28 +43,81 @@ type Config struct {
 		FirmwareVersion string `json:"firmware_version"`
 		// Device auth token (usually a hex string, can be empty for unauth)
 		DeviceAuth string `json:"device_auth"`
+		// Advertised BaseURL override (e.g. "https://hdhr.example.com" behind a
+		// reverse proxy). Derived from each request/interface if empty.
+		BaseURL string `json:"base_url"`
+		// Present the app proxy's direct HDHomeRuns as this one device, pooling
+		// their tuners and merging their lineups
+		VirtualDevice bool `json:"virtual_device"`
+		// Advertise the device as an _hdhomerun._tcp mDNS service
+		MDNS bool `json:"mdns"`
+		// Interfaces mDNS runs on; every broadcast-capable interface if empty
+		MDNSInterfaces []string `json:"mdns_interfaces"`
+		// Announce device.xml over SSDP for UPnP clients
+		SSDP bool `json:"ssdp"`
+		// Interfaces SSDP runs on; every broadcast-capable interface if empty
+		SSDPInterfaces []string `json:"ssdp_interfaces"`
+		// How long a fetched lineup is served before refetching from the backends
+		LineupCacheSeconds int `json:"lineup_cache_seconds"`
 	} `json:"device"`
 
 	// App proxy settings
 	App struct {
-		BindAddress  string `json:"bind_address"`
-		DirectHDHRIP string `json:"direct_hdhomerun_ip"`
+		BindAddress    string   `json:"bind_address"`
+		DirectHDHRIP   string   `json:"direct_hdhomerun_ip"`
+		DirectHDHRIPs  []string `json:"direct_hdhomerun_ips"` // Additional devices, queried alongside direct_hdhomerun_ip
+		ControlHDHRIP  string   `json:"control_hdhomerun_ip"` // Device relayed control sessions go to; required when more than one is known
+		RewriteBaseURL string   `json:"rewrite_base_url"`     // Replaces the address in relayed discovery replies' BaseURL/LineupURL
+		// Interfaces relayed discovery is broadcast on; every interface if empty
+		DiscoveryInterfaces []string `json:"discovery_interfaces"`
 	} `json:"app"`
 
+	// Bridge mode settings
+	Bridge struct {
+		AppInterface   string `json:"app_interface"`   // Interface apps broadcast discovery on
+		TunerInterface string `json:"tuner_interface"` // Interface the tuners are on
+	} `json:"bridge"`
+
 	// Tuner proxy settings
 	Tuner struct {
-		ProxyHost    string `json:"app_proxy_host"`
-		DirectMode   bool   `json:"direct_mode"`
-		DirectHDHRIP string `json:"direct_hdhomerun_ip"`
+		ProxyHost      string   `json:"app_proxy_host"`
+		DirectMode     bool     `json:"direct_mode"`
+		DirectHDHRIP   string   `json:"direct_hdhomerun_ip"`
+		DirectHDHRIPs  []string `json:"direct_hdhomerun_ips"` // Additional devices, queried alongside direct_hdhomerun_ip
+		RelayStreams   bool     `json:"relay_streams"`        // Serve devices' HTTP and streams on this VLAN through the tunnel
+		RewriteBaseURL string   `json:"rewrite_base_url"`     // Replaces the address in discovery replies relayed to apps
 	} `json:"tuner"`
 
-	// Tunarr backend settings
+	// Authentication of the app proxy <-> tuner proxy tunnel; both ends must match
+	Tunnel struct {
+		PSK           string `json:"psk"`             // Pre-shared key each side must prove before discovery is relayed
+		TLSCert       string `json:"tls_cert_file"`   // This proxy's certificate; enables mutual TLS
+		TLSKey        string `json:"tls_key_file"`    // Key for tls_cert_file
+		TLSCA         string `json:"tls_ca_file"`     // CA that signed the peer's certificate
+		TLSServerName string `json:"tls_server_name"` // Name on the app proxy's certificate; defaults to app_proxy_host
+	} `json:"tunnel"`
+
+	// Ordered list of channel and tuner sources. When empty, the backends are
+	// derived from the tunarr section and the direct HDHomeRun settings.
+	Backends []BackendConfig `json:"backends"`
+
+	// Rewrites applied to the backend lineups before they are served
+	ChannelRules []ChannelRule `json:"channel_rules"`
+
+	// Guide served from /xmltv.xml
+	XMLTV struct {
+		Sources        []XMLTVSource `json:"sources"`         // Guides beyond those the backends publish
+		RefreshSeconds int           `json:"refresh_seconds"` // How long the merged guide is served before refetching
+	} `json:"xmltv"`
+
+	// Tunarr backend settings (used when backends is empty)
 	Tunarr struct {
 		Enabled       bool   `json:"enabled"`
 		Host          string `json:"host"`
 		Port          int    `json:"port"`
 		UseTunarrOnly bool   `json:"use_tunarr_only"` // If true, only use Tunarr, ignore HDHR
 		HttpTimeout   int    `json:"http_timeout_seconds"`
+		LineupCache   int    `json:"lineup_cache_seconds"` // Deprecated: read only if device.lineup_cache_seconds is unset
 	} `json:"tunarr"`
 
 	// Web UI settings (stored in config so credentials persist across restarts)
@@ -65,6 +128,41 @@ type Config struct {
 	} `json:"webui"`
 }
 
+// BackendConfig is one entry in the backends list
+type BackendConfig struct {
+	Type     string `json:"type"`     // "hdhr", "hdhr_http", "tunarr" or "iptv"
+	Name     string `json:"name"`     // Shown in logs and stats; defaults to the type
+	Priority int    `json:"priority"` // Lower is consulted first; ties keep list order
+	Fallback string `json:"fallback"` // "next" (default) passes requests this backend can't serve on; "none" stops here
+
+	LineupSync int `json:"lineup_sync_seconds,omitempty"` // How often the lineup is re-read in the background; 0 uses the default, -1 disables
+
+	// hdhr
+	Devices       []string `json:"devices,omitempty"`        // Device IPs (virtual_device also accepts host:port or base URLs)
+	VirtualDevice bool     `json:"virtual_device,omitempty"` // Present the devices as the emulated device, pooling their tuners
+
+	// tunarr
+	Host        string `json:"host,omitempty"`
+	Port        int    `json:"port,omitempty"`
+	HttpTimeout int    `json:"http_timeout_seconds,omitempty"` // Also used by hdhr_http and iptv
+
+	// hdhr_http
+	URL string `json:"url,omitempty"` // Base URL of any HDHomeRun-compatible HTTP server
+
+	// iptv
+	Playlist   string `json:"playlist,omitempty"`    // M3U file path or http(s) URL
+	MaxStreams int    `json:"max_streams,omitempty"` // Simultaneous streams, advertised as the tuner count
+	XMLTV      string `json:"xmltv,omitempty"`       // XMLTV guide file path or http(s) URL; defaults to the playlist's url-tvg
+}
+
+// displayName returns the backend's configured name, or its type if unnamed
+func (bc BackendConfig) displayName() string {
+	if bc.Name != "" {
+		return bc.Name
+	}
+	return bc.Type
+}
+
 // DefaultConfig returns a config with default values
 func DefaultConfig() *Config {
 	return &Config{
@@ -113,6 +211,7 @@ func SaveConfigTemplate(filepath string) error {
 		UDPReadTimeout:               500,
 		UDPReadBuffSize:              4096,
 		ReconnectInterval:            3,
+		TunnelKeepalive:              DefaultTunnelKeepaliveSeconds,
 		Debug:                        false,
 		LogActiveConnectionsInterval: 60, // Log every 60 seconds
 	}
@@ -122,12 +221,37 @@ func SaveConfigTemplate(filepath string) error {
 	template.Device.FriendlyName = "HDHomeRun FLEX 4K"
 	template.Device.FirmwareVersion = "20250825"
 	template.Device.DeviceAuth = ""
+	template.Device.BaseURL = ""
+	template.Device.VirtualDevice = false
+	template.Device.MDNS = false
+	template.Device.MDNSInterfaces = []string{}
+	template.Device.SSDP = false
+	template.Device.SSDPInterfaces = []string{}
+	template.Device.LineupCacheSeconds = DefaultLineupCacheSeconds
 
 	template.App.BindAddress = "0.0.0.0"
 	template.App.DirectHDHRIP = "192.168.1.50"
+	template.App.DirectHDHRIPs = []string{}
+	template.App.ControlHDHRIP = ""
+	template.App.RewriteBaseURL = ""
+	template.App.DiscoveryInterfaces = []string{}
 	template.Tuner.ProxyHost = "10.10.10.9"
 	template.Tuner.DirectMode = false
 	template.Tuner.DirectHDHRIP = "10.10.10.50"
+	template.Tuner.DirectHDHRIPs = []string{}
+	template.Tuner.RelayStreams = false
+	template.Tuner.RewriteBaseURL = ""
+	template.Bridge.AppInterface = ""
+	template.Bridge.TunerInterface = ""
+	template.Tunnel.PSK = ""
+	template.Tunnel.TLSCert = ""
+	template.Tunnel.TLSKey = ""
+	template.Tunnel.TLSCA = ""
+	template.Tunnel.TLSServerName = ""
+	template.Backends = []BackendConfig{}
+	template.ChannelRules = []ChannelRule{}
+	template.XMLTV.Sources = []XMLTVSource{}
+	template.XMLTV.RefreshSeconds = DefaultXMLTVRefreshSeconds
 	template.Tunarr.Enabled = false
 	template.Tunarr.Host = "tunarr.local"
 	template.Tunarr.Port = 8000
@@ -170,6 +294,13 @@ func (c *Config) GetReconnectInterval() int {
 	return ReconnectInterval
 }
 
+func (c *Config) GetTunnelKeepaliveSeconds() int {
+	if c.TunnelKeepalive > 0 {
+		return c.TunnelKeepalive
+	}
+	return DefaultTunnelKeepaliveSeconds
+}
+
 func (c *Config) GetHDHomeRunPort() int {
 	if c.HDHomeRunPort > 0 {
 		return c.HDHomeRunPort
@@ -184,6 +315,90 @@ func (c *Config) GetTCPPort() int {
 	return TCPPort
 }
 
+// GetLineupCacheSeconds returns how long a backend lineup is cached, falling
+// back to the tunarr section where the setting used to live
+func (c *Config) GetLineupCacheSeconds() int {
+	if c.Device.LineupCacheSeconds > 0 {
+		return c.Device.LineupCacheSeconds
+	}
+	if c.Tunarr.LineupCache > 0 {
+		return c.Tunarr.LineupCache
+	}
+	return DefaultLineupCacheSeconds
+}
+
+// GetXMLTVRefreshSeconds returns how long the merged XMLTV guide is cached
+func (c *Config) GetXMLTVRefreshSeconds() int {
+	if c.XMLTV.RefreshSeconds > 0 {
+		return c.XMLTV.RefreshSeconds
+	}
+	return DefaultXMLTVRefreshSeconds
+}
+
+// AppDirectHDHRIPs returns every direct HDHomeRun configured for the app proxy
+func (c *Config) AppDirectHDHRIPs() []string {
+	return mergeIPLists(splitIPList(c.App.DirectHDHRIP), c.App.DirectHDHRIPs)
+}
+
+// TunerDirectHDHRIPs returns every direct HDHomeRun configured for the tuner proxy
+func (c *Config) TunerDirectHDHRIPs() []string {
+	return mergeIPLists(splitIPList(c.Tuner.DirectHDHRIP), c.Tuner.DirectHDHRIPs)
+}
+
+// BackendConfigs returns the backends to route to: the backends list if set,
+// otherwise the legacy settings: Tunarr ahead of the direct HDHomeRuns (and
+// alone if use_tunarr_only), or the HDHomeRuns first when pooled as a
+// virtual device
+func (c *Config) BackendConfigs(directIPs []string, virtualDevice bool) []BackendConfig {
+	if len(c.Backends) > 0 {
+		return c.Backends
+	}
+
+	var hdhr, tunarr []BackendConfig
+	if len(directIPs) > 0 {
+		hdhr = append(hdhr, BackendConfig{Type: backendTypeHDHR, Devices: directIPs, VirtualDevice: virtualDevice})
+	}
+	if c.Tunarr.Enabled {
+		bc := BackendConfig{Type: backendTypeTunarr, Host: c.Tunarr.Host, Port: c.Tunarr.Port, HttpTimeout: c.Tunarr.HttpTimeout}
+		if c.Tunarr.UseTunarrOnly {
+			bc.Fallback = backendFallbackNone
+		}
+		tunarr = append(tunarr, bc)
+	}
+	if virtualDevice {
+		return append(hdhr, tunarr...)
+	}
+	return append(tunarr, hdhr...)
+}
+
+// splitIPList splits a comma-separated list of addresses, dropping blanks
+func splitIPList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// mergeIPLists concatenates address lists, dropping blanks and duplicates
+func mergeIPLists(lists ...[]string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		for _, ip := range list {
+			ip = strings.TrimSpace(ip)
+			if ip == "" || seen[ip] {
+				continue
+			}
+			seen[ip] = true
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
 // configStore holds a live *Config protected by a mutex.
 // filePath is the file the config was loaded from; empty means no backing file.
 type configStore struct {
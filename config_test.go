@@ -67,3 +67,48 @@ func TestConfigStoreSetNoFileOK(t *testing.T) {
 		t.Error("in-memory update failed")
 	}
 }
+
+func TestBackendConfigsLegacy(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Tunarr.Enabled = true
+	cfg.Tunarr.Host = "tunarr.local"
+
+	got := cfg.BackendConfigs([]string{"10.0.0.5"}, false)
+	if len(got) != 2 || got[0].Type != backendTypeTunarr || got[1].Type != backendTypeHDHR || got[0].Fallback != "" {
+		t.Errorf("Expected Tunarr ahead of the direct HDHomeRuns, got %+v", got)
+	}
+
+	got = cfg.BackendConfigs([]string{"10.0.0.5"}, true)
+	if len(got) != 2 || got[0].Type != backendTypeHDHR || !got[0].VirtualDevice {
+		t.Errorf("Expected the virtual device ahead of Tunarr, got %+v", got)
+	}
+
+	cfg.Tunarr.UseTunarrOnly = true
+	got = cfg.BackendConfigs(nil, false)
+	if len(got) != 1 || got[0].Fallback != backendFallbackNone {
+		t.Errorf("Expected use_tunarr_only to stop at Tunarr, got %+v", got)
+	}
+
+	cfg.Backends = []BackendConfig{{Type: backendTypeHDHR, Devices: []string{"10.0.0.9"}}}
+	got = cfg.BackendConfigs([]string{"10.0.0.5"}, false)
+	if len(got) != 1 || got[0].Devices[0] != "10.0.0.9" {
+		t.Errorf("Expected the backends list to replace the legacy settings, got %+v", got)
+	}
+}
+
+func TestGetLineupCacheSeconds(t *testing.T) {
+	cfg := DefaultConfig()
+	if got := cfg.GetLineupCacheSeconds(); got != DefaultLineupCacheSeconds {
+		t.Errorf("Expected the default when unset, got %d", got)
+	}
+
+	cfg.Tunarr.LineupCache = 30
+	if got := cfg.GetLineupCacheSeconds(); got != 30 {
+		t.Errorf("Expected the legacy tunarr setting to be read, got %d", got)
+	}
+
+	cfg.Device.LineupCacheSeconds = 120
+	if got := cfg.GetLineupCacheSeconds(); got != 120 {
+		t.Errorf("Expected device.lineup_cache_seconds to win, got %d", got)
+	}
+}
@@ -155,3 +155,47 @@ func GetModelInfo(modelType string) (DeviceIDModel, error) {
 	}
 	return model, nil
 }
+
+// DeviceIdentity is the emulated device as advertised to clients, with
+// defaults filled in for anything left empty in Config.Device
+type DeviceIdentity struct {
+	Model           DeviceIDModel
+	DeviceID        string
+	DeviceAuth      string
+	FriendlyName    string
+	FirmwareVersion string
+}
+
+// ResolveDeviceIdentity builds the DeviceIdentity for the given config
+func ResolveDeviceIdentity(cfg *Config) DeviceIdentity {
+	modelType := cfg.Device.ModelType
+	if modelType == "" {
+		modelType = "HDFX-4K"
+	}
+
+	modelInfo, err := GetModelInfo(modelType)
+	if err != nil {
+		modelInfo, _ = GetModelInfo("HDFX-4K")
+	}
+
+	id := DeviceIdentity{
+		Model:           modelInfo,
+		DeviceID:        cfg.Device.DeviceID,
+		DeviceAuth:      cfg.Device.DeviceAuth,
+		FriendlyName:    cfg.Device.FriendlyName,
+		FirmwareVersion: cfg.Device.FirmwareVersion,
+	}
+	if id.DeviceID == "" {
+		id.DeviceID = GenerateRealisticDeviceID(modelType)
+	}
+	if id.DeviceAuth == "" {
+		id.DeviceAuth = "00000000"
+	}
+	if id.FriendlyName == "" {
+		id.FriendlyName = modelInfo.FriendlyName
+	}
+	if id.FirmwareVersion == "" {
+		id.FirmwareVersion = "20250825"
+	}
+	return id
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// discoveryTarget is one interface the app proxy broadcasts discovery on:
+// its IPv4 subnet, this host's address on it and the subnet's directed
+// broadcast address
+type discoveryTarget struct {
+	iface     string
+	subnet    *net.IPNet
+	local     net.IP
+	broadcast net.IP
+}
+
+// DiscoveredTunerStats is a device that answered the app proxy's discovery
+// broadcasts, and the interface its latest reply arrived on
+type DiscoveredTunerStats struct {
+	DeviceID  string
+	IP        string
+	Interface string // "" if no discovery interface's subnet holds the device's address
+	LastSeen  time.Time
+}
+
+// discoveryTargets returns a target for every IPv4 subnet on the named
+// interfaces, or on every up, broadcast-capable, non-loopback interface if
+// names is empty
+func discoveryTargets(names []string) []discoveryTarget {
+	var ifaces []net.Interface
+	if len(names) == 0 {
+		all, err := net.Interfaces()
+		if err != nil {
+			slog.Warn("Listing network interfaces failed", "err", err)
+			return nil
+		}
+		for _, ifi := range all {
+			if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagBroadcast != 0 && ifi.Flags&net.FlagLoopback == 0 {
+				ifaces = append(ifaces, ifi)
+			}
+		}
+	} else {
+		for _, name := range names {
+			ifi, err := net.InterfaceByName(name)
+			if err != nil {
+				slog.Warn("Discovery interface not found", "interface", name, "err", err)
+				continue
+			}
+			ifaces = append(ifaces, *ifi)
+		}
+	}
+
+	var targets []discoveryTarget
+	for _, ifi := range ifaces {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil {
+				continue
+			}
+			subnet := &net.IPNet{IP: ipnet.IP.To4().Mask(ipnet.Mask), Mask: ipnet.Mask}
+			targets = append(targets, discoveryTarget{iface: ifi.Name, subnet: subnet, local: ipnet.IP.To4(), broadcast: directedBroadcast(subnet)})
+		}
+	}
+	return targets
+}
+
+// listenMulticastIPv4 joins group on the interfaces of targets, returning a
+// socket bound to the group's port and the interfaces it joined on. What the
+// socket multicasts also reaches listeners on this host, such as a browser
+// or media server running alongside the proxy.
+func listenMulticastIPv4(targets []discoveryTarget, group *net.UDPAddr) (*net.UDPConn, []string, error) {
+	var ifaces []*net.Interface
+	for _, t := range targets {
+		if len(ifaces) > 0 && ifaces[len(ifaces)-1].Name == t.iface {
+			continue
+		}
+		ifi, err := net.InterfaceByName(t.iface)
+		if err != nil {
+			return nil, nil, err
+		}
+		ifaces = append(ifaces, ifi)
+	}
+	if len(ifaces) == 0 {
+		return nil, nil, fmt.Errorf("no IPv4 interface to join %s on", group.IP)
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", ifaces[0], group)
+	if err != nil {
+		return nil, nil, err
+	}
+	joined := []string{ifaces[0].Name}
+	for _, ifi := range ifaces[1:] {
+		if err := joinIPv4Group(conn, ifi, group.IP); err != nil {
+			slog.Warn("Could not join multicast group", "group", group.IP.String(), "interface", ifi.Name, "err", err)
+			continue
+		}
+		joined = append(joined, ifi.Name)
+	}
+	if err := setMulticastLoopback(conn); err != nil {
+		slog.Debug("Could not enable multicast loopback", "err", err)
+	}
+	return conn, joined, nil
+}
+
+// directedBroadcast returns the broadcast address of an IPv4 subnet. /31 and
+// /32 subnets have none, so the limited broadcast address is used instead.
+func directedBroadcast(subnet *net.IPNet) net.IP {
+	ip, mask := subnet.IP.To4(), subnet.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	if ones, bits := mask.Size(); ip == nil || bits != 32 || ones >= 31 {
+		return net.IPv4bcast
+	}
+	out := make(net.IP, net.IPv4len)
+	for i := range out {
+		out[i] = ip[i] | ^mask[i]
+	}
+	return out
+}
+
+// interfaceFor returns the name of the target interface whose subnet holds
+// ip, or "" if none does
+func interfaceFor(targets []discoveryTarget, ip net.IP) string {
+	if t := targetFor(targets, ip); t != nil {
+		return t.iface
+	}
+	return ""
+}
+
+// targetFor returns the target whose subnet holds ip, or nil if none does
+func targetFor(targets []discoveryTarget, ip net.IP) *discoveryTarget {
+	for i := range targets {
+		if targets[i].subnet != nil && targets[i].subnet.Contains(ip) {
+			return &targets[i]
+		}
+	}
+	return nil
+}
+
+// discoveryReplyDeviceID returns the DeviceID of a binary or text discover
+// reply as 8 hex digits, or "" if it has none
+func discoveryReplyDeviceID(data []byte) string {
+	if reply, err := ParseDiscoverReply(data); err == nil {
+		if reply.DeviceID == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%08X", reply.DeviceID)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, "DeviceID:"); ok {
+			return strings.ToUpper(strings.TrimSpace(v))
+		}
+	}
+	return ""
+}
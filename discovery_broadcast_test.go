@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDirectedBroadcast(t *testing.T) {
+	for cidr, want := range map[string]string{
+		"192.168.1.0/24":      "192.168.1.255",
+		"10.0.16.0/20":        "10.0.31.255",
+		"172.16.0.0/31":       "255.255.255.255",
+		"172.16.0.1/32":       "255.255.255.255",
+		"::ffff:10.0.0.0/104": "10.255.255.255",
+	} {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := directedBroadcast(subnet); got.String() != want {
+			t.Errorf("directedBroadcast(%s) = %s, want %s", cidr, got, want)
+		}
+	}
+}
+
+func TestDiscoveryTargetsByName(t *testing.T) {
+	lo, err := net.InterfaceByIndex(1)
+	if err != nil || lo.Flags&net.FlagLoopback == 0 {
+		t.Skip("no loopback interface at index 1")
+	}
+	var found bool
+	for _, target := range discoveryTargets([]string{lo.Name}) {
+		if target.iface == lo.Name && target.subnet.Contains(net.IPv4(127, 0, 0, 1)) {
+			found = true
+			if !target.local.Equal(net.IPv4(127, 0, 0, 1)) {
+				t.Errorf("Expected the loopback address as the local address, got %s", target.local)
+			}
+			if target.broadcast.String() != "127.255.255.255" {
+				t.Errorf("Expected the loopback subnet's broadcast address, got %s", target.broadcast)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected a target for %s's 127.0.0.0/8", lo.Name)
+	}
+	if targets := discoveryTargets([]string{"no-such-interface"}); len(targets) != 0 {
+		t.Errorf("Expected no targets for an unknown interface, got %+v", targets)
+	}
+}
+
+func TestDiscoveryReplyDeviceID(t *testing.T) {
+	binary := (&DiscoverReply{DeviceType: HDHRDeviceTypeTuner, DeviceID: 0x1010abcd}).Marshal()
+	if got := discoveryReplyDeviceID(binary); got != "1010ABCD" {
+		t.Errorf("Expected the binary reply's DeviceID, got %q", got)
+	}
+	if got := discoveryReplyDeviceID([]byte("Device: HDHR3-US\r\nDeviceID: 1010abcd\r\n")); got != "1010ABCD" {
+		t.Errorf("Expected the text reply's DeviceID, got %q", got)
+	}
+	if got := discoveryReplyDeviceID([]byte("hello")); got != "" {
+		t.Errorf("Expected no DeviceID, got %q", got)
+	}
+}
+
+func TestCollectTunerRepliesDedupesByDeviceID(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Two answers from one device, as if it were reached on two interfaces, and one from another
+	replies := [][]byte{
+		(&DiscoverReply{DeviceType: HDHRDeviceTypeTuner, DeviceID: 0x10101010}).Marshal(),
+		(&DiscoverReply{DeviceType: HDHRDeviceTypeTuner, DeviceID: 0x10101010}).Marshal(),
+		(&DiscoverReply{DeviceType: HDHRDeviceTypeTuner, DeviceID: 0x20202020}).Marshal(),
+	}
+	for _, r := range replies {
+		device, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		device.Write(r) //nolint:errcheck
+		device.Close()
+	}
+
+	ap := NewAppProxy(newConfigStore(DefaultConfig(), ""))
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	var relayed []string
+	ap.collectTunerReplies(conn, []discoveryTarget{{iface: "lo", subnet: loopback}}, func(data []byte) {
+		relayed = append(relayed, discoveryReplyDeviceID(data))
+	})
+
+	if len(relayed) != 2 || relayed[0] != "10101010" || relayed[1] != "20202020" {
+		t.Errorf("Expected one reply per device, got %v", relayed)
+	}
+	found := ap.Stats().Discovered
+	if len(found) != 2 || found[0].DeviceID != "10101010" || found[0].Interface != "lo" || found[0].IP != "127.0.0.1" {
+		t.Errorf("Expected both devices recorded with the interface that answered, got %+v", found)
+	}
+	if !ap.isKnownDevice("127.0.0.1") {
+		t.Error("Expected the answering address to be a known device")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+)
+
+// HDHomeRunDiscoveryIPv6Group is the link-local multicast group HDHomeRun
+// apps send discovery to over IPv6, on the same port as the IPv4 broadcast
+const HDHomeRunDiscoveryIPv6Group = "ff02::176"
+
+var discoveryIPv6Group = net.ParseIP(HDHomeRunDiscoveryIPv6Group)
+
+// ipv6MulticastInterfaces returns the interfaces IPv6 discovery runs on: up,
+// multicast-capable, not loopback, and with an IPv6 address
+func ipv6MulticastInterfaces() []net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		slog.Debug("Listing network interfaces failed", "err", err)
+		return nil
+	}
+
+	var out []net.Interface
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		for _, ip := range interfaceIPs(&ifi) {
+			if ip.To4() == nil {
+				out = append(out, ifi)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// interfaceIPs returns the unicast addresses assigned to ifi
+func interfaceIPs(ifi *net.Interface) []net.IP {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	var out []net.IP
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			out = append(out, ipnet.IP)
+		}
+	}
+	return out
+}
+
+// interfaceIPv4 returns ifi's first IPv4 address, or nil if it has none
+func interfaceIPv4(ifi *net.Interface) net.IP {
+	for _, ip := range interfaceIPs(ifi) {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+	}
+	return nil
+}
+
+// controlSocket runs set on conn's socket, returning its error
+func controlSocket(conn *net.UDPConn, set func(fd uintptr) error) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) { serr = set(fd) }); err != nil {
+		return err
+	}
+	return serr
+}
+
+// listenDiscoveryIPv6 joins the IPv6 discovery group on every multicast
+// interface and calls handle with each datagram the socket receives, until
+// ctx is done. The socket is bound to the discovery port on every IPv6
+// address, so unicast queries arrive on it too; replies are written to conn.
+func listenDiscoveryIPv6(ctx context.Context, handle func(data []byte, from *net.UDPAddr, conn *net.UDPConn)) error {
+	ifaces := ipv6MulticastInterfaces()
+	if len(ifaces) == 0 {
+		return fmt.Errorf("no IPv6 multicast interface")
+	}
+
+	group := &net.UDPAddr{IP: discoveryIPv6Group, Port: HDHomeRunDiscoveryUDPPort}
+	conn, err := net.ListenMulticastUDP("udp6", &ifaces[0], group)
+	if err != nil {
+		return err
+	}
+	joined := []string{ifaces[0].Name}
+	for i := 1; i < len(ifaces); i++ {
+		if err := joinIPv6Group(conn, &ifaces[i], discoveryIPv6Group); err != nil {
+			slog.Warn("Could not join IPv6 discovery group", "interface", ifaces[i].Name, "err", err)
+			continue
+		}
+		joined = append(joined, ifaces[i].Name)
+	}
+	slog.Info("Listening for IPv6 discovery", "group", HDHomeRunDiscoveryIPv6Group, "port", HDHomeRunDiscoveryUDPPort, "interfaces", joined)
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	go func() {
+		buf := make([]byte, UDPReadBufferSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Error("Error reading IPv6 discovery", "err", err)
+				continue
+			}
+			if n > 0 {
+				handle(append([]byte(nil), buf[:n]...), from, conn)
+			}
+		}
+	}()
+	return nil
+}
+
+// sendDiscoveryIPv6 sends a query to the IPv6 discovery group on every
+// multicast interface, or only the named ones if names isn't empty,
+// returning how many it went out on
+func sendDiscoveryIPv6(conn *net.UDPConn, data []byte, names []string) int {
+	sent := 0
+	for _, ifi := range ipv6MulticastInterfaces() {
+		if len(names) > 0 && !slices.Contains(names, ifi.Name) {
+			continue
+		}
+		group := &net.UDPAddr{IP: discoveryIPv6Group, Port: HDHomeRunDiscoveryUDPPort, Zone: ifi.Name}
+		if _, err := conn.WriteToUDP(data, group); err != nil {
+			slog.Debug("Error sending IPv6 discovery query", "interface", ifi.Name, "err", err)
+			continue
+		}
+		sent++
+	}
+	return sent
+}
+
+// udpAddrHost returns addr's IP with its zone, if any, as net.JoinHostPort
+// and net.Dial expect it
+func udpAddrHost(addr *net.UDPAddr) string {
+	if addr.Zone != "" {
+		return addr.IP.String() + "%" + addr.Zone
+	}
+	return addr.IP.String()
+}
+
+// localIPForApp returns the address of this host an app at appAddr should
+// put in URLs: the local address that routes to the app. An IPv6 link-local
+// address is useless to the app without our zone, so a routable address on
+// the same interface is preferred when there is one, IPv6 first.
+func localIPForApp(appAddr *net.UDPAddr) (string, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: appAddr.IP, Port: HDHomeRunDiscoveryUDPPort, Zone: appAddr.Zone})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.UDPAddr)
+	if local.IP.To4() != nil || !local.IP.IsLinkLocalUnicast() {
+		return local.IP.String(), nil
+	}
+
+	zone := local.Zone
+	if zone == "" {
+		zone = appAddr.Zone
+	}
+	if ifi, err := net.InterfaceByName(zone); err == nil {
+		var ipv4 net.IP
+		for _, ip := range interfaceIPs(ifi) {
+			if ip.IsLinkLocalUnicast() || ip.IsLoopback() {
+				continue
+			}
+			if ip.To4() == nil {
+				return ip.String(), nil
+			}
+			if ipv4 == nil {
+				ipv4 = ip
+			}
+		}
+		if ipv4 != nil {
+			return ipv4.String(), nil
+		}
+	}
+	return local.IP.String(), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// listenIPv6Loopback opens a UDP socket on ::1, skipping the test if the
+// host has no IPv6
+func listenIPv6Loopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestUDPAddrHost(t *testing.T) {
+	if got := udpAddrHost(&net.UDPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}); got != "fe80::1%eth0" {
+		t.Errorf("Expected the zone kept, got %q", got)
+	}
+	if got := udpAddrHost(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)}); got != "10.0.0.1" {
+		t.Errorf("Expected a plain IPv4 address, got %q", got)
+	}
+}
+
+func TestLocalIPForApp(t *testing.T) {
+	app := listenIPv6Loopback(t)
+	ip, err := localIPForApp(app.LocalAddr().(*net.UDPAddr))
+	if err != nil || ip != "::1" {
+		t.Errorf("Expected ::1 for an app on IPv6 loopback, got %q, %v", ip, err)
+	}
+
+	ip, err = localIPForApp(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil || ip != "127.0.0.1" {
+		t.Errorf("Expected 127.0.0.1 for an app on IPv4 loopback, got %q, %v", ip, err)
+	}
+}
+
+func TestTunerProxyRepliesToIPv6App(t *testing.T) {
+	app := listenIPv6Loopback(t)
+	tp := NewTunerProxy(newConfigStore(DefaultConfig(), ""))
+
+	typ, payload := encodeDiscoverPayload(app.LocalAddr().(*net.UDPAddr), []byte("reply"))
+	tp.replyToApp(typ, payload)
+
+	app.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	n, err := app.Read(buf)
+	if err != nil || string(buf[:n]) != "reply" {
+		t.Errorf("Expected the reply relayed to the IPv6 app, got %q, %v", buf[:n], err)
+	}
+}
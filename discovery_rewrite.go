@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// rewriteDiscoveryURLs passes the BaseURL and LineupURL of a discover reply
+// through rewrite and re-encodes the reply. Binary replies get a fresh CRC;
+// text replies ("BaseURL: ..." lines) keep their line endings. rewrite is
+// given the reply's device ID as 8 hex digits. Anything else is returned as is.
+func rewriteDiscoveryURLs(reply []byte, rewrite func(deviceID, rawURL string) string) []byte {
+	if pkt, err := ParseHDHRPacket(reply); err == nil {
+		if pkt.Type != HDHRTypeDiscoverRpy {
+			return reply
+		}
+		id, _ := pkt.GetUint32(HDHRTagDeviceID)
+		deviceID := fmt.Sprintf("%08X", id)
+		for _, tag := range []byte{HDHRTagBaseURL, HDHRTagLineupURL} {
+			if v, ok := pkt.Get(tag); ok {
+				pkt.Set(tag, []byte(rewrite(deviceID, string(v))))
+			}
+		}
+		return pkt.Marshal()
+	}
+
+	text := string(reply)
+	if !strings.Contains(text, "BaseURL:") && !strings.Contains(text, "LineupURL:") {
+		return reply
+	}
+	lines := strings.SplitAfter(text, "\n")
+	deviceID := ""
+	for _, line := range lines {
+		if v, ok := strings.CutPrefix(line, "DeviceID:"); ok {
+			deviceID = strings.ToUpper(strings.TrimSpace(v))
+		}
+	}
+	for i, line := range lines {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || (key != "BaseURL" && key != "LineupURL") {
+			continue
+		}
+		trimmed := strings.TrimRight(value, "\r\n")
+		ending := value[len(trimmed):]
+		lines[i] = key + ": " + rewrite(deviceID, strings.TrimSpace(trimmed)) + ending
+	}
+	return []byte(strings.Join(lines, ""))
+}
+
+// rewriteDiscoveryOrigin points a discover reply's BaseURL and LineupURL at
+// origin, for setups where the device's own address isn't reachable by apps
+func rewriteDiscoveryOrigin(reply []byte, origin string) []byte {
+	return rewriteDiscoveryURLs(reply, func(_, rawURL string) string {
+		return rewriteURLOrigin(rawURL, origin)
+	})
+}
+
+// rewriteURLOrigin replaces the scheme and host of rawURL with those of
+// origin, keeping its path and query. origin may omit the scheme ("host:port")
+// and may carry a path prefix. Unparseable URLs are returned unchanged.
+func rewriteURLOrigin(rawURL, origin string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	if !strings.Contains(origin, "://") {
+		origin = "http://" + origin
+	}
+	o, err := url.Parse(origin)
+	if err != nil || o.Host == "" {
+		return rawURL
+	}
+	u.Scheme = o.Scheme
+	u.Host = o.Host
+	u.Path = strings.TrimSuffix(o.Path, "/") + u.Path
+	return u.String()
+}
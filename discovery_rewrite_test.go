@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRewriteDiscoveryOriginBinary(t *testing.T) {
+	reply := (&DiscoverReply{
+		DeviceType: HDHRDeviceTypeTuner,
+		DeviceID:   0x1234ABCD,
+		TunerCount: 4,
+		DeviceAuth: "auth",
+		BaseURL:    "http://10.0.0.5:80",
+		LineupURL:  "http://10.0.0.5:80/lineup.json",
+	}).Marshal()
+
+	got, err := ParseDiscoverReply(rewriteDiscoveryOrigin(reply, "203.0.113.9:8080"))
+	if err != nil {
+		t.Fatalf("rewritten reply doesn't parse (bad CRC?): %v", err)
+	}
+	if got.BaseURL != "http://203.0.113.9:8080" || got.LineupURL != "http://203.0.113.9:8080/lineup.json" {
+		t.Errorf("Unexpected URLs %q, %q", got.BaseURL, got.LineupURL)
+	}
+	if got.DeviceID != 0x1234ABCD || got.TunerCount != 4 || got.DeviceAuth != "auth" {
+		t.Errorf("Other fields not preserved: %+v", got)
+	}
+}
+
+func TestRewriteDiscoveryOriginText(t *testing.T) {
+	reply := "Device: HDHR4-2US\r\nDeviceID: 1234abcd\r\nBaseURL: http://10.0.0.5:80\r\nLineupURL: http://10.0.0.5:80/lineup.json\r\nTunerCount: 2\r\n"
+	want := "Device: HDHR4-2US\r\nDeviceID: 1234abcd\r\nBaseURL: https://hdhr.example.com/tv\r\nLineupURL: https://hdhr.example.com/tv/lineup.json\r\nTunerCount: 2\r\n"
+	if got := string(rewriteDiscoveryOrigin([]byte(reply), "https://hdhr.example.com/tv/")); got != want {
+		t.Errorf("rewriteDiscoveryOrigin:\n got %q\nwant %q", got, want)
+	}
+
+	var seenID string
+	rewriteDiscoveryURLs([]byte(reply), func(deviceID, rawURL string) string {
+		seenID = deviceID
+		return rawURL
+	})
+	if seenID != "1234ABCD" {
+		t.Errorf("Expected text device ID 1234ABCD, got %q", seenID)
+	}
+}
+
+func TestRewriteDiscoveryIgnoresOtherPackets(t *testing.T) {
+	req := (&DiscoverRequest{DeviceTypes: []uint32{HDHRDeviceTypeTuner}, DeviceID: HDHRDeviceIDWildcard}).Marshal()
+	if got := rewriteDiscoveryOrigin(req, "10.1.1.1"); string(got) != string(req) {
+		t.Error("Expected a discover request to pass through untouched")
+	}
+	if got := rewriteDiscoveryOrigin([]byte("discover"), "10.1.1.1"); string(got) != "discover" {
+		t.Errorf("Expected plain text to pass through, got %q", got)
+	}
+}
+
+func TestRewriteURLOrigin(t *testing.T) {
+	tests := []struct{ raw, origin, want string }{
+		{"http://10.0.0.5:5004/auto/v5.1?x=1", "proxy:5004", "http://proxy:5004/auto/v5.1?x=1"},
+		{"http://10.0.0.5", "https://tv.example.com/hdhr", "https://tv.example.com/hdhr"},
+		{"not a url", "proxy", "not a url"},
+	}
+	for _, tt := range tests {
+		if got := rewriteURLOrigin(tt.raw, tt.origin); got != tt.want {
+			t.Errorf("rewriteURLOrigin(%q, %q) = %q, want %q", tt.raw, tt.origin, got, tt.want)
+		}
+	}
+}
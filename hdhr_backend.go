@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hdhrBackend serves from real HDHomeRun devices. By default their discovery
+// replies are relayed to the app as-is; as a virtual device they are pooled
+// behind the emulated device instead.
+type hdhrBackend struct {
+	name    string
+	devices []string
+	store   *configStore
+	pool    *virtualDevicePool // non-nil in virtual device mode
+
+	mu     sync.Mutex
+	health map[string]*directDeviceHealth
+}
+
+// directDeviceHealth tracks how a direct HDHomeRun has answered discovery queries
+type directDeviceHealth struct {
+	lastQueried time.Time
+	lastSeen    time.Time
+	replies     int
+	missed      int // consecutive queries without a reply
+}
+
+// DirectDeviceStats is a point-in-time snapshot of one direct HDHomeRun device.
+// Healthy means the device answered the most recent discovery query, or for
+// a pooled device, the most recent lineup refresh.
+type DirectDeviceStats struct {
+	IP          string
+	Healthy     bool
+	LastQueried time.Time
+	LastSeen    time.Time
+	Replies     int
+	Missed      int
+	TunerCount  int // pooled devices only
+	TunersInUse int // pooled devices only
+}
+
+// newHDHRBackend creates a backend over devices, pooled as one virtual
+// device if virtualDevice is set
+func newHDHRBackend(name string, devices []string, virtualDevice bool, store *configStore) *hdhrBackend {
+	b := &hdhrBackend{
+		name:    name,
+		devices: devices,
+		store:   store,
+		health:  make(map[string]*directDeviceHealth),
+	}
+	if virtualDevice {
+		b.pool = newVirtualDevicePool(devices)
+	}
+	return b
+}
+
+func (b *hdhrBackend) Name() string { return b.name }
+
+// Start learns the pooled devices' tuners and lineups in virtual device mode
+func (b *hdhrBackend) Start(ctx context.Context) error {
+	if b.pool == nil {
+		return nil
+	}
+	refreshCtx, cancel := context.WithTimeout(ctx, virtualDeviceHTTPTimeout)
+	defer cancel()
+	if _, err := b.pool.Refresh(refreshCtx); err != nil {
+		slog.Warn("No virtual device members reachable at startup", "err", err)
+	}
+	slog.Info("Virtual device mode enabled", "devices", b.devices, "tuners", b.pool.TunerCount())
+	return nil
+}
+
+// relaysDiscovery is set unless the devices are pooled as the emulated device
+func (b *hdhrBackend) relaysDiscovery() bool {
+	return b.pool == nil
+}
+
+// Discover relays the query to every device, or in virtual device mode
+// answers as the single pooled device
+func (b *hdhrBackend) Discover(ctx context.Context, q *discoveryQuery) bool {
+	if b.pool != nil {
+		return q.answerAsEmulatedDevice()
+	}
+
+	var wg sync.WaitGroup
+	var answered atomic.Bool
+	for _, ip := range b.devices {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			if b.queryDevice(ip, q) > 0 {
+				answered.Store(true)
+			}
+		}(ip)
+	}
+	wg.Wait()
+	return answered.Load()
+}
+
+// queryDevice sends the query to one HDHomeRun and relays each reply received
+// before the UDP read timeout, returning how many were relayed
+func (b *hdhrBackend) queryDevice(ip string, q *discoveryQuery) int {
+	done := q.router.beginDial()
+	defer done()
+
+	replies := 0
+	defer func() { b.recordQuery(ip, replies) }()
+
+	hdhrAddr := net.JoinHostPort(ip, strconv.Itoa(b.discoveryPort()))
+	hdhrUDPAddr, err := net.ResolveUDPAddr("udp", hdhrAddr)
+	if err != nil {
+		slog.Error("Error resolving HDHomeRun address", "addr", hdhrAddr, "err", err)
+		return replies
+	}
+
+	conn, err := net.DialUDP("udp", nil, hdhrUDPAddr)
+	if err != nil {
+		slog.Error("Error connecting to HDHomeRun", "addr", hdhrAddr, "err", err)
+		return replies
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(q.data)
+	if err != nil {
+		slog.Error("Error sending query to HDHomeRun", "addr", hdhrAddr, "err", err)
+		return replies
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Duration(UDPReadTimeout) * time.Millisecond))
+	respBuf := make([]byte, UDPReadBufferSize)
+	for {
+		n, err := conn.Read(respBuf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				slog.Error("Error reading response from HDHomeRun", "addr", hdhrAddr, "err", err)
+			}
+			return replies
+		}
+
+		if n > 0 {
+			replies++
+			slog.Debug("Response received from HDHomeRun", "addr", hdhrAddr, "bytes", n)
+			if err := q.reply(respBuf[:n]); err != nil {
+				slog.Error("Error sending response to app", "err", err)
+			}
+		}
+	}
+}
+
+// recordQuery updates a device's health after a query
+func (b *hdhrBackend) recordQuery(ip string, replies int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h, ok := b.health[ip]
+	if !ok {
+		h = &directDeviceHealth{}
+		b.health[ip] = h
+	}
+
+	now := time.Now()
+	h.lastQueried = now
+	if replies > 0 {
+		h.lastSeen = now
+		h.replies += replies
+		h.missed = 0
+	} else {
+		h.missed++
+		if h.missed == 1 {
+			slog.Warn("HDHomeRun did not answer discovery", "ip", ip)
+		}
+	}
+}
+
+// discoveryPort returns the UDP port real HDHomeRun devices listen on
+func (b *hdhrBackend) discoveryPort() int {
+	if b.store == nil {
+		return HDHomeRunDiscoveryUDPPort
+	}
+	return b.store.Get().GetHDHomeRunPort()
+}
+
+// preferredDevice returns the first device that answered its last query,
+// falling back to the first configured device
+func (b *hdhrBackend) preferredDevice() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, ip := range b.devices {
+		if h, ok := b.health[ip]; ok && !h.lastSeen.IsZero() && h.missed == 0 {
+			return ip
+		}
+	}
+	if len(b.devices) > 0 {
+		return b.devices[0]
+	}
+	return ""
+}
+
+// Lineup returns the merged pool lineup in virtual device mode. Relayed
+// devices publish their own lineups, so there is none to serve otherwise.
+func (b *hdhrBackend) Lineup(ctx context.Context) ([]TunarrLineupItem, error) {
+	if b.pool == nil {
+		return nil, nil
+	}
+	return b.pool.Refresh(ctx)
+}
+
+// TunerCount returns the pooled tuner total in virtual device mode
+func (b *hdhrBackend) TunerCount() int {
+	if b.pool == nil {
+		return 0
+	}
+	return b.pool.TunerCount()
+}
+
+// OpenStream reserves a pooled tuner in virtual device mode, otherwise
+// streams from the preferred device, which allocates its own tuners
+func (b *hdhrBackend) OpenStream(channel string) (string, func(), error) {
+	if b.pool != nil {
+		return b.pool.Acquire(channel)
+	}
+	ip := b.preferredDevice()
+	if ip == "" {
+		return "", nil, fmt.Errorf("no HDHomeRun configured")
+	}
+	return fmt.Sprintf("http://%s/auto/v%s", net.JoinHostPort(ip, strconv.Itoa(HDHRHTTPPort)), channel), func() {}, nil
+}
+
+// Healthy reports whether any device answered its last query or, in
+// virtual device mode, the last lineup refresh. Devices not yet queried
+// count as healthy.
+func (b *hdhrBackend) Healthy() bool {
+	for _, d := range b.deviceStats() {
+		if d.Healthy || d.LastQueried.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *hdhrBackend) Stats() BackendStats {
+	s := BackendStats{
+		Name:       b.name,
+		Type:       backendTypeHDHR,
+		TunerCount: b.TunerCount(),
+		Detail:     strings.Join(b.devices, ", "),
+		Devices:    b.deviceStats(),
+	}
+	s.Healthy = b.Healthy()
+	return s
+}
+
+// deviceStats returns each device's health, in configured order
+func (b *hdhrBackend) deviceStats() []DirectDeviceStats {
+	if b.pool != nil {
+		var out []DirectDeviceStats
+		for _, m := range b.pool.Stats() {
+			out = append(out, DirectDeviceStats{
+				IP:          m.Addr,
+				Healthy:     m.Reachable,
+				LastQueried: m.LastRefreshed,
+				LastSeen:    m.LastSeen,
+				TunerCount:  m.TunerCount,
+				TunersInUse: m.TunersInUse,
+			})
+		}
+		return out
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]DirectDeviceStats, 0, len(b.devices))
+	for _, ip := range b.devices {
+		ds := DirectDeviceStats{IP: ip}
+		if h, ok := b.health[ip]; ok {
+			ds.Healthy = !h.lastSeen.IsZero() && h.missed == 0
+			ds.LastQueried = h.lastQueried
+			ds.LastSeen = h.lastSeen
+			ds.Replies = h.replies
+			ds.Missed = h.missed
+		}
+		out = append(out, ds)
+	}
+	return out
+}
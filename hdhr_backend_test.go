@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeHDHR answers every datagram on conn with reply until conn is closed
+func fakeHDHR(conn *net.UDPConn, reply []byte) {
+	buf := make([]byte, UDPReadBufferSize)
+	for {
+		_, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		conn.WriteToUDP(reply, addr) //nolint:errcheck
+	}
+}
+
+func TestHDHRBackendQueriesEveryDevice(t *testing.T) {
+	first, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	port := first.LocalAddr().(*net.UDPAddr).Port
+	second, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: port})
+	if err != nil {
+		t.Skipf("cannot bind 127.0.0.2: %v", err)
+	}
+	defer second.Close()
+	go fakeHDHR(first, []byte("device-one"))
+	go fakeHDHR(second, []byte("device-two"))
+
+	cfg := DefaultConfig()
+	cfg.HDHomeRunPort = port
+	store := newConfigStore(cfg, "")
+	br := &backendRouter{name: "AppProxy", store: store}
+	hb := newHDHRBackend("hdhr", []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}, false, store)
+
+	app, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	proxy, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	q := &discoveryQuery{data: []byte("discover"), appAddr: app.LocalAddr().(*net.UDPAddr), conn: proxy, router: br}
+	if !hb.Discover(context.Background(), q) {
+		t.Error("expected Discover to report the devices' replies")
+	}
+
+	got := make(map[string]bool)
+	app.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, UDPReadBufferSize)
+	for len(got) < 2 {
+		n, _, err := app.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("expected replies from both devices, got %v: %v", got, err)
+		}
+		got[string(buf[:n])] = true
+	}
+	if !got["device-one"] || !got["device-two"] {
+		t.Errorf("unexpected replies relayed: %v", got)
+	}
+
+	s := hb.Stats()
+	if len(s.Devices) != 3 {
+		t.Fatalf("expected 3 direct devices, got %d", len(s.Devices))
+	}
+	for _, d := range s.Devices[:2] {
+		if !d.Healthy || d.LastSeen.IsZero() || d.Replies != 1 {
+			t.Errorf("expected %s healthy with one reply, got %+v", d.IP, d)
+		}
+	}
+	if silent := s.Devices[2]; silent.Healthy || silent.Missed != 1 || !silent.LastSeen.IsZero() {
+		t.Errorf("expected 127.0.0.3 unhealthy with one miss, got %+v", silent)
+	}
+	if s.Detail != "127.0.0.1, 127.0.0.2, 127.0.0.3" || !s.Healthy {
+		t.Errorf("unexpected backend stats %+v", s)
+	}
+	if ip := hb.preferredDevice(); ip != "127.0.0.1" {
+		t.Errorf("expected the first healthy device preferred, got %q", ip)
+	}
+	if url, _, err := hb.OpenStream("5.1"); err != nil || url != "http://127.0.0.1:5004/auto/v5.1" {
+		t.Errorf("unexpected stream URL %q, %v", url, err)
+	}
+}
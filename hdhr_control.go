@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unlockedSessionID is the SessionID of a tuner nobody holds a lockkey on
+const unlockedSessionID = "00000000"
+
+// controlErrUnknown is what a real device answers for variables it doesn't support
+const controlErrUnknown = "ERROR: unknown getset variable"
+
+// controlSysVars are the read-only /sys variables, keyed by name
+var controlSysVars = map[string]func(id DeviceIdentity) string{
+	"/sys/model":   func(id DeviceIdentity) string { return id.Model.FirmwareName },
+	"/sys/hwmodel": func(id DeviceIdentity) string { return id.Model.ModelNumber },
+	"/sys/version": func(id DeviceIdentity) string { return id.FirmwareVersion },
+}
+
+// controlTunerVars are the per-tuner variables; the bool reports whether they can be set
+var controlTunerVars = map[string]bool{
+	"status":     false,
+	"streaminfo": false,
+	"channel":    true,
+	"vchannel":   true,
+	"program":    true,
+	"target":     true,
+	"lockkey":    true,
+}
+
+// ServeControl answers HDHomeRun control protocol (get/set) sessions accepted
+// on listener until ctx is cancelled
+func (he *HDHREndpointServer) ServeControl(ctx context.Context, listener net.Listener) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("Error accepting control connection", "err", err)
+			continue
+		}
+		go he.HandleControlConn(ctx, conn)
+	}
+}
+
+// HandleControlConn answers get/set requests on conn until the client
+// disconnects or ctx is cancelled
+func (he *HDHREndpointServer) HandleControlConn(ctx context.Context, conn net.Conn) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	defer conn.Close()
+
+	peer := conn.RemoteAddr().String()
+	peerIP, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		peerIP = peer
+	}
+	slog.Debug("Control session opened", "client", peer)
+
+	for {
+		pkt, err := ReadHDHRPacket(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Debug("Control session closed", "client", peer, "err", err)
+			}
+			return
+		}
+
+		req, err := ParseControlRequest(pkt)
+		if err != nil {
+			slog.Debug("Ignoring control packet", "client", peer, "err", err)
+			continue
+		}
+
+		reply := &ControlReply{Name: req.Name}
+		reply.Value, err = he.controlGetSet(req, peerIP)
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		slog.Debug("Control request", "client", peer, "name", req.Name, "set", req.HasValue, "value", req.Value, "reply", reply.Value, "error", reply.Error)
+
+		if _, err := conn.Write(reply.Marshal()); err != nil {
+			return
+		}
+	}
+}
+
+// controlGetSet performs a single get or set against the emulated device and
+// returns the variable's resulting value. Errors carry the message sent back
+// to the client.
+func (he *HDHREndpointServer) controlGetSet(req *ControlRequest, peerIP string) (string, error) {
+	if req.Name == "help" {
+		return controlHelp(he.tunerStates.GetTunerCount()), nil
+	}
+
+	if get, ok := controlSysVars[req.Name]; ok {
+		if req.HasValue {
+			return "", errors.New(controlErrUnknown)
+		}
+		return get(ResolveDeviceIdentity(he.store.Get())), nil
+	}
+
+	index, variable, ok := parseTunerVar(req.Name)
+	if !ok {
+		return "", errors.New(controlErrUnknown)
+	}
+	settable, known := controlTunerVars[variable]
+	if !known || (req.HasValue && !settable) {
+		return "", errors.New(controlErrUnknown)
+	}
+
+	if req.HasValue {
+		err := he.tunerStates.UpdateTuner(index, func(t *TunerState) error {
+			return controlSetTuner(t, variable, req, peerIP)
+		})
+		if errors.Is(err, errTunerNotFound) {
+			return "", errors.New(controlErrUnknown)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	tuner, err := he.tunerStates.GetTuner(index)
+	if err != nil {
+		return "", errors.New(controlErrUnknown)
+	}
+	return controlTunerValue(tuner, variable), nil
+}
+
+// parseTunerVar splits "/tuner<N>/<variable>" into its tuner index and variable
+func parseTunerVar(name string) (int, string, bool) {
+	rest, ok := strings.CutPrefix(name, "/tuner")
+	if !ok {
+		return 0, "", false
+	}
+	num, variable, ok := strings.Cut(rest, "/")
+	if !ok {
+		return 0, "", false
+	}
+	index, err := strconv.Atoi(num)
+	if err != nil || index < 0 {
+		return 0, "", false
+	}
+	return index, variable, true
+}
+
+// controlSetTuner applies a set request to t, enforcing the tuner's lockkey
+func controlSetTuner(t *TunerState, variable string, req *ControlRequest, peerIP string) error {
+	if variable == "lockkey" && req.Value == "force" {
+		t.SessionID = unlockedSessionID
+		t.LockHolder = ""
+		refreshTunerStatus(t)
+		return nil
+	}
+
+	if t.SessionID != unlockedSessionID && (!req.HasLockkey || t.SessionID != lockkeySessionID(req.Lockkey)) {
+		return fmt.Errorf("ERROR: resource locked by %s", t.LockHolder)
+	}
+
+	switch variable {
+	case "lockkey":
+		if req.Value == "none" {
+			t.SessionID = unlockedSessionID
+			t.LockHolder = ""
+			break
+		}
+		key, err := strconv.ParseUint(req.Value, 10, 32)
+		if err != nil {
+			return errors.New("ERROR: invalid lockkey")
+		}
+		t.SessionID = lockkeySessionID(uint32(key))
+		t.LockHolder = peerIP
+		t.LockedAt = time.Now()
+
+	case "channel", "vchannel":
+		if req.Value == "none" {
+			t.Channel = ""
+			t.Program = ""
+			t.Tuning = false
+			t.BitRate = 0
+			break
+		}
+		t.Channel = req.Value
+		if variable == "vchannel" {
+			t.Program = req.Value
+		}
+		t.Tuning = true
+		t.LockedAt = time.Now()
+
+	case "program":
+		if req.Value == "none" || req.Value == "0" {
+			t.Program = ""
+		} else {
+			t.Program = req.Value
+		}
+
+	case "target":
+		if req.Value == "none" {
+			t.TargetIP = "0.0.0.0"
+			t.TargetPort = 0
+			break
+		}
+		ip, port, err := parseControlTarget(req.Value)
+		if err != nil {
+			return errors.New("ERROR: invalid target")
+		}
+		t.TargetIP = ip
+		t.TargetPort = port
+	}
+
+	refreshTunerStatus(t)
+	return nil
+}
+
+// controlTunerValue formats a tuner variable the way a real device reports it
+func controlTunerValue(t *TunerState, variable string) string {
+	switch variable {
+	case "status":
+		ch, lock := "none", "none"
+		if t.Channel != "" {
+			ch, lock = t.Channel, "8vsb"
+			if !strings.Contains(ch, ":") {
+				ch = "auto:" + ch
+			}
+		}
+		return fmt.Sprintf("ch=%s lock=%s ss=%d snq=%d seq=%d bps=%d pps=%d",
+			ch, lock, t.SignalStrength, t.SignalStrength, t.SignalStrength, t.BitRate, t.BitRate/(188*8))
+	case "streaminfo":
+		if t.Program == "" {
+			return "none"
+		}
+		return fmt.Sprintf("1: %s\n", t.Program)
+	case "channel":
+		return noneIfEmpty(t.Channel)
+	case "vchannel", "program":
+		return noneIfEmpty(t.Program)
+	case "target":
+		if t.TargetPort == 0 {
+			return "none"
+		}
+		return "udp://" + net.JoinHostPort(t.TargetIP, strconv.Itoa(t.TargetPort))
+	case "lockkey":
+		if t.SessionID == unlockedSessionID {
+			return "none"
+		}
+		return t.LockHolder
+	}
+	return ""
+}
+
+// parseControlTarget parses a target such as "udp://192.168.1.10:5000"
+func parseControlTarget(value string) (string, int, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", 0, err
+	}
+	if u.Scheme != "udp" && u.Scheme != "rtp" {
+		return "", 0, fmt.Errorf("unsupported target scheme %q", u.Scheme)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid target port %q", u.Port())
+	}
+	return u.Hostname(), port, nil
+}
+
+// refreshTunerStatus derives Status from whether the tuner is tuned or held
+func refreshTunerStatus(t *TunerState) {
+	if t.Channel == "" && t.SessionID == unlockedSessionID {
+		t.Status = "idle"
+	} else {
+		t.Status = "locked"
+	}
+}
+
+// lockkeySessionID stores a control-protocol lockkey in TunerState.SessionID
+func lockkeySessionID(key uint32) string {
+	return fmt.Sprintf("%08X", key)
+}
+
+// controlHelp lists the supported variables, as "get help" does on a real device
+func controlHelp(tunerCount int) string {
+	var names []string
+	for name := range controlSysVars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var vars []string
+	for variable := range controlTunerVars {
+		vars = append(vars, variable)
+	}
+	sort.Strings(vars)
+
+	var b strings.Builder
+	b.WriteString("Supported configuration options:\n")
+	for _, name := range names {
+		b.WriteString(name + "\n")
+	}
+	for _, variable := range vars {
+		fmt.Fprintf(&b, "/tuner<0-%d>/%s\n", tunerCount-1, variable)
+	}
+	return b.String()
+}
+
+func noneIfEmpty(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// controlClient is a minimal stand-in for hdhomerun_config's get/set commands
+type controlClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// newControlClient starts a control session against server over a pipe
+func newControlClient(t *testing.T, server *HDHREndpointServer) *controlClient {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.HandleControlConn(ctx, serverConn)
+	t.Cleanup(func() {
+		clientConn.Close()
+		cancel()
+	})
+	return &controlClient{t: t, conn: clientConn}
+}
+
+func (c *controlClient) do(req *ControlRequest) *ControlReply {
+	c.t.Helper()
+	if _, err := c.conn.Write(req.Marshal()); err != nil {
+		c.t.Fatalf("write %s: %v", req.Name, err)
+	}
+	pkt, err := ReadHDHRPacket(c.conn)
+	if err != nil {
+		c.t.Fatalf("read reply to %s: %v", req.Name, err)
+	}
+	reply, err := ParseControlReply(pkt)
+	if err != nil {
+		c.t.Fatalf("parse reply to %s: %v", req.Name, err)
+	}
+	if reply.Name != req.Name {
+		c.t.Errorf("Expected reply for %s, got %s", req.Name, reply.Name)
+	}
+	return reply
+}
+
+func (c *controlClient) get(name string) *ControlReply {
+	return c.do(&ControlRequest{Name: name})
+}
+
+func (c *controlClient) set(name, value string, lockkey uint32) *ControlReply {
+	return c.do(&ControlRequest{Name: name, Value: value, HasValue: true, Lockkey: lockkey, HasLockkey: lockkey != 0})
+}
+
+func newControlTestServer() *HDHREndpointServer {
+	cfg := DefaultConfig()
+	cfg.Device.ModelType = "HDHR4-2US"
+	cfg.Device.FirmwareVersion = "20240101"
+	return NewHDHREndpointServer(newConfigStore(cfg, ""), &mockHDHRStatsProvider{})
+}
+
+func TestControlSysVariables(t *testing.T) {
+	c := newControlClient(t, newControlTestServer())
+
+	if r := c.get("/sys/model"); r.Value != "hdhomerun4_atsc" {
+		t.Errorf("Expected /sys/model hdhomerun4_atsc, got %+v", r)
+	}
+	if r := c.get("/sys/hwmodel"); r.Value != "HDHR4-2US" {
+		t.Errorf("Expected /sys/hwmodel HDHR4-2US, got %+v", r)
+	}
+	if r := c.get("/sys/version"); r.Value != "20240101" {
+		t.Errorf("Expected /sys/version 20240101, got %+v", r)
+	}
+	if r := c.set("/sys/model", "x", 0); r.Error == "" {
+		t.Error("Expected error setting read-only /sys/model")
+	}
+	if r := c.get("/sys/bogus"); r.Error != controlErrUnknown {
+		t.Errorf("Expected unknown variable error, got %+v", r)
+	}
+	if r := c.get("/tuner2/status"); r.Error != controlErrUnknown {
+		t.Errorf("Expected unknown variable error for missing tuner, got %+v", r)
+	}
+	if r := c.set("/tuner2/channel", "auto:5.1", 0); r.Error != controlErrUnknown {
+		t.Errorf("Expected unknown variable error setting a missing tuner, got %+v", r)
+	}
+	if r := c.get("help"); !strings.Contains(r.Value, "/tuner<0-1>/channel") {
+		t.Errorf("Expected help to list tuner variables, got %q", r.Value)
+	}
+}
+
+func TestControlTuneAndStatus(t *testing.T) {
+	server := newControlTestServer()
+	c := newControlClient(t, server)
+
+	if r := c.get("/tuner0/status"); r.Value != "ch=none lock=none ss=0 snq=0 seq=0 bps=0 pps=0" {
+		t.Errorf("Unexpected idle status %q", r.Value)
+	}
+
+	if r := c.set("/tuner0/channel", "auto:575000000", 0); r.Error != "" || r.Value != "auto:575000000" {
+		t.Fatalf("set channel failed: %+v", r)
+	}
+	if r := c.set("/tuner0/program", "3", 0); r.Value != "3" {
+		t.Errorf("set program failed: %+v", r)
+	}
+	if r := c.set("/tuner0/target", "udp://192.168.1.10:5000", 0); r.Value != "udp://192.168.1.10:5000" {
+		t.Errorf("set target failed: %+v", r)
+	}
+	if r := c.get("/tuner0/status"); !strings.HasPrefix(r.Value, "ch=auto:575000000 lock=8vsb") {
+		t.Errorf("Unexpected tuned status %q", r.Value)
+	}
+
+	tuner, _ := server.tunerStates.GetTuner(0)
+	if tuner.Status != "locked" || tuner.Channel != "auto:575000000" || tuner.TargetPort != 5000 {
+		t.Errorf("Tuner state not updated: %+v", tuner)
+	}
+
+	c.set("/tuner0/channel", "none", 0)
+	c.set("/tuner0/target", "none", 0)
+	tuner, _ = server.tunerStates.GetTuner(0)
+	if tuner.Status != "idle" {
+		t.Errorf("Expected tuner idle after channel none, got %+v", tuner)
+	}
+	if r := c.set("/tuner0/target", "http://x", 0); r.Error == "" {
+		t.Error("Expected error for unsupported target scheme")
+	}
+}
+
+func TestControlLockkey(t *testing.T) {
+	server := newControlTestServer()
+	owner := newControlClient(t, server)
+	other := newControlClient(t, server)
+
+	if r := owner.set("/tuner1/lockkey", "12345", 12345); r.Error != "" {
+		t.Fatalf("lockkey request failed: %+v", r)
+	}
+	if r := other.get("/tuner1/lockkey"); r.Value != "pipe" {
+		t.Errorf("Expected lock holder address, got %+v", r)
+	}
+
+	if r := other.set("/tuner1/vchannel", "5.1", 999); !strings.HasPrefix(r.Error, "ERROR: resource locked") {
+		t.Errorf("Expected locked error for wrong lockkey, got %+v", r)
+	}
+	if r := other.set("/tuner1/vchannel", "5.1", 0); !strings.HasPrefix(r.Error, "ERROR: resource locked") {
+		t.Errorf("Expected locked error without lockkey, got %+v", r)
+	}
+	if r := owner.set("/tuner1/vchannel", "5.1", 12345); r.Error != "" || r.Value != "5.1" {
+		t.Errorf("Expected lock owner to tune, got %+v", r)
+	}
+	if r := owner.set("/tuner1/target", "udp://192.168.1.10:5000", 12345); r.Error != "" {
+		t.Errorf("Expected lock owner to set the target, got %+v", r)
+	}
+	if r := other.get("/tuner1/lockkey"); r.Value != "pipe" {
+		t.Errorf("Expected lockkey to name the holder, not the stream target, got %+v", r)
+	}
+	if r := other.set("/tuner1/vchannel", "5.2", 0); r.Error != "ERROR: resource locked by pipe" {
+		t.Errorf("Expected the locked error to name the holder, got %+v", r)
+	}
+	if r := owner.get("/tuner1/streaminfo"); r.Value != "1: 5.1\n" {
+		t.Errorf("Unexpected streaminfo %q", r.Value)
+	}
+
+	if r := other.set("/tuner1/lockkey", "force", 0); r.Error != "" || r.Value != "none" {
+		t.Errorf("Expected force to release the lock, got %+v", r)
+	}
+	if r := other.set("/tuner1/channel", "none", 0); r.Error != "" {
+		t.Errorf("Expected unlocked tuner to accept sets, got %+v", r)
+	}
+}
+
+func TestControlRejectsSetOnStreamingTuner(t *testing.T) {
+	server := newControlTestServer()
+	server.tunerStates.AllocateTuner("2.1", "ABCDEF01", "10.0.0.9", 40000) //nolint:errcheck
+	c := newControlClient(t, server)
+
+	if r := c.set("/tuner0/channel", "auto:5.1", 0); r.Error != "ERROR: resource locked by 10.0.0.9" {
+		t.Errorf("Expected tuner held by /auto stream to be locked, got %+v", r)
+	}
+}
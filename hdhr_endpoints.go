@@ -5,7 +5,12 @@ import (
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // HDHREndpointServer serves HDHR-compatible discovery endpoints
@@ -14,6 +19,10 @@ type HDHREndpointServer struct {
 	store        *configStore
 	router       statsProvider
 	tunerStates  *TunerStateManager
+	streamClient *http.Client // no timeout: streams run until the client disconnects
+	lineup       lineupCache
+	guide        guideCache
+	events       upnpSubscriptions
 }
 
 // DiscoverJSONResponse matches HDHomeRun discover.json format
@@ -33,7 +42,15 @@ type DiscoverJSONResponse struct {
 type LineupItemJSON struct {
 	GuideNumber string `json:"GuideNumber"`
 	GuideName   string `json:"GuideName"`
-	URL         string `json:"URL"`
+	HD          int    `json:"HD,omitempty" xml:",omitempty"`
+	Favorite    int    `json:"Favorite,omitempty" xml:",omitempty"`
+	URL         string `json:"URL,omitempty" xml:",omitempty"` // empty for hidden channels, which can't be streamed
+}
+
+// LineupXML is the lineup.xml response
+type LineupXML struct {
+	XMLName  xml.Name         `xml:"Lineup"`
+	Programs []LineupItemJSON `xml:"Program"`
 }
 
 // LineupStatusJSON is the lineup status response
@@ -45,33 +62,41 @@ type LineupStatusJSON struct {
 	NumChannels    int      `json:"NumChannels"`
 }
 
-// DeviceXML is the XML representation of an HDHR device
+// DeviceXML is the UPnP device description of an HDHR device
 type DeviceXML struct {
-	XMLName     xml.Name `xml:"root"`
-	Xmlns       string   `xml:"xmlns,attr"`
-	Device      DeviceXMLDevice
-	ServiceList ServiceList
+	XMLName     xml.Name        `xml:"root"`
+	Xmlns       string          `xml:"xmlns,attr"`
+	SpecVersion SpecVersion     `xml:"specVersion"`
+	URLBase     string          `xml:"URLBase"`
+	Device      DeviceXMLDevice `xml:"device"`
+}
+
+type SpecVersion struct {
+	Major int `xml:"major"`
+	Minor int `xml:"minor"`
 }
 
 type DeviceXMLDevice struct {
-	DeviceType   string
-	FriendlyName string
-	Manufacturer string
-	ModelNumber  string
-	DeviceID     string
-	BaseURL      string
+	DeviceType   string      `xml:"deviceType"`
+	FriendlyName string      `xml:"friendlyName"`
+	Manufacturer string      `xml:"manufacturer"`
+	ModelName    string      `xml:"modelName"`
+	ModelNumber  string      `xml:"modelNumber"`
+	SerialNumber string      `xml:"serialNumber"`
+	UDN          string      `xml:"UDN"`
+	ServiceList  ServiceList `xml:"serviceList"`
 }
 
 type ServiceList struct {
-	Service []Service
+	Service []Service `xml:"service"`
 }
 
 type Service struct {
-	ServiceType string
-	ServiceID   string
-	SCPDURL     string
-	ControlURL  string
-	EventSubURL string
+	ServiceType string `xml:"serviceType"`
+	ServiceID   string `xml:"serviceId"`
+	SCPDURL     string `xml:"SCPDURL"`
+	ControlURL  string `xml:"controlURL"`
+	EventSubURL string `xml:"eventSubURL"`
 }
 
 // TunerStatusJSON is per-tuner status
@@ -90,18 +115,38 @@ type TunerStatusJSON struct {
 // NewHDHREndpointServer creates a new HDHR endpoint server
 func NewHDHREndpointServer(store *configStore, router statsProvider) *HDHREndpointServer {
 	// Initialize tuner state manager with tuner count from config
-	cfg := store.Get()
-	modelType := cfg.Device.ModelType
-	if modelType == "" {
-		modelType = "HDFX-4K"
+	id := ResolveDeviceIdentity(store.Get())
+
+	he := &HDHREndpointServer{
+		store:        store,
+		router:       router,
+		tunerStates:  NewTunerStateManager(id.Model.TunerCount),
+		streamClient: &http.Client{},
+	}
+	if tc, ok := router.(tunerCounter); ok {
+		he.resizeTuners()
+		tc.watchTunerCount(he.resizeTuners)
 	}
-	modelInfo, _ := GetModelInfo(modelType)
+	return he
+}
+
+// tunerCounter is implemented by routers whose backends know how many
+// tuners they offer, a total that changes as pooled devices come and go.
+// watchTunerCount registers fn to be called whenever a backend starts or
+// refreshes, which is when the total may change.
+type tunerCounter interface {
+	TunerCount() int
+	watchTunerCount(fn func())
+}
 
-	return &HDHREndpointServer{
-		store:       store,
-		router:      router,
-		tunerStates: NewTunerStateManager(modelInfo.TunerCount),
+// resizeTuners resizes the tuner states to the router's current tuner total,
+// or the emulated model's count when the backends don't know theirs
+func (he *HDHREndpointServer) resizeTuners() {
+	n := ResolveDeviceIdentity(he.store.Get()).Model.TunerCount
+	if total := he.router.(tunerCounter).TunerCount(); total > 0 {
+		n = total
 	}
+	he.tunerStates.Resize(n)
 }
 
 // Handler returns the HTTP handler for HDHR endpoints
@@ -109,127 +154,211 @@ func (he *HDHREndpointServer) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/discover.json", he.handleDiscover)
 	mux.HandleFunc("/lineup.json", he.handleLineup)
+	mux.HandleFunc("/lineup.xml", he.handleLineupXML)
+	mux.HandleFunc("/lineup.m3u", he.handleLineupM3U)
 	mux.HandleFunc("/lineup_status.json", he.handleLineupStatus)
+	mux.HandleFunc("/xmltv.xml", he.handleXMLTV)
 	mux.HandleFunc("/device.xml", he.handleDeviceXML)
+	mux.HandleFunc("/content_directory.xml", he.handleContentDirectorySCPD)
+	mux.HandleFunc("/control", he.handleControl)
+	mux.HandleFunc("/subscribe", he.handleSubscribe)
 	mux.HandleFunc("/tuner", he.handleTunerList)
-	// Tuner status endpoints - pattern matching for /tuner{N}/status
-	for i := 0; i < 8; i++ {
-		tunerNum := i
-		mux.HandleFunc(fmt.Sprintf("/tuner%d/status", tunerNum), func(w http.ResponseWriter, r *http.Request) {
-			he.handleTunerStatus(w, r, tunerNum)
-		})
-		mux.HandleFunc(fmt.Sprintf("/tuner%d/streaminfo", tunerNum), func(w http.ResponseWriter, r *http.Request) {
-			he.handleTunerStreamInfo(w, r, tunerNum)
-		})
-	}
+	mux.HandleFunc("/auto/", he.handleAutoStream)
+	// Everything else is /tuner{N}/status or /tuner{N}/streaminfo, for
+	// however many tuners there are at the time
+	mux.HandleFunc("/", he.handleTunerPath)
 	return mux
 }
 
 // getDeviceConfig gets the current device configuration, auto-generating DeviceID if needed
-func (he *HDHREndpointServer) getDeviceConfig(ctx context.Context) *DiscoverJSONResponse {
-	cfg := he.store.Get()
-	model := cfg.Device.ModelType
-	if model == "" {
-		model = "HDFX-4K"
-	}
+func (he *HDHREndpointServer) getDeviceConfig(r *http.Request) *DiscoverJSONResponse {
+	id := ResolveDeviceIdentity(he.store.Get())
+	baseURL := he.getBaseURL(r)
 
-	modelInfo, err := GetModelInfo(model)
-	if err != nil {
-		modelInfo, _ = GetModelInfo("HDFX-4K")
+	return &DiscoverJSONResponse{
+		FriendlyName:    id.FriendlyName,
+		ModelNumber:     id.Model.ModelNumber,
+		FirmwareName:    id.Model.FirmwareName,
+		FirmwareVersion: id.FirmwareVersion,
+		DeviceID:        id.DeviceID,
+		DeviceAuth:      id.DeviceAuth,
+		BaseURL:         baseURL,
+		LineupURL:       baseURL + "/lineup.json",
+		TunerCount:      he.tunerStates.GetTunerCount(),
 	}
+}
 
-	deviceID := cfg.Device.DeviceID
-	if deviceID == "" {
-		// Auto-generate a realistic Device ID
-		deviceID = GenerateRealisticDeviceID(model)
-		// Update config with generated ID (in-memory only for now)
-		cfg.Device.DeviceID = deviceID
+// getBaseURL returns the base URL clients should use for this request: the
+// configured device.base_url override, or the address the client connected to
+func (he *HDHREndpointServer) getBaseURL(r *http.Request) string {
+	cfg := he.store.Get()
+	if cfg.Device.BaseURL != "" {
+		return advertisedBaseURL(cfg, "", "")
 	}
+	return he.UpdateBaseURLFromRequest(r)
+}
 
-	baseURL := he.getBaseURL()
-	friendlyName := cfg.Device.FriendlyName
-	if friendlyName == "" {
-		friendlyName = modelInfo.FriendlyName
+// advertisedBaseURL returns cfg's device.base_url override if set, otherwise
+// scheme://hostPort. Used by both the HTTP endpoints and discovery replies.
+func advertisedBaseURL(cfg *Config, scheme, hostPort string) string {
+	if cfg.Device.BaseURL != "" {
+		return strings.TrimRight(cfg.Device.BaseURL, "/")
 	}
+	return scheme + "://" + hostPort
+}
 
-	firmwareVersion := cfg.Device.FirmwareVersion
-	if firmwareVersion == "" {
-		firmwareVersion = "20250825"
+// handleDiscover handles /discover.json
+func (he *HDHREndpointServer) handleDiscover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	deviceAuth := cfg.Device.DeviceAuth
-	if deviceAuth == "" {
-		deviceAuth = "00000000"
+	discover := he.getDeviceConfig(r)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(discover) //nolint:errcheck
+}
+
+// backendLineup returns the backend lineup (cached), or nil when the router
+// has no lineup backend
+func (he *HDHREndpointServer) backendLineup(ctx context.Context) []TunarrLineupItem {
+	source, ok := he.router.(lineupSource)
+	if !ok {
+		return nil
 	}
 
-	return &DiscoverJSONResponse{
-		FriendlyName:    friendlyName,
-		ModelNumber:     modelInfo.ModelNumber,
-		FirmwareName:    modelInfo.FirmwareName,
-		FirmwareVersion: firmwareVersion,
-		DeviceID:        deviceID,
-		DeviceAuth:      deviceAuth,
-		BaseURL:         baseURL,
-		LineupURL:       baseURL + "/lineup.json",
-		TunerCount:      modelInfo.TunerCount,
+	ttl := time.Duration(he.store.Get().GetLineupCacheSeconds()) * time.Second
+	items, err := he.lineup.get(ctx, source, ttl)
+	if err != nil {
+		slog.Warn("Failed to fetch lineup from backend", "err", err, "cached_channels", len(items))
 	}
+	return items
 }
 
-// getBaseURL constructs the base URL for the device
-func (he *HDHREndpointServer) getBaseURL() string {
-	// This would be called in a real server context where we know the address
-	// For now, return a placeholder that would be set by the calling server
-	// In practice, this should use the request's Host header
-	return "http://192.168.1.100:5004"
+// Values of the ?show= parameter real devices accept on their lineup endpoints
+const (
+	lineupShowFound = "found" // channels in the lineup (the default)
+	lineupShowAll   = "all"   // also channels hidden by a channel rule
+	lineupShowDemo  = "demo"  // demo channels; the proxy has none
+)
+
+// lineupEntries returns the lineup for r as served by lineup.json,
+// lineup.xml and lineup.m3u, honoring ?show=. Channel URLs point at our own
+// /auto endpoint, which relays the backend stream; hidden channels, listed
+// by ?show=all, have none since they aren't routed.
+func (he *HDHREndpointServer) lineupEntries(r *http.Request) []LineupItemJSON {
+	show := r.URL.Query().Get("show")
+	lineup := []LineupItemJSON{}
+	if show == lineupShowDemo {
+		return lineup
+	}
+
+	baseURL := he.getBaseURL(r)
+	for _, item := range he.backendLineup(r.Context()) {
+		if item.GuideNumber == "" || (item.Hidden && show != lineupShowAll) {
+			continue
+		}
+		entry := LineupItemJSON{
+			GuideNumber: item.GuideNumber,
+			GuideName:   item.GuideName,
+			HD:          item.HD,
+			Favorite:    item.Favorite,
+		}
+		if !item.Hidden {
+			entry.URL = baseURL + "/auto/v" + item.GuideNumber
+		}
+		lineup = append(lineup, entry)
+	}
+	return lineup
 }
 
-// handleDiscover handles /discover.json
-func (he *HDHREndpointServer) handleDiscover(w http.ResponseWriter, r *http.Request) {
+// handleLineup handles /lineup.json
+func (he *HDHREndpointServer) handleLineup(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	discover := he.getDeviceConfig(r.Context())
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "no-cache")
-	json.NewEncoder(w).Encode(discover) //nolint:errcheck
+	json.NewEncoder(w).Encode(he.lineupEntries(r)) //nolint:errcheck
 }
 
-// handleLineup handles /lineup.json
-func (he *HDHREndpointServer) handleLineup(w http.ResponseWriter, r *http.Request) {
+// handleLineupXML handles /lineup.xml, in the real device's Lineup/Program shape
+func (he *HDHREndpointServer) handleLineupXML(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var lineup []LineupItemJSON
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(xml.Header)) //nolint:errcheck
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	enc.Encode(LineupXML{Programs: he.lineupEntries(r)}) //nolint:errcheck
+}
 
-	// If Tunarr is available, get lineup from it
-	baseURL := he.getBaseURL()
-	if stats := he.router.Stats(); stats.TunarrConfigured {
-		// This would normally fetch from Tunarr backend
-		// For now, return a sample lineup
-		lineup = []LineupItemJSON{
-			{
-				GuideNumber: "1.1",
-				GuideName:   "NBC",
-				URL:         baseURL + "/auto/v1.1",
-			},
-			{
-				GuideNumber: "2.1",
-				GuideName:   "CBS",
-				URL:         baseURL + "/auto/v2.1",
-			},
+// handleLineupM3U handles /lineup.m3u, a playlist for VLC, Kodi and similar
+// players. Hidden channels have no URL to play, so even ?show=all leaves them out.
+func (he *HDHREndpointServer) handleLineupM3U(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	for _, item := range he.lineupEntries(r) {
+		if item.URL == "" {
+			continue
 		}
-	} else {
-		// Empty lineup for direct HDHR mode
-		lineup = []LineupItemJSON{}
+		name := m3uQuote(item.GuideName)
+		fmt.Fprintf(&b, "#EXTINF:-1 channel-id=\"%s\" channel-number=\"%s\" tvg-id=\"%s\" tvg-chno=\"%s\" tvg-name=\"%s\"",
+			item.GuideNumber, item.GuideNumber, item.GuideNumber, item.GuideNumber, name)
+		if item.Favorite != 0 {
+			b.WriteString(` group-title="Favorites"`)
+		}
+		fmt.Fprintf(&b, ",%s\n%s\n", name, item.URL)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
 	w.Header().Set("Cache-Control", "no-cache")
-	json.NewEncoder(w).Encode(lineup) //nolint:errcheck
+	w.Write([]byte(b.String())) //nolint:errcheck
+}
+
+// m3uQuote makes s safe inside a double-quoted #EXTINF attribute
+func m3uQuote(s string) string {
+	return strings.NewReplacer(`"`, "'", "\n", " ", "\r", " ").Replace(s)
+}
+
+// handleXMLTV handles /xmltv.xml, the guide merged from the backends' and
+// configured XMLTV sources
+func (he *HDHREndpointServer) handleXMLTV(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	source, ok := he.router.(xmltvProvider)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	ttl := time.Duration(he.store.Get().GetXMLTVRefreshSeconds()) * time.Second
+	data, err := he.guide.get(r.Context(), source, ttl)
+	if err != nil {
+		slog.Warn("Failed to build XMLTV guide", "err", err, "cached_bytes", len(data))
+	}
+	if data == nil {
+		http.Error(w, "guide unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(data) //nolint:errcheck
 }
 
 // handleLineupStatus handles /lineup_status.json
@@ -239,12 +368,24 @@ func (he *HDHREndpointServer) handleLineupStatus(w http.ResponseWriter, r *http.
 		return
 	}
 
+	numChannels := 0
+	for _, item := range he.backendLineup(r.Context()) {
+		if !item.Hidden {
+			numChannels++
+		}
+	}
+
+	scanning := 0
+	if sr, ok := he.router.(lineupSyncReporter); ok && sr.LineupSyncing() {
+		scanning = 1
+	}
+
 	status := LineupStatusJSON{
-		ScanInProgress: 0,
+		ScanInProgress: scanning,
 		ScanPossible:   1,
 		Source:         "Cable",
 		SourceList:     []string{"Cable"},
-		NumChannels:    100,
+		NumChannels:    numChannels,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -259,25 +400,28 @@ func (he *HDHREndpointServer) handleDeviceXML(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	discover := he.getDeviceConfig(r.Context())
+	discover := he.getDeviceConfig(r)
 	device := DeviceXML{
-		Xmlns: "urn:schemas-upnp-org:device-1-0",
+		Xmlns:       "urn:schemas-upnp-org:device-1-0",
+		SpecVersion: SpecVersion{Major: 1, Minor: 0},
+		URLBase:     discover.BaseURL,
 		Device: DeviceXMLDevice{
-			DeviceType:   "urn:schemas-upnp-org:device:MediaServer:1",
+			DeviceType:   upnpDeviceType,
 			FriendlyName: discover.FriendlyName,
 			Manufacturer: "Silicondust",
+			ModelName:    discover.FriendlyName,
 			ModelNumber:  discover.ModelNumber,
-			DeviceID:     discover.DeviceID,
-			BaseURL:      discover.BaseURL,
-		},
-		ServiceList: ServiceList{
-			Service: []Service{
-				{
-					ServiceType: "urn:schemas-upnp-org:service:ContentDirectory:1",
-					ServiceID:   "urn:upnp-org:serviceId:ContentDirectory",
-					SCPDURL:     "/device.xml",
-					ControlURL:  "/control",
-					EventSubURL: "/subscribe",
+			SerialNumber: discover.DeviceID,
+			UDN:          deviceUDN(discover.DeviceID),
+			ServiceList: ServiceList{
+				Service: []Service{
+					{
+						ServiceType: upnpContentDirectoryType,
+						ServiceID:   "urn:upnp-org:serviceId:ContentDirectory",
+						SCPDURL:     "/content_directory.xml",
+						ControlURL:  "/control",
+						EventSubURL: "/subscribe",
+					},
 				},
 			},
 		},
@@ -295,8 +439,8 @@ func (he *HDHREndpointServer) handleTunerList(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	discover := he.getDeviceConfig(r.Context())
-	baseURL := he.getBaseURL()
+	discover := he.getDeviceConfig(r)
+	baseURL := he.getBaseURL(r)
 
 	type tunerInfo struct {
 		Index      int    `json:"Index"`
@@ -317,6 +461,24 @@ func (he *HDHREndpointServer) handleTunerList(w http.ResponseWriter, r *http.Req
 	json.NewEncoder(w).Encode(tuners) //nolint:errcheck
 }
 
+// handleTunerPath routes /tuner{N}/status and /tuner{N}/streaminfo
+func (he *HDHREndpointServer) handleTunerPath(w http.ResponseWriter, r *http.Request) {
+	tunerNum, endpoint, ok := parseTunerVar(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch endpoint {
+	case "status":
+		he.handleTunerStatus(w, r, tunerNum)
+	case "streaminfo":
+		he.handleTunerStreamInfo(w, r, tunerNum)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
 // handleTunerStatus handles /tuner{N}/status
 func (he *HDHREndpointServer) handleTunerStatus(w http.ResponseWriter, r *http.Request, tunerNum int) {
 	if r.Method != http.MethodGet {
@@ -387,8 +549,9 @@ func (he *HDHREndpointServer) handleTunerStreamInfo(w http.ResponseWriter, r *ht
 	json.NewEncoder(w).Encode(info) //nolint:errcheck
 }
 
-// UpdateBaseURLFromRequest updates the base URL based on the incoming request
-// This should be called on the first request to set the correct base URL for responses
+// UpdateBaseURLFromRequest derives the base URL from the incoming request: the
+// Host header the client used, or failing that the local address the
+// connection arrived on (so each interface advertises its own address)
 func (he *HDHREndpointServer) UpdateBaseURLFromRequest(r *http.Request) string {
 	var scheme string
 	if r.TLS != nil {
@@ -401,6 +564,15 @@ func (he *HDHREndpointServer) UpdateBaseURLFromRequest(r *http.Request) string {
 	if host == "" {
 		host = r.Header.Get("Host")
 	}
+	if host == "" {
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+			// A link-local zone means nothing to the client, so it is left out
+			host = net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+		}
+	}
+	if host == "" {
+		host = net.JoinHostPort("127.0.0.1", strconv.Itoa(HDHRHTTPPort))
+	}
 
 	baseURL := fmt.Sprintf("%s://%s", scheme, host)
 	return baseURL
@@ -3,8 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -17,6 +21,16 @@ func (m *mockHDHRStatsProvider) Stats() ProxyStats {
 	return m.stats
 }
 
+// mockTunerCountRouter is a router whose backends' tuner total can change
+type mockTunerCountRouter struct {
+	mockHDHRStatsProvider
+	tuners  int
+	changed func()
+}
+
+func (m *mockTunerCountRouter) TunerCount() int           { return m.tuners }
+func (m *mockTunerCountRouter) watchTunerCount(fn func()) { m.changed = fn }
+
 func TestDiscoverJSONEndpoint(t *testing.T) {
 	cfg := DefaultConfig()
 	cfg.Device.ModelType = "HDFX-4K"
@@ -27,10 +41,9 @@ func TestDiscoverJSONEndpoint(t *testing.T) {
 	store := newConfigStore(cfg, "")
 	mockStats := &mockHDHRStatsProvider{
 		stats: ProxyStats{
-			Name:             "TestProxy",
-			TunarrConfigured: false,
-			ActiveUDP:        0,
-			ActiveDial:       0,
+			Name:       "TestProxy",
+			ActiveUDP:  0,
+			ActiveDial: 0,
 		},
 	}
 
@@ -70,8 +83,7 @@ func TestLineupStatusEndpoint(t *testing.T) {
 	store := newConfigStore(cfg, "")
 	mockStats := &mockHDHRStatsProvider{
 		stats: ProxyStats{
-			Name:             "TestProxy",
-			TunarrConfigured: false,
+			Name: "TestProxy",
 		},
 	}
 
@@ -108,8 +120,7 @@ func TestLineupJSONEndpoint(t *testing.T) {
 	store := newConfigStore(cfg, "")
 	mockStats := &mockHDHRStatsProvider{
 		stats: ProxyStats{
-			Name:             "TestProxy",
-			TunarrConfigured: false,
+			Name: "TestProxy",
 		},
 	}
 
@@ -141,8 +152,7 @@ func TestTunerStatusEndpoint(t *testing.T) {
 	store := newConfigStore(cfg, "")
 	mockStats := &mockHDHRStatsProvider{
 		stats: ProxyStats{
-			Name:             "TestProxy",
-			TunarrConfigured: false,
+			Name: "TestProxy",
 		},
 	}
 
@@ -179,8 +189,7 @@ func TestDeviceXMLEndpoint(t *testing.T) {
 	store := newConfigStore(cfg, "")
 	mockStats := &mockHDHRStatsProvider{
 		stats: ProxyStats{
-			Name:             "TestProxy",
-			TunarrConfigured: false,
+			Name: "TestProxy",
 		},
 	}
 
@@ -213,8 +222,7 @@ func TestMethodNotAllowedOnEndpoints(t *testing.T) {
 	store := newConfigStore(cfg, "")
 	mockStats := &mockHDHRStatsProvider{
 		stats: ProxyStats{
-			Name:             "TestProxy",
-			TunarrConfigured: false,
+			Name: "TestProxy",
 		},
 	}
 
@@ -224,6 +232,8 @@ func TestMethodNotAllowedOnEndpoints(t *testing.T) {
 	tests := []string{
 		"/discover.json",
 		"/lineup.json",
+		"/lineup.xml",
+		"/lineup.m3u",
 		"/lineup_status.json",
 		"/device.xml",
 	}
@@ -250,13 +260,12 @@ func TestGetDeviceConfigAutoGeneration(t *testing.T) {
 	store := newConfigStore(cfg, "")
 	mockStats := &mockHDHRStatsProvider{
 		stats: ProxyStats{
-			Name:             "TestProxy",
-			TunarrConfigured: false,
+			Name: "TestProxy",
 		},
 	}
 
 	server := NewHDHREndpointServer(store, mockStats)
-	deviceCfg := server.getDeviceConfig(context.Background())
+	deviceCfg := server.getDeviceConfig(httptest.NewRequest("GET", "/discover.json", nil))
 
 	if deviceCfg.DeviceID == "" {
 		t.Errorf("Expected auto-generated DeviceID, got empty string")
@@ -271,6 +280,121 @@ func TestGetDeviceConfigAutoGeneration(t *testing.T) {
 	}
 }
 
+// mockLineupRouter is a statsProvider that also serves a backend lineup
+type mockLineupRouter struct {
+	mockHDHRStatsProvider
+	items []TunarrLineupItem
+}
+
+func (m *mockLineupRouter) Lineup(ctx context.Context) ([]TunarrLineupItem, error) {
+	return m.items, nil
+}
+
+func TestLineupJSONFromBackend(t *testing.T) {
+	store := newConfigStore(DefaultConfig(), "")
+	router := &mockLineupRouter{items: []TunarrLineupItem{
+		{GuideNumber: "100", GuideName: "Movies", URL: "http://tunarr:8000/stream/100"},
+		{GuideNumber: "101", GuideName: "Cartoons", URL: "http://tunarr:8000/stream/101"},
+		{GuideNumber: "102", GuideName: "News", URL: "http://tunarr:8000/stream/102"},
+	}}
+
+	server := NewHDHREndpointServer(store, router)
+	handler := server.Handler()
+
+	req := httptest.NewRequest("GET", "/lineup.json", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var lineup []LineupItemJSON
+	if err := json.NewDecoder(w.Body).Decode(&lineup); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(lineup) != 3 {
+		t.Fatalf("Expected 3 channels, got %d", len(lineup))
+	}
+	if lineup[1].GuideNumber != "101" || lineup[1].GuideName != "Cartoons" {
+		t.Errorf("Unexpected channel: %+v", lineup[1])
+	}
+	if lineup[1].URL != "http://example.com/auto/v101" {
+		t.Errorf("Expected URL rewritten to proxy /auto endpoint, got %q", lineup[1].URL)
+	}
+
+	req = httptest.NewRequest("GET", "/lineup_status.json", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var status LineupStatusJSON
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if status.NumChannels != 3 {
+		t.Errorf("Expected NumChannels 3, got %d", status.NumChannels)
+	}
+}
+
+func TestBaseURLFromHostHeader(t *testing.T) {
+	cfg := DefaultConfig()
+	store := newConfigStore(cfg, "")
+	server := NewHDHREndpointServer(store, &mockHDHRStatsProvider{})
+	handler := server.Handler()
+
+	req := httptest.NewRequest("GET", "/discover.json", nil)
+	req.Host = "10.20.30.40:5004"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var response DiscoverJSONResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response.BaseURL != "http://10.20.30.40:5004" {
+		t.Errorf("Expected BaseURL from Host header, got %q", response.BaseURL)
+	}
+	if response.LineupURL != "http://10.20.30.40:5004/lineup.json" {
+		t.Errorf("Expected LineupURL from Host header, got %q", response.LineupURL)
+	}
+}
+
+func TestBaseURLFromLocalAddr(t *testing.T) {
+	server := NewHDHREndpointServer(newConfigStore(DefaultConfig(), ""), &mockHDHRStatsProvider{})
+
+	req := httptest.NewRequest("GET", "/discover.json", nil)
+	req.Host = ""
+	local := &net.TCPAddr{IP: net.ParseIP("192.168.7.2"), Port: 5004}
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, local))
+
+	if got := server.getBaseURL(req); got != "http://192.168.7.2:5004" {
+		t.Errorf("Expected BaseURL from local address, got %q", got)
+	}
+
+	local = &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 5004, Zone: "eth0"}
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, local))
+	if got := server.getBaseURL(req); got != "http://[fe80::1]:5004" {
+		t.Errorf("Expected a bracketed IPv6 BaseURL without the zone, got %q", got)
+	}
+}
+
+func TestBaseURLConfigOverride(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Device.BaseURL = "https://hdhr.example.net/"
+	server := NewHDHREndpointServer(newConfigStore(cfg, ""), &mockHDHRStatsProvider{})
+
+	req := httptest.NewRequest("GET", "/tuner", nil)
+	req.Host = "10.20.30.40:5004"
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+
+	var tuners []struct {
+		StatusURL string `json:"StatusURL"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&tuners); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(tuners) == 0 || tuners[0].StatusURL != "https://hdhr.example.net/tuner0/status" {
+		t.Errorf("Expected override BaseURL in tuner list, got %+v", tuners)
+	}
+}
+
 // Helper function
 func contains(s, substr string) bool {
 	for i := 0; i <= len(s)-len(substr); i++ {
@@ -280,3 +404,161 @@ func contains(s, substr string) bool {
 	}
 	return false
 }
+
+func TestLineupFormatsHonorShow(t *testing.T) {
+	store := newConfigStore(DefaultConfig(), "")
+	router := &mockLineupRouter{items: []TunarrLineupItem{
+		{GuideNumber: "5.1", GuideName: "WXYZ", HD: 1},
+		{GuideNumber: "1007", GuideName: "Cartoons", Favorite: 1},
+		{GuideNumber: "1009", GuideName: "Shopping", Hidden: true},
+	}}
+	handler := NewHDHREndpointServer(store, router).Handler()
+
+	get := func(path string) string {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "example.com"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got %d", path, w.Code)
+		}
+		return w.Body.String()
+	}
+
+	var lineup LineupXML
+	if err := xml.Unmarshal([]byte(get("/lineup.xml")), &lineup); err != nil {
+		t.Fatalf("Failed to parse lineup.xml: %v", err)
+	}
+	if len(lineup.Programs) != 2 || lineup.Programs[0].GuideNumber != "5.1" || lineup.Programs[0].HD != 1 {
+		t.Errorf("Unexpected lineup.xml programs %+v", lineup.Programs)
+	}
+	if lineup.Programs[1].URL != "http://example.com/auto/v1007" {
+		t.Errorf("Expected URL rewritten to proxy /auto endpoint, got %q", lineup.Programs[1].URL)
+	}
+
+	m3u := get("/lineup.m3u")
+	if !strings.HasPrefix(m3u, "#EXTM3U\n") {
+		t.Errorf("Expected an #EXTM3U header, got %q", m3u)
+	}
+	if !strings.Contains(m3u, `tvg-chno="1007" tvg-name="Cartoons" group-title="Favorites",Cartoons`+"\nhttp://example.com/auto/v1007\n") {
+		t.Errorf("Expected a tagged entry for 1007, got %q", m3u)
+	}
+	if strings.Contains(m3u, "Shopping") {
+		t.Error("Expected hidden channels to be left out by default")
+	}
+
+	var all []LineupItemJSON
+	json.Unmarshal([]byte(get("/lineup.json?show=all")), &all) //nolint:errcheck
+	if len(all) != 3 || all[2].GuideName != "Shopping" || all[2].URL != "" {
+		t.Errorf("Expected ?show=all to list the hidden channel without a URL, got %+v", all)
+	}
+	if strings.Contains(get("/lineup.m3u?show=all"), "Shopping") {
+		t.Error("Expected the playlist to leave out hidden channels, which can't be played")
+	}
+	var found []LineupItemJSON
+	json.Unmarshal([]byte(get("/lineup.json?show=found")), &found) //nolint:errcheck
+	if len(found) != 2 {
+		t.Errorf("Expected 2 channels for ?show=found, got %d", len(found))
+	}
+	var demo []LineupItemJSON
+	json.Unmarshal([]byte(get("/lineup.json?show=demo")), &demo) //nolint:errcheck
+	if demo == nil || len(demo) != 0 {
+		t.Errorf("Expected an empty list for ?show=demo, got %v", demo)
+	}
+}
+
+func TestTunerCountFollowsRouter(t *testing.T) {
+	router := &mockTunerCountRouter{tuners: 2}
+	server := NewHDHREndpointServer(newConfigStore(DefaultConfig(), ""), router)
+	handler := server.Handler()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	discovered := func() int {
+		var discover DiscoverJSONResponse
+		json.NewDecoder(get("/discover.json").Body).Decode(&discover) //nolint:errcheck
+		return discover.TunerCount
+	}
+
+	if n := discovered(); n != 2 {
+		t.Errorf("Expected 2 tuners, got %d", n)
+	}
+	if w := get("/tuner9/status"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a tuner beyond the count, got %d", w.Code)
+	}
+
+	router.tuners = 10
+	router.changed()
+	if n := discovered(); n != 10 {
+		t.Errorf("Expected the tuner count to follow the router, got %d", n)
+	}
+	if w := get("/tuner9/streaminfo"); w.Code != http.StatusOK {
+		t.Errorf("Expected a tuner that joined later to be served, got %d", w.Code)
+	}
+	if _, err := server.tunerStates.GetTuner(9); err != nil {
+		t.Errorf("Expected the tuner states to grow, got %v", err)
+	}
+
+	router.tuners = 0
+	router.changed()
+	if n := discovered(); n != ResolveDeviceIdentity(DefaultConfig()).Model.TunerCount {
+		t.Errorf("Expected the model's count when the backends don't know theirs, got %d", n)
+	}
+	for _, path := range []string{"/tuner0/other", "/tunerx/status", "/nothing"} {
+		if w := get(path); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestShowAllListsOnlyStreamableURLs(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte{0x47}) //nolint:errcheck
+	}))
+	defer up.Close()
+
+	// fakeBackend streams from http://<name>/<channel>, so name it after the upstream
+	br := fakeChain([]*fakeBackend{{name: strings.TrimPrefix(up.URL, "http://"), healthy: true, lineup: []TunarrLineupItem{
+		{GuideNumber: "5", GuideName: "WXYZ"},
+		{GuideNumber: "9", GuideName: "Shopping"},
+	}}})
+	cfg := DefaultConfig()
+	cfg.ChannelRules = []ChannelRule{{Channels: []string{"9"}, Hide: true}}
+	br.store = newConfigStore(cfg, "")
+	server := NewHDHREndpointServer(br.store, br)
+	front := httptest.NewServer(server.Handler())
+	defer front.Close()
+
+	resp, err := http.Get(front.URL + "/lineup.json?show=all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lineup []LineupItemJSON
+	json.NewDecoder(resp.Body).Decode(&lineup) //nolint:errcheck
+	resp.Body.Close()
+	if len(lineup) != 2 {
+		t.Fatalf("Expected the visible and the hidden channel, got %+v", lineup)
+	}
+
+	for _, item := range lineup {
+		if item.URL == "" {
+			if item.GuideNumber != "9" {
+				t.Errorf("Expected only the hidden channel to have no URL, got %+v", item)
+			}
+			continue
+		}
+		resp, err := http.Get(item.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body) //nolint:errcheck
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected %s listed by ?show=all to stream, got %d", item.URL, resp.StatusCode)
+		}
+	}
+	waitForIdleTuners(t, server)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hdhrHTTPBackend consumes any server that speaks the HDHomeRun HTTP API:
+// ErsatzTV, Tunarr, another proxy, or a real device's port 80. Its lineup is
+// served from the emulated device's own endpoints and its streams relayed
+// through /auto/v.
+type hdhrHTTPBackend struct {
+	name    string
+	baseURL string
+	client  *http.Client
+
+	mu         sync.Mutex
+	healthy    bool
+	discover   *TunarrDiscoverResponse // from the last successful fetch
+	status     *upstreamLineupStatus   // nil if the upstream doesn't serve lineup_status.json
+	tunersBusy int                     // busy tuners per /status.json; -1 if not served
+	streamURLs map[string]string       // GuideNumber -> stream URL from the last lineup; nil until fetched
+	inUse      int                     // streams opened through this backend
+}
+
+// upstreamLineupStatus is the part of lineup_status.json we report
+type upstreamLineupStatus struct {
+	ScanInProgress int    `json:"ScanInProgress"`
+	Source         string `json:"Source"`
+}
+
+// upstreamTunerStatus is one entry of a real HDHomeRun's /status.json; idle
+// tuners have no VctNumber
+type upstreamTunerStatus struct {
+	Resource  string `json:"Resource"`
+	VctNumber string `json:"VctNumber"`
+}
+
+// newHDHRHTTPBackend creates a backend for the HDHomeRun-compatible server at
+// baseURL, which may omit the scheme
+func newHDHRHTTPBackend(name, baseURL string, timeout int) *hdhrHTTPBackend {
+	if timeout <= 0 {
+		timeout = 5
+	}
+	return &hdhrHTTPBackend{
+		name:       name,
+		baseURL:    memberBaseURL(baseURL),
+		client:     &http.Client{Timeout: time.Duration(timeout) * time.Second},
+		healthy:    true,
+		tunersBusy: -1,
+	}
+}
+
+func (b *hdhrHTTPBackend) Name() string { return b.name }
+
+// Start reads the upstream's discover.json
+func (b *hdhrHTTPBackend) Start(ctx context.Context) error {
+	var discover TunarrDiscoverResponse
+	if err := fetchJSON(ctx, b.client, b.baseURL+"/discover.json", &discover); err != nil {
+		b.setHealthy(false, err)
+		return fmt.Errorf("HDHomeRun-compatible server not available at %s: %w", b.baseURL, err)
+	}
+	b.mu.Lock()
+	b.discover = &discover
+	b.mu.Unlock()
+	slog.Info("HDHomeRun-compatible backend available", "backend", b.name, "url", b.baseURL,
+		"friendly_name", discover.FriendlyName, "model", discover.ModelNumber, "tuners", discover.TunerCount)
+	return nil
+}
+
+// Discover answers as the emulated device, whose endpoints serve the upstream's lineup
+func (b *hdhrHTTPBackend) Discover(ctx context.Context, q *discoveryQuery) bool {
+	return q.answerAsEmulatedDevice()
+}
+
+// Lineup fetches the upstream's lineup, refreshing its tuner count and status
+// on the way. Only a failed lineup.json marks the backend unhealthy; the
+// status endpoints are optional.
+func (b *hdhrHTTPBackend) Lineup(ctx context.Context) ([]TunarrLineupItem, error) {
+	var lineup []TunarrLineupItem
+	if err := fetchJSON(ctx, b.client, b.baseURL+"/lineup.json", &lineup); err != nil {
+		b.setHealthy(false, err)
+		return nil, err
+	}
+
+	var discover TunarrDiscoverResponse
+	discoverErr := fetchJSON(ctx, b.client, b.baseURL+"/discover.json", &discover)
+
+	var status upstreamLineupStatus
+	statusErr := fetchJSON(ctx, b.client, b.baseURL+"/lineup_status.json", &status)
+
+	var tuners []upstreamTunerStatus
+	busy := -1
+	if err := fetchJSON(ctx, b.client, b.baseURL+"/status.json", &tuners); err == nil {
+		busy = 0
+		for _, t := range tuners {
+			if strings.HasPrefix(t.Resource, "tuner") && t.VctNumber != "" {
+				busy++
+			}
+		}
+	}
+
+	urls := make(map[string]string, len(lineup))
+	for _, item := range lineup {
+		if item.GuideNumber != "" {
+			urls[item.GuideNumber] = item.URL
+		}
+	}
+
+	b.mu.Lock()
+	b.streamURLs = urls
+	if discoverErr == nil {
+		b.discover = &discover
+	}
+	if statusErr == nil {
+		b.status = &status
+	} else {
+		b.status = nil
+	}
+	b.tunersBusy = busy
+	b.mu.Unlock()
+
+	b.setHealthy(true, nil)
+	return lineup, nil
+}
+
+// TunerCount is the upstream's advertised TunerCount, 0 until discover.json has been read
+func (b *hdhrHTTPBackend) TunerCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.discover == nil {
+		return 0
+	}
+	return b.discover.TunerCount
+}
+
+// OpenStream returns the URL the upstream published for channel, falling back
+// to its /auto/v endpoint before a lineup has been fetched. At most
+// TunerCount streams are opened through it at once, so the router can move
+// on to another backend rather than have the upstream refuse.
+func (b *hdhrHTTPBackend) OpenStream(channel string) (string, func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	url, ok := b.streamURLs[channel]
+	if b.streamURLs != nil && !ok {
+		return "", nil, errChannelNotCarried
+	}
+	if b.discover != nil && b.discover.TunerCount > 0 && b.inUse >= b.discover.TunerCount {
+		return "", nil, ErrNoTunerAvailable
+	}
+	if url == "" {
+		url = fmt.Sprintf("%s/auto/v%s", b.baseURL, channel)
+	}
+	b.inUse++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			b.inUse--
+			b.mu.Unlock()
+		})
+	}
+	return url, release, nil
+}
+
+// Healthy reports whether the upstream answered the last discover or lineup fetch
+func (b *hdhrHTTPBackend) Healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy
+}
+
+func (b *hdhrHTTPBackend) setHealthy(healthy bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.healthy && !healthy {
+		slog.Warn("HDHomeRun-compatible backend unavailable", "backend", b.name, "url", b.baseURL, "err", err)
+	}
+	b.healthy = healthy
+}
+
+func (b *hdhrHTTPBackend) Stats() BackendStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := BackendStats{
+		Name:    b.name,
+		Type:    backendTypeHDHRHTTP,
+		Healthy: b.healthy,
+		Detail:  b.baseURL,
+	}
+	if b.discover == nil {
+		return s
+	}
+
+	s.TunerCount = b.discover.TunerCount
+	var parts []string
+	if b.discover.ModelNumber != "" {
+		parts = append(parts, b.discover.ModelNumber)
+	}
+	if b.tunersBusy >= 0 {
+		parts = append(parts, fmt.Sprintf("%d/%d tuners busy", b.tunersBusy, b.discover.TunerCount))
+	} else {
+		parts = append(parts, fmt.Sprintf("%d tuners, %d streams open", b.discover.TunerCount, b.inUse))
+	}
+	if b.status != nil {
+		if b.status.Source != "" {
+			parts = append(parts, "source "+b.status.Source)
+		}
+		if b.status.ScanInProgress != 0 {
+			parts = append(parts, "scanning")
+		}
+	}
+	s.Detail = fmt.Sprintf("%s (%s)", b.baseURL, strings.Join(parts, ", "))
+	return s
+}
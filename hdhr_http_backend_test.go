@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHDHRHTTPBackendConsumesUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/discover.json":
+			w.Write([]byte(`{"FriendlyName":"ErsatzTV","ModelNumber":"HDTC-2US","TunerCount":2}`)) //nolint:errcheck
+		case "/lineup.json":
+			w.Write([]byte(`[{"GuideNumber":"1","GuideName":"Reruns","URL":"http://ersatz:8409/iptv/channel/1.ts"},{"GuideNumber":"2","GuideName":"Cartoons"}]`)) //nolint:errcheck
+		case "/lineup_status.json":
+			w.Write([]byte(`{"ScanInProgress":0,"ScanPossible":0,"Source":"Cable"}`)) //nolint:errcheck
+		case "/status.json":
+			w.Write([]byte(`[{"Resource":"tuner0","VctNumber":"1"},{"Resource":"tuner1"}]`)) //nolint:errcheck
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	b := newHDHRHTTPBackend("ersatz", strings.TrimPrefix(upstream.URL, "http://"), 1)
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if b.TunerCount() != 2 {
+		t.Errorf("Expected the upstream's TunerCount 2, got %d", b.TunerCount())
+	}
+
+	if got, _, err := b.OpenStream("7"); err != nil || got != upstream.URL+"/auto/v7" {
+		t.Errorf("Expected /auto/v fallback before the lineup is fetched, got %q, %v", got, err)
+	}
+
+	if _, err := b.Lineup(context.Background()); err != nil {
+		t.Fatalf("Lineup error: %v", err)
+	}
+	if _, _, err := b.OpenStream("7"); !errors.Is(err, errChannelNotCarried) {
+		t.Errorf("Expected a channel missing from the lineup to be left to other backends, got %v", err)
+	}
+	got, release, err := b.OpenStream("1")
+	if err != nil || got != "http://ersatz:8409/iptv/channel/1.ts" {
+		t.Errorf("Expected the published stream URL, got %q, %v", got, err)
+	}
+	if _, _, err := b.OpenStream("2"); !errors.Is(err, ErrNoTunerAvailable) {
+		t.Errorf("Expected ErrNoTunerAvailable once the upstream's tuners are used, got %v", err)
+	}
+	release()
+	if got, _, err := b.OpenStream("2"); err != nil || got != upstream.URL+"/auto/v2" {
+		t.Errorf("Expected /auto/v for a channel without a URL, got %q, %v", got, err)
+	}
+
+	s := b.Stats()
+	if s.Type != backendTypeHDHRHTTP || s.TunerCount != 2 || !s.Healthy {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+	for _, want := range []string{"HDTC-2US", "1/2 tuners busy", "source Cable"} {
+		if !strings.Contains(s.Detail, want) {
+			t.Errorf("Expected stats detail to mention %q, got %q", want, s.Detail)
+		}
+	}
+
+	upstream.Close()
+	if _, err := b.Lineup(context.Background()); err == nil || b.Healthy() {
+		t.Error("Expected the backend to turn unhealthy once its lineup can't be fetched")
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+)
+
+// HDHomeRun packet types and TLV tags, as defined in libhdhomerun's hdhomerun_pkt.h
+const (
+	HDHRTypeDiscoverReq = 0x0002
+	HDHRTypeDiscoverRpy = 0x0003
+	HDHRTypeGetSetReq   = 0x0004
+	HDHRTypeGetSetRpy   = 0x0005
+
+	HDHRTagDeviceType    = 0x01
+	HDHRTagDeviceID      = 0x02
+	HDHRTagGetSetName    = 0x03
+	HDHRTagGetSetValue   = 0x04
+	HDHRTagErrorMessage  = 0x05
+	HDHRTagTunerCount    = 0x10
+	HDHRTagGetSetLockkey = 0x15
+	HDHRTagLineupURL     = 0x27
+	HDHRTagStorageURL    = 0x28
+	HDHRTagBaseURL       = 0x2A
+	HDHRTagDeviceAuthStr = 0x2B
+	HDHRTagStorageID     = 0x2C
+	HDHRTagMultiType     = 0x2D
+
+	HDHRDeviceTypeWildcard = 0xFFFFFFFF
+	HDHRDeviceTypeTuner    = 0x00000001
+	HDHRDeviceTypeStorage  = 0x00000005
+	HDHRDeviceIDWildcard   = 0xFFFFFFFF
+
+	// HDHomeRunControlTCPPort is the TCP port devices answer get/set control requests on
+	HDHomeRunControlTCPPort = 65001
+
+	// hdhrPacketOverhead is the 4-byte header plus the 4-byte CRC trailer
+	hdhrPacketOverhead = 8
+	// hdhrMaxTLVLength is the largest value the 2-byte varlen encoding can express
+	hdhrMaxTLVLength = 0x7FFF
+)
+
+var (
+	errHDHRPacketShort  = errors.New("hdhomerun packet too short")
+	errHDHRPacketLength = errors.New("hdhomerun packet length mismatch")
+	errHDHRPacketCRC    = errors.New("hdhomerun packet CRC mismatch")
+	errHDHRTLVTruncated = errors.New("hdhomerun packet TLV truncated")
+)
+
+// HDHRTLV is a single tag/length/value field inside an HDHomeRun packet
+type HDHRTLV struct {
+	Tag   byte
+	Value []byte
+}
+
+// HDHRPacket is a decoded HDHomeRun protocol packet.
+// Wire format: type (2 bytes BE), payload length (2 bytes BE), TLV payload,
+// CRC32 (IEEE) of everything before it, stored little-endian.
+type HDHRPacket struct {
+	Type uint16
+	TLVs []HDHRTLV
+}
+
+// Add appends a TLV to the packet
+func (p *HDHRPacket) Add(tag byte, value []byte) {
+	p.TLVs = append(p.TLVs, HDHRTLV{Tag: tag, Value: value})
+}
+
+// AddString appends a string TLV (without a NUL terminator)
+func (p *HDHRPacket) AddString(tag byte, value string) {
+	p.Add(tag, []byte(value))
+}
+
+// AddUint8 appends a single-byte TLV
+func (p *HDHRPacket) AddUint8(tag byte, value uint8) {
+	p.Add(tag, []byte{value})
+}
+
+// AddUint32 appends a 4-byte big-endian TLV
+func (p *HDHRPacket) AddUint32(tag byte, value uint32) {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, value)
+	p.Add(tag, buf)
+}
+
+// Set replaces the value of the first TLV with the given tag, appending one if absent
+func (p *HDHRPacket) Set(tag byte, value []byte) {
+	for i := range p.TLVs {
+		if p.TLVs[i].Tag == tag {
+			p.TLVs[i].Value = value
+			return
+		}
+	}
+	p.Add(tag, value)
+}
+
+// Get returns the value of the first TLV with the given tag
+func (p *HDHRPacket) Get(tag byte) ([]byte, bool) {
+	for _, tlv := range p.TLVs {
+		if tlv.Tag == tag {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// GetUint32 returns the first TLV with the given tag as a big-endian uint32
+func (p *HDHRPacket) GetUint32(tag byte) (uint32, bool) {
+	v, ok := p.Get(tag)
+	if !ok || len(v) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(v), true
+}
+
+// Marshal encodes the packet including its header and CRC trailer.
+// Values longer than the TLV length field can express are truncated.
+func (p *HDHRPacket) Marshal() []byte {
+	buf := make([]byte, 4, 64)
+	binary.BigEndian.PutUint16(buf[0:2], p.Type)
+
+	for _, tlv := range p.TLVs {
+		value := tlv.Value
+		if len(value) > hdhrMaxTLVLength {
+			value = value[:hdhrMaxTLVLength]
+		}
+		buf = append(buf, tlv.Tag)
+		buf = appendVarLen(buf, len(value))
+		buf = append(buf, value...)
+	}
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)-4))
+
+	crc := crc32.ChecksumIEEE(buf)
+	return binary.LittleEndian.AppendUint32(buf, crc)
+}
+
+// ReadHDHRPacket reads one complete packet from a stream connection such as
+// a TCP control session
+func ReadHDHRPacket(r io.Reader) (*HDHRPacket, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	payloadLen := int(binary.BigEndian.Uint16(header[2:4]))
+
+	data := make([]byte, 4+payloadLen+4)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return ParseHDHRPacket(data)
+}
+
+// ParseHDHRPacket decodes a complete HDHomeRun packet and verifies its CRC
+func ParseHDHRPacket(data []byte) (*HDHRPacket, error) {
+	if len(data) < hdhrPacketOverhead {
+		return nil, errHDHRPacketShort
+	}
+
+	payloadLen := int(binary.BigEndian.Uint16(data[2:4]))
+	if len(data) != 4+payloadLen+4 {
+		return nil, errHDHRPacketLength
+	}
+
+	crcOffset := 4 + payloadLen
+	want := binary.LittleEndian.Uint32(data[crcOffset:])
+	if crc32.ChecksumIEEE(data[:crcOffset]) != want {
+		return nil, errHDHRPacketCRC
+	}
+
+	pkt := &HDHRPacket{Type: binary.BigEndian.Uint16(data[0:2])}
+	payload := data[4:crcOffset]
+	for len(payload) > 0 {
+		tag := payload[0]
+		length, n, err := readVarLen(payload[1:])
+		if err != nil {
+			return nil, err
+		}
+		start := 1 + n
+		if len(payload) < start+length {
+			return nil, errHDHRTLVTruncated
+		}
+		value := make([]byte, length)
+		copy(value, payload[start:start+length])
+		pkt.TLVs = append(pkt.TLVs, HDHRTLV{Tag: tag, Value: value})
+		payload = payload[start+length:]
+	}
+
+	return pkt, nil
+}
+
+// appendVarLen appends a TLV length: one byte up to 127, otherwise two bytes
+// with the low 7 bits first (high bit set) followed by the remaining bits
+func appendVarLen(buf []byte, length int) []byte {
+	if length <= 0x7F {
+		return append(buf, byte(length))
+	}
+	return append(buf, byte(length&0x7F)|0x80, byte(length>>7))
+}
+
+// readVarLen reads a TLV length, returning the length and the bytes consumed
+func readVarLen(data []byte) (int, int, error) {
+	if len(data) < 1 {
+		return 0, 0, errHDHRTLVTruncated
+	}
+	length := int(data[0])
+	if length&0x80 == 0 {
+		return length, 1, nil
+	}
+	if len(data) < 2 {
+		return 0, 0, errHDHRTLVTruncated
+	}
+	return (length & 0x7F) | int(data[1])<<7, 2, nil
+}
+
+// DiscoverRequest is a decoded HDHomeRun discover request (packet type 0x0002)
+type DiscoverRequest struct {
+	DeviceTypes []uint32 // from the DeviceType and MultiType tags; empty means any
+	DeviceID    uint32   // HDHRDeviceIDWildcard when not filtered
+}
+
+// ParseDiscoverRequest decodes a binary discover request
+func ParseDiscoverRequest(data []byte) (*DiscoverRequest, error) {
+	pkt, err := ParseHDHRPacket(data)
+	if err != nil {
+		return nil, err
+	}
+	if pkt.Type != HDHRTypeDiscoverReq {
+		return nil, fmt.Errorf("not a discover request: packet type 0x%04x", pkt.Type)
+	}
+
+	req := &DiscoverRequest{DeviceID: HDHRDeviceIDWildcard}
+	for _, tlv := range pkt.TLVs {
+		switch tlv.Tag {
+		case HDHRTagDeviceType:
+			if len(tlv.Value) == 4 {
+				req.DeviceTypes = append(req.DeviceTypes, binary.BigEndian.Uint32(tlv.Value))
+			}
+		case HDHRTagMultiType:
+			for i := 0; i+4 <= len(tlv.Value); i += 4 {
+				req.DeviceTypes = append(req.DeviceTypes, binary.BigEndian.Uint32(tlv.Value[i:i+4]))
+			}
+		case HDHRTagDeviceID:
+			if len(tlv.Value) == 4 {
+				req.DeviceID = binary.BigEndian.Uint32(tlv.Value)
+			}
+		}
+	}
+	return req, nil
+}
+
+// Marshal encodes the request the way libhdhomerun sends it
+func (dr *DiscoverRequest) Marshal() []byte {
+	pkt := &HDHRPacket{Type: HDHRTypeDiscoverReq}
+	deviceTypes := dr.DeviceTypes
+	if len(deviceTypes) == 0 {
+		deviceTypes = []uint32{HDHRDeviceTypeWildcard}
+	}
+	for _, dt := range deviceTypes {
+		pkt.AddUint32(HDHRTagDeviceType, dt)
+	}
+	pkt.AddUint32(HDHRTagDeviceID, dr.DeviceID)
+	return pkt.Marshal()
+}
+
+// Matches reports whether a device with the given type and ID should answer
+func (dr *DiscoverRequest) Matches(deviceType, deviceID uint32) bool {
+	if dr.DeviceID != HDHRDeviceIDWildcard && dr.DeviceID != deviceID {
+		return false
+	}
+	if len(dr.DeviceTypes) == 0 {
+		return true
+	}
+	for _, dt := range dr.DeviceTypes {
+		if dt == HDHRDeviceTypeWildcard || dt == deviceType {
+			return true
+		}
+	}
+	return false
+}
+
+// DiscoverReply is a decoded HDHomeRun discover reply (packet type 0x0003)
+type DiscoverReply struct {
+	DeviceType uint32
+	DeviceID   uint32
+	TunerCount int
+	DeviceAuth string
+	BaseURL    string
+	LineupURL  string
+}
+
+// Marshal encodes the reply as a binary discover reply packet
+func (r *DiscoverReply) Marshal() []byte {
+	pkt := &HDHRPacket{Type: HDHRTypeDiscoverRpy}
+	pkt.AddUint32(HDHRTagDeviceType, r.DeviceType)
+	pkt.AddUint32(HDHRTagDeviceID, r.DeviceID)
+	if r.TunerCount > 0 {
+		pkt.AddUint8(HDHRTagTunerCount, uint8(r.TunerCount))
+	}
+	if r.DeviceAuth != "" {
+		pkt.AddString(HDHRTagDeviceAuthStr, r.DeviceAuth)
+	}
+	if r.BaseURL != "" {
+		pkt.AddString(HDHRTagBaseURL, r.BaseURL)
+	}
+	if r.LineupURL != "" {
+		pkt.AddString(HDHRTagLineupURL, r.LineupURL)
+	}
+	return pkt.Marshal()
+}
+
+// ParseDiscoverReply decodes a binary discover reply
+func ParseDiscoverReply(data []byte) (*DiscoverReply, error) {
+	pkt, err := ParseHDHRPacket(data)
+	if err != nil {
+		return nil, err
+	}
+	if pkt.Type != HDHRTypeDiscoverRpy {
+		return nil, fmt.Errorf("not a discover reply: packet type 0x%04x", pkt.Type)
+	}
+
+	reply := &DiscoverReply{}
+	for _, tlv := range pkt.TLVs {
+		switch tlv.Tag {
+		case HDHRTagDeviceType:
+			if len(tlv.Value) == 4 {
+				reply.DeviceType = binary.BigEndian.Uint32(tlv.Value)
+			}
+		case HDHRTagDeviceID:
+			if len(tlv.Value) == 4 {
+				reply.DeviceID = binary.BigEndian.Uint32(tlv.Value)
+			}
+		case HDHRTagTunerCount:
+			if len(tlv.Value) == 1 {
+				reply.TunerCount = int(tlv.Value[0])
+			}
+		case HDHRTagDeviceAuthStr:
+			reply.DeviceAuth = string(tlv.Value)
+		case HDHRTagBaseURL:
+			reply.BaseURL = string(tlv.Value)
+		case HDHRTagLineupURL:
+			reply.LineupURL = string(tlv.Value)
+		}
+	}
+	return reply, nil
+}
+
+// ControlRequest is a decoded get/set control request (packet type 0x0004).
+// A request without a value is a get; Lockkey is only sent with sets.
+type ControlRequest struct {
+	Name       string
+	Value      string
+	HasValue   bool
+	Lockkey    uint32
+	HasLockkey bool
+}
+
+// ParseControlRequest decodes a get/set request packet
+func ParseControlRequest(pkt *HDHRPacket) (*ControlRequest, error) {
+	if pkt.Type != HDHRTypeGetSetReq {
+		return nil, fmt.Errorf("not a get/set request: packet type 0x%04x", pkt.Type)
+	}
+
+	req := &ControlRequest{}
+	name, ok := pkt.Get(HDHRTagGetSetName)
+	if !ok {
+		return nil, fmt.Errorf("get/set request has no name")
+	}
+	req.Name = cString(name)
+	if value, ok := pkt.Get(HDHRTagGetSetValue); ok {
+		req.Value = cString(value)
+		req.HasValue = true
+	}
+	if lockkey, ok := pkt.GetUint32(HDHRTagGetSetLockkey); ok {
+		req.Lockkey = lockkey
+		req.HasLockkey = true
+	}
+	return req, nil
+}
+
+// Marshal encodes the request the way libhdhomerun sends it, with
+// NUL-terminated strings
+func (cr *ControlRequest) Marshal() []byte {
+	pkt := &HDHRPacket{Type: HDHRTypeGetSetReq}
+	pkt.AddString(HDHRTagGetSetName, cr.Name+"\x00")
+	if cr.HasValue {
+		pkt.AddString(HDHRTagGetSetValue, cr.Value+"\x00")
+	}
+	if cr.HasLockkey {
+		pkt.AddUint32(HDHRTagGetSetLockkey, cr.Lockkey)
+	}
+	return pkt.Marshal()
+}
+
+// ControlReply is a decoded get/set reply (packet type 0x0005). Error is set
+// instead of Value when the device rejected the request.
+type ControlReply struct {
+	Name  string
+	Value string
+	Error string
+}
+
+// Marshal encodes the reply with NUL-terminated strings
+func (cr *ControlReply) Marshal() []byte {
+	pkt := &HDHRPacket{Type: HDHRTypeGetSetRpy}
+	pkt.AddString(HDHRTagGetSetName, cr.Name+"\x00")
+	if cr.Error != "" {
+		pkt.AddString(HDHRTagErrorMessage, cr.Error+"\x00")
+	} else {
+		pkt.AddString(HDHRTagGetSetValue, cr.Value+"\x00")
+	}
+	return pkt.Marshal()
+}
+
+// ParseControlReply decodes a get/set reply packet
+func ParseControlReply(pkt *HDHRPacket) (*ControlReply, error) {
+	if pkt.Type != HDHRTypeGetSetRpy {
+		return nil, fmt.Errorf("not a get/set reply: packet type 0x%04x", pkt.Type)
+	}
+
+	reply := &ControlReply{}
+	if name, ok := pkt.Get(HDHRTagGetSetName); ok {
+		reply.Name = cString(name)
+	}
+	if value, ok := pkt.Get(HDHRTagGetSetValue); ok {
+		reply.Value = cString(value)
+	}
+	if msg, ok := pkt.Get(HDHRTagErrorMessage); ok {
+		reply.Error = cString(msg)
+	}
+	return reply, nil
+}
+
+// cString converts a TLV string value, dropping the NUL terminator and anything after it
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// parseDeviceIDHex converts an 8-hex-digit Device ID string to its numeric form
+func parseDeviceIDHex(deviceID string) (uint32, error) {
+	if !IsValidDeviceIDFormat(deviceID) {
+		return 0, fmt.Errorf("invalid device ID: %q", deviceID)
+	}
+	id, err := strconv.ParseUint(deviceID, 16, 32)
+	return uint32(id), err
+}
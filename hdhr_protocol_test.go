@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
+	"testing"
+)
+
+// libhdhomerunDiscoverReq is a wildcard discover request as sent by
+// hdhomerun_config discover: DeviceType=wildcard, DeviceID=wildcard
+var libhdhomerunDiscoverReq = []byte{
+	0x00, 0x02, 0x00, 0x0c,
+	0x01, 0x04, 0xff, 0xff, 0xff, 0xff,
+	0x02, 0x04, 0xff, 0xff, 0xff, 0xff,
+}
+
+func withCRC(data []byte) []byte {
+	return binary.LittleEndian.AppendUint32(append([]byte(nil), data...), crc32.ChecksumIEEE(data))
+}
+
+func TestParseDiscoverRequestLibhdhomerun(t *testing.T) {
+	req, err := ParseDiscoverRequest(withCRC(libhdhomerunDiscoverReq))
+	if err != nil {
+		t.Fatalf("ParseDiscoverRequest error: %v", err)
+	}
+	if req.DeviceID != HDHRDeviceIDWildcard {
+		t.Errorf("expected wildcard DeviceID, got %08X", req.DeviceID)
+	}
+	if len(req.DeviceTypes) != 1 || req.DeviceTypes[0] != HDHRDeviceTypeWildcard {
+		t.Errorf("expected wildcard DeviceTypes, got %v", req.DeviceTypes)
+	}
+	if !req.Matches(HDHRDeviceTypeTuner, 0x1072ABCD) {
+		t.Error("wildcard request should match any tuner")
+	}
+}
+
+func TestDiscoverRequestMarshalMatchesLibhdhomerun(t *testing.T) {
+	req := &DiscoverRequest{DeviceID: HDHRDeviceIDWildcard}
+	got := req.Marshal()
+	want := withCRC(libhdhomerunDiscoverReq)
+	if !bytes.Equal(got, want) {
+		t.Errorf("Marshal() = % x, want % x", got, want)
+	}
+}
+
+func TestDiscoverRequestMatchesFilters(t *testing.T) {
+	tests := []struct {
+		name string
+		req  DiscoverRequest
+		want bool
+	}{
+		{"no filters", DiscoverRequest{DeviceID: HDHRDeviceIDWildcard}, true},
+		{"tuner type", DiscoverRequest{DeviceTypes: []uint32{HDHRDeviceTypeTuner}, DeviceID: HDHRDeviceIDWildcard}, true},
+		{"storage type only", DiscoverRequest{DeviceTypes: []uint32{HDHRDeviceTypeStorage}, DeviceID: HDHRDeviceIDWildcard}, false},
+		{"storage and tuner", DiscoverRequest{DeviceTypes: []uint32{HDHRDeviceTypeStorage, HDHRDeviceTypeTuner}, DeviceID: HDHRDeviceIDWildcard}, true},
+		{"matching device ID", DiscoverRequest{DeviceID: 0x1072ABCD}, true},
+		{"other device ID", DiscoverRequest{DeviceID: 0x10123456}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.req.Matches(HDHRDeviceTypeTuner, 0x1072ABCD); got != test.want {
+				t.Errorf("Matches() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseDiscoverRequestMultiType(t *testing.T) {
+	pkt := &HDHRPacket{Type: HDHRTypeDiscoverReq}
+	multi := make([]byte, 8)
+	binary.BigEndian.PutUint32(multi[0:4], HDHRDeviceTypeTuner)
+	binary.BigEndian.PutUint32(multi[4:8], HDHRDeviceTypeStorage)
+	pkt.Add(HDHRTagMultiType, multi)
+
+	req, err := ParseDiscoverRequest(pkt.Marshal())
+	if err != nil {
+		t.Fatalf("ParseDiscoverRequest error: %v", err)
+	}
+	if len(req.DeviceTypes) != 2 {
+		t.Fatalf("expected 2 device types, got %v", req.DeviceTypes)
+	}
+	if !req.Matches(HDHRDeviceTypeTuner, 0x1072ABCD) {
+		t.Error("multi-type request including tuner should match")
+	}
+}
+
+func TestDiscoverReplyRoundTrip(t *testing.T) {
+	reply := &DiscoverReply{
+		DeviceType: HDHRDeviceTypeTuner,
+		DeviceID:   0x1072ABCD,
+		TunerCount: 4,
+		DeviceAuth: "abc123",
+		BaseURL:    "http://192.168.1.20:5004",
+		LineupURL:  "http://192.168.1.20:5004/lineup.json",
+	}
+
+	data := reply.Marshal()
+	if binary.BigEndian.Uint16(data[0:2]) != HDHRTypeDiscoverRpy {
+		t.Errorf("expected packet type 0x0003, got 0x%04x", binary.BigEndian.Uint16(data[0:2]))
+	}
+
+	got, err := ParseDiscoverReply(data)
+	if err != nil {
+		t.Fatalf("ParseDiscoverReply error: %v", err)
+	}
+	if *got != *reply {
+		t.Errorf("round trip mismatch:\n got  %+v\n want %+v", *got, *reply)
+	}
+}
+
+func TestParseHDHRPacketBadCRC(t *testing.T) {
+	data := withCRC(libhdhomerunDiscoverReq)
+	data[len(data)-1] ^= 0xFF
+	if _, err := ParseHDHRPacket(data); err != errHDHRPacketCRC {
+		t.Errorf("expected CRC error, got %v", err)
+	}
+}
+
+func TestParseHDHRPacketRejectsText(t *testing.T) {
+	for _, text := range []string{"discover", "TYPE: discover\r\n"} {
+		if _, err := ParseHDHRPacket([]byte(text)); err == nil {
+			t.Errorf("expected error parsing %q", text)
+		}
+	}
+}
+
+func TestHDHRPacketLongTLV(t *testing.T) {
+	long := "http://" + strings.Repeat("a", 300) + ":5004"
+	pkt := &HDHRPacket{Type: HDHRTypeDiscoverRpy}
+	pkt.AddString(HDHRTagBaseURL, long)
+
+	parsed, err := ParseHDHRPacket(pkt.Marshal())
+	if err != nil {
+		t.Fatalf("ParseHDHRPacket error: %v", err)
+	}
+	v, ok := parsed.Get(HDHRTagBaseURL)
+	if !ok || string(v) != long {
+		t.Errorf("long TLV did not round trip (len %d)", len(v))
+	}
+}
+
+func TestControlRequestRoundTrip(t *testing.T) {
+	req := &ControlRequest{Name: "/tuner0/channel", Value: "auto:5.1", HasValue: true, Lockkey: 42, HasLockkey: true}
+	data := req.Marshal()
+
+	pkt, err := ReadHDHRPacket(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadHDHRPacket error: %v", err)
+	}
+	if name, _ := pkt.Get(HDHRTagGetSetName); !bytes.Equal(name, []byte("/tuner0/channel\x00")) {
+		t.Errorf("expected NUL-terminated name, got %q", name)
+	}
+	got, err := ParseControlRequest(pkt)
+	if err != nil {
+		t.Fatalf("ParseControlRequest error: %v", err)
+	}
+	if *got != *req {
+		t.Errorf("round trip mismatch:\n got  %+v\n want %+v", *got, *req)
+	}
+
+	if _, err := ReadHDHRPacket(bytes.NewReader(data[:len(data)-2])); err == nil {
+		t.Error("expected error reading truncated packet")
+	}
+}
+
+func TestHDHRPacketSet(t *testing.T) {
+	pkt := &HDHRPacket{Type: HDHRTypeDiscoverRpy}
+	pkt.AddString(HDHRTagBaseURL, "http://a")
+	pkt.Set(HDHRTagBaseURL, []byte("http://b"))
+	pkt.Set(HDHRTagLineupURL, []byte("http://b/lineup.json"))
+
+	if v, _ := pkt.Get(HDHRTagBaseURL); string(v) != "http://b" || len(pkt.TLVs) != 2 {
+		t.Errorf("Expected BaseURL replaced and LineupURL appended, got %+v", pkt.TLVs)
+	}
+}
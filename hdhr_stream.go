@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamSource is implemented by backendRouter; it reserves a backend tuner
+// for a channel and resolves its upstream URL so HDHREndpointServer can relay
+// it from /auto/v<channel>
+type streamSource interface {
+	OpenStream(channel string) (string, func(), error)
+}
+
+// streamCopyBufferSize is a multiple of the 188-byte MPEG-TS packet size
+const streamCopyBufferSize = 188 * 348
+
+// handleAutoStream handles /auto/v<GuideNumber>: it allocates a tuner, opens
+// the upstream stream and relays it to the client as continuous MPEG-TS
+func (he *HDHREndpointServer) handleAutoStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	channel, ok := strings.CutPrefix(r.URL.Path, "/auto/v")
+	if !ok || channel == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	upstreamURL, releaseUpstream, err := he.acquireUpstream(channel)
+	if errors.Is(err, ErrNoTunerAvailable) {
+		he.rejectAllTunersInUse(w, r, channel)
+		return
+	}
+	if err != nil {
+		slog.Warn("No upstream for stream request", "channel", channel, "err", err)
+		http.Error(w, "Stream Backend Not Available", http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseUpstream()
+	if r.URL.RawQuery != "" {
+		sep := "?"
+		if strings.Contains(upstreamURL, "?") {
+			sep = "&"
+		}
+		upstreamURL += sep + r.URL.RawQuery
+	}
+
+	clientIP, clientPortStr, _ := net.SplitHostPort(r.RemoteAddr)
+	clientPort, _ := strconv.Atoi(clientPortStr)
+	sessionID := fmt.Sprintf("%08X", rand.Uint32())
+
+	tunerIndex, err := he.tunerStates.AllocateTuner(channel, sessionID, clientIP, clientPort)
+	if err != nil {
+		he.rejectAllTunersInUse(w, r, channel)
+		return
+	}
+	defer func() {
+		he.tunerStates.ReleaseTuner(tunerIndex) //nolint:errcheck
+		slog.Info("Tuner released", "tuner", tunerIndex, "channel", channel, "client", r.RemoteAddr)
+	}()
+
+	slog.Info("Tuner allocated", "tuner", tunerIndex, "channel", channel, "client", r.RemoteAddr, "upstream", upstreamURL)
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	resp, err := he.streamClient.Do(req)
+	if err != nil {
+		slog.Error("Error opening upstream stream", "url", upstreamURL, "err", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		slog.Error("Upstream stream returned error", "url", upstreamURL, "status", resp.StatusCode)
+		if hdhrErr := resp.Header.Get("X-HDHomeRun-Error"); hdhrErr != "" {
+			w.Header().Set("X-HDHomeRun-Error", hdhrErr)
+		}
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	written, err := he.relayStream(w, resp.Body, tunerIndex)
+	slog.Debug("Stream ended", "tuner", tunerIndex, "channel", channel, "bytes", written, "err", err)
+}
+
+// rejectAllTunersInUse sends the same error a real device returns when all tuners are busy
+func (he *HDHREndpointServer) rejectAllTunersInUse(w http.ResponseWriter, r *http.Request, channel string) {
+	slog.Warn("Stream request rejected, all tuners in use", "channel", channel, "client", r.RemoteAddr)
+	w.Header().Set("X-HDHomeRun-Error", "805 All Tuners In Use")
+	http.Error(w, "All Tuners In Use", http.StatusServiceUnavailable)
+}
+
+// acquireUpstream resolves the upstream URL for channel from the router,
+// reserving a tuner on the backend that will serve it; the returned func
+// releases that reservation
+func (he *HDHREndpointServer) acquireUpstream(channel string) (string, func(), error) {
+	source, ok := he.router.(streamSource)
+	if !ok {
+		return "", nil, fmt.Errorf("router has no stream backend")
+	}
+	return source.OpenStream(channel)
+}
+
+// relayStream copies upstream to w, flushing after every write so the client
+// sees a continuous stream, and publishes the measured bit rate on the tuner
+func (he *HDHREndpointServer) relayStream(w http.ResponseWriter, upstream io.Reader, tunerIndex int) (int64, error) {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, streamCopyBufferSize)
+
+	var total, windowBytes int64
+	windowStart := time.Now()
+
+	for {
+		n, readErr := upstream.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return total, err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			total += int64(n)
+			windowBytes += int64(n)
+
+			if elapsed := time.Since(windowStart); elapsed >= time.Second {
+				he.tunerStates.SetBitRate(tunerIndex, int(float64(windowBytes*8)/elapsed.Seconds())) //nolint:errcheck
+				windowBytes = 0
+				windowStart = time.Now()
+			}
+		}
+		if readErr != nil {
+			if readErr == io.EOF {
+				return total, nil
+			}
+			return total, readErr
+		}
+	}
+}
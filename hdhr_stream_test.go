@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// mockStreamRouter is a statsProvider that also resolves stream URLs
+type mockStreamRouter struct {
+	mockHDHRStatsProvider
+	upstream string
+}
+
+func (m *mockStreamRouter) OpenStream(channel string) (string, func(), error) {
+	return m.upstream + "/stream/" + channel, func() {}, nil
+}
+
+func newStreamTestServer(t *testing.T, upstream http.HandlerFunc) (*HDHREndpointServer, *httptest.Server) {
+	t.Helper()
+	up := httptest.NewServer(upstream)
+	t.Cleanup(up.Close)
+
+	cfg := DefaultConfig()
+	cfg.Device.ModelType = "HDHR4-2US" // 2 tuners
+	server := NewHDHREndpointServer(newConfigStore(cfg, ""), &mockStreamRouter{upstream: up.URL})
+	front := httptest.NewServer(server.Handler())
+	t.Cleanup(front.Close)
+	return server, front
+}
+
+func TestAutoStreamRelaysMPEGTS(t *testing.T) {
+	payload := bytes.Repeat([]byte{0x47}, 188*10)
+	var gotPath string
+	server, front := newStreamTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Write(payload) //nolint:errcheck
+	})
+
+	resp, err := http.Get(front.URL + "/auto/v2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "video/mp2t" {
+		t.Errorf("Expected Content-Type video/mp2t, got %q", ct)
+	}
+	if !bytes.Equal(body, payload) {
+		t.Errorf("Relayed %d bytes, expected %d", len(body), len(payload))
+	}
+	if gotPath != "/stream/2.1" {
+		t.Errorf("Expected upstream path /stream/2.1, got %q", gotPath)
+	}
+
+	waitForIdleTuners(t, server)
+}
+
+func TestAutoStreamLocksTunerWhileStreaming(t *testing.T) {
+	release := make(chan struct{})
+	server, front := newStreamTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte{0x47}) //nolint:errcheck
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer close(release)
+
+	resp, err := http.Get(front.URL + "/auto/v5.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Read(make([]byte, 1)) //nolint:errcheck
+
+	tuner, _ := server.tunerStates.GetTuner(0)
+	if tuner.Status != "locked" || tuner.Channel != "5.1" {
+		t.Errorf("Expected tuner 0 locked on 5.1, got %+v", tuner)
+	}
+
+	// Client disconnect must release the tuner
+	resp.Body.Close()
+	waitForIdleTuners(t, server)
+}
+
+func TestAutoStreamAllTunersInUse(t *testing.T) {
+	server, front := newStreamTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	server.tunerStates.AllocateTuner("1.1", "A", "10.0.0.1", 1) //nolint:errcheck
+	server.tunerStates.AllocateTuner("1.2", "B", "10.0.0.2", 2) //nolint:errcheck
+
+	resp, err := http.Get(front.URL + "/auto/v2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", resp.StatusCode)
+	}
+	if e := resp.Header.Get("X-HDHomeRun-Error"); e != "805 All Tuners In Use" {
+		t.Errorf("Expected X-HDHomeRun-Error 805, got %q", e)
+	}
+}
+
+func TestAutoStreamUpstreamErrorReleasesTuner(t *testing.T) {
+	server, front := newStreamTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+
+	resp, err := http.Get(front.URL + "/auto/v9.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected status 502, got %d", resp.StatusCode)
+	}
+	waitForIdleTuners(t, server)
+}
+
+func TestAutoStreamWithoutBackend(t *testing.T) {
+	server := NewHDHREndpointServer(newConfigStore(DefaultConfig(), ""), &mockHDHRStatsProvider{})
+	req := httptest.NewRequest("GET", "/auto/v2.1", nil)
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", w.Code)
+	}
+}
+
+func waitForIdleTuners(t *testing.T, server *HDHREndpointServer) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		idle := true
+		for _, tuner := range server.tunerStates.GetAllTuners() {
+			if tuner.Status != "idle" {
+				idle = false
+			}
+		}
+		if idle {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected all tuners to be released")
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultIPTVMaxStreams is how many streams an IPTV backend serves at once
+// when max_streams is unset
+const DefaultIPTVMaxStreams = 2
+
+// iptvBackend serves the channels of an M3U playlist through the emulated
+// device, and publishes its XMLTV guide. max_streams caps how many play at
+// once and is advertised as its tuner count.
+type iptvBackend struct {
+	name       string
+	playlist   string // file path or http(s) URL
+	guide      string // configured XMLTV file path or URL, overriding url-tvg
+	maxStreams int
+	client     *http.Client
+
+	mu       sync.Mutex
+	channels []TunarrLineupItem
+	urls     map[string]string // GuideNumber -> stream URL; nil until the playlist is loaded
+	guideURL string            // from the playlist's url-tvg header
+	inUse    int
+	healthy  bool
+}
+
+// m3uAttr matches one key="value" attribute of an #EXTINF line
+var m3uAttr = regexp.MustCompile(`([A-Za-z0-9_-]+)="([^"]*)"`)
+
+// newIPTVBackend creates a backend over the playlist at a path or URL, with
+// the guide at a path or URL, or the playlist's own if guide is empty
+func newIPTVBackend(name, playlist, guide string, maxStreams, timeout int) *iptvBackend {
+	if maxStreams <= 0 {
+		maxStreams = DefaultIPTVMaxStreams
+	}
+	if timeout <= 0 {
+		timeout = 5
+	}
+	return &iptvBackend{
+		name:       name,
+		playlist:   playlist,
+		guide:      guide,
+		maxStreams: maxStreams,
+		client:     &http.Client{Timeout: time.Duration(timeout) * time.Second},
+		healthy:    true,
+	}
+}
+
+func (b *iptvBackend) Name() string { return b.name }
+
+// Start loads the playlist
+func (b *iptvBackend) Start(ctx context.Context) error {
+	channels, err := b.Lineup(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("IPTV playlist loaded", "backend", b.name, "playlist", b.playlist, "channels", len(channels), "max_streams", b.maxStreams)
+	return nil
+}
+
+// Discover answers as the emulated device, whose endpoints serve the playlist
+func (b *iptvBackend) Discover(ctx context.Context, q *discoveryQuery) bool {
+	return q.answerAsEmulatedDevice()
+}
+
+// Lineup reloads the playlist. If it can't be read the last loaded channels
+// stay routable, but the error is returned.
+func (b *iptvBackend) Lineup(ctx context.Context) ([]TunarrLineupItem, error) {
+	channels, guideURL, err := b.load(ctx)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		if b.healthy {
+			slog.Warn("IPTV playlist unavailable", "backend", b.name, "playlist", b.playlist, "err", err)
+		}
+		b.healthy = false
+		return nil, err
+	}
+
+	b.healthy = true
+	b.channels = channels
+	b.guideURL = guideURL
+	b.urls = make(map[string]string, len(channels))
+	for _, ch := range channels {
+		b.urls[ch.GuideNumber] = ch.URL
+	}
+	return channels, nil
+}
+
+// load reads and parses the playlist
+func (b *iptvBackend) load(ctx context.Context) ([]TunarrLineupItem, string, error) {
+	rc, err := openPathOrURL(ctx, b.client, b.playlist)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+	return parseM3U(rc)
+}
+
+// openPathOrURL opens a local file, or GETs an http(s) URL
+func openPathOrURL(ctx context.Context, client *http.Client, source string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.Open(source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s returned status %d", source, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// parseM3U reads an extended M3U playlist and the guide URL in its header.
+// Each #EXTINF entry becomes a channel: tvg-chno is its GuideNumber, tvg-name
+// its GuideName, falling back to the entry's title, and tvg-id its XMLTV
+// channel ID. Entries without a channel number are numbered after the
+// highest one in the playlist; repeated numbers keep the first entry.
+func parseM3U(r io.Reader) ([]TunarrLineupItem, string, error) {
+	type entry struct {
+		number, name, guideID string
+	}
+	var (
+		channels  []TunarrLineupItem
+		pending   *entry
+		sawEXTM3U bool
+		guideURL  string
+	)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTM3U"):
+			sawEXTM3U = true
+			for _, m := range m3uAttr.FindAllStringSubmatch(line, -1) {
+				if k := strings.ToLower(m[1]); k == "url-tvg" || k == "x-tvg-url" {
+					// Some playlists list several guides; the first is used
+					guideURL, _, _ = strings.Cut(strings.TrimSpace(m[2]), ",")
+				}
+			}
+		case strings.HasPrefix(line, "#EXTINF:"):
+			e := &entry{}
+			info, title, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			for _, m := range m3uAttr.FindAllStringSubmatch(info, -1) {
+				switch strings.ToLower(m[1]) {
+				case "tvg-chno", "channel-number":
+					e.number = strings.TrimSpace(m[2])
+				case "tvg-name":
+					e.name = strings.TrimSpace(m[2])
+				case "tvg-id":
+					e.guideID = strings.TrimSpace(m[2])
+				}
+			}
+			if e.name == "" {
+				e.name = strings.TrimSpace(title)
+			}
+			pending = e
+		case strings.HasPrefix(line, "#"):
+			// #EXTVLCOPT, #EXTGRP and other directives don't affect the lineup
+		default:
+			if pending == nil {
+				continue
+			}
+			channels = append(channels, TunarrLineupItem{GuideNumber: pending.number, GuideName: pending.name, URL: line, GuideID: pending.guideID})
+			pending = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	if !sawEXTM3U {
+		return nil, "", fmt.Errorf("not an M3U playlist: missing #EXTM3U header")
+	}
+
+	next := 1
+	for _, ch := range channels {
+		if n, err := strconv.Atoi(ch.GuideNumber); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	out := make([]TunarrLineupItem, 0, len(channels))
+	seen := make(map[string]bool)
+	for _, ch := range channels {
+		if ch.GuideNumber == "" {
+			ch.GuideNumber = strconv.Itoa(next)
+			next++
+		}
+		if seen[ch.GuideNumber] {
+			slog.Debug("Skipping duplicate IPTV channel number", "guide_number", ch.GuideNumber, "name", ch.GuideName)
+			continue
+		}
+		seen[ch.GuideNumber] = true
+		out = append(out, ch)
+	}
+	return out, guideURL, nil
+}
+
+// TunerCount is the configured stream limit
+func (b *iptvBackend) TunerCount() int { return b.maxStreams }
+
+// OpenStream reserves one of the max_streams slots for channel
+func (b *iptvBackend) OpenStream(channel string) (string, func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	url, ok := b.urls[channel]
+	if !ok {
+		return "", nil, errChannelNotCarried
+	}
+	if b.inUse >= b.maxStreams {
+		return "", nil, ErrNoTunerAvailable
+	}
+	b.inUse++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			b.inUse--
+			b.mu.Unlock()
+		})
+	}
+	return url, release, nil
+}
+
+// GuideURL is the configured XMLTV guide, or else the one named in the
+// playlist's header, if any
+func (b *iptvBackend) GuideURL() string {
+	if b.guide != "" {
+		return b.guide
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.guideURL
+}
+
+// Healthy reports whether the playlist loaded the last time it was read
+func (b *iptvBackend) Healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy
+}
+
+func (b *iptvBackend) Stats() BackendStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BackendStats{
+		Name:       b.name,
+		Type:       backendTypeIPTV,
+		Healthy:    b.healthy,
+		TunerCount: b.maxStreams,
+		Detail:     fmt.Sprintf("%s, %d channels, %d/%d streams", b.playlist, len(b.channels), b.inUse, b.maxStreams),
+	}
+}
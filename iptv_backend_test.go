@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPlaylist = `#EXTM3U url-tvg="http://epg.local/guide.xml"
+#EXTINF:-1 tvg-id="news.us" tvg-chno="5" tvg-name="News" group-title="News",News HD
+#EXTVLCOPT:http-user-agent=VLC
+http://iptv.local/live/news.ts
+#EXTINF:-1 tvg-id="movies.us",Movies
+http://iptv.local/live/movies.ts?token=abc
+#EXTINF:-1 tvg-chno="12",Sports
+http://iptv.local/live/sports.ts
+#EXTINF:-1 tvg-chno="5",Duplicate
+http://iptv.local/live/dup.ts
+`
+
+func TestParseM3U(t *testing.T) {
+	channels, guideURL, err := parseM3U(strings.NewReader(testPlaylist))
+	if err != nil {
+		t.Fatalf("parseM3U error: %v", err)
+	}
+	if guideURL != "http://epg.local/guide.xml" {
+		t.Errorf("Expected the url-tvg guide, got %q", guideURL)
+	}
+
+	want := []TunarrLineupItem{
+		{GuideNumber: "5", GuideName: "News", URL: "http://iptv.local/live/news.ts", GuideID: "news.us"},
+		{GuideNumber: "13", GuideName: "Movies", URL: "http://iptv.local/live/movies.ts?token=abc", GuideID: "movies.us"},
+		{GuideNumber: "12", GuideName: "Sports", URL: "http://iptv.local/live/sports.ts"},
+	}
+	if len(channels) != len(want) {
+		t.Fatalf("Expected %d channels, got %d: %+v", len(want), len(channels), channels)
+	}
+	for i, ch := range channels {
+		if ch != want[i] {
+			t.Errorf("Expected channel %d to be %+v, got %+v", i, want[i], ch)
+		}
+	}
+
+	if _, _, err := parseM3U(strings.NewReader("http://iptv.local/live/news.ts\n")); err == nil {
+		t.Error("Expected a playlist without #EXTM3U to be rejected")
+	}
+}
+
+func TestIPTVBackendLoadsFileAndURL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "playlist.m3u")
+	if err := os.WriteFile(path, []byte(testPlaylist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fromFile := newIPTVBackend("file", path, "", 0, 0)
+	if err := fromFile.Start(context.Background()); err != nil {
+		t.Fatalf("Start from file: %v", err)
+	}
+	if fromFile.TunerCount() != DefaultIPTVMaxStreams {
+		t.Errorf("Expected the default stream limit %d, got %d", DefaultIPTVMaxStreams, fromFile.TunerCount())
+	}
+	if got := fromFile.GuideURL(); got != "http://epg.local/guide.xml" {
+		t.Errorf("Expected the playlist's url-tvg guide, got %q", got)
+	}
+	withGuide := newIPTVBackend("guide", path, "/srv/epg/guide.xml", 0, 0)
+	if err := withGuide.Start(context.Background()); err != nil {
+		t.Fatalf("Start with guide: %v", err)
+	}
+	if got := withGuide.GuideURL(); got != "/srv/epg/guide.xml" {
+		t.Errorf("Expected the configured guide to override url-tvg, got %q", got)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPlaylist)) //nolint:errcheck
+	}))
+	fromURL := newIPTVBackend("url", srv.URL+"/playlist.m3u", "", 3, 1)
+	channels, err := fromURL.Lineup(context.Background())
+	if err != nil || len(channels) != 3 {
+		t.Fatalf("Expected 3 channels from URL, got %d, %v", len(channels), err)
+	}
+
+	srv.Close()
+	if _, err := fromURL.Lineup(context.Background()); err == nil || fromURL.Healthy() {
+		t.Error("Expected the backend to turn unhealthy once its playlist can't be fetched")
+	}
+	if got, _, err := fromURL.OpenStream("5"); err != nil || got != "http://iptv.local/live/news.ts" {
+		t.Errorf("Expected the last loaded channels to stay routable, got %q, %v", got, err)
+	}
+}
+
+func TestIPTVBackendEnforcesMaxStreams(t *testing.T) {
+	b := newIPTVBackend("iptv", "unused", "", 2, 0)
+	if _, _, err := b.OpenStream("5"); !errors.Is(err, errChannelNotCarried) {
+		t.Errorf("Expected errChannelNotCarried before the playlist is loaded, got %v", err)
+	}
+
+	channels, _, _ := parseM3U(strings.NewReader(testPlaylist))
+	b.urls = make(map[string]string)
+	for _, ch := range channels {
+		b.urls[ch.GuideNumber] = ch.URL
+	}
+
+	_, release1, err := b.OpenStream("5")
+	if err != nil {
+		t.Fatalf("First stream: %v", err)
+	}
+	_, release2, err := b.OpenStream("12")
+	if err != nil {
+		t.Fatalf("Second stream: %v", err)
+	}
+	if _, _, err := b.OpenStream("13"); !errors.Is(err, ErrNoTunerAvailable) {
+		t.Errorf("Expected ErrNoTunerAvailable past max_streams, got %v", err)
+	}
+
+	release1()
+	release1() // releasing twice must not free a second slot
+	if _, _, err := b.OpenStream("13"); err != nil {
+		t.Errorf("Expected a slot to free up after release, got %v", err)
+	}
+	if _, _, err := b.OpenStream("13"); !errors.Is(err, ErrNoTunerAvailable) {
+		t.Errorf("Expected a double release to free only one slot, got %v", err)
+	}
+	release2()
+}
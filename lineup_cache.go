@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// lineupSource is implemented by backendRouter; it fetches the backend's
+// channel lineup for HDHREndpointServer to serve from /lineup.json
+type lineupSource interface {
+	Lineup(ctx context.Context) ([]TunarrLineupItem, error)
+}
+
+// lineupSyncReporter is implemented by backendRouter; it reports background
+// lineup syncs as a channel scan in lineup_status.json
+type lineupSyncReporter interface {
+	LineupSyncing() bool
+}
+
+// lineupVersioner is implemented by backendRouter; its version changes when
+// a background sync changes a backend's lineup
+type lineupVersioner interface {
+	LineupVersion() uint64
+}
+
+// lineupCache holds the most recently fetched backend lineup so every
+// lineup.json / lineup_status.json request doesn't hit the backend
+type lineupCache struct {
+	mu        sync.Mutex
+	items     []TunarrLineupItem
+	err       error         // the last fetch's error, if it failed; items are then stale
+	fetchedAt time.Time     // when the last fetch finished, whether or not it failed
+	version   uint64        // the source's LineupVersion when items were fetched
+	fetching  chan struct{} // closed when the fetch in flight finishes; nil if none
+}
+
+// get returns the cached lineup, refetching from source once the last fetch
+// is older than ttl or the source's lineup version has moved on. A failed
+// fetch is remembered like a successful one, so while a backend is down the
+// stale lineup is returned alongside the error until ttl has passed, rather
+// than every request waiting on a fetch of its own. Only one fetch runs at a
+// time, without holding the lock; callers arriving meanwhile get the stale
+// lineup, or wait if there is none yet.
+func (lc *lineupCache) get(ctx context.Context, source lineupSource, ttl time.Duration) ([]TunarrLineupItem, error) {
+	var version uint64
+	if v, ok := source.(lineupVersioner); ok {
+		version = v.LineupVersion()
+	}
+
+	lc.mu.Lock()
+	for {
+		fresh := !lc.fetchedAt.IsZero() && time.Since(lc.fetchedAt) < ttl && version == lc.version
+		if fresh || (lc.fetching != nil && !lc.fetchedAt.IsZero()) {
+			items, err := lc.items, lc.err
+			lc.mu.Unlock()
+			return items, err
+		}
+		if lc.fetching == nil {
+			break
+		}
+		wait := lc.fetching
+		lc.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		lc.mu.Lock()
+	}
+	done := make(chan struct{})
+	lc.fetching = done
+	lc.mu.Unlock()
+
+	items, err := source.Lineup(ctx)
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.fetching = nil
+	close(done)
+	if err != nil && ctx.Err() != nil {
+		// The caller went away; that says nothing about the backend
+		return lc.items, err
+	}
+	lc.fetchedAt = time.Now()
+	lc.version = version
+	lc.err = err
+	if err != nil {
+		return lc.items, err
+	}
+
+	slog.Debug("Lineup fetched from backend", "channels", len(items))
+	lc.items = items
+	return lc.items, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// countingLineupSource returns a fixed lineup and counts fetches
+type countingLineupSource struct {
+	items   []TunarrLineupItem
+	err     error
+	fetches int
+}
+
+func (c *countingLineupSource) Lineup(ctx context.Context) ([]TunarrLineupItem, error) {
+	c.fetches++
+	return c.items, c.err
+}
+
+func TestLineupCacheServesWithinTTL(t *testing.T) {
+	src := &countingLineupSource{items: []TunarrLineupItem{{GuideNumber: "1", GuideName: "One"}}}
+	var lc lineupCache
+
+	for i := 0; i < 3; i++ {
+		items, err := lc.get(context.Background(), src, time.Minute)
+		if err != nil || len(items) != 1 {
+			t.Fatalf("get() = %v, %v", items, err)
+		}
+	}
+	if src.fetches != 1 {
+		t.Errorf("expected 1 fetch within TTL, got %d", src.fetches)
+	}
+}
+
+func TestLineupCacheRefetchesAfterTTL(t *testing.T) {
+	src := &countingLineupSource{items: []TunarrLineupItem{{GuideNumber: "1"}}}
+	var lc lineupCache
+
+	lc.get(context.Background(), src, 0) //nolint:errcheck
+	lc.get(context.Background(), src, 0) //nolint:errcheck
+	if src.fetches != 2 {
+		t.Errorf("expected 2 fetches with zero TTL, got %d", src.fetches)
+	}
+}
+
+func TestLineupCacheKeepsStaleOnError(t *testing.T) {
+	src := &countingLineupSource{items: []TunarrLineupItem{{GuideNumber: "1", URL: "http://tunarr/1"}}}
+	var lc lineupCache
+	lc.get(context.Background(), src, 0) //nolint:errcheck
+
+	src.err = errors.New("backend down")
+	items, err := lc.get(context.Background(), src, 0)
+	if err == nil {
+		t.Error("expected error from failed refetch")
+	}
+	if len(items) != 1 {
+		t.Errorf("expected stale lineup to be returned, got %v", items)
+	}
+}
+
+func TestLineupCacheRemembersFailure(t *testing.T) {
+	src := &countingLineupSource{items: []TunarrLineupItem{{GuideNumber: "1"}}}
+	var lc lineupCache
+	lc.get(context.Background(), src, time.Minute) //nolint:errcheck
+	lc.fetchedAt = time.Now().Add(-2 * time.Minute)
+
+	src.err = errors.New("backend down")
+	for i := 0; i < 3; i++ {
+		items, err := lc.get(context.Background(), src, time.Minute)
+		if err == nil || len(items) != 1 {
+			t.Errorf("Expected the stale lineup with the error, got %v, %v", items, err)
+		}
+	}
+	if src.fetches != 2 {
+		t.Errorf("Expected a failed fetch not to be retried within the TTL, got %d fetches", src.fetches)
+	}
+}
+
+// blockingLineupSource returns its lineup once release is closed
+type blockingLineupSource struct {
+	items   []TunarrLineupItem
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingLineupSource) Lineup(ctx context.Context) ([]TunarrLineupItem, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return b.items, nil
+}
+
+func TestLineupCacheServesStaleDuringFetch(t *testing.T) {
+	src := &blockingLineupSource{
+		items:   []TunarrLineupItem{{GuideNumber: "1"}},
+		started: make(chan struct{}, 2),
+		release: make(chan struct{}),
+	}
+	var lc lineupCache
+	lc.items = []TunarrLineupItem{{GuideNumber: "0"}}
+	lc.fetchedAt = time.Now().Add(-time.Hour)
+
+	done := make(chan []TunarrLineupItem)
+	go func() {
+		items, _ := lc.get(context.Background(), src, time.Minute)
+		done <- items
+	}()
+	<-src.started
+
+	items, err := lc.get(context.Background(), src, time.Minute)
+	if err != nil || len(items) != 1 || items[0].GuideNumber != "0" {
+		t.Errorf("Expected the stale lineup while a fetch is in flight, got %v, %v", items, err)
+	}
+	close(src.release)
+	if items := <-done; len(items) != 1 || items[0].GuideNumber != "1" {
+		t.Errorf("Expected the fetched lineup, got %v", items)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DefaultLineupSyncSeconds is how often each backend's lineup is re-read in
+// the background when lineup_sync_seconds is unset
+const DefaultLineupSyncSeconds = 300
+
+// lineupSyncTimeout bounds a single background lineup fetch
+const lineupSyncTimeout = 30 * time.Second
+
+// LineupDiff describes how a backend's lineup changed between two syncs.
+// Each entry is "<GuideNumber> <GuideName>"; renames read "<GuideNumber> <old> -> <new>".
+type LineupDiff struct {
+	Added   []string
+	Removed []string
+	Renamed []string
+}
+
+// empty reports whether the lineup didn't change
+func (d LineupDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Renamed) == 0
+}
+
+// diffLineups compares two lineups by GuideNumber. Added and renamed channels
+// are listed in the new lineup's order, removed ones in the old lineup's.
+func diffLineups(before, after []TunarrLineupItem) LineupDiff {
+	var d LineupDiff
+	old := make(map[string]string, len(before))
+	for _, item := range before {
+		old[item.GuideNumber] = item.GuideName
+	}
+	current := make(map[string]bool, len(after))
+	for _, item := range after {
+		current[item.GuideNumber] = true
+		name, ok := old[item.GuideNumber]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, item.GuideNumber+" "+item.GuideName)
+		case name != item.GuideName:
+			d.Renamed = append(d.Renamed, item.GuideNumber+" "+name+" -> "+item.GuideName)
+		}
+	}
+	for _, item := range before {
+		if !current[item.GuideNumber] {
+			d.Removed = append(d.Removed, item.GuideNumber+" "+item.GuideName)
+		}
+	}
+	return d
+}
+
+// LineupSyncStats is a point-in-time snapshot of a backend's lineup syncer
+type LineupSyncStats struct {
+	IntervalSeconds int
+	Syncing         bool
+	LastSync        time.Time // last completed sync, successful or not
+	LastError       string    // empty if the last sync succeeded
+	Channels        int
+	LastChange      time.Time  // last sync that found a difference
+	LastDiff        LineupDiff // what that sync found
+}
+
+// lineupSyncer re-reads one backend's lineup on a schedule through the
+// router, which stores it for serving and logs what changed
+type lineupSyncer struct {
+	backend  Backend
+	interval time.Duration
+
+	mu       sync.Mutex
+	synced   bool // a fetch has succeeded
+	noLineup bool // the backend turned out to publish no lineup
+	stats    LineupSyncStats
+}
+
+// newLineupSyncer creates a syncer that polls b every interval
+func newLineupSyncer(b Backend, interval time.Duration) *lineupSyncer {
+	return &lineupSyncer{
+		backend:  b,
+		interval: interval,
+		stats:    LineupSyncStats{IntervalSeconds: int(interval / time.Second)},
+	}
+}
+
+// run syncs immediately and then every interval until ctx is done. A backend
+// that publishes no lineup is only polled once.
+func (s *lineupSyncer) run(ctx context.Context, br *backendRouter) {
+	if !s.sync(ctx, br) {
+		slog.Debug("Backend publishes no lineup, not syncing it", "backend", s.backend.Name())
+		return
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sync(ctx, br)
+		}
+	}
+}
+
+// sync refreshes the backend's lineup in br once, reporting false if the
+// backend has no lineup to sync. The router diffs it against the lineup it
+// was serving and records any change here.
+func (s *lineupSyncer) sync(ctx context.Context, br *backendRouter) bool {
+	s.mu.Lock()
+	s.stats.Syncing = true
+	s.mu.Unlock()
+
+	fetchCtx, cancel := context.WithTimeout(ctx, lineupSyncTimeout)
+	items, err := br.refreshLineup(fetchCtx, s.backend, s)
+	cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Syncing = false
+	s.stats.LastSync = time.Now()
+	if err != nil {
+		s.stats.LastError = err.Error()
+		slog.Warn("Lineup sync failed", "backend", s.backend.Name(), "err", err)
+		return true
+	}
+	s.stats.LastError = ""
+	if items == nil && !s.synced {
+		s.noLineup = true
+		return false
+	}
+
+	if !s.synced {
+		slog.Info("Lineup synced", "backend", s.backend.Name(), "channels", len(items))
+	}
+	s.synced = true
+	s.stats.Channels = len(items)
+	return true
+}
+
+// recordChange records a change to the backend's lineup, however it was
+// found; s may be nil for a backend that isn't synced
+func (s *lineupSyncer) recordChange(d LineupDiff) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.LastChange = time.Now()
+	s.stats.LastDiff = d
+}
+
+// logLineupDiff logs a summary of a lineup change and then each changed channel
+func logLineupDiff(backend string, d LineupDiff) {
+	slog.Info("Lineup changed", "backend", backend, "added", len(d.Added), "removed", len(d.Removed), "renamed", len(d.Renamed))
+	for _, ch := range d.Added {
+		slog.Info("Channel added", "backend", backend, "channel", ch)
+	}
+	for _, ch := range d.Removed {
+		slog.Info("Channel removed", "backend", backend, "channel", ch)
+	}
+	for _, ch := range d.Renamed {
+		slog.Info("Channel renamed", "backend", backend, "channel", ch)
+	}
+}
+
+// syncing reports whether a sync is in progress
+func (s *lineupSyncer) syncing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats.Syncing
+}
+
+// Stats returns a snapshot of the syncer, or false if the backend publishes
+// no lineup to sync
+func (s *lineupSyncer) Stats() (LineupSyncStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats, !s.noLineup
+}
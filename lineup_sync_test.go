@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffLineups(t *testing.T) {
+	before := []TunarrLineupItem{
+		{GuideNumber: "1", GuideName: "News"},
+		{GuideNumber: "2", GuideName: "Movies"},
+		{GuideNumber: "3", GuideName: "Sports"},
+	}
+	after := []TunarrLineupItem{
+		{GuideNumber: "1", GuideName: "News"},
+		{GuideNumber: "3", GuideName: "Sports HD"},
+		{GuideNumber: "4", GuideName: "Kids"},
+	}
+
+	got := diffLineups(before, after)
+	want := LineupDiff{
+		Added:   []string{"4 Kids"},
+		Removed: []string{"2 Movies"},
+		Renamed: []string{"3 Sports -> Sports HD"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	if !diffLineups(after, after).empty() {
+		t.Error("Expected an unchanged lineup to produce an empty diff")
+	}
+}
+
+func TestLineupSyncerRecordsChanges(t *testing.T) {
+	fb := &fakeBackend{name: "tunarr", lineup: []TunarrLineupItem{{GuideNumber: "1", GuideName: "News"}}}
+	br := fakeChain([]*fakeBackend{fb})
+	s := newLineupSyncer(fb, time.Minute)
+	br.backends[0].syncer = s
+
+	if !s.sync(context.Background(), br) {
+		t.Fatal("Expected a backend with a lineup to be synced")
+	}
+	stats, ok := s.Stats()
+	if !ok || stats.Channels != 1 || stats.LastSync.IsZero() || !stats.LastChange.IsZero() {
+		t.Errorf("Expected the first sync to be a baseline without changes, got %+v", stats)
+	}
+
+	fb.lineup = []TunarrLineupItem{{GuideNumber: "1", GuideName: "News"}, {GuideNumber: "2", GuideName: "Movies"}}
+	s.sync(context.Background(), br)
+	stats, _ = s.Stats()
+	if stats.Channels != 2 || stats.LastChange.IsZero() || !reflect.DeepEqual(stats.LastDiff.Added, []string{"2 Movies"}) {
+		t.Errorf("Expected the added channel to be recorded, got %+v", stats)
+	}
+
+	fb.lineupErr = errors.New("unreachable")
+	s.sync(context.Background(), br)
+	stats, _ = s.Stats()
+	if stats.LastError != "unreachable" || stats.Channels != 2 || len(stats.LastDiff.Added) != 1 {
+		t.Errorf("Expected a failed sync to keep the last lineup and diff, got %+v", stats)
+	}
+
+	noLineup := newLineupSyncer(&fakeBackend{name: "hdhr"}, time.Minute)
+	if noLineup.sync(context.Background(), br) {
+		t.Error("Expected a backend without a lineup not to be synced")
+	}
+	if _, ok := noLineup.Stats(); ok {
+		t.Error("Expected no sync stats for a backend without a lineup")
+	}
+}
+
+// blockingBackend is a fakeBackend whose Lineup waits until released
+type blockingBackend struct {
+	fakeBackend
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBackend) Lineup(ctx context.Context) ([]TunarrLineupItem, error) {
+	b.entered <- struct{}{}
+	<-b.release
+	return b.lineup, nil
+}
+
+func TestLineupStatusReportsSyncAsScan(t *testing.T) {
+	bb := &blockingBackend{
+		fakeBackend: fakeBackend{name: "slow", healthy: true, lineup: []TunarrLineupItem{{GuideNumber: "1"}}},
+		entered:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	br := fakeChain(nil)
+	br.backends = append(br.backends, routedBackend{Backend: bb, fallback: backendFallbackNext, syncer: newLineupSyncer(bb, time.Minute)})
+	server := NewHDHREndpointServer(br.store, br)
+	server.lineup.fetchedAt = time.Now() // serve NumChannels from the cache rather than the blocked backend
+	handler := server.Handler()
+
+	scanInProgress := func() int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/lineup_status.json", nil))
+		var status LineupStatusJSON
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return status.ScanInProgress
+	}
+
+	done := make(chan bool)
+	go func() { done <- br.backends[0].syncer.sync(context.Background(), br) }()
+	<-bb.entered
+	if got := scanInProgress(); got != 1 {
+		t.Errorf("Expected ScanInProgress 1 during a sync, got %d", got)
+	}
+	close(bb.release)
+	<-done
+	if got := scanInProgress(); got != 0 {
+		t.Errorf("Expected ScanInProgress 0 once the sync finished, got %d", got)
+	}
+}
+
+func TestLineupSyncUpdatesServedLineup(t *testing.T) {
+	fb := &fakeBackend{name: "tunarr", lineup: []TunarrLineupItem{{GuideNumber: "1", GuideName: "News"}}}
+	br := fakeChain([]*fakeBackend{fb})
+	s := newLineupSyncer(fb, time.Minute)
+	br.backends[0].syncer = s
+	handler := NewHDHREndpointServer(br.store, br).Handler()
+
+	served := func() []LineupItemJSON {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/lineup.json", nil))
+		var lineup []LineupItemJSON
+		if err := json.NewDecoder(w.Body).Decode(&lineup); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return lineup
+	}
+
+	s.sync(context.Background(), br)
+	if got := served(); len(got) != 1 || fb.fetches != 1 {
+		t.Errorf("Expected the synced lineup served without refetching, got %+v after %d fetches", got, fb.fetches)
+	}
+
+	fb.lineup = append(fb.lineup, TunarrLineupItem{GuideNumber: "2", GuideName: "Movies"})
+	s.sync(context.Background(), br)
+	if got := served(); len(got) != 2 || got[1].GuideNumber != "2" || fb.fetches != 2 {
+		t.Errorf("Expected the change served as soon as it was synced, got %+v after %d fetches", got, fb.fetches)
+	}
+	if stats, _ := s.Stats(); !reflect.DeepEqual(stats.LastDiff.Added, []string{"2 Movies"}) {
+		t.Errorf("Expected the sync to record the served change, got %+v", stats.LastDiff)
+	}
+}
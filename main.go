@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 )
 
@@ -107,6 +108,8 @@ func main() {
 		runAppProxy(args[1:], store, tuiMode)
 	case "tuner":
 		runTunerProxy(args[1:], store, tuiMode)
+	case "bridge":
+		runBridge(args[1:], store, tuiMode)
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown mode: %s\n", mode)
 		printUsage()
@@ -116,8 +119,9 @@ func main() {
 
 func printUsage() {
 	fmt.Fprintf(os.Stderr, "Usage:\n")
-	fmt.Fprintf(os.Stderr, "  %s app [bind_address] [hdhomerun_ip]\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "  %s tuner <app_proxy_host_or_hdhomerun_ip> [-direct]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s app [bind_address] [hdhomerun_ip[,hdhomerun_ip...]]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s tuner <app_proxy_host_or_hdhomerun_ip[,hdhomerun_ip...]> [-direct]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s bridge <app_interface> <tuner_interface>\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "\nFlags:\n")
 	fmt.Fprintf(os.Stderr, "  -config string\n\tPath to JSON config file\n")
 	fmt.Fprintf(os.Stderr, "  -debug\n\tEnable debug logging\n")
@@ -134,20 +138,21 @@ func printUsage() {
 
 func runAppProxy(args []string, store *configStore, tuiMode bool) {
 	cfg := store.Get()
-	var bindAddr, directIP string
+	var bindAddr string
+	var directIPs []string
 
 	if len(args) > 0 {
 		bindAddr = args[0]
 	}
 	if len(args) > 1 {
-		directIP = args[1]
+		directIPs = splitIPList(args[1])
 	}
 
 	if bindAddr == "" && cfg.App.BindAddress != "" {
 		bindAddr = cfg.App.BindAddress
 	}
-	if directIP == "" && cfg.App.DirectHDHRIP != "" {
-		directIP = cfg.App.DirectHDHRIP
+	if len(directIPs) == 0 {
+		directIPs = cfg.AppDirectHDHRIPs()
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -174,12 +179,12 @@ func runAppProxy(args []string, store *configStore, tuiMode bool) {
 
 	if tuiMode {
 		runWithTUI(ctx, cancel, proxy, func() error {
-			return proxy.Run(ctx, bindAddr, directIP, store)
+			return proxy.Run(ctx, bindAddr, directIPs, store)
 		})
 		return
 	}
 
-	if err := proxy.Run(ctx, bindAddr, directIP, store); err != nil {
+	if err := proxy.Run(ctx, bindAddr, directIPs, store); err != nil {
 		slog.Error("App proxy error", "err", err)
 		os.Exit(1)
 	}
@@ -210,9 +215,11 @@ func runTunerProxy(args []string, store *configStore, tuiMode bool) {
 		isDirectMode = args[1] == "-direct"
 	}
 
+	// In direct mode hostOrIP may be a comma-separated list of HDHomeRun IPs
+	configDirectIPs := strings.Join(cfg.TunerDirectHDHRIPs(), ",")
 	if hostOrIP == "" {
-		if isDirectMode && cfg.Tuner.DirectHDHRIP != "" {
-			hostOrIP = cfg.Tuner.DirectHDHRIP
+		if isDirectMode && configDirectIPs != "" {
+			hostOrIP = configDirectIPs
 		} else if !isDirectMode && cfg.Tuner.ProxyHost != "" {
 			hostOrIP = cfg.Tuner.ProxyHost
 		}
@@ -220,8 +227,8 @@ func runTunerProxy(args []string, store *configStore, tuiMode bool) {
 
 	if !isDirectMode && cfg.Tuner.DirectMode {
 		isDirectMode = true
-		if hostOrIP == "" && cfg.Tuner.DirectHDHRIP != "" {
-			hostOrIP = cfg.Tuner.DirectHDHRIP
+		if hostOrIP == "" && configDirectIPs != "" {
+			hostOrIP = configDirectIPs
 		}
 	}
 
@@ -265,3 +272,59 @@ func runTunerProxy(args []string, store *configStore, tuiMode bool) {
 		os.Exit(1)
 	}
 }
+
+func runBridge(args []string, store *configStore, tuiMode bool) {
+	cfg := store.Get()
+	if len(args) > 2 {
+		fmt.Fprintf(os.Stderr, "Error: too many arguments for bridge mode\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s [-flags] bridge [<app_interface> <tuner_interface>]\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	appIface, tunerIface := cfg.Bridge.AppInterface, cfg.Bridge.TunerInterface
+	if len(args) > 0 {
+		appIface = args[0]
+	}
+	if len(args) > 1 {
+		tunerIface = args[1]
+	}
+	if appIface == "" || tunerIface == "" {
+		fmt.Fprintf(os.Stderr, "Error: bridge mode needs an app interface and a tuner interface, on the command line or in config\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s [-config file.json] bridge <app_interface> <tuner_interface>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		slog.Info("Shutdown signal received")
+		cancel()
+	}()
+
+	proxy := NewBridgeProxy(store)
+
+	if store.Get().WebUI.Addr != "" {
+		ws := newWebServer(store, proxy)
+		go func() {
+			if err := ws.start(ctx); err != nil {
+				slog.Error("Web UI error", "err", err)
+			}
+		}()
+	}
+
+	if tuiMode {
+		runWithTUI(ctx, cancel, proxy, func() error {
+			return proxy.Run(ctx, appIface, tunerIface)
+		})
+		return
+	}
+
+	if err := proxy.Run(ctx, appIface, tunerIface); err != nil {
+		slog.Error("Bridge error", "err", err)
+		os.Exit(1)
+	}
+}
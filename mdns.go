@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// mDNS (RFC 6762) and DNS-SD (RFC 6763) constants
+const (
+	mdnsPort = 5353
+
+	// mdnsServiceType is the DNS-SD service HDHomeRun apps browse for
+	mdnsServiceType = "_hdhomerun._tcp.local."
+	// mdnsServicesName lists every service type advertised on the link
+	mdnsServicesName = "_services._dns-sd._udp.local."
+
+	mdnsHostTTL    = 120  // A and SRV records
+	mdnsServiceTTL = 4500 // PTR and TXT records
+	mdnsLegacyTTL  = 10   // cap for answers to legacy unicast queries
+
+	dnsTypeA   uint16 = 1
+	dnsTypePTR uint16 = 12
+	dnsTypeTXT uint16 = 16
+	dnsTypeSRV uint16 = 33
+	dnsTypeANY uint16 = 255
+	dnsClassIN uint16 = 1
+
+	// dnsClassCacheFlush marks a record as the only one of its name and type
+	dnsClassCacheFlush uint16 = 0x8000
+	// dnsClassUnicast in a question asks for a unicast response
+	dnsClassUnicast uint16 = 0x8000
+
+	dnsFlagResponse  uint16 = 0x8000
+	dnsFlagAuthority uint16 = 0x0400
+)
+
+var mdnsGroup = net.IPv4(224, 0, 0, 251)
+
+var (
+	errDNSShort    = errors.New("dns message truncated")
+	errDNSResponse = errors.New("dns message is a response")
+	errDNSName     = errors.New("dns name malformed")
+)
+
+// dnsQuestion is one entry of a DNS message's question section
+type dnsQuestion struct {
+	name    string // lower case, with the trailing dot
+	qtype   uint16
+	unicast bool
+}
+
+// dnsRecord is a resource record with its RDATA already encoded
+type dnsRecord struct {
+	name   string
+	rtype  uint16
+	unique bool // sets the cache-flush bit
+	ttl    uint32
+	data   []byte
+}
+
+// parseDNSQuery returns a query's ID and questions. Responses, including
+// our own announcements looped back to us, are rejected.
+func parseDNSQuery(msg []byte) (uint16, []dnsQuestion, error) {
+	if len(msg) < 12 {
+		return 0, nil, errDNSShort
+	}
+	id := binary.BigEndian.Uint16(msg[0:2])
+	if binary.BigEndian.Uint16(msg[2:4])&dnsFlagResponse != 0 {
+		return 0, nil, errDNSResponse
+	}
+
+	count := int(binary.BigEndian.Uint16(msg[4:6]))
+	questions := make([]dnsQuestion, 0, count)
+	off := 12
+	for i := 0; i < count; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return 0, nil, err
+		}
+		if next+4 > len(msg) {
+			return 0, nil, errDNSShort
+		}
+		class := binary.BigEndian.Uint16(msg[next+2 : next+4])
+		questions = append(questions, dnsQuestion{
+			name:    strings.ToLower(name),
+			qtype:   binary.BigEndian.Uint16(msg[next : next+2]),
+			unicast: class&dnsClassUnicast != 0,
+		})
+		off = next + 4
+	}
+	return id, questions, nil
+}
+
+// readDNSName decodes the possibly compressed name at off, returning it with
+// a trailing dot and the offset just past it
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSShort
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSShort
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, errDNSName
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:off+2]) & 0x3FFF)
+		case n&0xC0 != 0:
+			return "", 0, errDNSName
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errDNSShort
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// appendDNSName appends name, uncompressed, in wire format
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// marshalDNSResponse builds an authoritative response. questions are
+// repeated only for legacy unicast queries, which expect them.
+func marshalDNSResponse(id uint16, questions []dnsQuestion, answers, extras []dnsRecord) []byte {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:2], id)
+	binary.BigEndian.PutUint16(b[2:4], dnsFlagResponse|dnsFlagAuthority)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(questions)))
+	binary.BigEndian.PutUint16(b[6:8], uint16(len(answers)))
+	binary.BigEndian.PutUint16(b[10:12], uint16(len(extras)))
+
+	for _, q := range questions {
+		b = appendDNSName(b, q.name)
+		b = binary.BigEndian.AppendUint16(b, q.qtype)
+		b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+	}
+	for _, r := range append(answers, extras...) {
+		class := dnsClassIN
+		if r.unique {
+			class |= dnsClassCacheFlush
+		}
+		b = appendDNSName(b, r.name)
+		b = binary.BigEndian.AppendUint16(b, r.rtype)
+		b = binary.BigEndian.AppendUint16(b, class)
+		b = binary.BigEndian.AppendUint32(b, r.ttl)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(r.data)))
+		b = append(b, r.data...)
+	}
+	return b
+}
+
+// mdnsRecords are the records advertising the emulated device on one interface
+type mdnsRecords struct {
+	services dnsRecord // _services._dns-sd._udp PTR to the service type
+	ptr      dnsRecord // service type PTR to the instance
+	srv      dnsRecord
+	txt      dnsRecord
+	a        dnsRecord
+}
+
+// all lists the records in the order they are announced
+func (r *mdnsRecords) all() []dnsRecord {
+	return []dnsRecord{r.ptr, r.srv, r.txt, r.a, r.services}
+}
+
+// mdnsResponder advertises the emulated device as an _hdhomerun._tcp
+// service, with the same DeviceID, BaseURL and model as its discovery
+// replies, and answers mDNS queries for it on IPv4
+type mdnsResponder struct {
+	*multicastResponder
+	router *backendRouter
+}
+
+// newMDNSResponder creates an mDNS responder for the named interfaces
+func newMDNSResponder(router *backendRouter, names []string) *mdnsResponder {
+	group := &net.UDPAddr{IP: mdnsGroup, Port: mdnsPort}
+	return &mdnsResponder{multicastResponder: newMulticastResponder("mDNS", group, names), router: router}
+}
+
+// start joins the mDNS group on the interfaces, announces the device and
+// answers queries until stop is called
+func (m *mdnsResponder) start() error {
+	joined, err := m.listen(m.handle, func() {
+		// RFC 6762 section 8.3: announce at least twice, a second apart
+		m.announce(false)
+		select {
+		case <-m.stopped:
+		case <-time.After(time.Second):
+			m.announce(false)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("Advertising device over mDNS", "service", mdnsServiceType, "interfaces", joined)
+	return nil
+}
+
+// stop withdraws the advertisement with a goodbye and closes the socket
+func (m *mdnsResponder) stop() {
+	m.shutdown(func() { m.announce(true) })
+}
+
+// handle answers a query from a host on one of our subnets
+func (m *mdnsResponder) handle(msg []byte, from *net.UDPAddr) {
+	id, questions, err := parseDNSQuery(msg)
+	if err != nil {
+		return
+	}
+	target := targetFor(m.targets, from.IP)
+	if target == nil {
+		return
+	}
+
+	answers, extras := m.records(target.local, false).answer(questions)
+	if len(answers) == 0 {
+		return
+	}
+
+	// Legacy resolvers query from a port other than 5353 and take a plain
+	// DNS response; anyone asking only QU questions gets a unicast one
+	if from.Port != mdnsPort {
+		for i := range answers {
+			answers[i].ttl = min(answers[i].ttl, mdnsLegacyTTL)
+		}
+		for i := range extras {
+			extras[i].ttl = min(extras[i].ttl, mdnsLegacyTTL)
+		}
+		m.send(marshalDNSResponse(id, questions, answers, extras), from, nil)
+		return
+	}
+	unicast := true
+	for _, q := range questions {
+		unicast = unicast && q.unicast
+	}
+	resp := marshalDNSResponse(0, nil, answers, extras)
+	if unicast {
+		m.send(resp, from, nil)
+		return
+	}
+	m.send(resp, m.group, target.local)
+	slog.Debug("Answered mDNS query", "source", from.String(), "answers", len(answers))
+}
+
+// announce multicasts every record on every interface, with a TTL of zero
+// if goodbye is set so that browsers drop the device at once
+func (m *mdnsResponder) announce(goodbye bool) {
+	for _, t := range m.targets {
+		records := m.records(t.local, goodbye).all()
+		m.send(marshalDNSResponse(0, nil, records, nil), m.group, t.local)
+	}
+}
+
+// records describes the emulated device as reached at local, from the same
+// reply discovery sends
+func (m *mdnsResponder) records(local net.IP, goodbye bool) *mdnsRecords {
+	id := ResolveDeviceIdentity(m.router.store.Get())
+	reply := m.router.buildDiscoveryReply(local.String())
+	deviceID := fmt.Sprintf("%08X", reply.DeviceID)
+	instance := deviceID + "." + mdnsServiceType
+	host := "hdhr-" + strings.ToLower(deviceID) + ".local."
+
+	hostTTL, serviceTTL := uint32(mdnsHostTTL), uint32(mdnsServiceTTL)
+	if goodbye {
+		hostTTL, serviceTTL = 0, 0
+	}
+
+	srv := binary.BigEndian.AppendUint16(nil, 0) // priority
+	srv = binary.BigEndian.AppendUint16(srv, 0)  // weight
+	srv = binary.BigEndian.AppendUint16(srv, HDHRHTTPPort)
+	srv = appendDNSName(srv, host)
+
+	var txt []byte
+	for _, kv := range []string{
+		"DeviceID=" + deviceID,
+		"BaseURL=" + reply.BaseURL,
+		"ModelNumber=" + id.Model.ModelNumber,
+	} {
+		txt = append(txt, byte(len(kv)))
+		txt = append(txt, kv...)
+	}
+
+	return &mdnsRecords{
+		services: dnsRecord{name: mdnsServicesName, rtype: dnsTypePTR, ttl: serviceTTL, data: appendDNSName(nil, mdnsServiceType)},
+		ptr:      dnsRecord{name: mdnsServiceType, rtype: dnsTypePTR, ttl: serviceTTL, data: appendDNSName(nil, instance)},
+		srv:      dnsRecord{name: instance, rtype: dnsTypeSRV, unique: true, ttl: hostTTL, data: srv},
+		txt:      dnsRecord{name: instance, rtype: dnsTypeTXT, unique: true, ttl: serviceTTL, data: txt},
+		a:        dnsRecord{name: host, rtype: dnsTypeA, unique: true, ttl: hostTTL, data: local.To4()},
+	}
+}
+
+// answer returns the records that answer questions, and the additional
+// records a browser needs to resolve them without asking again
+func (r *mdnsRecords) answer(questions []dnsQuestion) (answers, extras []dnsRecord) {
+	has := func(list []dnsRecord, rec dnsRecord) bool {
+		for _, x := range list {
+			if x.name == rec.name && x.rtype == rec.rtype {
+				return true
+			}
+		}
+		return false
+	}
+	for _, q := range questions {
+		for _, rec := range []dnsRecord{r.services, r.ptr, r.srv, r.txt, r.a} {
+			if q.name == strings.ToLower(rec.name) && (q.qtype == rec.rtype || q.qtype == dnsTypeANY) && !has(answers, rec) {
+				answers = append(answers, rec)
+			}
+		}
+	}
+
+	var wanted []dnsRecord
+	if has(answers, r.ptr) {
+		wanted = append(wanted, r.srv, r.txt, r.a)
+	} else if has(answers, r.srv) {
+		wanted = append(wanted, r.a)
+	}
+	for _, rec := range wanted {
+		if !has(answers, rec) && !has(extras, rec) {
+			extras = append(extras, rec)
+		}
+	}
+	return answers, extras
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dnsQuery builds a one-question query as a browser would send it
+func dnsQuery(id uint16, name string, qtype uint16) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[0:2], id)
+	binary.BigEndian.PutUint16(b[4:6], 1)
+	b = appendDNSName(b, name)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	return binary.BigEndian.AppendUint16(b, dnsClassIN)
+}
+
+func TestReadDNSNameCompressed(t *testing.T) {
+	msg := appendDNSName(make([]byte, 12), "_hdhomerun._tcp.local.")
+	// "1010ABCD" followed by a pointer to the service type at offset 12
+	start := len(msg)
+	msg = append(msg, 8)
+	msg = append(msg, "1010ABCD"...)
+	msg = append(msg, 0xC0, 12)
+
+	name, next, err := readDNSName(msg, start)
+	if err != nil || name != "1010ABCD._hdhomerun._tcp.local." || next != len(msg) {
+		t.Errorf("Expected the compressed instance name, got %q, %d, %v", name, next, err)
+	}
+
+	loop := append(make([]byte, 12), 0xC0, 12)
+	if _, _, err := readDNSName(loop, 12); err == nil {
+		t.Error("Expected an error for a pointer loop")
+	}
+}
+
+func TestParseDNSQuery(t *testing.T) {
+	id, questions, err := parseDNSQuery(dnsQuery(7, "_HDHomeRun._tcp.local.", dnsTypePTR))
+	if err != nil || id != 7 || len(questions) != 1 {
+		t.Fatalf("Expected one question, got %d, %+v, %v", id, questions, err)
+	}
+	if questions[0].name != mdnsServiceType || questions[0].qtype != dnsTypePTR || questions[0].unicast {
+		t.Errorf("Expected a lower-cased multicast PTR question, got %+v", questions[0])
+	}
+
+	if _, _, err := parseDNSQuery(marshalDNSResponse(0, nil, nil, nil)); err != errDNSResponse {
+		t.Errorf("Expected responses to be rejected, got %v", err)
+	}
+}
+
+func TestMDNSRecordsAnswerBrowse(t *testing.T) {
+	ap := NewAppProxy(newConfigStore(DefaultConfig(), ""))
+	m := newMDNSResponder(&ap.backendRouter, nil)
+
+	records := m.records(net.IPv4(192, 168, 1, 5), false)
+	answers, extras := records.answer([]dnsQuestion{{name: mdnsServiceType, qtype: dnsTypePTR}})
+	if len(answers) != 1 || answers[0].rtype != dnsTypePTR {
+		t.Fatalf("Expected the service PTR, got %+v", answers)
+	}
+	if len(extras) != 3 || extras[0].rtype != dnsTypeSRV || extras[1].rtype != dnsTypeTXT || extras[2].rtype != dnsTypeA {
+		t.Fatalf("Expected SRV, TXT and A as additional records, got %+v", extras)
+	}
+	txt := string(extras[1].data)
+	for _, want := range []string{"DeviceID=" + ResolveDeviceIdentity(DefaultConfig()).DeviceID, "BaseURL=http://192.168.1.5:5004", "ModelNumber=HDFX-4K"} {
+		if !strings.Contains(txt, want) {
+			t.Errorf("Expected TXT to contain %q, got %q", want, txt)
+		}
+	}
+	if !net.IP(extras[2].data).Equal(net.IPv4(192, 168, 1, 5)) {
+		t.Errorf("Expected the A record to hold the interface address, got %v", extras[2].data)
+	}
+
+	if answers, _ := records.answer([]dnsQuestion{{name: "_other._tcp.local.", qtype: dnsTypePTR}}); len(answers) != 0 {
+		t.Errorf("Expected no answer for another service, got %+v", answers)
+	}
+	for _, r := range m.records(net.IPv4(192, 168, 1, 5), true).all() {
+		if r.ttl != 0 {
+			t.Errorf("Expected goodbye records to have TTL 0, got %+v", r)
+		}
+	}
+}
+
+func TestMDNSAnswersLegacyUnicastQuery(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ap := NewAppProxy(newConfigStore(DefaultConfig(), ""))
+	m := newMDNSResponder(&ap.backendRouter, nil)
+	m.conn = conn
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	m.targets = []discoveryTarget{{iface: "lo", subnet: loopback, local: net.IPv4(127, 0, 0, 1)}}
+
+	m.handle(dnsQuery(42, mdnsServiceType, dnsTypePTR), client.LocalAddr().(*net.UDPAddr))
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected a unicast response, got %v", err)
+	}
+	resp := buf[:n]
+	if id := binary.BigEndian.Uint16(resp[0:2]); id != 42 {
+		t.Errorf("Expected the query ID echoed, got %d", id)
+	}
+	if qd, an := binary.BigEndian.Uint16(resp[4:6]), binary.BigEndian.Uint16(resp[6:8]); qd != 1 || an != 1 {
+		t.Errorf("Expected the question repeated and one answer, got %d and %d", qd, an)
+	}
+
+	// Skip the question to the answer's TTL
+	_, off, err := readDNSName(resp, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, off, err = readDNSName(resp, off+4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := binary.BigEndian.Uint32(resp[off+4 : off+8]); ttl > mdnsLegacyTTL {
+		t.Errorf("Expected the TTL capped for a legacy query, got %d", ttl)
+	}
+}
@@ -11,6 +11,7 @@ const (
 	UDPReadTimeout            = 500 // milliseconds
 	UDPReadBufferSize         = 4096
 	ReconnectInterval         = 3 // seconds
+	HDHRHTTPPort              = 5004
 )
 
 // MessageCodec encodes and decodes messages to/from a byte stream
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// multicastResponder is the socket and lifecycle shared by the mDNS and SSDP
+// responders: it joins a multicast group on the advertised interfaces, hands
+// each datagram to the protocol's handler and sends replies out of the
+// interface they belong to
+type multicastResponder struct {
+	protocol   string // named in log messages
+	group      *net.UDPAddr
+	names      []string
+	targets    []discoveryTarget
+	conn       *net.UDPConn
+	sendMu     sync.Mutex // serializes choosing the multicast interface and sending
+	stopped    chan struct{}
+	announcing chan struct{} // closed once the announcer has stopped
+	done       chan struct{} // closed once serve has returned
+}
+
+// newMulticastResponder creates a responder for the named interfaces, or every
+// broadcast-capable one if names is empty
+func newMulticastResponder(protocol string, group *net.UDPAddr, names []string) *multicastResponder {
+	return &multicastResponder{protocol: protocol, group: group, names: names}
+}
+
+// listen joins the group on the interfaces, then passes what arrives to
+// handle and runs announce until shutdown is called. It returns the
+// interfaces joined.
+func (mr *multicastResponder) listen(handle func(data []byte, from *net.UDPAddr), announce func()) ([]string, error) {
+	mr.targets = discoveryTargets(mr.names)
+	if len(mr.targets) == 0 {
+		return nil, fmt.Errorf("no IPv4 interface to advertise on")
+	}
+
+	conn, joined, err := listenMulticastIPv4(mr.targets, mr.group)
+	if err != nil {
+		return nil, err
+	}
+	mr.conn = conn
+	mr.stopped = make(chan struct{})
+	mr.announcing = make(chan struct{})
+	mr.done = make(chan struct{})
+
+	go mr.serve(handle)
+	go func() {
+		defer close(mr.announcing)
+		announce()
+	}()
+	return joined, nil
+}
+
+// shutdown stops the announcer, sends goodbye and closes the socket
+func (mr *multicastResponder) shutdown(goodbye func()) {
+	if mr.conn == nil {
+		return
+	}
+	close(mr.stopped)
+	<-mr.announcing
+	goodbye()
+	mr.conn.Close()
+	<-mr.done
+}
+
+// serve hands datagrams to handle until the socket is closed
+func (mr *multicastResponder) serve(handle func(data []byte, from *net.UDPAddr)) {
+	defer close(mr.done)
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := mr.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("Error reading multicast", "protocol", mr.protocol, "err", err)
+			continue
+		}
+		handle(buf[:n], from)
+	}
+}
+
+// send writes a message to dst, multicasting it out of the interface
+// holding local when that is set
+func (mr *multicastResponder) send(msg []byte, dst *net.UDPAddr, local net.IP) {
+	mr.sendMu.Lock()
+	defer mr.sendMu.Unlock()
+	if local != nil {
+		if err := setMulticastInterface(mr.conn, local); err != nil {
+			slog.Debug("Error choosing multicast interface", "protocol", mr.protocol, "local", local.String(), "err", err)
+			return
+		}
+	}
+	if _, err := mr.conn.WriteToUDP(msg, dst); err != nil && !errors.Is(err, net.ErrClosed) {
+		slog.Debug("Error sending multicast message", "protocol", mr.protocol, "dst", dst.String(), "err", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMulticastResponderLifecycle(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	mr := newMulticastResponder("test", nil, nil)
+	mr.conn = conn
+	mr.stopped = make(chan struct{})
+	mr.announcing = make(chan struct{})
+	mr.done = make(chan struct{})
+	received := make(chan string, 1)
+	go mr.serve(func(data []byte, from *net.UDPAddr) {
+		mr.send(append([]byte("re: "), data...), from, nil)
+		received <- string(data)
+	})
+	go func() {
+		defer close(mr.announcing)
+		<-mr.stopped
+	}()
+
+	if _, err := peer.WriteToUDP([]byte("hello"), conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		if got != "hello" {
+			t.Errorf("Expected the handler to get the datagram, got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the handler to be called")
+	}
+	buf := make([]byte, 64)
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := peer.Read(buf); err != nil || string(buf[:n]) != "re: hello" {
+		t.Errorf("Expected the reply, got %q %v", buf[:n], err)
+	}
+
+	goodbye := false
+	mr.shutdown(func() { goodbye = true })
+	if !goodbye {
+		t.Error("Expected shutdown to send the goodbye")
+	}
+	select {
+	case <-mr.done:
+	default:
+		t.Error("Expected serve to have returned after shutdown")
+	}
+}
@@ -0,0 +1,54 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// joinIPv6Group adds ifi to the multicast groups conn receives
+func joinIPv6Group(conn *net.UDPConn, ifi *net.Interface, group net.IP) error {
+	mreq := &syscall.IPv6Mreq{Interface: uint32(ifi.Index)}
+	copy(mreq.Multiaddr[:], group.To16())
+
+	return controlSocket(conn, func(fd uintptr) error {
+		return syscall.SetsockoptIPv6Mreq(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+	})
+}
+
+// joinIPv4Group adds ifi, identified by its IPv4 address, to the multicast
+// groups conn receives
+func joinIPv4Group(conn *net.UDPConn, ifi *net.Interface, group net.IP) error {
+	local := interfaceIPv4(ifi)
+	if local == nil {
+		return fmt.Errorf("no IPv4 address on %s", ifi.Name)
+	}
+	mreq := &syscall.IPMreq{}
+	copy(mreq.Multiaddr[:], group.To4())
+	copy(mreq.Interface[:], local)
+
+	return controlSocket(conn, func(fd uintptr) error {
+		return syscall.SetsockoptIPMreq(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+	})
+}
+
+// setMulticastInterface makes conn send IPv4 multicast out of the interface
+// holding local
+func setMulticastInterface(conn *net.UDPConn, local net.IP) error {
+	var addr [4]byte
+	copy(addr[:], local.To4())
+
+	return controlSocket(conn, func(fd uintptr) error {
+		return syscall.SetsockoptInet4Addr(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, addr)
+	})
+}
+
+// setMulticastLoopback makes conn's IPv4 multicast reach this host's own
+// listeners too, which ListenMulticastUDP turns off
+func setMulticastLoopback(conn *net.UDPConn) error {
+	return controlSocket(conn, func(fd uintptr) error {
+		return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, 1)
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With tuner.relay_streams, the TunerProxy serves each device found through
+// the tunnel at http://<tuner proxy>:5004/devices/<DeviceID>/ on the app VLAN,
+// and rewrites discovery replies to point there. Requests are relayed through
+// the tunnel, and the AppProxy fetches them from the device.
+const (
+	relayPathPrefix = "/devices/"
+
+	// relayHeaderTimeout bounds how long a relayed request waits for the
+	// device's response header
+	relayHeaderTimeout = 10 * time.Second
+)
+
+// rememberRelayDevice records the real BaseURL of a device seen in discovery
+func (tp *TunerProxy) rememberRelayDevice(deviceID, baseURL string) {
+	tp.relayMutex.Lock()
+	defer tp.relayMutex.Unlock()
+	if tp.relayDevices == nil {
+		tp.relayDevices = make(map[string]string)
+	}
+	tp.relayDevices[deviceID] = baseURL
+}
+
+// relayDeviceBaseURL returns the real BaseURL of a device seen in discovery
+func (tp *TunerProxy) relayDeviceBaseURL(deviceID string) (string, bool) {
+	tp.relayMutex.Lock()
+	defer tp.relayMutex.Unlock()
+	baseURL, ok := tp.relayDevices[strings.ToUpper(deviceID)]
+	return baseURL, ok
+}
+
+// rewriteDiscoveryForRelay points a discover reply's BaseURL and LineupURL at
+// this proxy's relay endpoint for the device, as reached from appAddr or at
+// tuner.rewrite_base_url if set, and remembers where the device really is
+func (tp *TunerProxy) rewriteDiscoveryForRelay(reply []byte, appAddr *net.UDPAddr) []byte {
+	origin := tp.store.Get().Tuner.RewriteBaseURL
+	if origin == "" {
+		localIP, err := localIPForApp(appAddr)
+		if err != nil {
+			return reply
+		}
+		origin = net.JoinHostPort(localIP, strconv.Itoa(HDHRHTTPPort))
+	}
+
+	return rewriteDiscoveryURLs(reply, func(deviceID, rawURL string) string {
+		u, err := url.Parse(rawURL)
+		if deviceID == "" || err != nil || u.Host == "" {
+			return rawURL
+		}
+		tp.rememberRelayDevice(deviceID, u.Scheme+"://"+u.Host)
+		relayed := rewriteURLOrigin(rawURL, origin+relayPathPrefix+deviceID)
+		slog.Debug("Rewrote discovery reply for stream relay", "device_id", deviceID, "url", rawURL, "relay", relayed)
+		return relayed
+	})
+}
+
+// relayBaseURL is the BaseURL advertised for a relayed device
+func relayBaseURL(hostPort, deviceID string) string {
+	return "http://" + hostPort + relayPathPrefix + deviceID
+}
+
+// relayUpstreamURL maps a path below a relayed device's prefix to the URL on
+// the device itself: /auto streams on its stream port, everything else on its BaseURL
+func relayUpstreamURL(baseURL, path, rawQuery string) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid device BaseURL %q", baseURL)
+	}
+	if strings.HasPrefix(path, "/auto/") {
+		u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(HDHRHTTPPort))
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = rawQuery
+	return u.String(), nil
+}
+
+// rewriteRelayedBody replaces a device's own URLs in a discover.json or
+// lineup.json body with the relay's, so follow-up requests come back through us
+func rewriteRelayedBody(body []byte, baseURL, relayBase string) []byte {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return body
+	}
+	host := u.Hostname()
+	// One pass, longest origins first, so the relay's own URL is never rewritten again
+	r := strings.NewReplacer(
+		u.Scheme+"://"+net.JoinHostPort(host, strconv.Itoa(HDHRHTTPPort)), relayBase,
+		u.Scheme+"://"+net.JoinHostPort(host, "80"), relayBase,
+		strings.TrimSuffix(baseURL, "/"), relayBase,
+		u.Scheme+"://"+u.Host, relayBase,
+	)
+	return []byte(r.Replace(string(body)))
+}
+
+// serveRelay serves relayed devices on the app VLAN until ctx is cancelled
+func (tp *TunerProxy) serveRelay(ctx context.Context) {
+	addr := net.JoinHostPort("", strconv.Itoa(HDHRHTTPPort))
+	mux := http.NewServeMux()
+	mux.HandleFunc(relayPathPrefix, tp.handleRelayedRequest)
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutCtx) //nolint:errcheck
+	}()
+
+	slog.Info("Relaying device HTTP and streams through the tunnel", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("Stream relay server error", "err", err)
+	}
+}
+
+// handleRelayedRequest relays /devices/<DeviceID>/<path> to the device
+// through the tunnel
+func (tp *TunerProxy) handleRelayedRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, relayPathPrefix), "/")
+	path = "/" + path
+	baseURL, ok := tp.relayDeviceBaseURL(deviceID)
+	if !ok {
+		http.Error(w, "Unknown device", http.StatusNotFound)
+		return
+	}
+	upstream, err := relayUpstreamURL(baseURL, path, r.URL.RawQuery)
+	if err != nil {
+		http.Error(w, "Unknown device", http.StatusNotFound)
+		return
+	}
+
+	link := tp.getLink()
+	if link == nil || link.isLegacy() {
+		http.Error(w, "Stream relay not available", http.StatusBadGateway)
+		return
+	}
+	stream, err := tp.streams.open(upstream)
+	if err != nil {
+		http.Error(w, "Stream relay not available", http.StatusBadGateway)
+		return
+	}
+	defer tp.streams.finish(stream.id, true)
+	slog.Debug("Relaying request through tunnel", "client", r.RemoteAddr, "url", upstream, "stream", stream.id)
+
+	var header streamHeader
+	select {
+	case ev, ok := <-stream.events:
+		if !ok || ev.op != streamOpHeader || json.Unmarshal(ev.data, &header) != nil {
+			http.Error(w, "Device Not Reachable", http.StatusBadGateway)
+			return
+		}
+	case <-time.After(relayHeaderTimeout):
+		http.Error(w, "Device Not Reachable", http.StatusGatewayTimeout)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	if header.ContentType != "" {
+		w.Header().Set("Content-Type", header.ContentType)
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// Streams are passed straight through; documents are buffered so the
+	// device's own URLs can be pointed back at the relay
+	if strings.HasPrefix(path, "/auto/") {
+		w.WriteHeader(header.Status)
+		tp.copyRelayedStream(w, r, stream)
+		return
+	}
+
+	var body []byte
+	for ev := range stream.events {
+		body = append(body, ev.data...)
+	}
+	host := r.Host
+	if host == "" {
+		host = net.JoinHostPort("localhost", strconv.Itoa(HDHRHTTPPort))
+	}
+	body = rewriteRelayedBody(body, baseURL, relayBaseURL(host, strings.ToUpper(deviceID)))
+	w.WriteHeader(header.Status)
+	w.Write(body) //nolint:errcheck
+}
+
+// copyRelayedStream writes a relayed stream's body to the client until either ends
+func (tp *TunerProxy) copyRelayedStream(w http.ResponseWriter, r *http.Request, stream *relayedStream) {
+	flusher, _ := w.(http.Flusher)
+	for {
+		select {
+		case ev, ok := <-stream.events:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(ev.data); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
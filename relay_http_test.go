@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRewriteDiscoveryForRelay(t *testing.T) {
+	tp := NewTunerProxy(newConfigStore(DefaultConfig(), ""))
+	reply := (&DiscoverReply{
+		DeviceType: HDHRDeviceTypeTuner,
+		DeviceID:   0x1234ABCD,
+		TunerCount: 2,
+		BaseURL:    "http://10.0.0.5:80",
+		LineupURL:  "http://10.0.0.5:80/lineup.json",
+	}).Marshal()
+
+	rewritten, err := ParseDiscoverReply(tp.rewriteDiscoveryForRelay(reply, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	if err != nil {
+		t.Fatalf("rewritten reply doesn't parse (bad CRC?): %v", err)
+	}
+	if rewritten.BaseURL != "http://127.0.0.1:5004/devices/1234ABCD" {
+		t.Errorf("Unexpected BaseURL %q", rewritten.BaseURL)
+	}
+	if rewritten.LineupURL != rewritten.BaseURL+"/lineup.json" {
+		t.Errorf("Unexpected LineupURL %q", rewritten.LineupURL)
+	}
+	if rewritten.DeviceID != 0x1234ABCD || rewritten.TunerCount != 2 {
+		t.Errorf("Other fields not preserved: %+v", rewritten)
+	}
+	if base, ok := tp.relayDeviceBaseURL("1234abcd"); !ok || base != "http://10.0.0.5:80" {
+		t.Errorf("Expected device remembered, got %q, %v", base, ok)
+	}
+
+	text := []byte("DeviceID: 0000BEEF\r\nBaseURL: http://10.0.0.6\r\n")
+	if got := string(tp.rewriteDiscoveryForRelay(text, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})); got != "DeviceID: 0000BEEF\r\nBaseURL: http://127.0.0.1:5004/devices/0000BEEF\r\n" {
+		t.Errorf("Expected text reply pointed at the relay, got %q", got)
+	}
+}
+
+func TestRewriteDiscoveryForRelayUsesConfiguredOrigin(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Tuner.RewriteBaseURL = "https://tv.example.com"
+	tp := NewTunerProxy(newConfigStore(cfg, ""))
+	reply := (&DiscoverReply{DeviceType: HDHRDeviceTypeTuner, DeviceID: 0xBEEF, BaseURL: "http://10.0.0.6"}).Marshal()
+
+	got, err := ParseDiscoverReply(tp.rewriteDiscoveryForRelay(reply, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	if err != nil || got.BaseURL != "https://tv.example.com/devices/0000BEEF" {
+		t.Errorf("Expected relay behind the configured origin, got %+v, %v", got, err)
+	}
+}
+
+func TestRelayUpstreamURL(t *testing.T) {
+	tests := []struct{ base, path, query, want string }{
+		{"http://10.0.0.5:80", "/discover.json", "", "http://10.0.0.5:80/discover.json"},
+		{"http://10.0.0.5", "/auto/v5.1", "transcode=mobile", "http://10.0.0.5:5004/auto/v5.1?transcode=mobile"},
+		{"http://10.0.0.7:5004", "/lineup.json", "", "http://10.0.0.7:5004/lineup.json"},
+	}
+	for _, tt := range tests {
+		if got, err := relayUpstreamURL(tt.base, tt.path, tt.query); err != nil || got != tt.want {
+			t.Errorf("relayUpstreamURL(%q, %q) = %q, %v; want %q", tt.base, tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestRewriteRelayedBody(t *testing.T) {
+	body := `[{"GuideNumber":"5.1","URL":"http://10.0.0.5:5004/auto/v5.1"}] {"BaseURL":"http://10.0.0.5:80","LineupURL":"http://10.0.0.5:80/lineup.json"}`
+	got := string(rewriteRelayedBody([]byte(body), "http://10.0.0.5:80", "http://10.0.0.50:5004/devices/1234ABCD"))
+	want := `[{"GuideNumber":"5.1","URL":"http://10.0.0.50:5004/devices/1234ABCD/auto/v5.1"}] {"BaseURL":"http://10.0.0.50:5004/devices/1234ABCD","LineupURL":"http://10.0.0.50:5004/devices/1234ABCD/lineup.json"}`
+	if got != want {
+		t.Errorf("rewriteRelayedBody:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestTunerProxyRelaysDeviceHTTP(t *testing.T) {
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `[{"GuideNumber":"5.1","URL":"http://`+r.Host+`/auto/v5.1"}]`) //nolint:errcheck
+	}))
+	defer device.Close()
+
+	tp := NewTunerProxy(newConfigStore(DefaultConfig(), ""))
+	appSide, deviceSide := linkedStreamRelays(httpFetch)
+	tp.streams = appSide
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	tp.setLink(newTunnelLink(conn, ""))
+	tp.getLink().settle(false, tunnelHello{Version: tunnelProtocolVersion})
+	tp.rememberRelayDevice("1234ABCD", device.URL)
+
+	req := httptest.NewRequest(http.MethodGet, "/devices/1234ABCD/lineup.json", nil)
+	req.Host = "tuner-proxy:5004"
+	rec := httptest.NewRecorder()
+	tp.handleRelayedRequest(rec, req)
+
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected relayed JSON, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), `"URL":"http://tuner-proxy:5004/devices/1234ABCD/auto/v5.1"`) {
+		t.Errorf("Expected lineup URLs pointed at the relay, got %s", rec.Body.String())
+	}
+	waitForStreams(t, appSide, deviceSide)
+
+	rec = httptest.NewRecorder()
+	tp.handleRelayedRequest(rec, httptest.NewRequest(http.MethodGet, "/devices/FFFFFFFF/lineup.json", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an undiscovered device, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SSDP (UPnP Device Architecture 1.0, section 1) constants
+const (
+	ssdpPort = 1900
+
+	// ssdpMaxAge is how long, in seconds, clients may cache an advertisement;
+	// it is renewed at half that interval
+	ssdpMaxAge = 1800
+	// ssdpMaxDelay caps the MX delay before answering an M-SEARCH
+	ssdpMaxDelay = 5
+
+	// upnpDeviceType and upnpContentDirectoryType are what device.xml
+	// describes the emulated device and its one service as
+	upnpDeviceType           = "urn:schemas-upnp-org:device:MediaServer:1"
+	upnpContentDirectoryType = "urn:schemas-upnp-org:service:ContentDirectory:1"
+)
+
+var ssdpGroup = net.IPv4(239, 255, 255, 250)
+
+// deviceUDN returns the UPnP unique device name for a DeviceID: a name-based
+// UUID, so it stays the same across restarts
+func deviceUDN(deviceID string) string {
+	sum := sha1.Sum([]byte("hdhomerun:" + strings.ToUpper(deviceID)))
+	sum[6] = sum[6]&0x0F | 0x50 // version 5
+	sum[8] = sum[8]&0x3F | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// ssdpServer is the SERVER header value: OS, UPnP version and product
+var ssdpServer = runtime.GOOS + "/1.0 UPnP/1.0 hdhomerun_proxy/1.0"
+
+// ssdpAdvertisement is one notification type the device is announced as,
+// with the unique service name that goes with it
+type ssdpAdvertisement struct {
+	nt  string
+	usn string
+}
+
+// ssdpAdvertisements lists the root device, the device itself, its type and
+// its service, as UPnP requires a root device with one service to announce
+func ssdpAdvertisements(udn string) []ssdpAdvertisement {
+	return []ssdpAdvertisement{
+		{nt: "upnp:rootdevice", usn: udn + "::upnp:rootdevice"},
+		{nt: udn, usn: udn},
+		{nt: upnpDeviceType, usn: udn + "::" + upnpDeviceType},
+		{nt: upnpContentDirectoryType, usn: udn + "::" + upnpContentDirectoryType},
+	}
+}
+
+// ssdpResponder announces the emulated device's device.xml over SSDP and
+// answers M-SEARCH requests for it, so UPnP clients find the device
+type ssdpResponder struct {
+	*multicastResponder
+	router *backendRouter
+}
+
+// newSSDPResponder creates an SSDP responder for the named interfaces
+func newSSDPResponder(router *backendRouter, names []string) *ssdpResponder {
+	group := &net.UDPAddr{IP: ssdpGroup, Port: ssdpPort}
+	return &ssdpResponder{multicastResponder: newMulticastResponder("SSDP", group, names), router: router}
+}
+
+// start joins the SSDP group on the interfaces, announces the device and
+// answers searches until stop is called
+func (s *ssdpResponder) start() error {
+	joined, err := s.listen(s.handle, func() {
+		ticker := time.NewTicker(ssdpMaxAge / 2 * time.Second)
+		defer ticker.Stop()
+		for {
+			s.notify("ssdp:alive")
+			select {
+			case <-s.stopped:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("Advertising device over SSDP", "device_type", upnpDeviceType, "interfaces", joined)
+	return nil
+}
+
+// stop withdraws the advertisement with a byebye and closes the socket
+func (s *ssdpResponder) stop() {
+	s.shutdown(func() { s.notify("ssdp:byebye") })
+}
+
+// handle answers an M-SEARCH from a host on one of our subnets, after the
+// random delay of up to MX seconds the searcher asked for
+func (s *ssdpResponder) handle(data []byte, from *net.UDPAddr) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil || req.Method != "M-SEARCH" || req.Header.Get("MAN") != `"ssdp:discover"` {
+		return
+	}
+	target := targetFor(s.targets, from.IP)
+	if target == nil {
+		return
+	}
+
+	location, udn := s.advertised(target.local)
+	st := req.Header.Get("ST")
+	var matched []ssdpAdvertisement
+	for _, ad := range ssdpAdvertisements(udn) {
+		if st == "ssdp:all" || strings.EqualFold(st, ad.nt) {
+			matched = append(matched, ad)
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+
+	var delay time.Duration
+	if mx, err := strconv.Atoi(req.Header.Get("MX")); err == nil && mx > 0 {
+		delay = rand.N(time.Duration(min(mx, ssdpMaxDelay)) * time.Second)
+	}
+	go func() {
+		select {
+		case <-s.stopped:
+			return
+		case <-time.After(delay):
+		}
+		for _, ad := range matched {
+			resp := "HTTP/1.1 200 OK\r\n" +
+				fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", ssdpMaxAge) +
+				"EXT:\r\n" +
+				"LOCATION: " + location + "\r\n" +
+				"SERVER: " + ssdpServer + "\r\n" +
+				"ST: " + ad.nt + "\r\n" +
+				"USN: " + ad.usn + "\r\n\r\n"
+			s.send([]byte(resp), from, nil)
+		}
+		slog.Debug("Answered SSDP search", "source", from.String(), "st", st)
+	}()
+}
+
+// notify multicasts every advertisement on every interface with the given
+// NTS, ssdp:alive or ssdp:byebye
+func (s *ssdpResponder) notify(nts string) {
+	for _, t := range s.targets {
+		location, udn := s.advertised(t.local)
+		for _, ad := range ssdpAdvertisements(udn) {
+			msg := "NOTIFY * HTTP/1.1\r\n" +
+				fmt.Sprintf("HOST: %s\r\n", s.group)
+			if nts == "ssdp:alive" {
+				msg += fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", ssdpMaxAge) +
+					"LOCATION: " + location + "\r\n" +
+					"SERVER: " + ssdpServer + "\r\n"
+			}
+			msg += "NT: " + ad.nt + "\r\n" +
+				"NTS: " + nts + "\r\n" +
+				"USN: " + ad.usn + "\r\n\r\n"
+			s.send([]byte(msg), s.group, t.local)
+		}
+	}
+}
+
+// advertised returns the device.xml URL for clients reaching us at local,
+// from the same BaseURL discovery replies advertise, and the device's UDN
+func (s *ssdpResponder) advertised(local net.IP) (location, udn string) {
+	reply := s.router.buildDiscoveryReply(local.String())
+	return reply.BaseURL + "/device.xml", deviceUDN(fmt.Sprintf("%08X", reply.DeviceID))
+}
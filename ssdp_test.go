@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeviceUDN(t *testing.T) {
+	udn := deviceUDN("1010ABCD")
+	if !regexp.MustCompile(`^uuid:[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(udn) {
+		t.Errorf("Expected a version 5 UUID, got %q", udn)
+	}
+	if deviceUDN("1010abcd") != udn {
+		t.Error("Expected the UDN not to depend on the DeviceID's case")
+	}
+	if deviceUDN("1020ABCD") == udn {
+		t.Error("Expected different devices to get different UDNs")
+	}
+}
+
+// newLoopbackSSDPResponder returns a responder answering on 127.0.0.1 as if
+// the loopback subnet were an advertised interface, and a searcher socket
+func newLoopbackSSDPResponder(t *testing.T) (*ssdpResponder, *net.UDPConn) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	searcher, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { searcher.Close() })
+
+	ap := NewAppProxy(newConfigStore(DefaultConfig(), ""))
+	s := newSSDPResponder(&ap.backendRouter, nil)
+	s.conn = conn
+	s.stopped = make(chan struct{})
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s.targets = []discoveryTarget{{iface: "lo", subnet: loopback, local: net.IPv4(127, 0, 0, 1)}}
+	return s, searcher
+}
+
+// readSSDPResponses collects what the searcher receives until it goes quiet
+func readSSDPResponses(searcher *net.UDPConn) []string {
+	var out []string
+	buf := make([]byte, 1500)
+	for {
+		searcher.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		n, err := searcher.Read(buf)
+		if err != nil {
+			return out
+		}
+		out = append(out, string(buf[:n]))
+	}
+}
+
+func mSearch(st string) []byte {
+	return []byte("M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nST: " + st + "\r\n\r\n")
+}
+
+func TestSSDPAnswersMSearch(t *testing.T) {
+	s, searcher := newLoopbackSSDPResponder(t)
+	from := searcher.LocalAddr().(*net.UDPAddr)
+	udn := deviceUDN(ResolveDeviceIdentity(DefaultConfig()).DeviceID)
+
+	s.handle(mSearch("upnp:rootdevice"), from)
+	got := readSSDPResponses(searcher)
+	if len(got) != 1 {
+		t.Fatalf("Expected one response, got %q", got)
+	}
+	for _, want := range []string{
+		"HTTP/1.1 200 OK\r\n",
+		"LOCATION: http://127.0.0.1:5004/device.xml\r\n",
+		"ST: upnp:rootdevice\r\n",
+		"USN: " + udn + "::upnp:rootdevice\r\n",
+	} {
+		if !strings.Contains(got[0], want) {
+			t.Errorf("Expected response to contain %q, got %q", want, got[0])
+		}
+	}
+
+	s.handle(mSearch("ssdp:all"), from)
+	if got := readSSDPResponses(searcher); len(got) != 4 {
+		t.Errorf("Expected a response per advertisement for ssdp:all, got %d", len(got))
+	}
+
+	s.handle(mSearch("urn:schemas-upnp-org:device:MediaRenderer:1"), from)
+	if got := readSSDPResponses(searcher); len(got) != 0 {
+		t.Errorf("Expected no response for another device type, got %q", got)
+	}
+}
+
+func TestSSDPIgnoresOtherSubnets(t *testing.T) {
+	s, searcher := newLoopbackSSDPResponder(t)
+	_, other, _ := net.ParseCIDR("192.168.1.0/24")
+	s.targets[0].subnet = other
+
+	s.handle(mSearch("ssdp:all"), searcher.LocalAddr().(*net.UDPAddr))
+	if got := readSSDPResponses(searcher); len(got) != 0 {
+		t.Errorf("Expected searches from outside the advertised subnets to be ignored, got %q", got)
+	}
+}
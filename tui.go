@@ -39,6 +39,7 @@ var (
 			Foreground(lipgloss.Color("240"))
 
 	greenDot = lipgloss.NewStyle().Foreground(lipgloss.Color("76")).Render("●")
+	redDot   = lipgloss.NewStyle().Foreground(lipgloss.Color("196")).Render("●")
 
 	sidebarStyle = lipgloss.NewStyle().
 			Width(sidebarInnerWidth).
@@ -151,13 +152,59 @@ func (m tuiModel) renderSidebar() string {
 	b.WriteString(fmt.Sprintf("Dial  %s\n", valueStyle.Render(fmt.Sprintf("%d", m.stats.ActiveDial))))
 	b.WriteString(fmt.Sprintf("Total %s\n", valueStyle.Render(fmt.Sprintf("%d", m.stats.ActiveUDP+m.stats.ActiveDial))))
 
-	if m.stats.DirectHDHRIP != "" || m.stats.TunarrConfigured {
-		b.WriteString("\n" + labelStyle.Render("BACKENDS") + "\n")
-		if m.stats.DirectHDHRIP != "" {
-			b.WriteString(greenDot + " HDHR " + dimStyle.Render(m.stats.DirectHDHRIP) + "\n")
+	if len(m.stats.TunerProxies) > 0 {
+		b.WriteString("\n" + labelStyle.Render("TUNER PROXIES") + "\n")
+		for _, tp := range m.stats.TunerProxies {
+			b.WriteString(greenDot + " " + valueStyle.Render(tp.RemoteAddr) + "\n")
+			b.WriteString(dimStyle.Render(fmt.Sprintf("  v%d q%d r%d c%d s%d", tp.Protocol, tp.Queries, tp.Replies, tp.Controls, tp.Streams)) + "\n")
 		}
-		if m.stats.TunarrConfigured {
-			b.WriteString(greenDot + " Tunarr " + dimStyle.Render(fmt.Sprintf(":%d", m.stats.TunarrPort)) + "\n")
+	}
+
+	if len(m.stats.Discovered) > 0 {
+		b.WriteString("\n" + labelStyle.Render("DISCOVERED") + "\n")
+		for _, d := range m.stats.Discovered {
+			b.WriteString(greenDot + " " + valueStyle.Render(d.DeviceID) + " " + dimStyle.Render(d.IP) + "\n")
+			via := d.Interface
+			if via == "" {
+				via = "?"
+			}
+			b.WriteString(dimStyle.Render("  via "+via+", seen "+formatLastSeen(d.LastSeen)) + "\n")
+		}
+	}
+
+	if len(m.stats.Backends) > 0 {
+		b.WriteString("\n" + labelStyle.Render("BACKENDS") + "\n")
+		for _, be := range m.stats.Backends {
+			dot := greenDot
+			if !be.Healthy {
+				dot = redDot
+			}
+			b.WriteString(dot + " " + be.Name + " " + dimStyle.Render(fmt.Sprintf("p%d %s", be.Priority, be.Fallback)) + "\n")
+			if len(be.Devices) == 0 && be.Detail != "" {
+				b.WriteString(dimStyle.Render("  "+be.Detail) + "\n")
+			}
+			for _, d := range be.Devices {
+				dot := greenDot
+				if !d.Healthy {
+					dot = redDot
+				}
+				b.WriteString("  " + dot + " " + dimStyle.Render(d.IP) + "\n")
+				b.WriteString(dimStyle.Render("    seen "+formatLastSeen(d.LastSeen)) + "\n")
+				if d.TunerCount > 0 {
+					b.WriteString(dimStyle.Render(fmt.Sprintf("    tuners %d/%d", d.TunersInUse, d.TunerCount)) + "\n")
+				}
+			}
+			if be.Sync != nil {
+				sync := "synced " + formatLastSeen(be.Sync.LastSync)
+				if be.Sync.Syncing {
+					sync = "syncing"
+				}
+				d := be.Sync.LastDiff
+				b.WriteString(dimStyle.Render(fmt.Sprintf("  %s, %d ch", sync, be.Sync.Channels)) + "\n")
+				if !be.Sync.LastChange.IsZero() {
+					b.WriteString(dimStyle.Render(fmt.Sprintf("  +%d -%d ~%d %s", len(d.Added), len(d.Removed), len(d.Renamed), formatLastSeen(be.Sync.LastChange))) + "\n")
+				}
+			}
 		}
 	}
 
@@ -223,3 +270,11 @@ func runWithTUI(ctx context.Context, cancel context.CancelFunc, proxy statsProvi
 	}
 	cancel()
 }
+
+// formatLastSeen renders how long ago a device last answered, or "never"
+func formatLastSeen(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return time.Since(t).Truncate(time.Second).String() + " ago"
+}
@@ -8,15 +8,23 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 )
 
-// TunarrBackend communicates with a Tunarr server via HTTP API
+// TunarrBackend communicates with a Tunarr server via HTTP API. As a Backend
+// it is served from the emulated device's own endpoints.
 type TunarrBackend struct {
+	name       string
 	host       string
 	port       int
 	baseURL    string
 	httpClient *http.Client
+
+	mu         sync.Mutex
+	healthy    bool
+	streamURLs map[string]string // GuideNumber -> stream URL from the last lineup; nil until fetched
 }
 
 // TunarrDiscoverResponse matches Tunarr's discover.json endpoint
@@ -36,6 +44,10 @@ type TunarrLineupItem struct {
 	GuideName   string `json:"GuideName"`
 	URL         string `json:"URL"`
 	HDHRNumber  string `json:"HDHRNumber"`
+	HD          int    `json:"HD,omitempty"`
+	Favorite    int    `json:"Favorite,omitempty"`
+	GuideID     string `json:"-"` // XMLTV channel ID the backend publishes for the channel, if any
+	Hidden      bool   `json:"-"` // hidden by a channel rule: listed only by ?show=all
 }
 
 // TunarrTunerStatus represents a tuner's status
@@ -56,9 +68,11 @@ func NewTunarrBackend(host string, port int, timeout int) *TunarrBackend {
 	}
 
 	return &TunarrBackend{
+		name:    backendTypeTunarr,
+		healthy: true,
 		host:    host,
 		port:    port,
-		baseURL: fmt.Sprintf("http://%s:%d", host, port),
+		baseURL: "http://" + net.JoinHostPort(host, strconv.Itoa(port)),
 		httpClient: &http.Client{
 			Timeout: time.Duration(timeout) * time.Second,
 		},
@@ -77,10 +91,12 @@ func (tb *TunarrBackend) IsAvailable(ctx context.Context) bool {
 	resp, err := tb.httpClient.Do(req)
 	if err != nil {
 		slog.Debug("Tunarr server not available", "err", err)
+		tb.setHealthy(false)
 		return false
 	}
 	defer resp.Body.Close()
 
+	tb.setHealthy(resp.StatusCode == http.StatusOK)
 	return resp.StatusCode == http.StatusOK
 }
 
@@ -143,6 +159,94 @@ func (tb *TunarrBackend) GetLineup(ctx context.Context) ([]TunarrLineupItem, err
 	return lineup, nil
 }
 
+// Name identifies the backend in logs and stats
+func (tb *TunarrBackend) Name() string { return tb.name }
+
+// Start checks that Tunarr is reachable
+func (tb *TunarrBackend) Start(ctx context.Context) error {
+	if !tb.IsAvailable(ctx) {
+		return fmt.Errorf("tunarr not available at %s", tb.baseURL)
+	}
+	slog.Info("Tunarr backend available", "host", tb.host, "port", tb.port)
+	return nil
+}
+
+// Discover answers as the emulated device, whose endpoints serve Tunarr's lineup
+func (tb *TunarrBackend) Discover(ctx context.Context, q *discoveryQuery) bool {
+	return q.answerAsEmulatedDevice()
+}
+
+// Lineup fetches Tunarr's lineup, remembering the stream URL it publishes for each channel
+func (tb *TunarrBackend) Lineup(ctx context.Context) ([]TunarrLineupItem, error) {
+	lineup, err := tb.GetLineup(ctx)
+	tb.setHealthy(err == nil)
+	if err != nil {
+		return nil, err
+	}
+
+	urls := make(map[string]string, len(lineup))
+	for _, item := range lineup {
+		if item.GuideNumber != "" {
+			urls[item.GuideNumber] = item.URL
+		}
+	}
+	tb.mu.Lock()
+	tb.streamURLs = urls
+	tb.mu.Unlock()
+	return lineup, nil
+}
+
+// TunerCount is unknown: Tunarr allocates its own tuners
+func (tb *TunarrBackend) TunerCount() int { return 0 }
+
+// OpenStream returns the URL Tunarr published for channel, falling back to
+// its /watch endpoint. Once a lineup has been fetched, channels missing from
+// it are left to the next backend.
+func (tb *TunarrBackend) OpenStream(channel string) (string, func(), error) {
+	tb.mu.Lock()
+	url, ok := tb.streamURLs[channel]
+	fetched := tb.streamURLs != nil
+	tb.mu.Unlock()
+
+	if fetched && !ok {
+		return "", nil, errChannelNotCarried
+	}
+	if url == "" {
+		url = tb.GetStreamURL(channel)
+	}
+	return url, func() {}, nil
+}
+
+// GuideURL is Tunarr's XMLTV guide for its channels
+func (tb *TunarrBackend) GuideURL() string {
+	return tb.baseURL + "/api/xmltv.xml"
+}
+
+// Healthy reports whether Tunarr answered the last availability check or lineup fetch
+func (tb *TunarrBackend) Healthy() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.healthy
+}
+
+func (tb *TunarrBackend) setHealthy(healthy bool) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.healthy && !healthy {
+		slog.Warn("Tunarr backend unavailable", "backend", tb.name, "url", tb.baseURL)
+	}
+	tb.healthy = healthy
+}
+
+func (tb *TunarrBackend) Stats() BackendStats {
+	return BackendStats{
+		Name:    tb.name,
+		Type:    backendTypeTunarr,
+		Healthy: tb.Healthy(),
+		Detail:  net.JoinHostPort(tb.host, strconv.Itoa(tb.port)),
+	}
+}
+
 // GetLineupStatus retrieves lineup status from Tunarr
 func (tb *TunarrBackend) GetLineupStatus(ctx context.Context) (map[string]interface{}, error) {
 	statusURL := fmt.Sprintf("%s/lineup_status.json", tb.baseURL)
@@ -238,8 +342,9 @@ func ConvertLineupToHDHRFormat(lineup []TunarrLineupItem) string {
 func BuildHDHRDiscoveryPacket(tunarrInfo *TunarrDiscoverResponse, tunarPort int, srcIP string) []byte {
 	response := fmt.Sprintf("Device: HDHR3-US\r\n")
 	response += fmt.Sprintf("DeviceAuth: 00000000\r\n")
-	response += fmt.Sprintf("BaseURL: http://%s:%d\r\n", srcIP, tunarPort)
-	response += fmt.Sprintf("LineupURL: http://%s:%d/lineup.json\r\n", srcIP, tunarPort)
+	hostPort := net.JoinHostPort(srcIP, strconv.Itoa(tunarPort))
+	response += fmt.Sprintf("BaseURL: http://%s\r\n", hostPort)
+	response += fmt.Sprintf("LineupURL: http://%s/lineup.json\r\n", hostPort)
 	response += fmt.Sprintf("TunerCount: %d\r\n", tunarrInfo.TunerCount)
 	response += fmt.Sprintf("FirmwareName: http_live\r\n")
 	response += fmt.Sprintf("FirmwareVersion: 20191217\r\n")
@@ -247,15 +352,3 @@ func BuildHDHRDiscoveryPacket(tunarrInfo *TunarrDiscoverResponse, tunarPort int,
 
 	return []byte(response)
 }
-
-// GetLocalIPForConnection returns the local IP address that would be used to connect to a given address
-// This is useful for building responses with the correct source IP
-func GetLocalIPForConnection(remoteAddr string) (string, error) {
-	conn, err := net.Dial("udp", remoteAddr)
-	if err != nil {
-		return "", err
-	}
-	defer conn.Close()
-
-	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
-}
@@ -2,6 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -55,3 +60,39 @@ func TestBuildHDHRDiscoveryPacketNoDuplicateBaseURL(t *testing.T) {
 		t.Errorf("expected 1 BaseURL field, got %d", count)
 	}
 }
+
+func TestTunarrBackendStreamsFromPublishedLineup(t *testing.T) {
+	tunarr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/lineup.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[{"GuideNumber":"100","GuideName":"Movies","URL":"http://tunarr:8000/stream/100"},{"GuideNumber":"101","GuideName":"News"}]`)) //nolint:errcheck
+	}))
+	u, _ := url.Parse(tunarr.URL)
+	port, _ := strconv.Atoi(u.Port())
+	tb := NewTunarrBackend(u.Hostname(), port, 1)
+
+	// Before a lineup is known every channel is assumed carried
+	if got, _, err := tb.OpenStream("999"); err != nil || got != tb.baseURL+"/watch/999" {
+		t.Errorf("Expected /watch fallback before the lineup is fetched, got %q, %v", got, err)
+	}
+
+	if _, err := tb.Lineup(context.Background()); err != nil {
+		t.Fatalf("Lineup error: %v", err)
+	}
+	if got, _, err := tb.OpenStream("100"); err != nil || got != "http://tunarr:8000/stream/100" {
+		t.Errorf("Expected the published stream URL, got %q, %v", got, err)
+	}
+	if got, _, err := tb.OpenStream("101"); err != nil || got != tb.baseURL+"/watch/101" {
+		t.Errorf("Expected /watch for a channel without a URL, got %q, %v", got, err)
+	}
+	if _, _, err := tb.OpenStream("999"); !errors.Is(err, errChannelNotCarried) {
+		t.Errorf("Expected a channel missing from the lineup to be left to other backends, got %v", err)
+	}
+
+	tunarr.Close()
+	if _, err := tb.Lineup(context.Background()); err == nil || tb.Healthy() {
+		t.Error("Expected Tunarr to turn unhealthy once its lineup can't be fetched")
+	}
+}
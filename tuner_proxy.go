@@ -2,7 +2,8 @@ package main
 
 import (
 	"context"
-	"encoding/binary"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
@@ -14,18 +15,21 @@ import (
 
 // TunerProxy acts like an HDHomeRun tuner
 type TunerProxy struct {
-	codec        *MessageCodec
-	tcpTransport net.Conn
-	tcpMutex     sync.Mutex
+	link         *tunnelLink // connection to the app proxy once its handshake settles
+	linkMutex    sync.Mutex
+	tunnelTLS    *tls.Config // set when the tunnel runs over mutual TLS
 	udpTransport *net.UDPConn
 	udpMutex     sync.Mutex
+	controls     *controlRelay
+	streams      *streamRelay
+	relayDevices map[string]string // DeviceID -> real BaseURL, for tuner.relay_streams
+	relayMutex   sync.Mutex
 	backendRouter
 }
 
 // NewTunerProxy creates a new TunerProxy
 func NewTunerProxy(store *configStore) *TunerProxy {
-	return &TunerProxy{
-		codec: NewMessageCodec(),
+	tp := &TunerProxy{
 		backendRouter: backendRouter{
 			name:  "TunerProxy",
 			store: store,
@@ -34,27 +38,31 @@ func NewTunerProxy(store *configStore) *TunerProxy {
 			},
 		},
 	}
+	tp.controls = newControlRelay(func(id uint16, op byte, data []byte) error {
+		return tp.sendToAppProxy(tunnelMsgControl, uint32(id), encodeOpPayload(op, data))
+	}, nil)
+	tp.streams = newStreamRelay(func(id uint32, op byte, data []byte) error {
+		return tp.sendToAppProxy(tunnelMsgStream, id, encodeOpPayload(op, data))
+	}, nil)
+	return tp
 }
 
 // Run starts the tuner proxy
-// appProxyHostOrIP: app proxy hostname (tuner proxy mode) or HDHomeRun IP (direct mode)
+// appProxyHostOrIP: app proxy hostname (tuner proxy mode) or comma-separated HDHomeRun IPs (direct mode)
 // isDirectMode: if true, appProxyHostOrIP is treated as direct HDHomeRun IP
 // cfg: configuration object for tuning parameters
 func (tp *TunerProxy) Run(ctx context.Context, appProxyHostOrIP string, isDirectMode bool, store *configStore) error {
 	cfg := store.Get()
-	tp.useTunarrOnly = cfg.Tunarr.UseTunarrOnly
 
-	// Initialize Tunarr backend if enabled
-	if cfg.Tunarr.Enabled {
-		tp.tunarr = NewTunarrBackend(cfg.Tunarr.Host, cfg.Tunarr.Port, cfg.Tunarr.HttpTimeout)
-		if tp.tunarr.IsAvailable(ctx) {
-			slog.Info("Tunarr backend available", "host", cfg.Tunarr.Host, "port", cfg.Tunarr.Port)
-		} else {
-			slog.Warn("Tunarr backend not available", "host", cfg.Tunarr.Host, "port", cfg.Tunarr.Port)
-			if cfg.Tunarr.UseTunarrOnly {
-				return fmt.Errorf("tunarr backend required but not available")
-			}
-		}
+	var directIPs []string
+	if isDirectMode {
+		directIPs = splitIPList(appProxyHostOrIP)
+	}
+	if err := tp.useBackends(cfg.BackendConfigs(directIPs, false)); err != nil {
+		return err
+	}
+	if err := tp.startBackends(ctx); err != nil {
+		return err
 	}
 
 	if store.Get().LogActiveConnectionsInterval > 0 {
@@ -62,7 +70,6 @@ func (tp *TunerProxy) Run(ctx context.Context, appProxyHostOrIP string, isDirect
 	}
 
 	if isDirectMode {
-		tp.directHDHRIP = appProxyHostOrIP
 		return tp.runDirectMode(ctx, cfg)
 	} else {
 		return tp.runTunerProxyMode(ctx, appProxyHostOrIP, cfg)
@@ -79,12 +86,12 @@ func (tp *TunerProxy) runDirectMode(ctx context.Context, cfg *Config) error {
 		bindAddr = "255.255.255.255"
 	}
 
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", bindAddr, HDHomeRunDiscoveryUDPPort))
+	addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", bindAddr, HDHomeRunDiscoveryUDPPort))
 	if err != nil {
 		return fmt.Errorf("failed to resolve UDP address: %w", err)
 	}
 
-	udpConn, err := net.ListenUDP("udp", addr)
+	udpConn, err := net.ListenUDP("udp4", addr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on UDP: %w", err)
 	}
@@ -94,7 +101,14 @@ func (tp *TunerProxy) runDirectMode(ctx context.Context, cfg *Config) error {
 	tp.udpTransport = udpConn
 	tp.udpMutex.Unlock()
 
-	slog.Info("Tuner proxy listening for broadcasts (direct mode)", "bind_addr", bindAddr, "direct_hdhomerun_ip", tp.directHDHRIP)
+	slog.Info("Tuner proxy listening for broadcasts (direct mode)", "bind_addr", bindAddr, "backends", tp.backendNames())
+
+	if err := listenDiscoveryIPv6(ctx, func(data []byte, from *net.UDPAddr, conn *net.UDPConn) {
+		slog.Debug("Request received from app (direct mode)", "bytes", len(data), "source", from.String())
+		go tp.forwardToBackend(data, from, conn, ctx)
+	}); err != nil {
+		slog.Warn("IPv6 discovery not started", "err", err)
+	}
 
 	buf := make([]byte, UDPReadBufferSize)
 
@@ -126,13 +140,22 @@ func (tp *TunerProxy) runDirectMode(ctx context.Context, cfg *Config) error {
 			slog.Debug("Request received from app (direct mode)", "bytes", n, "source", fmt.Sprintf("%s:%d", ip, port))
 
 			// Forward the query to HDHR or Tunarr backend and reply back
-			go tp.forwardToBackend(buf[:n], remoteAddr, udpConn, ctx)
+			go tp.forwardToBackend(append([]byte(nil), buf[:n]...), remoteAddr, udpConn, ctx)
 		}
 	}
 }
 
 // runTunerProxyMode connects to app proxy and relays broadcasts
 func (tp *TunerProxy) runTunerProxyMode(ctx context.Context, appProxyHost string, cfg *Config) error {
+	tlsCfg, err := loadTunnelTLS(cfg, false)
+	if err != nil {
+		return err
+	}
+	if tlsCfg != nil && tlsCfg.ServerName == "" {
+		tlsCfg.ServerName = appProxyHost
+	}
+	tp.tunnelTLS = tlsCfg
+
 	// Create UDP listener for broadcast packets
 	var bindAddr string
 	if runtime.GOOS == "windows" {
@@ -141,12 +164,12 @@ func (tp *TunerProxy) runTunerProxyMode(ctx context.Context, appProxyHost string
 		bindAddr = "255.255.255.255"
 	}
 
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", bindAddr, HDHomeRunDiscoveryUDPPort))
+	addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", bindAddr, HDHomeRunDiscoveryUDPPort))
 	if err != nil {
 		return fmt.Errorf("failed to resolve UDP address: %w", err)
 	}
 
-	udpConn, err := net.ListenUDP("udp", addr)
+	udpConn, err := net.ListenUDP("udp4", addr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on UDP: %w", err)
 	}
@@ -160,6 +183,18 @@ func (tp *TunerProxy) runTunerProxyMode(ctx context.Context, appProxyHost string
 
 	// Start UDP listener goroutine
 	go tp.handleUDPBroadcasts(ctx)
+	if err := listenDiscoveryIPv6(ctx, func(data []byte, from *net.UDPAddr, _ *net.UDPConn) {
+		tp.relayQuery(data, from)
+	}); err != nil {
+		slog.Warn("IPv6 discovery not started", "err", err)
+	}
+
+	// Apps that found a device through us open control sessions to us too
+	go tp.listenControl(ctx)
+
+	if cfg.Tuner.RelayStreams {
+		go tp.serveRelay(ctx)
+	}
 
 	// Keep trying to connect to app proxy
 	ticker := time.NewTicker(time.Duration(cfg.GetReconnectInterval()) * time.Second)
@@ -171,7 +206,7 @@ func (tp *TunerProxy) runTunerProxyMode(ctx context.Context, appProxyHost string
 			tp.closeTCP()
 			return nil
 		case <-ticker.C:
-			if tp.getTCPTransport() == nil {
+			if tp.getLink() == nil {
 				slog.Info("Connecting to app proxy", "host", appProxyHost)
 				if err := tp.connectToAppProxy(ctx, appProxyHost); err != nil {
 					slog.Error("Failed to connect to app proxy", "err", err)
@@ -188,31 +223,91 @@ func (tp *TunerProxy) runTunerProxyMode(ctx context.Context, appProxyHost string
 	}
 }
 
-// getTCPTransport safely gets the TCP transport
-func (tp *TunerProxy) getTCPTransport() net.Conn {
-	tp.tcpMutex.Lock()
-	defer tp.tcpMutex.Unlock()
-	return tp.tcpTransport
+// getLink safely gets the link to the app proxy
+func (tp *TunerProxy) getLink() *tunnelLink {
+	tp.linkMutex.Lock()
+	defer tp.linkMutex.Unlock()
+	return tp.link
 }
 
-// setTCPTransport safely sets the TCP transport
-func (tp *TunerProxy) setTCPTransport(conn net.Conn) {
-	tp.tcpMutex.Lock()
-	defer tp.tcpMutex.Unlock()
-	tp.tcpTransport = conn
+// setLink safely sets the link to the app proxy
+func (tp *TunerProxy) setLink(link *tunnelLink) {
+	tp.linkMutex.Lock()
+	defer tp.linkMutex.Unlock()
+	tp.link = link
 }
 
-// closeTCP safely closes the TCP transport
+// closeTCP safely closes the link to the app proxy
 func (tp *TunerProxy) closeTCP() {
-	tp.tcpMutex.Lock()
-	defer tp.tcpMutex.Unlock()
-	if tp.tcpTransport != nil {
-		tp.tcpTransport.Close()
-		tp.tcpTransport = nil
+	tp.linkMutex.Lock()
+	defer tp.linkMutex.Unlock()
+	if tp.link != nil {
+		tp.link.conn.Close()
+		tp.link = nil
+		tp.controls.closeAll()
+		tp.streams.closeAll()
+	}
+}
+
+// sendToAppProxy writes a frame to the app proxy
+func (tp *TunerProxy) sendToAppProxy(typ byte, channel uint32, payload []byte) error {
+	link := tp.getLink()
+	if link == nil {
+		return fmt.Errorf("not connected to app proxy")
+	}
+
+	err := link.send(typ, channel, payload)
+	if err != nil && err != errTunnelLegacyPeer {
+		tp.closeTCP()
+	}
+	return err
+}
+
+// listenControl accepts HDHomeRun control-protocol connections from apps and
+// relays each one through the tunnel to the device behind the app proxy
+func (tp *TunerProxy) listenControl(ctx context.Context) {
+	addr := fmt.Sprintf(":%d", HDHomeRunControlTCPPort)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Warn("Control protocol relay not started", "addr", addr, "err", err)
+		return
+	}
+	slog.Info("Relaying control protocol connections", "addr", addr)
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+				slog.Error("Error accepting control connection", "err", err)
+			}
+			continue
+		}
+
+		link := tp.getLink()
+		if link == nil {
+			slog.Debug("Rejecting control connection, not connected to app proxy", "client", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		if link.isLegacy() {
+			slog.Debug("Rejecting control connection, app proxy speaks the legacy tunnel protocol", "client", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		tp.controls.attach(conn)
 	}
 }
 
-// connectToAppProxy connects to the app proxy and handles the connection
+// connectToAppProxy connects to the app proxy, performs the tunnel handshake
+// and handles the connection
 func (tp *TunerProxy) connectToAppProxy(ctx context.Context, appProxyHost string) error {
 	addr := net.JoinHostPort(appProxyHost, fmt.Sprintf("%d", TCPPort))
 	conn, err := net.Dial("tcp", addr)
@@ -220,12 +315,32 @@ func (tp *TunerProxy) connectToAppProxy(ctx context.Context, appProxyHost string
 		return err
 	}
 
-	tp.setTCPTransport(conn)
+	if tp.tunnelTLS != nil {
+		tlsConn := tls.Client(conn, tp.tunnelTLS)
+		tlsConn.SetDeadline(time.Now().Add(tunnelHelloTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return fmt.Errorf("TLS handshake with app proxy: %w", err)
+		}
+		tlsConn.SetDeadline(time.Time{})
+		slog.Debug("App proxy presented certificate", "name", tlsPeerName(tlsConn))
+		conn = tlsConn
+	}
+
+	link := newTunnelLink(conn, tp.store.Get().Tunnel.PSK)
+	if err := link.sendHello("TunerProxy"); err != nil {
+		conn.Close()
+		return err
+	}
 	peername := conn.RemoteAddr()
 	slog.Info("Connected to app proxy", "addr", peername)
 
+	interval := time.Duration(tp.store.Get().GetTunnelKeepaliveSeconds()) * time.Second
+	done := make(chan struct{})
+
 	// Handle the connection in a separate goroutine
 	go func() {
+		defer close(done)
 		codec := NewMessageCodec()
 		buf := make([]byte, UDPReadBufferSize)
 
@@ -237,27 +352,48 @@ func (tp *TunerProxy) connectToAppProxy(ctx context.Context, appProxyHost string
 			default:
 			}
 
+			if link.isSettled() {
+				link.extendDeadline(keepaliveTimeout(interval))
+			}
 			n, err := conn.Read(buf)
 			if err != nil {
-				slog.Info("Disconnected from app proxy")
+				slog.Info("Disconnected from app proxy", "err", err)
+				conn.Close()
 				tp.closeTCP()
 				return
 			}
 
 			if n > 0 {
 				slog.Debug("Reply received from app proxy", "bytes", n)
-				codec.Decode(buf[:n], tp.onMessageReceivedFromAppProxy)
+				codec.Decode(buf[:n], func(msg []byte) {
+					tp.onMessageReceivedFromAppProxy(link, msg)
+				})
 			}
 		}
 	}()
 
+	// An app proxy from before the tunnel handshake never answers the hello
+	select {
+	case <-link.ready:
+	case <-done:
+		return fmt.Errorf("app proxy closed the connection during the tunnel handshake")
+	case <-time.After(tunnelHelloTimeout):
+		if link.requiresAuth() {
+			conn.Close()
+			return fmt.Errorf("%w: app proxy did not complete the pre-shared key handshake", errTunnelUnauthenticated)
+		}
+		link.settle(true, tunnelHello{Version: tunnelLegacyVersion})
+		slog.Warn("App proxy did not answer the tunnel handshake; assuming the legacy protocol, control sessions will not be relayed", "addr", peername)
+	}
+
+	tp.setLink(link)
+	go link.runKeepalive(interval, done)
 	return nil
 }
 
 // handleUDPBroadcasts handles incoming broadcast packets
 func (tp *TunerProxy) handleUDPBroadcasts(ctx context.Context) {
 	buf := make([]byte, UDPReadBufferSize)
-	codec := NewMessageCodec()
 
 	for {
 		select {
@@ -287,58 +423,85 @@ func (tp *TunerProxy) handleUDPBroadcasts(ctx context.Context) {
 			continue
 		}
 
-		// Ignore datagrams until TCP is connected
-		if tp.getTCPTransport() == nil {
-			continue
+		if n > 0 {
+			tp.relayQuery(buf[:n], remoteAddr)
 		}
+	}
+}
 
-		if n > 0 {
-			ip := remoteAddr.IP.String()
-			port := remoteAddr.Port
-			slog.Debug("Request received from app", "bytes", n, "ip", ip, "port", port)
-
-			// Package into a message with source address and port
-			msgData := make([]byte, 6+n)
-			copy(msgData[0:4], remoteAddr.IP.To4())
-			binary.BigEndian.PutUint16(msgData[4:6], uint16(port))
-			copy(msgData[6:], buf[:n])
-
-			// Encode and send to app proxy
-			encodedMsg := codec.Encode(msgData)
-
-			tcpConn := tp.getTCPTransport()
-			if tcpConn != nil {
-				_, err := tcpConn.Write(encodedMsg)
-				if err != nil {
-					slog.Error("Error sending to app proxy", "err", err)
-					tp.closeTCP()
-				}
-			}
+// relayQuery sends an app's discovery query to the app proxy, tagged with
+// the app's address so the replies can be sent back to it. Queries are
+// dropped until the app proxy is connected.
+func (tp *TunerProxy) relayQuery(data []byte, from *net.UDPAddr) {
+	if tp.getLink() == nil {
+		return
+	}
+	slog.Debug("Request received from app", "bytes", len(data), "ip", udpAddrHost(from), "port", from.Port)
+
+	typ, payload := encodeDiscoverPayload(from, data)
+	if err := tp.sendToAppProxy(typ, 0, payload); err != nil {
+		if err == errTunnelLegacyPeer {
+			slog.Debug("Dropping IPv6 query, app proxy speaks the legacy tunnel protocol", "ip", udpAddrHost(from))
+			return
 		}
+		slog.Error("Error sending to app proxy", "err", err)
 	}
 }
 
 // onMessageReceivedFromAppProxy handles a message from the app proxy
-func (tp *TunerProxy) onMessageReceivedFromAppProxy(msg []byte) {
-	if len(msg) < 6 {
-		slog.Warn("Invalid message: too short", "len", len(msg))
+func (tp *TunerProxy) onMessageReceivedFromAppProxy(link *tunnelLink, msg []byte) {
+	f, err := link.receive(msg)
+	if err != nil {
+		if errors.Is(err, errTunnelUnauthenticated) {
+			slog.Warn("Refused unauthenticated app proxy", "addr", link.conn.RemoteAddr(), "err", err)
+		} else {
+			slog.Error("Dropping app proxy connection", "err", err)
+		}
+		link.conn.Close()
 		return
 	}
 
-	// Unpack the message
-	sourceAddr := msg[0:4]
-	sourcePort := binary.BigEndian.Uint16(msg[4:6])
-	replyData := msg[6:]
+	switch f.Type {
+	case tunnelMsgHello:
+		if link.requiresAuth() {
+			if err := link.sendAuth("TunerProxy"); err != nil {
+				link.conn.Close()
+				return
+			}
+		}
+		slog.Info("App proxy handshake complete", "protocol", tunnelProtocolVersion, "psk", link.requiresAuth())
+	case tunnelMsgDiscover, tunnelMsgDiscover6:
+		tp.replyToApp(f.Type, f.Payload)
+	case tunnelMsgControl:
+		if op, data, ok := decodeOpPayload(f.Payload); ok {
+			tp.controls.handle(uint16(f.Channel), op, data)
+		}
+	case tunnelMsgStream:
+		if op, data, ok := decodeOpPayload(f.Payload); ok {
+			tp.streams.handle(f.Channel, op, data)
+		}
+	case tunnelMsgPing:
+		link.send(tunnelMsgPong, f.Channel, nil) //nolint:errcheck
+	case tunnelMsgPong:
+	default:
+		slog.Debug("Ignoring unknown tunnel message", "type", f.Type)
+	}
+}
 
-	// Convert IP bytes to string
-	ip := net.IPv4(sourceAddr[0], sourceAddr[1], sourceAddr[2], sourceAddr[3]).String()
+// replyToApp sends a discovery reply relayed by the app proxy back to the app
+func (tp *TunerProxy) replyToApp(typ byte, msg []byte) {
+	addr, replyData, err := decodeDiscoverPayload(typ, msg)
+	if err != nil {
+		slog.Warn("Invalid discovery reply", "len", len(msg), "err", err)
+		return
+	}
 
-	slog.Debug("Replying to app", "bytes", len(replyData), "ip", ip, "port", sourcePort)
+	slog.Debug("Replying to app", "bytes", len(replyData), "ip", udpAddrHost(addr), "port", addr.Port)
 
-	// Send reply back to the app
-	addr := &net.UDPAddr{
-		IP:   net.IPv4(sourceAddr[0], sourceAddr[1], sourceAddr[2], sourceAddr[3]),
-		Port: int(sourcePort),
+	if cfg := tp.store.Get(); cfg.Tuner.RelayStreams {
+		replyData = tp.rewriteDiscoveryForRelay(replyData, addr)
+	} else if cfg.Tuner.RewriteBaseURL != "" {
+		replyData = rewriteDiscoveryOrigin(replyData, cfg.Tuner.RewriteBaseURL)
 	}
 
 	conn, err := net.DialUDP("udp", nil, addr)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -19,9 +20,16 @@ type TunerState struct {
 	BitRate        int
 	TargetIP       string    // Client IP address
 	TargetPort     int       // Client port
+	LockHolder     string    // IP address of the client holding the lock
 	LockedAt       time.Time // When the tuner was locked
 }
 
+// errTunerNotFound is returned for a tuner index beyond the tuner count
+var errTunerNotFound = errors.New("not found")
+
+// ErrNoTunerAvailable is returned by AllocateTuner when every tuner is in use
+var ErrNoTunerAvailable = errors.New("no tuner available")
+
 // TunerStateManager manages state for multiple tuners
 type TunerStateManager struct {
 	mu     sync.RWMutex
@@ -36,23 +44,54 @@ func NewTunerStateManager(tunerCount int) *TunerStateManager {
 		count:  tunerCount,
 	}
 	for i := 0; i < tunerCount; i++ {
-		tm.tuners[i] = &TunerState{
-			Index:          i,
-			Status:         "idle",
-			Channel:        "",
-			Program:        "",
-			SessionID:      "00000000",
-			Tuning:         false,
-			VCT:            false,
-			SignalStrength: 0,
-			BitRate:        0,
-			TargetIP:       "0.0.0.0",
-			TargetPort:     0,
-		}
+		tm.tuners[i] = newIdleTuner(i)
 	}
 	return tm
 }
 
+// newIdleTuner returns the state of an idle tuner at index
+func newIdleTuner(index int) *TunerState {
+	return &TunerState{
+		Index:          index,
+		Status:         "idle",
+		Channel:        "",
+		Program:        "",
+		SessionID:      "00000000",
+		Tuning:         false,
+		VCT:            false,
+		SignalStrength: 0,
+		BitRate:        0,
+		TargetIP:       "0.0.0.0",
+		TargetPort:     0,
+	}
+}
+
+// Resize changes the number of tuners to tunerCount, as backends come and
+// go. New tuners start idle. A tuner still in use is never dropped: the
+// count shrinks no further than the highest busy one, so its stream keeps
+// its index until released, and a later Resize finishes the shrink.
+func (tm *TunerStateManager) Resize(tunerCount int) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	for i := tm.count - 1; i >= tunerCount; i-- {
+		if tm.tuners[i].Status != "idle" {
+			tunerCount = i + 1
+			break
+		}
+	}
+	if tunerCount == tm.count {
+		return
+	}
+	for i := tm.count; i < tunerCount; i++ {
+		tm.tuners[i] = newIdleTuner(i)
+	}
+	for i := tunerCount; i < tm.count; i++ {
+		delete(tm.tuners, i)
+	}
+	tm.count = tunerCount
+}
+
 // GetTuner returns a copy of the tuner state at index
 func (tm *TunerStateManager) GetTuner(index int) (*TunerState, error) {
 	tm.mu.RLock()
@@ -60,7 +99,7 @@ func (tm *TunerStateManager) GetTuner(index int) (*TunerState, error) {
 
 	tuner, ok := tm.tuners[index]
 	if !ok {
-		return nil, fmt.Errorf("tuner %d not found", index)
+		return nil, fmt.Errorf("tuner %d %w", index, errTunerNotFound)
 	}
 
 	// Return a copy to prevent external modification
@@ -75,7 +114,7 @@ func (tm *TunerStateManager) SetTunerChannel(index int, channel string) error {
 
 	tuner, ok := tm.tuners[index]
 	if !ok {
-		return fmt.Errorf("tuner %d not found", index)
+		return fmt.Errorf("tuner %d %w", index, errTunerNotFound)
 	}
 
 	tuner.Channel = channel
@@ -93,7 +132,7 @@ func (tm *TunerStateManager) ReleaseTuner(index int) error {
 
 	tuner, ok := tm.tuners[index]
 	if !ok {
-		return fmt.Errorf("tuner %d not found", index)
+		return fmt.Errorf("tuner %d %w", index, errTunerNotFound)
 	}
 
 	tuner.Channel = ""
@@ -103,6 +142,8 @@ func (tm *TunerStateManager) ReleaseTuner(index int) error {
 	tuner.SessionID = "00000000"
 	tuner.TargetIP = "0.0.0.0"
 	tuner.TargetPort = 0
+	tuner.LockHolder = ""
+	tuner.BitRate = 0
 
 	return nil
 }
@@ -114,7 +155,7 @@ func (tm *TunerStateManager) LockTuner(index int, sessionID, targetIP string, ta
 
 	tuner, ok := tm.tuners[index]
 	if !ok {
-		return fmt.Errorf("tuner %d not found", index)
+		return fmt.Errorf("tuner %d %w", index, errTunerNotFound)
 	}
 
 	if tuner.Status != "idle" {
@@ -124,12 +165,39 @@ func (tm *TunerStateManager) LockTuner(index int, sessionID, targetIP string, ta
 	tuner.SessionID = sessionID
 	tuner.TargetIP = targetIP
 	tuner.TargetPort = targetPort
+	tuner.LockHolder = targetIP
 	tuner.Status = "locked"
 	tuner.LockedAt = time.Now()
 
 	return nil
 }
 
+// AllocateTuner locks the first idle tuner for streaming channel to a client
+// and returns its index. Release it with ReleaseTuner when the stream ends.
+func (tm *TunerStateManager) AllocateTuner(channel, sessionID, targetIP string, targetPort int) (int, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	for i := 0; i < tm.count; i++ {
+		tuner, ok := tm.tuners[i]
+		if !ok || tuner.Status != "idle" {
+			continue
+		}
+
+		tuner.Channel = channel
+		tuner.SessionID = sessionID
+		tuner.TargetIP = targetIP
+		tuner.TargetPort = targetPort
+		tuner.LockHolder = targetIP
+		tuner.Status = "locked"
+		tuner.Tuning = true
+		tuner.LockedAt = time.Now()
+		return i, nil
+	}
+
+	return -1, ErrNoTunerAvailable
+}
+
 // UnlockTuner unlocks a tuner
 func (tm *TunerStateManager) UnlockTuner(index int) error {
 	tm.mu.Lock()
@@ -137,18 +205,32 @@ func (tm *TunerStateManager) UnlockTuner(index int) error {
 
 	tuner, ok := tm.tuners[index]
 	if !ok {
-		return fmt.Errorf("tuner %d not found", index)
+		return fmt.Errorf("tuner %d %w", index, errTunerNotFound)
 	}
 
 	tuner.Status = "idle"
 	tuner.SessionID = "00000000"
 	tuner.TargetIP = "0.0.0.0"
 	tuner.TargetPort = 0
+	tuner.LockHolder = ""
 	tuner.Tuning = false
 
 	return nil
 }
 
+// UpdateTuner applies fn to the tuner at index while holding the manager's
+// lock, for callers such as the control protocol that change several fields at once
+func (tm *TunerStateManager) UpdateTuner(index int, fn func(*TunerState) error) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tuner, ok := tm.tuners[index]
+	if !ok {
+		return fmt.Errorf("tuner %d %w", index, errTunerNotFound)
+	}
+	return fn(tuner)
+}
+
 // GetAllTuners returns a snapshot of all tuner states
 func (tm *TunerStateManager) GetAllTuners() []*TunerState {
 	tm.mu.RLock()
@@ -171,7 +253,7 @@ func (tm *TunerStateManager) SetSignalStrength(index int, strength int) error {
 
 	tuner, ok := tm.tuners[index]
 	if !ok {
-		return fmt.Errorf("tuner %d not found", index)
+		return fmt.Errorf("tuner %d %w", index, errTunerNotFound)
 	}
 
 	tuner.SignalStrength = strength
@@ -185,7 +267,7 @@ func (tm *TunerStateManager) SetBitRate(index int, bitrate int) error {
 
 	tuner, ok := tm.tuners[index]
 	if !ok {
-		return fmt.Errorf("tuner %d not found", index)
+		return fmt.Errorf("tuner %d %w", index, errTunerNotFound)
 	}
 
 	tuner.BitRate = bitrate
@@ -194,5 +276,7 @@ func (tm *TunerStateManager) SetBitRate(index int, bitrate int) error {
 
 // GetTunerCount returns the number of tuners
 func (tm *TunerStateManager) GetTunerCount() int {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
 	return tm.count
 }
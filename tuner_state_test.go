@@ -250,3 +250,58 @@ func TestConcurrentAccess(t *testing.T) {
 		}
 	}
 }
+
+func TestAllocateTuner(t *testing.T) {
+	tm := NewTunerStateManager(2)
+
+	first, err := tm.AllocateTuner("2.1", "AAAA0001", "192.168.1.10", 5000)
+	if err != nil {
+		t.Fatalf("AllocateTuner error: %v", err)
+	}
+	second, err := tm.AllocateTuner("4.1", "AAAA0002", "192.168.1.11", 5001)
+	if err != nil {
+		t.Fatalf("AllocateTuner error: %v", err)
+	}
+	if first == second {
+		t.Errorf("Expected distinct tuners, both got %d", first)
+	}
+
+	tuner, _ := tm.GetTuner(second)
+	if tuner.Channel != "4.1" || tuner.Status != "locked" || tuner.TargetIP != "192.168.1.11" {
+		t.Errorf("Unexpected allocated tuner state: %+v", tuner)
+	}
+
+	if _, err := tm.AllocateTuner("5.1", "AAAA0003", "192.168.1.12", 5002); err != ErrNoTunerAvailable {
+		t.Errorf("Expected ErrNoTunerAvailable, got %v", err)
+	}
+
+	tm.ReleaseTuner(first)
+	if idx, err := tm.AllocateTuner("5.1", "AAAA0003", "192.168.1.12", 5002); err != nil || idx != first {
+		t.Errorf("Expected released tuner %d to be reused, got %d (%v)", first, idx, err)
+	}
+}
+
+func TestResizeKeepsBusyTuners(t *testing.T) {
+	tm := NewTunerStateManager(2)
+	tm.Resize(4)
+	busy, _ := tm.AllocateTuner("2.1", "AAAA0001", "192.168.1.10", 5000)
+	tm.LockTuner(2, "AAAA0002", "192.168.1.11", 5001) //nolint:errcheck
+
+	tm.Resize(1)
+	if n := tm.GetTunerCount(); n != 3 {
+		t.Fatalf("Expected the count to stop at the highest busy tuner, got %d", n)
+	}
+	tm.Resize(4)
+	if tuner, _ := tm.GetTuner(2); tuner.SessionID != "AAAA0002" {
+		t.Errorf("Expected the busy tuner to survive a shrink and grow, got %+v", tuner)
+	}
+
+	tm.ReleaseTuner(2) //nolint:errcheck
+	tm.Resize(1)
+	if n := tm.GetTunerCount(); n != 1 {
+		t.Errorf("Expected the shrink to finish once the tuners are idle, got %d", n)
+	}
+	if tuner, _ := tm.GetTuner(busy); tuner.SessionID != "AAAA0001" {
+		t.Errorf("Expected tuner %d to stay allocated, got %+v", busy, tuner)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Tunnel framing between AppProxy and TunerProxy. Every message is still
+// length-prefixed by MessageCodec; its body is a frame:
+//
+//	[version (1)] [type (1)] [channel (4, BE)] [payload]
+//
+// The TunerProxy opens each connection with a hello frame and the AppProxy
+// answers with its own. Peers built before framing existed (protocol v1)
+// send bare discovery messages ([IPv4 (4)] [port (2)] [datagram]) with no
+// hello; both sides fall back to that legacy format for such a peer, which
+// carries discovery only. A legacy AppProxy broadcasts the hello it doesn't
+// understand as a query, which devices ignore.
+//
+// Discovery from IPv6 apps travels as tunnelMsgDiscover6, which only framed
+// peers carry. A peer built before it existed logs and ignores the frame, so
+// only its IPv6 apps go unanswered.
+const (
+	tunnelProtocolVersion = 2
+	tunnelLegacyVersion   = 1
+
+	tunnelMsgHello     byte = 1
+	tunnelMsgDiscover  byte = 2 // payload: [IPv4 (4)] [port (2)] [datagram]; channel unused
+	tunnelMsgControl   byte = 3 // payload: [op (1)] [data]; channel is the control session ID
+	tunnelMsgStream    byte = 4 // payload: [op (1)] [data]; channel is the stream ID
+	tunnelMsgPing      byte = 5
+	tunnelMsgPong      byte = 6
+	tunnelMsgDiscover6 byte = 8 // payload: [IPv6 (16)] [port (2)] [zone length (1)] [zone] [datagram]; channel unused
+
+	tunnelFrameHeaderLen = 6
+
+	// tunnelHelloTimeout is how long the TunerProxy waits for the AppProxy's
+	// hello before assuming a legacy peer
+	tunnelHelloTimeout = 3 * time.Second
+)
+
+var (
+	errTunnelFrameShort = errors.New("tunnel frame too short")
+	errTunnelLegacyPeer = errors.New("peer speaks the legacy tunnel protocol")
+)
+
+// tunnelFrame is one decoded tunnel message
+type tunnelFrame struct {
+	Version byte
+	Type    byte
+	Channel uint32
+	Payload []byte
+}
+
+// marshal encodes the frame body (without the MessageCodec length prefix)
+func (f tunnelFrame) marshal() []byte {
+	buf := make([]byte, tunnelFrameHeaderLen+len(f.Payload))
+	buf[0] = f.Version
+	buf[1] = f.Type
+	binary.BigEndian.PutUint32(buf[2:6], f.Channel)
+	copy(buf[tunnelFrameHeaderLen:], f.Payload)
+	return buf
+}
+
+// parseTunnelFrame decodes a frame body
+func parseTunnelFrame(msg []byte) (tunnelFrame, error) {
+	if len(msg) < tunnelFrameHeaderLen {
+		return tunnelFrame{}, errTunnelFrameShort
+	}
+	return tunnelFrame{
+		Version: msg[0],
+		Type:    msg[1],
+		Channel: binary.BigEndian.Uint32(msg[2:6]),
+		Payload: msg[tunnelFrameHeaderLen:],
+	}, nil
+}
+
+// encodeOpPayload builds the [op (1)] [data] payload of a control or stream frame
+func encodeOpPayload(op byte, data []byte) []byte {
+	return append([]byte{op}, data...)
+}
+
+// decodeOpPayload splits a control or stream frame payload into its op and data
+func decodeOpPayload(payload []byte) (byte, []byte, bool) {
+	if len(payload) < 1 {
+		return 0, nil, false
+	}
+	return payload[0], payload[1:], true
+}
+
+// encodeDiscoverPayload packs the address of the app that sent (or will
+// receive) a discovery datagram in front of it, returning the message type
+// for the address family
+func encodeDiscoverPayload(addr *net.UDPAddr, datagram []byte) (byte, []byte) {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		payload := make([]byte, 6+len(datagram))
+		copy(payload[0:4], ip4)
+		binary.BigEndian.PutUint16(payload[4:6], uint16(addr.Port))
+		copy(payload[6:], datagram)
+		return tunnelMsgDiscover, payload
+	}
+
+	zone := addr.Zone
+	if len(zone) > 255 {
+		zone = ""
+	}
+	payload := make([]byte, 19+len(zone)+len(datagram))
+	copy(payload[0:16], addr.IP.To16())
+	binary.BigEndian.PutUint16(payload[16:18], uint16(addr.Port))
+	payload[18] = byte(len(zone))
+	copy(payload[19:], zone)
+	copy(payload[19+len(zone):], datagram)
+	return tunnelMsgDiscover6, payload
+}
+
+// decodeDiscoverPayload splits a discovery message of type typ into the
+// app's address and the datagram
+func decodeDiscoverPayload(typ byte, payload []byte) (*net.UDPAddr, []byte, error) {
+	switch typ {
+	case tunnelMsgDiscover:
+		if len(payload) < 6 {
+			return nil, nil, errTunnelFrameShort
+		}
+		ip := net.IPv4(payload[0], payload[1], payload[2], payload[3])
+		return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(payload[4:6]))}, payload[6:], nil
+	case tunnelMsgDiscover6:
+		if len(payload) < 19 || len(payload) < 19+int(payload[18]) {
+			return nil, nil, errTunnelFrameShort
+		}
+		zoneEnd := 19 + int(payload[18])
+		addr := &net.UDPAddr{
+			IP:   net.IP(append([]byte(nil), payload[0:16]...)),
+			Port: int(binary.BigEndian.Uint16(payload[16:18])),
+			Zone: string(payload[19:zoneEnd]),
+		}
+		return addr, payload[zoneEnd:], nil
+	}
+	return nil, nil, fmt.Errorf("message type %d is not discovery", typ)
+}
+
+// tunnelHello is the payload of a hello frame
+type tunnelHello struct {
+	Magic   string `json:"magic"`
+	Version int    `json:"version"`
+	Role    string `json:"role"`
+	Nonce   string `json:"nonce,omitempty"` // pre-shared key challenge; see tunnel_auth.go
+	MAC     string `json:"mac,omitempty"`
+}
+
+// tunnelHelloMagic identifies a hello frame, so a legacy discovery message
+// can never be mistaken for one
+const tunnelHelloMagic = "hdhomerun_proxy"
+
+// parseTunnelHello decodes msg as a hello frame, failing if it is anything else
+func parseTunnelHello(msg []byte) (tunnelHello, error) {
+	var hello tunnelHello
+	f, err := parseTunnelFrame(msg)
+	if err != nil {
+		return hello, err
+	}
+	if f.Type != tunnelMsgHello {
+		return hello, fmt.Errorf("expected hello, got message type %d", f.Type)
+	}
+	if err := json.Unmarshal(f.Payload, &hello); err != nil || hello.Magic != tunnelHelloMagic {
+		return hello, fmt.Errorf("malformed hello")
+	}
+	return hello, nil
+}
+
+// tunnelLink is one AppProxy<->TunerProxy connection. It tracks whether the
+// peer completed the hello handshake or is a legacy peer, and serializes writes.
+type tunnelLink struct {
+	conn    net.Conn
+	codec   *MessageCodec
+	psk     []byte // pre-shared key the peer must prove; nil if not required
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	settled bool
+	legacy  bool
+	greeted bool   // peer's hello received, pre-shared key exchange in progress
+	nonce   string // our pre-shared key challenge
+	role    string // the role our hello announced
+	peer    tunnelHello
+	ready   chan struct{} // closed once the handshake settles either way
+}
+
+// newTunnelLink wraps conn; the handshake is still pending. A non-empty psk
+// refuses peers that can't prove they hold the same key.
+func newTunnelLink(conn net.Conn, psk string) *tunnelLink {
+	l := &tunnelLink{
+		conn:  conn,
+		codec: NewMessageCodec(),
+		ready: make(chan struct{}),
+	}
+	if psk != "" {
+		l.psk = []byte(psk)
+	}
+	return l
+}
+
+// settle records the handshake outcome
+func (l *tunnelLink) settle(legacy bool, peer tunnelHello) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.settled {
+		return
+	}
+	l.settled = true
+	l.legacy = legacy
+	l.peer = peer
+	close(l.ready)
+}
+
+// isSettled reports whether the handshake has completed either way
+func (l *tunnelLink) isSettled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.settled
+}
+
+// isLegacy reports whether the peer speaks the pre-framing protocol
+func (l *tunnelLink) isLegacy() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.legacy
+}
+
+// protocolVersion returns the protocol version in use on this link
+func (l *tunnelLink) protocolVersion() int {
+	if l.isLegacy() {
+		return tunnelLegacyVersion
+	}
+	return tunnelProtocolVersion
+}
+
+// sendHello writes our hello frame, with our key challenge and, when answering
+// the peer's hello, our proof of the pre-shared key
+func (l *tunnelLink) sendHello(role string) error {
+	hello := tunnelHello{Magic: tunnelHelloMagic, Version: tunnelProtocolVersion, Role: role}
+	if l.requiresAuth() {
+		nonce, err := newTunnelNonce()
+		if err != nil {
+			return err
+		}
+		l.mu.Lock()
+		l.nonce = nonce
+		l.role = role
+		if l.greeted {
+			hello.MAC = tunnelMAC(l.psk, role, l.peer.Nonce, nonce)
+		}
+		l.mu.Unlock()
+		hello.Nonce = nonce
+	}
+	payload, err := json.Marshal(hello)
+	if err != nil {
+		return err
+	}
+	return l.write(tunnelFrame{Version: tunnelProtocolVersion, Type: tunnelMsgHello, Payload: payload}.marshal())
+}
+
+// send writes a frame. On a legacy link only discovery can be sent, as a bare
+// discovery message.
+func (l *tunnelLink) send(typ byte, channel uint32, payload []byte) error {
+	if l.isLegacy() {
+		if typ != tunnelMsgDiscover {
+			return errTunnelLegacyPeer
+		}
+		return l.write(payload)
+	}
+	return l.write(tunnelFrame{Version: tunnelProtocolVersion, Type: typ, Channel: channel, Payload: payload}.marshal())
+}
+
+// write length-prefixes msg and writes it to the connection
+func (l *tunnelLink) write(msg []byte) error {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	_, err := l.conn.Write(l.codec.Encode(msg))
+	return err
+}
+
+// receive decodes a message from the peer. Until the handshake settles, a
+// hello settles it as framed and anything else settles it as legacy; hello
+// frames are returned to the caller so the accepting side can answer them.
+// A link requiring a pre-shared key settles only once the key is proven.
+func (l *tunnelLink) receive(msg []byte) (tunnelFrame, error) {
+	l.mu.Lock()
+	settled, legacy, greeted := l.settled, l.legacy, l.greeted
+	l.mu.Unlock()
+
+	if !settled && greeted {
+		return l.receiveAuth(msg)
+	}
+	if !settled {
+		hello, err := parseTunnelHello(msg)
+		if err != nil {
+			if l.requiresAuth() {
+				return tunnelFrame{}, fmt.Errorf("%w: legacy peers can't prove the pre-shared key", errTunnelUnauthenticated)
+			}
+			l.settle(true, tunnelHello{Version: tunnelLegacyVersion})
+			return tunnelFrame{Version: tunnelLegacyVersion, Type: tunnelMsgDiscover, Payload: msg}, nil
+		}
+		if hello.Version != tunnelProtocolVersion {
+			return tunnelFrame{}, fmt.Errorf("peer speaks tunnel protocol v%d, this build speaks v%d; run the same release on both ends", hello.Version, tunnelProtocolVersion)
+		}
+		if l.requiresAuth() {
+			return l.receiveHelloAuth(hello)
+		}
+		l.settle(false, hello)
+		return tunnelFrame{Version: tunnelProtocolVersion, Type: tunnelMsgHello}, nil
+	}
+
+	if legacy {
+		return tunnelFrame{Version: tunnelLegacyVersion, Type: tunnelMsgDiscover, Payload: msg}, nil
+	}
+
+	f, err := parseTunnelFrame(msg)
+	if err != nil {
+		return f, err
+	}
+	if f.Version != tunnelProtocolVersion {
+		return f, fmt.Errorf("unexpected tunnel frame version %d", f.Version)
+	}
+	return f, nil
+}
+
+// extendDeadline pushes the read deadline out by timeout on a framed link, so
+// a peer that stops sending pings is detected. Legacy peers never ping, so
+// their links have no deadline.
+func (l *tunnelLink) extendDeadline(timeout time.Duration) {
+	l.mu.Lock()
+	legacy := l.settled && l.legacy
+	l.mu.Unlock()
+
+	if legacy || timeout <= 0 {
+		l.conn.SetReadDeadline(time.Time{})
+		return
+	}
+	l.conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// keepaliveTimeout is how long a framed link may stay silent before it is
+// considered dead: three missed pings
+func keepaliveTimeout(interval time.Duration) time.Duration {
+	return 3 * interval
+}
+
+// runKeepalive pings the peer every interval until done is closed or a write fails
+func (l *tunnelLink) runKeepalive(interval time.Duration, done <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	select {
+	case <-l.ready:
+	case <-done:
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if l.isLegacy() {
+				return
+			}
+			if err := l.send(tunnelMsgPing, 0, nil); err != nil {
+				return
+			}
+		}
+	}
+}
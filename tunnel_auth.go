@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Tunnel peers can be authenticated two ways, separately or together:
+//
+//   - Mutual TLS: the connection is wrapped in TLS and each side verifies the
+//     other's certificate against tunnel.tls_ca_file.
+//   - Pre-shared key: each hello carries a random nonce, and each side proves
+//     it knows tunnel.psk with an HMAC over the other's nonce. The AppProxy's
+//     MAC rides in its hello; the TunerProxy answers with a tunnelMsgAuth frame.
+//
+// A peer that can't authenticate is refused, including legacy peers.
+const tunnelMsgAuth byte = 7 // payload: hex HMAC; channel unused
+
+var errTunnelUnauthenticated = errors.New("tunnel peer not authenticated")
+
+// newTunnelNonce returns a random hex nonce for a hello
+func newTunnelNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// tunnelMAC is the proof sent by the side playing role: an HMAC of the
+// verifier's nonce, which the verifier chose, and the sender's own nonce
+func tunnelMAC(psk []byte, role, verifierNonce, senderNonce string) string {
+	mac := hmac.New(sha256.New, psk)
+	mac.Write([]byte(role + "\x00" + verifierNonce + "\x00" + senderNonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// tunnelPeerRole is the role the other end of a link must prove it plays.
+// Proofs are checked against it rather than the role the peer claims, so a
+// peer can't claim ours and reflect our own proof back.
+func tunnelPeerRole(ourRole string) string {
+	if ourRole == "AppProxy" {
+		return "TunerProxy"
+	}
+	return "AppProxy"
+}
+
+// receiveHelloAuth records a hello on a link that requires a pre-shared key.
+// If we sent our hello first, the peer's must carry a valid MAC; the link
+// settles once sendAuth has answered it. Otherwise the link waits for the
+// peer's auth frame (see receiveAuth).
+func (l *tunnelLink) receiveHelloAuth(hello tunnelHello) (tunnelFrame, error) {
+	if hello.Nonce == "" {
+		return tunnelFrame{}, fmt.Errorf("%w: peer sent no pre-shared key proof; set the same tunnel.psk on both ends", errTunnelUnauthenticated)
+	}
+
+	l.mu.Lock()
+	ourNonce, ourRole := l.nonce, l.role
+	l.peer = hello
+	l.greeted = true
+	l.mu.Unlock()
+
+	if ourNonce != "" && !hmac.Equal([]byte(hello.MAC), []byte(tunnelMAC(l.psk, tunnelPeerRole(ourRole), ourNonce, hello.Nonce))) {
+		return tunnelFrame{}, fmt.Errorf("%w: pre-shared key mismatch", errTunnelUnauthenticated)
+	}
+	return tunnelFrame{Version: tunnelProtocolVersion, Type: tunnelMsgHello}, nil
+}
+
+// receiveAuth checks the auth frame that must follow the peer's hello, and
+// settles the link if it proves the peer knows the pre-shared key
+func (l *tunnelLink) receiveAuth(msg []byte) (tunnelFrame, error) {
+	f, err := parseTunnelFrame(msg)
+	if err != nil || f.Type != tunnelMsgAuth {
+		return tunnelFrame{}, fmt.Errorf("%w: expected auth frame", errTunnelUnauthenticated)
+	}
+
+	l.mu.Lock()
+	peer, ourNonce, ourRole := l.peer, l.nonce, l.role
+	l.mu.Unlock()
+
+	if ourNonce == "" || !hmac.Equal(f.Payload, []byte(tunnelMAC(l.psk, tunnelPeerRole(ourRole), ourNonce, peer.Nonce))) {
+		return tunnelFrame{}, fmt.Errorf("%w: pre-shared key mismatch", errTunnelUnauthenticated)
+	}
+	l.settle(false, peer)
+	return f, nil
+}
+
+// sendAuth proves our key to the peer after its hello was verified, settling the link
+func (l *tunnelLink) sendAuth(role string) error {
+	l.mu.Lock()
+	peer, ourNonce := l.peer, l.nonce
+	l.mu.Unlock()
+
+	mac := tunnelMAC(l.psk, role, peer.Nonce, ourNonce)
+	if err := l.write(tunnelFrame{Version: tunnelProtocolVersion, Type: tunnelMsgAuth, Payload: []byte(mac)}.marshal()); err != nil {
+		return err
+	}
+	l.settle(false, peer)
+	return nil
+}
+
+// requiresAuth reports whether the link only settles for a peer holding the pre-shared key
+func (l *tunnelLink) requiresAuth() bool {
+	return len(l.psk) > 0
+}
+
+// loadTunnelTLS builds the TLS config for the tunnel from cfg, or returns nil
+// if TLS is not configured. The server side requires and verifies a client
+// certificate; the client side verifies the server against the same CA.
+func loadTunnelTLS(cfg *Config, server bool) (*tls.Config, error) {
+	t := cfg.Tunnel
+	if t.TLSCert == "" && t.TLSKey == "" {
+		return nil, nil
+	}
+	if t.TLSCA == "" {
+		return nil, fmt.Errorf("tunnel.tls_ca_file is required to verify the peer's certificate")
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.TLSCert, t.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading tunnel certificate: %w", err)
+	}
+	caPEM, err := os.ReadFile(t.TLSCA)
+	if err != nil {
+		return nil, fmt.Errorf("loading tunnel CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", t.TLSCA)
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if server {
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		tlsCfg.RootCAs = pool
+		tlsCfg.ServerName = t.TLSServerName
+	}
+	return tlsCfg, nil
+}
+
+// tlsPeerName returns the common name of the verified peer certificate on conn, if any
+func tlsPeerName(conn *tls.Conn) string {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// pskAppProxy starts an app proxy requiring psk on one end of a pipe and
+// returns the other end
+func pskAppProxy(t *testing.T, psk string) (*AppProxy, net.Conn) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Tunnel.PSK = psk
+	ap := NewAppProxy(newConfigStore(cfg, ""))
+
+	server, client := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		client.Close()
+	})
+	go ap.handleTCPConnection(ctx, server)
+	client.SetDeadline(time.Now().Add(time.Second))
+	return ap, client
+}
+
+func TestTunnelPSKHandshake(t *testing.T) {
+	ap, client := pskAppProxy(t, "s3cret")
+	peer := newTunnelLink(client, "s3cret")
+
+	if err := peer.sendHello("TunerProxy"); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := peer.receive(readTunnelMessage(t, client)); err != nil || f.Type != tunnelMsgHello {
+		t.Fatalf("Expected verified AppProxy hello, got %+v, %v", f, err)
+	}
+	if peer.isSettled() {
+		t.Error("Expected the link to wait for our auth frame before settling")
+	}
+	if err := peer.sendAuth("TunerProxy"); err != nil {
+		t.Fatal(err)
+	}
+	if !peer.isSettled() || peer.isLegacy() {
+		t.Error("Expected the link to settle after sending auth")
+	}
+
+	// Only an authenticated session answers pings
+	if err := peer.send(tunnelMsgPing, 3, nil); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := parseTunnelFrame(readTunnelMessage(t, client)); err != nil || f.Type != tunnelMsgPong {
+		t.Errorf("Expected pong after authenticating, got %+v, %v", f, err)
+	}
+	if s := ap.Stats(); len(s.TunerProxies) != 1 || s.TunerProxies[0].Protocol != tunnelProtocolVersion {
+		t.Errorf("Expected one authenticated tuner proxy, got %+v", s.TunerProxies)
+	}
+}
+
+func TestTunnelPSKMismatch(t *testing.T) {
+	_, client := pskAppProxy(t, "s3cret")
+	peer := newTunnelLink(client, "wrong")
+
+	if err := peer.sendHello("TunerProxy"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.receive(readTunnelMessage(t, client)); !errors.Is(err, errTunnelUnauthenticated) {
+		t.Errorf("Expected the tuner proxy to reject the app proxy's proof, got %v", err)
+	}
+
+	// A forged auth frame is refused by the app proxy
+	peer.write(tunnelFrame{Version: tunnelProtocolVersion, Type: tunnelMsgAuth, Payload: []byte("00")}.marshal()) //nolint:errcheck
+	if _, err := client.Read(make([]byte, 16)); err == nil {
+		t.Error("Expected the app proxy to close a connection with a bad proof")
+	}
+}
+
+func TestTunnelPSKChecksExpectedRole(t *testing.T) {
+	// A peer claiming the app proxy's own role can't pass off that role's proof
+	_, client := pskAppProxy(t, "s3cret")
+	peer := newTunnelLink(client, "s3cret")
+	if err := peer.sendHello("AppProxy"); err != nil {
+		t.Fatal(err)
+	}
+	readTunnelMessage(t, client)
+	peer.sendAuth("AppProxy") //nolint:errcheck
+	if _, err := client.Read(make([]byte, 16)); err == nil {
+		t.Error("Expected the app proxy to refuse a proof made for its own role")
+	}
+
+	// Likewise the tuner proxy checks the app proxy's proof for the AppProxy role
+	server, other := net.Pipe()
+	defer server.Close()
+	defer other.Close()
+	tuner := newTunnelLink(server, "s3cret")
+	go tuner.sendHello("TunerProxy") //nolint:errcheck
+	other.SetDeadline(time.Now().Add(time.Second))
+	hello, err := parseTunnelHello(readTunnelMessage(t, other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := tunnelHello{Magic: tunnelHelloMagic, Version: tunnelProtocolVersion, Role: "TunerProxy", Nonce: "00",
+		MAC: tunnelMAC([]byte("s3cret"), "TunerProxy", hello.Nonce, "00")}
+	if _, err := tuner.receiveHelloAuth(forged); !errors.Is(err, errTunnelUnauthenticated) {
+		t.Errorf("Expected a proof made for the TunerProxy role to be refused, got %v", err)
+	}
+	forged.MAC = tunnelMAC([]byte("s3cret"), "AppProxy", hello.Nonce, "00")
+	if _, err := tuner.receiveHelloAuth(forged); err != nil {
+		t.Errorf("Expected a proof for the AppProxy role to pass, got %v", err)
+	}
+}
+
+func TestTunnelPSKRefusesUnauthenticatedPeers(t *testing.T) {
+	t.Run("no key", func(t *testing.T) {
+		_, client := pskAppProxy(t, "s3cret")
+		newTunnelLink(client, "").sendHello("TunerProxy") //nolint:errcheck
+		if _, err := client.Read(make([]byte, 16)); err == nil {
+			t.Error("Expected a hello without a key proof to be refused")
+		}
+	})
+	t.Run("legacy", func(t *testing.T) {
+		_, client := pskAppProxy(t, "s3cret")
+		discovery := append([]byte{192, 168, 1, 7, 0x13, 0x88}, []byte("discover")...)
+		client.Write(NewMessageCodec().Encode(discovery)) //nolint:errcheck
+		if _, err := client.Read(make([]byte, 16)); err == nil {
+			t.Error("Expected a legacy peer to be refused when a key is required")
+		}
+	})
+	t.Run("data before auth", func(t *testing.T) {
+		_, client := pskAppProxy(t, "s3cret")
+		peer := newTunnelLink(client, "s3cret")
+		peer.sendHello("TunerProxy") //nolint:errcheck
+		readTunnelMessage(t, client)
+		peer.write(tunnelFrame{Version: tunnelProtocolVersion, Type: tunnelMsgDiscover, Payload: make([]byte, 8)}.marshal()) //nolint:errcheck
+		if _, err := client.Read(make([]byte, 16)); err == nil {
+			t.Error("Expected discovery before auth to be refused")
+		}
+	})
+}
+
+func TestTunnelTLSRequiresClientCertificate(t *testing.T) {
+	cfg := writeTunnelCerts(t)
+	serverTLS, err := loadTunnelTLS(cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTLS, err := loadTunnelTLS(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTLS.ServerName = "app-proxy"
+
+	dial := func(t *testing.T) net.Conn {
+		ap := NewAppProxy(newConfigStore(DefaultConfig(), ""))
+		ap.tunnelTLS = serverTLS
+		server, client := net.Pipe()
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(func() {
+			cancel()
+			client.Close()
+		})
+		go ap.handleTCPConnection(ctx, server)
+		client.SetDeadline(time.Now().Add(2 * time.Second))
+		return client
+	}
+
+	t.Run("mutual", func(t *testing.T) {
+		conn := tls.Client(dial(t), clientTLS)
+		peer := newTunnelLink(conn, "")
+		if err := peer.sendHello("TunerProxy"); err != nil {
+			t.Fatalf("TLS tunnel refused: %v", err)
+		}
+		if _, err := parseTunnelHello(readTunnelMessage(t, conn)); err != nil {
+			t.Errorf("Expected AppProxy hello over TLS, got %v", err)
+		}
+	})
+	t.Run("no client certificate", func(t *testing.T) {
+		anon := clientTLS.Clone()
+		anon.Certificates = nil
+		conn := tls.Client(dial(t), anon)
+		conn.Handshake() //nolint:errcheck
+		if _, err := conn.Read(make([]byte, 16)); err == nil {
+			t.Error("Expected a client without a certificate to be refused")
+		}
+	})
+	t.Run("plaintext", func(t *testing.T) {
+		conn := dial(t)
+		newTunnelLink(conn, "").sendHello("TunerProxy") //nolint:errcheck
+		if _, err := conn.Read(make([]byte, 16)); err == nil {
+			t.Error("Expected a plaintext tuner proxy to be refused")
+		}
+	})
+}
+
+func TestLoadTunnelTLSRequiresCA(t *testing.T) {
+	cfg := writeTunnelCerts(t)
+	cfg.Tunnel.TLSCA = ""
+	if _, err := loadTunnelTLS(cfg, true); err == nil {
+		t.Error("Expected an error without tls_ca_file")
+	}
+	if tlsCfg, err := loadTunnelTLS(DefaultConfig(), true); tlsCfg != nil || err != nil {
+		t.Errorf("Expected TLS disabled by default, got %v, %v", tlsCfg, err)
+	}
+}
+
+// writeTunnelCerts writes a CA and one certificate signed by it, valid for
+// both ends of the tunnel, and returns a config pointing at them
+func writeTunnelCerts(t *testing.T) *Config {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tunnel-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "app-proxy"},
+		DNSNames:     []string{"app-proxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	write := func(name, typ string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	cfg := DefaultConfig()
+	cfg.Tunnel.TLSCA = write("ca.pem", "CERTIFICATE", caDER)
+	cfg.Tunnel.TLSCert = write("cert.pem", "CERTIFICATE", der)
+	cfg.Tunnel.TLSKey = write("key.pem", "EC PRIVATE KEY", keyDER)
+	return cfg
+}
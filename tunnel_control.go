@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// Control-protocol sessions are carried in tunnelMsgControl frames whose
+// channel is the session ID and whose payload is [op (1)] [data]. The app
+// VLAN side (TunerProxy) assigns session IDs when it accepts an app's control
+// connection; the tuner VLAN side (AppProxy) opens a matching connection to
+// the device for each one.
+const (
+	controlOpOpen  byte = 1
+	controlOpData  byte = 2
+	controlOpClose byte = 3
+
+	// controlOutboxSize bounds how many packets may queue for a session
+	// while its connection is being dialed or is slow to accept writes
+	controlOutboxSize = 32
+)
+
+// controlRelay multiplexes the control-protocol TCP sessions carried over one tunnel
+type controlRelay struct {
+	mu       sync.Mutex
+	sessions map[uint16]*relayedControl
+	nextID   uint16
+	send     func(sessionID uint16, op byte, data []byte) error // writes one control frame to the peer
+	dial     func() (net.Conn, error)                           // opens a device connection; nil on the app VLAN side
+}
+
+// relayedControl is one control session; outbox holds data waiting to be
+// written to its connection
+type relayedControl struct {
+	outbox chan []byte
+}
+
+// newControlRelay creates a relay that talks to its peer through send. dial
+// is only set on the side that connects to real devices.
+func newControlRelay(send func(sessionID uint16, op byte, data []byte) error, dial func() (net.Conn, error)) *controlRelay {
+	return &controlRelay{
+		sessions: make(map[uint16]*relayedControl),
+		send:     send,
+		dial:     dial,
+	}
+}
+
+// attach relays an app's control connection through the tunnel
+func (cr *controlRelay) attach(conn net.Conn) {
+	cr.mu.Lock()
+	cr.nextID++
+	if cr.nextID == 0 {
+		cr.nextID++
+	}
+	id := cr.nextID
+	cr.sessions[id] = &relayedControl{outbox: make(chan []byte, controlOutboxSize)}
+	cr.mu.Unlock()
+
+	if err := cr.send(id, controlOpOpen, nil); err != nil {
+		slog.Warn("Could not open relayed control session", "session", id, "err", err)
+		cr.finish(id, false)
+		conn.Close()
+		return
+	}
+	slog.Debug("Relaying control session", "session", id, "client", conn.RemoteAddr())
+	cr.run(id, func() (net.Conn, error) { return conn, nil })
+}
+
+// handle processes a control message received from the peer
+func (cr *controlRelay) handle(sessionID uint16, op byte, data []byte) {
+	switch op {
+	case controlOpOpen:
+		if cr.dial == nil {
+			cr.send(sessionID, controlOpClose, nil) //nolint:errcheck
+			return
+		}
+		cr.mu.Lock()
+		if _, exists := cr.sessions[sessionID]; exists {
+			cr.mu.Unlock()
+			return
+		}
+		cr.sessions[sessionID] = &relayedControl{outbox: make(chan []byte, controlOutboxSize)}
+		cr.mu.Unlock()
+		cr.run(sessionID, cr.dial)
+
+	case controlOpData:
+		cr.mu.Lock()
+		s, ok := cr.sessions[sessionID]
+		backlogged := false
+		if ok {
+			select {
+			case s.outbox <- data:
+			default:
+				backlogged = true
+			}
+		}
+		cr.mu.Unlock()
+		// The session carries a byte stream, so dropping data would corrupt
+		// its packet framing; end it on both sides instead
+		if backlogged {
+			slog.Warn("Relayed control session backlogged, closing it", "session", sessionID)
+			cr.finish(sessionID, true)
+		}
+
+	case controlOpClose:
+		cr.finish(sessionID, false)
+	}
+}
+
+// run connects a session and pumps data in both directions until either end closes
+func (cr *controlRelay) run(id uint16, connect func() (net.Conn, error)) {
+	cr.mu.Lock()
+	s, ok := cr.sessions[id]
+	cr.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	go func() {
+		conn, err := connect()
+		if err != nil {
+			slog.Warn("Could not connect relayed control session", "session", id, "err", err)
+			cr.finish(id, true)
+			return
+		}
+
+		// Tunnel -> connection; ends when finish closes the outbox
+		go func() {
+			for data := range s.outbox {
+				if _, err := conn.Write(data); err != nil {
+					break
+				}
+			}
+			conn.Close()
+		}()
+
+		// Connection -> tunnel
+		buf := make([]byte, UDPReadBufferSize)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if sendErr := cr.send(id, controlOpData, buf[:n]); sendErr != nil {
+					cr.finish(id, false)
+					return
+				}
+			}
+			if err != nil {
+				cr.finish(id, !errors.Is(err, net.ErrClosed))
+				return
+			}
+		}
+	}()
+}
+
+// finish ends a session, telling the peer to close its end if notifyPeer is set
+func (cr *controlRelay) finish(id uint16, notifyPeer bool) {
+	cr.mu.Lock()
+	s, ok := cr.sessions[id]
+	if ok {
+		delete(cr.sessions, id)
+		close(s.outbox)
+	}
+	cr.mu.Unlock()
+
+	if ok && notifyPeer {
+		cr.send(id, controlOpClose, nil) //nolint:errcheck
+	}
+}
+
+// closeAll ends every session without notifying the peer, for when the tunnel drops
+func (cr *controlRelay) closeAll() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	for id, s := range cr.sessions {
+		delete(cr.sessions, id)
+		close(s.outbox)
+	}
+}
+
+// count returns the number of open sessions
+func (cr *controlRelay) count() int {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return len(cr.sessions)
+}
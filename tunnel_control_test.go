@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// linkedControlRelays wires an app-side and a device-side relay back to back,
+// as if joined by the tunnel. The device side dials the emulated device in server.
+func linkedControlRelays(t *testing.T, server *HDHREndpointServer) (*controlRelay, *controlRelay) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	var appSide, deviceSide *controlRelay
+	deliver := func(to **controlRelay) func(uint16, byte, []byte) error {
+		return func(id uint16, op byte, data []byte) error {
+			(*to).handle(id, op, append([]byte(nil), data...))
+			return nil
+		}
+	}
+	appSide = newControlRelay(deliver(&deviceSide), nil)
+	deviceSide = newControlRelay(deliver(&appSide), func() (net.Conn, error) {
+		client, device := net.Pipe()
+		go server.HandleControlConn(ctx, device)
+		return client, nil
+	})
+	return appSide, deviceSide
+}
+
+func TestControlRelayCarriesSession(t *testing.T) {
+	server := newControlTestServer()
+	appSide, deviceSide := linkedControlRelays(t, server)
+
+	appConn, relayConn := net.Pipe()
+	defer appConn.Close()
+	appConn.SetDeadline(time.Now().Add(2 * time.Second))
+	appSide.attach(relayConn)
+
+	c := &controlClient{t: t, conn: appConn}
+	if r := c.get("/sys/hwmodel"); r.Value != "HDHR4-2US" {
+		t.Errorf("Expected relayed /sys/hwmodel HDHR4-2US, got %+v", r)
+	}
+	if r := c.set("/tuner1/channel", "auto:5.1", 0); r.Error != "" {
+		t.Errorf("Expected relayed set to succeed, got %+v", r)
+	}
+	tuner, _ := server.tunerStates.GetTuner(1)
+	if tuner.Channel != "auto:5.1" {
+		t.Errorf("Relayed set did not reach the device: %+v", tuner)
+	}
+
+	if appSide.count() != 1 || deviceSide.count() != 1 {
+		t.Errorf("Expected one open session per side, got %d/%d", appSide.count(), deviceSide.count())
+	}
+
+	// Closing the app's connection must tear down the device side too
+	appConn.Close()
+	waitForControlSessions(t, appSide, deviceSide)
+}
+
+func TestControlRelayDialFailureClosesApp(t *testing.T) {
+	var appSide, deviceSide *controlRelay
+	appSide = newControlRelay(func(id uint16, op byte, data []byte) error {
+		deviceSide.handle(id, op, data)
+		return nil
+	}, nil)
+	deviceSide = newControlRelay(func(id uint16, op byte, data []byte) error {
+		appSide.handle(id, op, data)
+		return nil
+	}, func() (net.Conn, error) { return nil, errors.New("unreachable") })
+
+	appConn, relayConn := net.Pipe()
+	defer appConn.Close()
+	appSide.attach(relayConn)
+
+	appConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := appConn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected app connection to be closed when the device can't be reached")
+	}
+	waitForControlSessions(t, appSide, deviceSide)
+}
+
+func TestControlRelayRejectsOpenWithoutDialer(t *testing.T) {
+	var sentID uint16
+	var sentOp byte
+	appSide := newControlRelay(func(id uint16, op byte, data []byte) error {
+		sentID, sentOp = id, op
+		return nil
+	}, nil)
+	appSide.handle(7, controlOpOpen, nil)
+
+	if sentID != 7 || sentOp != controlOpClose {
+		t.Errorf("Expected close for session 7, got session %d op %d", sentID, sentOp)
+	}
+}
+
+func waitForControlSessions(t *testing.T, relays ...*controlRelay) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		open := 0
+		for _, r := range relays {
+			open += r.count()
+		}
+		if open == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected all relayed control sessions to close")
+}
+
+func TestControlRelayClosesBackloggedSession(t *testing.T) {
+	var closed []uint16
+	dialing := make(chan struct{})
+	defer close(dialing)
+	deviceSide := newControlRelay(func(id uint16, op byte, data []byte) error {
+		if op == controlOpClose {
+			closed = append(closed, id)
+		}
+		return nil
+	}, func() (net.Conn, error) {
+		<-dialing
+		return nil, errors.New("unreachable")
+	})
+
+	deviceSide.handle(3, controlOpOpen, nil)
+	for i := 0; i <= controlOutboxSize; i++ {
+		deviceSide.handle(3, controlOpData, []byte{byte(i)})
+	}
+	if deviceSide.count() != 0 {
+		t.Error("Expected the backlogged session to be closed rather than lose data")
+	}
+	if len(closed) != 1 || closed[0] != 3 {
+		t.Errorf("Expected the peer told to close session 3, got %v", closed)
+	}
+}
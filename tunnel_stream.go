@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// HTTP requests relayed through the tunnel are carried in tunnelMsgStream
+// frames whose channel is the stream ID and whose payload is [op (1)] [data].
+// The app VLAN side (TunerProxy) opens a stream with the upstream URL; the
+// tuner VLAN side (AppProxy) fetches it from the device and sends back a
+// header, the body in chunks, and a close. Either side may close early.
+const (
+	streamOpOpen   byte = 1 // data: upstream URL
+	streamOpHeader byte = 2 // data: JSON streamHeader
+	streamOpData   byte = 3 // data: body bytes
+	streamOpClose  byte = 4 // data: error text, empty on a clean end
+
+	// streamChunkSize keeps each data frame, with its headers, inside the
+	// MessageCodec's 16-bit length prefix; it is a whole number of TS packets
+	streamChunkSize = 188 * 340
+
+	// streamBacklog bounds how many chunks may queue for a slow HTTP client
+	// before its stream is dropped rather than stalling the whole tunnel
+	streamBacklog = 256
+)
+
+var errStreamBacklogged = errors.New("relayed stream backlogged")
+
+// streamHeader is the status line of a relayed response
+type streamHeader struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type"`
+}
+
+// streamEvent is one header or data message delivered to a relayed stream
+type streamEvent struct {
+	op   byte
+	data []byte
+}
+
+// streamRelay multiplexes the HTTP requests carried over one tunnel
+type streamRelay struct {
+	mu      sync.Mutex
+	streams map[uint32]*relayedStream
+	nextID  uint32
+	send    func(streamID uint32, op byte, data []byte) error             // writes one stream frame to the peer
+	fetch   func(ctx context.Context, url string) (*http.Response, error) // nil on the app VLAN side
+}
+
+// relayedStream is one relayed request. On the app VLAN side events carries
+// its response; on the tuner VLAN side cancel aborts the upstream fetch.
+type relayedStream struct {
+	id     uint32
+	events chan streamEvent
+	cancel context.CancelFunc
+}
+
+// newStreamRelay creates a relay that talks to its peer through send. fetch
+// is only set on the side that can reach the devices.
+func newStreamRelay(send func(streamID uint32, op byte, data []byte) error, fetch func(ctx context.Context, url string) (*http.Response, error)) *streamRelay {
+	return &streamRelay{
+		streams: make(map[uint32]*relayedStream),
+		send:    send,
+		fetch:   fetch,
+	}
+}
+
+// open asks the peer to fetch url; the response arrives on the stream's events
+func (sr *streamRelay) open(url string) (*relayedStream, error) {
+	sr.mu.Lock()
+	sr.nextID++
+	if sr.nextID == 0 {
+		sr.nextID++
+	}
+	s := &relayedStream{id: sr.nextID, events: make(chan streamEvent, streamBacklog)}
+	sr.streams[s.id] = s
+	sr.mu.Unlock()
+
+	if err := sr.send(s.id, streamOpOpen, []byte(url)); err != nil {
+		sr.finish(s.id, false)
+		return nil, err
+	}
+	return s, nil
+}
+
+// handle processes a stream message received from the peer
+func (sr *streamRelay) handle(streamID uint32, op byte, data []byte) {
+	switch op {
+	case streamOpOpen:
+		if sr.fetch == nil {
+			sr.send(streamID, streamOpClose, []byte("stream relay not available")) //nolint:errcheck
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		sr.mu.Lock()
+		if _, exists := sr.streams[streamID]; exists {
+			sr.mu.Unlock()
+			cancel()
+			return
+		}
+		sr.streams[streamID] = &relayedStream{id: streamID, cancel: cancel}
+		sr.mu.Unlock()
+		go sr.serve(ctx, streamID, string(data))
+
+	case streamOpHeader, streamOpData:
+		sr.mu.Lock()
+		s, ok := sr.streams[streamID]
+		if !ok || s.events == nil {
+			sr.mu.Unlock()
+			return
+		}
+		select {
+		case s.events <- streamEvent{op: op, data: data}:
+			sr.mu.Unlock()
+		default:
+			sr.mu.Unlock()
+			slog.Warn("Relayed stream backlogged, dropping it", "stream", streamID)
+			sr.finishWithError(streamID, errStreamBacklogged)
+		}
+
+	case streamOpClose:
+		if len(data) > 0 {
+			slog.Debug("Relayed stream closed by peer", "stream", streamID, "err", string(data))
+		}
+		sr.finish(streamID, false)
+	}
+}
+
+// serve fetches url and sends the response back to the peer
+func (sr *streamRelay) serve(ctx context.Context, id uint32, url string) {
+	resp, err := sr.fetch(ctx, url)
+	if err != nil {
+		slog.Warn("Could not fetch relayed stream", "stream", id, "url", url, "err", err)
+		sr.finishWithError(id, err)
+		return
+	}
+	defer resp.Body.Close()
+	slog.Debug("Relaying stream", "stream", id, "url", url, "status", resp.StatusCode)
+
+	header, _ := json.Marshal(streamHeader{Status: resp.StatusCode, ContentType: resp.Header.Get("Content-Type")})
+	if err := sr.send(id, streamOpHeader, header); err != nil {
+		sr.finish(id, false)
+		return
+	}
+
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if sendErr := sr.send(id, streamOpData, buf[:n]); sendErr != nil {
+				sr.finish(id, false)
+				return
+			}
+		}
+		if err == io.EOF {
+			sr.finish(id, true)
+			return
+		}
+		if err != nil {
+			sr.finishWithError(id, err)
+			return
+		}
+	}
+}
+
+// finish ends a stream, telling the peer to close its end if notifyPeer is set
+func (sr *streamRelay) finish(id uint32, notifyPeer bool) {
+	if sr.remove(id) && notifyPeer {
+		sr.send(id, streamOpClose, nil) //nolint:errcheck
+	}
+}
+
+// finishWithError ends a stream and passes the reason on to the peer
+func (sr *streamRelay) finishWithError(id uint32, err error) {
+	if sr.remove(id) {
+		sr.send(id, streamOpClose, []byte(err.Error())) //nolint:errcheck
+	}
+}
+
+// remove forgets a stream and releases it, reporting whether it was open
+func (sr *streamRelay) remove(id uint32) bool {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	s, ok := sr.streams[id]
+	if !ok {
+		return false
+	}
+	delete(sr.streams, id)
+	s.release()
+	return true
+}
+
+// release ends whichever half of the stream this side holds
+func (s *relayedStream) release() {
+	if s.events != nil {
+		close(s.events)
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// closeAll ends every stream without notifying the peer, for when the tunnel drops
+func (sr *streamRelay) closeAll() {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	for id, s := range sr.streams {
+		delete(sr.streams, id)
+		s.release()
+	}
+}
+
+// count returns the number of open streams
+func (sr *streamRelay) count() int {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return len(sr.streams)
+}
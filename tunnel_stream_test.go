@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// linkedStreamRelays wires an app-side and a device-side stream relay back to
+// back, as if joined by the tunnel. The device side fetches with fetch.
+func linkedStreamRelays(fetch func(ctx context.Context, url string) (*http.Response, error)) (*streamRelay, *streamRelay) {
+	var appSide, deviceSide *streamRelay
+	deliver := func(to **streamRelay) func(uint32, byte, []byte) error {
+		return func(id uint32, op byte, data []byte) error {
+			(*to).handle(id, op, append([]byte(nil), data...))
+			return nil
+		}
+	}
+	appSide = newStreamRelay(deliver(&deviceSide), nil)
+	deviceSide = newStreamRelay(deliver(&appSide), fetch)
+	return appSide, deviceSide
+}
+
+func httpFetch(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func TestStreamRelayCarriesResponse(t *testing.T) {
+	body := strings.Repeat("x", streamChunkSize*2+100)
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Write([]byte(body)) //nolint:errcheck
+	}))
+	defer device.Close()
+
+	appSide, deviceSide := linkedStreamRelays(httpFetch)
+	stream, err := appSide.open(device.URL + "/auto/v5.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var header streamHeader
+	var got strings.Builder
+	timeout := time.After(2 * time.Second)
+	for done := false; !done; {
+		select {
+		case ev, ok := <-stream.events:
+			if !ok {
+				done = true
+				break
+			}
+			if ev.op == streamOpHeader {
+				json.Unmarshal(ev.data, &header) //nolint:errcheck
+				continue
+			}
+			got.Write(ev.data)
+		case <-timeout:
+			t.Fatal("relayed stream did not finish")
+		}
+	}
+
+	if header.Status != http.StatusOK || header.ContentType != "video/mp2t" || got.Len() != len(body) {
+		t.Errorf("Expected video/mp2t and %d bytes, got %+v and %d bytes", len(body), header, got.Len())
+	}
+	waitForStreams(t, appSide, deviceSide)
+}
+
+func TestStreamRelayCloseCancelsFetch(t *testing.T) {
+	cancelled := make(chan struct{})
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer device.Close()
+
+	appSide, deviceSide := linkedStreamRelays(httpFetch)
+	stream, err := appSide.open(device.URL + "/auto/v5.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev := <-stream.events; ev.op != streamOpHeader {
+		t.Fatalf("Expected header first, got op %d", ev.op)
+	}
+
+	// The app disconnecting must stop the upstream fetch
+	appSide.finish(stream.id, true)
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the device request to be cancelled")
+	}
+	waitForStreams(t, appSide, deviceSide)
+}
+
+func TestStreamRelayWithoutFetcherRefusesOpen(t *testing.T) {
+	a, b := linkedStreamRelays(nil)
+	b.fetch = nil
+	stream, err := a.open("http://10.0.0.5/discover.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-stream.events; ok {
+		t.Error("Expected the stream to be closed by a peer that can't fetch")
+	}
+}
+
+func waitForStreams(t *testing.T, relays ...*streamRelay) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		open := 0
+		for _, r := range relays {
+			open += r.count()
+		}
+		if open == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected all relayed streams to close")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTunnelFrameRoundTrip(t *testing.T) {
+	in := tunnelFrame{Version: tunnelProtocolVersion, Type: tunnelMsgControl, Channel: 0xdeadbeef, Payload: []byte("data")}
+	out, err := parseTunnelFrame(in.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Version != in.Version || out.Type != in.Type || out.Channel != in.Channel || !bytes.Equal(out.Payload, in.Payload) {
+		t.Errorf("Expected %+v, got %+v", in, out)
+	}
+	if _, err := parseTunnelFrame([]byte{2, 1, 0}); err != errTunnelFrameShort {
+		t.Errorf("Expected errTunnelFrameShort, got %v", err)
+	}
+}
+
+func TestOpPayloadRoundTrip(t *testing.T) {
+	op, data, ok := decodeOpPayload(encodeOpPayload(controlOpData, []byte("payload")))
+	if !ok || op != controlOpData || !bytes.Equal(data, []byte("payload")) {
+		t.Errorf("round trip mismatch: op=%d data=%q ok=%v", op, data, ok)
+	}
+	if _, _, ok := decodeOpPayload(nil); ok {
+		t.Error("empty payload decoded as a control message")
+	}
+}
+
+func TestDiscoverPayloadRoundTrip(t *testing.T) {
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.IPv4(192, 168, 1, 7), Port: 5000},
+		{IP: net.ParseIP("fe80::1"), Port: 5000, Zone: "eth0"},
+		{IP: net.ParseIP("fd00::7"), Port: 65001},
+	} {
+		typ, payload := encodeDiscoverPayload(addr, []byte("discover"))
+		if want := addr.IP.To4() == nil; (typ == tunnelMsgDiscover6) != want {
+			t.Errorf("%v: unexpected message type %d", addr, typ)
+		}
+		got, data, err := decodeDiscoverPayload(typ, payload)
+		if err != nil || !got.IP.Equal(addr.IP) || got.Port != addr.Port || got.Zone != addr.Zone || string(data) != "discover" {
+			t.Errorf("Expected %v and the datagram back, got %v %q, %v", addr, got, data, err)
+		}
+	}
+
+	if _, _, err := decodeDiscoverPayload(tunnelMsgDiscover6, make([]byte, 18)); err == nil {
+		t.Error("Expected a truncated IPv6 discovery message to be rejected")
+	}
+	if _, _, err := decodeDiscoverPayload(tunnelMsgDiscover6, append(make([]byte, 18), 4, 'e')); err == nil {
+		t.Error("Expected a truncated zone to be rejected")
+	}
+}
+
+// linkPair returns a link and the raw connection of its peer
+func linkPair(t *testing.T) (*tunnelLink, net.Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	b.SetDeadline(time.Now().Add(time.Second))
+	return newTunnelLink(a, ""), b
+}
+
+func TestTunnelLinkHandshake(t *testing.T) {
+	link, _ := linkPair(t)
+
+	hello := tunnelFrame{Version: tunnelProtocolVersion, Type: tunnelMsgHello, Payload: []byte(`{"magic":"hdhomerun_proxy","version":2,"role":"TunerProxy"}`)}
+	f, err := link.receive(hello.marshal())
+	if err != nil || f.Type != tunnelMsgHello {
+		t.Fatalf("Expected hello frame, got %+v, %v", f, err)
+	}
+	if !link.isSettled() || link.isLegacy() || link.protocolVersion() != tunnelProtocolVersion {
+		t.Errorf("Expected link settled on v%d, got legacy=%v", tunnelProtocolVersion, link.isLegacy())
+	}
+
+	ping := tunnelFrame{Version: tunnelProtocolVersion, Type: tunnelMsgPing, Channel: 4}
+	if f, err := link.receive(ping.marshal()); err != nil || f.Type != tunnelMsgPing || f.Channel != 4 {
+		t.Errorf("Expected ping on channel 4, got %+v, %v", f, err)
+	}
+	stale := tunnelFrame{Version: 7, Type: tunnelMsgPing}
+	if _, err := link.receive(stale.marshal()); err == nil {
+		t.Error("Expected error for a frame with another version")
+	}
+}
+
+func TestTunnelLinkRejectsOtherVersion(t *testing.T) {
+	link, _ := linkPair(t)
+	hello := tunnelFrame{Version: 3, Type: tunnelMsgHello, Payload: []byte(`{"magic":"hdhomerun_proxy","version":3,"role":"TunerProxy"}`)}
+	if _, err := link.receive(hello.marshal()); err == nil {
+		t.Error("Expected a version mismatch error")
+	}
+	if link.isSettled() {
+		t.Error("Expected a mismatched hello not to settle the link")
+	}
+}
+
+func TestTunnelLinkLegacyPeer(t *testing.T) {
+	link, peer := linkPair(t)
+
+	discovery := append([]byte{192, 168, 1, 7, 0x13, 0x88}, []byte("discover")...)
+	f, err := link.receive(discovery)
+	if err != nil || f.Type != tunnelMsgDiscover || !bytes.Equal(f.Payload, discovery) {
+		t.Fatalf("Expected legacy discovery, got %+v, %v", f, err)
+	}
+	if !link.isLegacy() || link.protocolVersion() != tunnelLegacyVersion {
+		t.Error("Expected link to settle as legacy")
+	}
+
+	if err := link.send(tunnelMsgControl, 1, []byte{controlOpOpen}); err != errTunnelLegacyPeer {
+		t.Errorf("Expected errTunnelLegacyPeer for control on a legacy link, got %v", err)
+	}
+
+	// Discovery goes out bare, with no frame header
+	go link.send(tunnelMsgDiscover, 0, discovery) //nolint:errcheck
+	if msg := readTunnelMessage(t, peer); !bytes.Equal(msg, discovery) {
+		t.Errorf("Expected bare discovery message, got % x", msg)
+	}
+}
+
+func TestTunnelLinkKeepalive(t *testing.T) {
+	link, peer := linkPair(t)
+	link.settle(false, tunnelHello{Version: tunnelProtocolVersion})
+
+	done := make(chan struct{})
+	defer close(done)
+	go link.runKeepalive(10*time.Millisecond, done)
+
+	msg := readTunnelMessage(t, peer)
+	if f, err := parseTunnelFrame(msg); err != nil || f.Type != tunnelMsgPing {
+		t.Errorf("Expected ping, got % x", msg)
+	}
+}
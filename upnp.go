@@ -0,0 +1,421 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UPnP ContentDirectory service, as advertised in device.xml: /control takes
+// SOAP actions browsing the lineup and /subscribe takes GENA subscriptions
+const (
+	// upnpSubscriptionSeconds is the longest subscription granted
+	upnpSubscriptionSeconds = 1800
+	// upnpMaxSubscriptions caps the subscriptions held at once
+	upnpMaxSubscriptions = 64
+
+	// UPnP error codes (UPnP Device Architecture 1.0, section 3.2.2, and
+	// ContentDirectory:1, section 2.5.4)
+	upnpErrInvalidAction = 401
+	upnpErrInvalidArgs   = 402
+	upnpErrNoSuchObject  = 701
+)
+
+// contentDirectorySCPD describes the actions /control implements
+const contentDirectorySCPD = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action><name>GetSearchCapabilities</name><argumentList>
+      <argument><name>SearchCaps</name><direction>out</direction><relatedStateVariable>SearchCapabilities</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSortCapabilities</name><argumentList>
+      <argument><name>SortCaps</name><direction>out</direction><relatedStateVariable>SortCapabilities</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSystemUpdateID</name><argumentList>
+      <argument><name>Id</name><direction>out</direction><relatedStateVariable>SystemUpdateID</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>Browse</name><argumentList>
+      <argument><name>ObjectID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+      <argument><name>BrowseFlag</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_BrowseFlag</relatedStateVariable></argument>
+      <argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+      <argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+      <argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+      <argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+      <argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+    </argumentList></action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="no"><name>SearchCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SortCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SystemUpdateID</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ObjectID</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Result</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_BrowseFlag</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>BrowseMetadata</allowedValue><allowedValue>BrowseDirectChildren</allowedValue></allowedValueList></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Filter</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_SortCriteria</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Index</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Count</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_UpdateID</name><dataType>ui4</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>
+`
+
+// soapArg is one named argument of a SOAP action or its response
+type soapArg struct {
+	name  string
+	value string
+}
+
+// soapRequest is the part of a SOAP envelope /control reads: the action
+// element and the Browse arguments, whichever namespace the client used
+type soapRequest struct {
+	Body struct {
+		Action struct {
+			XMLName        xml.Name
+			ObjectID       string `xml:"ObjectID"`
+			BrowseFlag     string `xml:"BrowseFlag"`
+			StartingIndex  string `xml:"StartingIndex"`
+			RequestedCount string `xml:"RequestedCount"`
+		} `xml:",any"`
+	} `xml:"Body"`
+}
+
+// handleContentDirectorySCPD handles /content_directory.xml
+func (he *HDHREndpointServer) handleContentDirectorySCPD(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write([]byte(contentDirectorySCPD)) //nolint:errcheck
+}
+
+// handleControl handles /control, the ContentDirectory's SOAP actions. The
+// root container "0" holds one videoBroadcast item per lineup channel,
+// streamed from /auto like lineup.json's URLs.
+func (he *HDHREndpointServer) handleControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req soapRequest
+	if err := xml.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeSOAPFault(w, upnpErrInvalidAction, "Invalid Action")
+		return
+	}
+	action := req.Body.Action.XMLName.Local
+	if soapAction := strings.Trim(r.Header.Get("SOAPACTION"), `"`); soapAction != "" {
+		if _, name, ok := strings.Cut(soapAction, "#"); ok {
+			action = name
+		}
+	}
+
+	switch action {
+	case "GetSearchCapabilities":
+		writeSOAPResponse(w, action, soapArg{"SearchCaps", ""})
+	case "GetSortCapabilities":
+		writeSOAPResponse(w, action, soapArg{"SortCaps", ""})
+	case "GetSystemUpdateID":
+		writeSOAPResponse(w, action, soapArg{"Id", he.systemUpdateID()})
+	case "Browse":
+		args := req.Body.Action
+		he.browse(w, r, args.ObjectID, args.BrowseFlag, args.StartingIndex, args.RequestedCount)
+	default:
+		writeSOAPFault(w, upnpErrInvalidAction, "Invalid Action")
+	}
+}
+
+// systemUpdateID is the ContentDirectory's SystemUpdateID. It follows the
+// router's lineup version, so clients can tell when the lineup has changed.
+func (he *HDHREndpointServer) systemUpdateID() string {
+	var version uint64
+	if v, ok := he.router.(lineupVersioner); ok {
+		version = v.LineupVersion()
+	}
+	return strconv.FormatUint(uint64(uint32(version+1)), 10) // a ui4, starting at 1
+}
+
+// browse answers a Browse action for the root container or one channel
+func (he *HDHREndpointServer) browse(w http.ResponseWriter, r *http.Request, objectID, flag, startArg, countArg string) {
+	start, err1 := strconv.Atoi(cmp.Or(startArg, "0"))
+	count, err2 := strconv.Atoi(cmp.Or(countArg, "0"))
+	if err1 != nil || err2 != nil || start < 0 || count < 0 {
+		writeSOAPFault(w, upnpErrInvalidArgs, "Invalid Args")
+		return
+	}
+
+	lineup := he.lineupEntries(r)
+	var objects []string
+	total := 1
+	switch {
+	case objectID == "0" && flag == "BrowseMetadata":
+		title := he.getDeviceConfig(r).FriendlyName
+		objects = append(objects, fmt.Sprintf(`<container id="0" parentID="-1" restricted="1" childCount="%d"><dc:title>%s</dc:title><upnp:class>object.container</upnp:class></container>`,
+			len(lineup), xmlEscape(title)))
+	case objectID == "0" && flag == "BrowseDirectChildren":
+		total = len(lineup)
+		end := total
+		if count > 0 {
+			end = min(start+count, total)
+		}
+		for i := start; i < end; i++ {
+			objects = append(objects, didlItem(lineup[i]))
+		}
+	case flag == "BrowseMetadata":
+		for _, item := range lineup {
+			if "v"+item.GuideNumber == objectID {
+				objects = append(objects, didlItem(item))
+			}
+		}
+		if len(objects) == 0 {
+			writeSOAPFault(w, upnpErrNoSuchObject, "No such object")
+			return
+		}
+	case flag == "BrowseDirectChildren":
+		writeSOAPFault(w, upnpErrNoSuchObject, "No such object")
+		return
+	default:
+		writeSOAPFault(w, upnpErrInvalidArgs, "Invalid Args")
+		return
+	}
+
+	didl := `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">` +
+		strings.Join(objects, "") + `</DIDL-Lite>`
+	writeSOAPResponse(w, "Browse",
+		soapArg{"Result", didl},
+		soapArg{"NumberReturned", strconv.Itoa(len(objects))},
+		soapArg{"TotalMatches", strconv.Itoa(total)},
+		soapArg{"UpdateID", he.systemUpdateID()})
+}
+
+// didlItem describes a lineup channel as a DIDL-Lite broadcast item
+func didlItem(item LineupItemJSON) string {
+	return fmt.Sprintf(`<item id="v%s" parentID="0" restricted="1"><dc:title>%s</dc:title><upnp:class>object.item.videoItem.videoBroadcast</upnp:class><res protocolInfo="http-get:*:video/mpeg:*">%s</res></item>`,
+		xmlEscape(item.GuideNumber), xmlEscape(item.GuideNumber+" "+item.GuideName), xmlEscape(item.URL))
+}
+
+// writeSOAPResponse writes the response to a ContentDirectory action
+func writeSOAPResponse(w http.ResponseWriter, action string, args ...soapArg) {
+	var b strings.Builder
+	for _, arg := range args {
+		fmt.Fprintf(&b, "<%s>%s</%s>", arg.name, xmlEscape(arg.value), arg.name)
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("EXT", "")
+	fmt.Fprintf(w, `<?xml version="1.0"?>`+"\n"+
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">`+
+		`<s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>`,
+		action, upnpContentDirectoryType, b.String(), action)
+}
+
+// writeSOAPFault writes a UPnP error, which SOAP carries as a 500 fault
+func writeSOAPFault(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0"?>`+"\n"+
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">`+
+		`<s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError>`+
+		`</detail></s:Fault></s:Body></s:Envelope>`,
+		code, xmlEscape(description))
+}
+
+// xmlEscape escapes s for XML character data and attribute values
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s)) //nolint:errcheck
+	return b.String()
+}
+
+// upnpSubscriptions tracks GENA event subscriptions to the ContentDirectory
+// by SID, with when each expires
+type upnpSubscriptions struct {
+	mu   sync.Mutex
+	subs map[string]time.Time
+}
+
+// subscribe adds a subscription, returning its SID, or false if
+// upnpMaxSubscriptions are already held
+func (us *upnpSubscriptions) subscribe(timeout time.Duration) (string, bool) {
+	var b [16]byte
+	rand.Read(b[:]) //nolint:errcheck
+	sid := fmt.Sprintf("uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.expire()
+	if len(us.subs) >= upnpMaxSubscriptions {
+		return "", false
+	}
+	if us.subs == nil {
+		us.subs = make(map[string]time.Time)
+	}
+	us.subs[sid] = time.Now().Add(timeout)
+	return sid, true
+}
+
+// renew extends a subscription, reporting false if sid is unknown or expired
+func (us *upnpSubscriptions) renew(sid string, timeout time.Duration) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.expire()
+	if _, ok := us.subs[sid]; !ok {
+		return false
+	}
+	us.subs[sid] = time.Now().Add(timeout)
+	return true
+}
+
+// cancel removes a subscription, reporting false if sid is unknown or expired
+func (us *upnpSubscriptions) cancel(sid string) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.expire()
+	if _, ok := us.subs[sid]; !ok {
+		return false
+	}
+	delete(us.subs, sid)
+	return true
+}
+
+// expire drops lapsed subscriptions; the caller holds mu
+func (us *upnpSubscriptions) expire() {
+	now := time.Now()
+	for sid, expires := range us.subs {
+		if now.After(expires) {
+			delete(us.subs, sid)
+		}
+	}
+}
+
+// subscriptionTimeout parses a TIMEOUT header such as "Second-300", capped
+// at the longest subscription granted
+func subscriptionTimeout(header string) time.Duration {
+	if n, err := strconv.Atoi(strings.TrimPrefix(header, "Second-")); err == nil && n > 0 && n < upnpSubscriptionSeconds {
+		return time.Duration(n) * time.Second
+	}
+	return upnpSubscriptionSeconds * time.Second
+}
+
+// handleSubscribe handles /subscribe: GENA SUBSCRIBE, renewal and
+// UNSUBSCRIBE for the ContentDirectory's evented SystemUpdateID. A new
+// subscriber is sent the initial event at its callback URL.
+func (he *HDHREndpointServer) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	sid := r.Header.Get("SID")
+	callback := r.Header.Get("CALLBACK")
+	nt := r.Header.Get("NT")
+
+	switch r.Method {
+	case "SUBSCRIBE":
+		timeout := subscriptionTimeout(r.Header.Get("TIMEOUT"))
+		switch {
+		case sid != "" && (callback != "" || nt != ""):
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		case sid != "":
+			if !he.events.renew(sid, timeout) {
+				http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+				return
+			}
+		default:
+			url, ok := eventCallbackURL(callback)
+			if nt != "upnp:event" || !ok || !callbackToRequester(url, r.RemoteAddr) {
+				http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+				return
+			}
+			if sid, ok = he.events.subscribe(timeout); !ok {
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			go sendInitialEvent(url, sid, he.systemUpdateID())
+		}
+		w.Header().Set("SID", sid)
+		w.Header().Set("TIMEOUT", fmt.Sprintf("Second-%d", int(timeout.Seconds())))
+		w.Header().Set("SERVER", ssdpServer)
+		w.WriteHeader(http.StatusOK)
+	case "UNSUBSCRIBE":
+		if sid == "" || callback != "" || nt != "" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if !he.events.cancel(sid) {
+			http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// eventCallbackURL returns the first http URL of a CALLBACK header, which
+// lists them in angle brackets
+func eventCallbackURL(header string) (string, bool) {
+	for _, part := range strings.Split(header, ">") {
+		url := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(part), "<"))
+		if strings.HasPrefix(url, "http://") {
+			return url, true
+		}
+	}
+	return "", false
+}
+
+// callbackToRequester reports whether a callback URL points back at the host
+// that subscribed, so a subscription can't aim events at a third party
+func callbackToRequester(callback, remoteAddr string) bool {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(u.Hostname())
+	return ip != nil && ip.Equal(net.ParseIP(host))
+}
+
+// eventClient delivers event messages; subscribers that don't answer
+// promptly are given up on
+var eventClient = &http.Client{Timeout: 5 * time.Second}
+
+// sendInitialEvent sends a new subscriber the current value of every evented
+// variable, as GENA requires
+func sendInitialEvent(url, sid, systemUpdateID string) {
+	body := `<?xml version="1.0"?>` + "\n" +
+		`<e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0"><e:property><SystemUpdateID>` +
+		systemUpdateID + `</SystemUpdateID></e:property></e:propertyset>`
+	req, err := http.NewRequest("NOTIFY", url, strings.NewReader(body))
+	if err != nil {
+		slog.Debug("Invalid UPnP event callback", "url", url, "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("NT", "upnp:event")
+	req.Header.Set("NTS", "upnp:propchange")
+	req.Header.Set("SID", sid)
+	req.Header.Set("SEQ", "0")
+
+	resp, err := eventClient.Do(req)
+	if err != nil {
+		slog.Debug("Error sending UPnP event", "url", url, "err", err)
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeviceXMLDescribesContentDirectory(t *testing.T) {
+	store := newConfigStore(DefaultConfig(), "")
+	handler := NewHDHREndpointServer(store, &mockHDHRStatsProvider{}).Handler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/device.xml", nil))
+
+	var device DeviceXML
+	if err := xml.Unmarshal(w.Body.Bytes(), &device); err != nil {
+		t.Fatalf("Failed to decode device.xml: %v", err)
+	}
+	id := ResolveDeviceIdentity(store.Get())
+	if device.Device.DeviceType != upnpDeviceType || device.Device.UDN != deviceUDN(id.DeviceID) {
+		t.Errorf("Expected the MediaServer type and the SSDP UDN, got %+v", device.Device)
+	}
+	if device.URLBase != "http://example.com" {
+		t.Errorf("Expected URLBase from the request, got %q", device.URLBase)
+	}
+	services := device.Device.ServiceList.Service
+	if len(services) != 1 || services[0].ControlURL != "/control" || services[0].SCPDURL != "/content_directory.xml" {
+		t.Fatalf("Expected the ContentDirectory service, got %+v", services)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", services[0].SCPDURL, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<name>Browse</name>") {
+		t.Errorf("Expected the service description, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+// soapCall posts a ContentDirectory action to /control
+func soapCall(handler http.Handler, action, args string) *httptest.ResponseRecorder {
+	body := `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+		`<u:` + action + ` xmlns:u="urn:schemas-upnp-org:service:ContentDirectory:1">` + args + `</u:` + action + `>` +
+		`</s:Body></s:Envelope>`
+	req := httptest.NewRequest("POST", "/control", strings.NewReader(body))
+	req.Header.Set("SOAPACTION", `"urn:schemas-upnp-org:service:ContentDirectory:1#`+action+`"`)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestControlBrowseLineup(t *testing.T) {
+	router := &mockLineupRouter{items: []TunarrLineupItem{
+		{GuideNumber: "100", GuideName: "Movies"},
+		{GuideNumber: "101", GuideName: "Cats & Dogs"},
+		{GuideNumber: "102", GuideName: "Hidden", Hidden: true},
+	}}
+	handler := NewHDHREndpointServer(newConfigStore(DefaultConfig(), ""), router).Handler()
+
+	w := soapCall(handler, "Browse", "<ObjectID>0</ObjectID><BrowseFlag>BrowseDirectChildren</BrowseFlag><StartingIndex>1</StartingIndex><RequestedCount>0</RequestedCount>")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Result         string `xml:"Body>BrowseResponse>Result"`
+		NumberReturned int    `xml:"Body>BrowseResponse>NumberReturned"`
+		TotalMatches   int    `xml:"Body>BrowseResponse>TotalMatches"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode Browse response: %v", err)
+	}
+	if resp.NumberReturned != 1 || resp.TotalMatches != 2 {
+		t.Errorf("Expected the second of two visible channels, got %d of %d", resp.NumberReturned, resp.TotalMatches)
+	}
+	for _, want := range []string{`id="v101"`, "101 Cats &amp; Dogs", ">http://example.com/auto/v101</res>", "object.item.videoItem.videoBroadcast"} {
+		if !strings.Contains(resp.Result, want) {
+			t.Errorf("Expected DIDL-Lite to contain %q, got %q", want, resp.Result)
+		}
+	}
+
+	if w := soapCall(handler, "Browse", "<ObjectID>v999</ObjectID><BrowseFlag>BrowseMetadata</BrowseFlag>"); w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "<errorCode>701</errorCode>") {
+		t.Errorf("Expected No such object for an unknown channel, got %d %q", w.Code, w.Body.String())
+	}
+	if w := soapCall(handler, "DestroyObject", ""); !strings.Contains(w.Body.String(), "<errorCode>401</errorCode>") {
+		t.Errorf("Expected Invalid Action for an unimplemented action, got %q", w.Body.String())
+	}
+	if w := soapCall(handler, "GetSystemUpdateID", ""); !strings.Contains(w.Body.String(), "<Id>1</Id>") {
+		t.Errorf("Expected the SystemUpdateID, got %q", w.Body.String())
+	}
+}
+
+// versionedLineupRouter is a lineup router whose lineup version can move on
+type versionedLineupRouter struct {
+	mockLineupRouter
+	version uint64
+}
+
+func (m *versionedLineupRouter) LineupVersion() uint64 { return m.version }
+
+func TestSystemUpdateIDFollowsLineupVersion(t *testing.T) {
+	router := &versionedLineupRouter{mockLineupRouter: mockLineupRouter{items: []TunarrLineupItem{{GuideNumber: "100", GuideName: "Movies"}}}}
+	handler := NewHDHREndpointServer(newConfigStore(DefaultConfig(), ""), router).Handler()
+
+	if w := soapCall(handler, "GetSystemUpdateID", ""); !strings.Contains(w.Body.String(), "<Id>1</Id>") {
+		t.Errorf("Expected SystemUpdateID 1 before any change, got %q", w.Body.String())
+	}
+	router.version = 2
+	if w := soapCall(handler, "GetSystemUpdateID", ""); !strings.Contains(w.Body.String(), "<Id>3</Id>") {
+		t.Errorf("Expected the SystemUpdateID to follow the lineup version, got %q", w.Body.String())
+	}
+	w := soapCall(handler, "Browse", "<ObjectID>0</ObjectID><BrowseFlag>BrowseDirectChildren</BrowseFlag>")
+	if !strings.Contains(w.Body.String(), "<UpdateID>3</UpdateID>") {
+		t.Errorf("Expected Browse to report the same UpdateID, got %q", w.Body.String())
+	}
+}
+
+func TestSubscribeLifecycle(t *testing.T) {
+	events := make(chan *http.Request, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r
+	}))
+	defer callback.Close()
+
+	handler := NewHDHREndpointServer(newConfigStore(DefaultConfig(), ""), &mockHDHRStatsProvider{}).Handler()
+	gena := func(method string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/subscribe", nil)
+		req.RemoteAddr = "127.0.0.1:40000"
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := gena("SUBSCRIBE", map[string]string{"CALLBACK": "<" + callback.URL + "/event>", "NT": "upnp:event", "TIMEOUT": "Second-300"})
+	sid := w.Header().Get("SID")
+	if w.Code != http.StatusOK || !strings.HasPrefix(sid, "uuid:") || w.Header().Get("TIMEOUT") != "Second-300" {
+		t.Fatalf("Expected a subscription, got %d %v", w.Code, w.Header())
+	}
+	select {
+	case r := <-events:
+		if r.Method != "NOTIFY" || r.Header.Get("SID") != sid || r.Header.Get("SEQ") != "0" || r.URL.Path != "/event" {
+			t.Errorf("Expected the initial event at the callback, got %s %s %v", r.Method, r.URL.Path, r.Header)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the initial event to be sent")
+	}
+
+	if w := gena("SUBSCRIBE", map[string]string{"SID": sid}); w.Code != http.StatusOK || w.Header().Get("SID") != sid {
+		t.Errorf("Expected the subscription renewed, got %d", w.Code)
+	}
+	if w := gena("SUBSCRIBE", map[string]string{"CALLBACK": "<" + callback.URL + ">"}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 without NT, got %d", w.Code)
+	}
+	if w := gena("UNSUBSCRIBE", map[string]string{"SID": sid}); w.Code != http.StatusOK {
+		t.Errorf("Expected the subscription cancelled, got %d", w.Code)
+	}
+	if w := gena("SUBSCRIBE", map[string]string{"SID": sid}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 renewing a cancelled subscription, got %d", w.Code)
+	}
+	if w := gena("GET", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", w.Code)
+	}
+}
+
+func TestSubscribeRejectsForeignCallback(t *testing.T) {
+	handler := NewHDHREndpointServer(newConfigStore(DefaultConfig(), ""), &mockHDHRStatsProvider{}).Handler()
+
+	req := httptest.NewRequest("SUBSCRIBE", "/subscribe", nil)
+	req.RemoteAddr = "192.168.1.20:40000"
+	req.Header.Set("CALLBACK", "<http://10.0.0.5:8080/event>")
+	req.Header.Set("NT", "upnp:event")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a callback to another host, got %d", w.Code)
+	}
+
+	for _, tc := range []struct {
+		callback, remote string
+		want             bool
+	}{
+		{"http://192.168.1.20:8080/event", "192.168.1.20:40000", true},
+		{"http://[fe80::1]:8080/", "[fe80::1]:40000", true},
+		{"http://192.168.1.21/", "192.168.1.20:40000", false},
+		{"http://localhost/", "127.0.0.1:40000", false},
+	} {
+		if got := callbackToRequester(tc.callback, tc.remote); got != tc.want {
+			t.Errorf("Expected callbackToRequester(%q, %q) = %v, got %v", tc.callback, tc.remote, tc.want, got)
+		}
+	}
+}
+
+func TestSubscriptionsCapped(t *testing.T) {
+	var us upnpSubscriptions
+	for i := 0; i < upnpMaxSubscriptions; i++ {
+		if _, ok := us.subscribe(time.Minute); !ok {
+			t.Fatalf("Expected subscription %d to be granted", i)
+		}
+	}
+	if _, ok := us.subscribe(time.Minute); ok {
+		t.Error("Expected subscriptions past the cap to be refused")
+	}
+
+	us.mu.Lock()
+	for sid := range us.subs {
+		us.subs[sid] = time.Now().Add(-time.Second)
+	}
+	us.mu.Unlock()
+	if _, ok := us.subscribe(time.Minute); !ok {
+		t.Error("Expected lapsed subscriptions to make room")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// virtualDeviceHTTPTimeout bounds each discover.json / lineup.json fetch from a pool member
+const virtualDeviceHTTPTimeout = 5 * time.Second
+
+// errChannelNotInPool is returned by virtualDevicePool.Acquire when no member carries the channel
+var errChannelNotInPool = fmt.Errorf("%w: no pooled device carries it", errChannelNotCarried)
+
+// virtualDevicePool presents several physical HDHomeRuns as a single device:
+// their tuners are pooled and their lineups merged
+type virtualDevicePool struct {
+	client  *http.Client
+	mu      sync.Mutex
+	members []*poolMember
+}
+
+// poolMember is one physical HDHomeRun in a virtualDevicePool
+type poolMember struct {
+	addr       string // as configured: IP, host:port or base URL
+	baseURL    string
+	tunerCount int
+	inUse      int
+	channels   map[string]string // GuideNumber -> stream URL on this device; nil if the last refresh failed
+	refreshed  time.Time         // last refresh attempt
+	seen       time.Time         // last successful refresh
+}
+
+// PoolMemberStats is a point-in-time snapshot of one pooled device
+type PoolMemberStats struct {
+	Addr          string
+	TunerCount    int
+	TunersInUse   int
+	Channels      int
+	Reachable     bool // answered the last refresh
+	LastRefreshed time.Time
+	LastSeen      time.Time
+}
+
+// newVirtualDevicePool creates a pool over the given device addresses.
+// Call Refresh to learn each device's tuner count and lineup.
+func newVirtualDevicePool(addrs []string) *virtualDevicePool {
+	p := &virtualDevicePool{client: &http.Client{Timeout: virtualDeviceHTTPTimeout}}
+	for _, addr := range addrs {
+		p.members = append(p.members, &poolMember{addr: addr, baseURL: memberBaseURL(addr)})
+	}
+	return p
+}
+
+// memberBaseURL turns a configured device address into the URL its HTTP API is served from
+func memberBaseURL(addr string) string {
+	if strings.Contains(addr, "://") {
+		return strings.TrimRight(addr, "/")
+	}
+	return "http://" + addr
+}
+
+// Refresh re-reads every member's discover.json and lineup.json and returns
+// the merged lineup. When several devices carry the same GuideNumber the
+// first configured device's entry is listed; streams may still be served by
+// any device carrying it. An error is returned only if no member answered.
+func (p *virtualDevicePool) Refresh(ctx context.Context) ([]TunarrLineupItem, error) {
+	type result struct {
+		tunerCount int
+		lineup     []TunarrLineupItem
+		err        error
+	}
+	results := make([]result, len(p.members))
+
+	var wg sync.WaitGroup
+	for i, m := range p.members {
+		wg.Add(1)
+		go func(i int, baseURL string) {
+			defer wg.Done()
+			var discover TunarrDiscoverResponse
+			if err := fetchJSON(ctx, p.client, baseURL+"/discover.json", &discover); err != nil {
+				results[i].err = err
+				return
+			}
+			var lineup []TunarrLineupItem
+			if err := fetchJSON(ctx, p.client, baseURL+"/lineup.json", &lineup); err != nil {
+				results[i].err = err
+				return
+			}
+			results[i] = result{tunerCount: discover.TunerCount, lineup: lineup}
+		}(i, m.baseURL)
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var merged []TunarrLineupItem
+	var errs []error
+	seen := make(map[string]bool)
+	now := time.Now()
+	for i, m := range p.members {
+		res := results[i]
+		m.refreshed = now
+		if res.err != nil {
+			// Keep the last known tuner count but stop routing streams to the device
+			slog.Warn("Virtual device member unavailable", "device", m.addr, "err", res.err)
+			m.channels = nil
+			errs = append(errs, fmt.Errorf("%s: %w", m.addr, res.err))
+			continue
+		}
+
+		m.tunerCount = res.tunerCount
+		m.seen = now
+		m.channels = make(map[string]string, len(res.lineup))
+		for _, item := range res.lineup {
+			if item.GuideNumber == "" {
+				continue
+			}
+			m.channels[item.GuideNumber] = item.URL
+			if seen[item.GuideNumber] {
+				continue
+			}
+			seen[item.GuideNumber] = true
+			merged = append(merged, item)
+		}
+	}
+
+	if len(errs) == len(p.members) {
+		return nil, errors.Join(errs...)
+	}
+	slog.Debug("Virtual device lineup merged", "devices", len(p.members), "channels", len(merged))
+	return merged, nil
+}
+
+// fetchJSON GETs url and decodes its JSON body into v
+func fetchJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// TunerCount returns the number of tuners across all pooled devices
+func (p *virtualDevicePool) TunerCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	total := 0
+	for _, m := range p.members {
+		total += m.tunerCount
+	}
+	return total
+}
+
+// Acquire reserves a tuner on the first device that carries channel and has
+// one free, returning that device's stream URL and a func that frees the tuner
+func (p *virtualDevicePool) Acquire(channel string) (string, func(), error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	carried := false
+	for _, m := range p.members {
+		url, ok := m.channels[channel]
+		if !ok {
+			continue
+		}
+		carried = true
+		if m.inUse >= m.tunerCount {
+			continue
+		}
+
+		m.inUse++
+		if url == "" {
+			url = fmt.Sprintf("%s/auto/v%s", m.baseURL, channel)
+		}
+		slog.Debug("Virtual device tuner acquired", "device", m.addr, "channel", channel, "in_use", m.inUse)
+
+		var once sync.Once
+		release := func() {
+			once.Do(func() {
+				p.mu.Lock()
+				m.inUse--
+				p.mu.Unlock()
+			})
+		}
+		return url, release, nil
+	}
+
+	if carried {
+		return "", nil, ErrNoTunerAvailable
+	}
+	return "", nil, errChannelNotInPool
+}
+
+// Stats returns a snapshot of every pooled device, in configured order
+func (p *virtualDevicePool) Stats() []PoolMemberStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]PoolMemberStats, 0, len(p.members))
+	for _, m := range p.members {
+		stats = append(stats, PoolMemberStats{
+			Addr:          m.addr,
+			TunerCount:    m.tunerCount,
+			TunersInUse:   m.inUse,
+			Channels:      len(m.channels),
+			Reachable:     m.channels != nil,
+			LastRefreshed: m.refreshed,
+			LastSeen:      m.seen,
+		})
+	}
+	return stats
+}
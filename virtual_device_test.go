@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeHDHRDevice serves discover.json and lineup.json like a physical
+// HDHomeRun, with stream URLs pointing back at itself
+func fakeHDHRDevice(t *testing.T, tuners int, channels ...string) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/discover.json":
+			json.NewEncoder(w).Encode(TunarrDiscoverResponse{TunerCount: tuners}) //nolint:errcheck
+		case "/lineup.json":
+			var lineup []TunarrLineupItem
+			for _, ch := range channels {
+				lineup = append(lineup, TunarrLineupItem{GuideNumber: ch, GuideName: "Ch " + ch, URL: srv.URL + "/auto/v" + ch})
+			}
+			json.NewEncoder(w).Encode(lineup) //nolint:errcheck
+		default:
+			w.Write([]byte{0x47}) //nolint:errcheck
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestVirtualDevicePoolMergesLineups(t *testing.T) {
+	flex := fakeHDHRDevice(t, 4, "2.1", "4.1", "5.1")
+	prime := fakeHDHRDevice(t, 3, "4.1", "702")
+
+	pool := newVirtualDevicePool([]string{flex.URL, prime.URL})
+	lineup, err := pool.Refresh(context.Background())
+	if err != nil {
+		t.Fatalf("Refresh error: %v", err)
+	}
+
+	if pool.TunerCount() != 7 {
+		t.Errorf("Expected 7 pooled tuners, got %d", pool.TunerCount())
+	}
+
+	var got []string
+	for _, item := range lineup {
+		got = append(got, item.GuideNumber)
+	}
+	want := []string{"2.1", "4.1", "5.1", "702"}
+	if len(got) != len(want) {
+		t.Fatalf("Expected merged lineup %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected merged lineup %v, got %v", want, got)
+			break
+		}
+	}
+	if lineup[1].URL != flex.URL+"/auto/v4.1" {
+		t.Errorf("Expected duplicate 4.1 listed from the first device, got %q", lineup[1].URL)
+	}
+}
+
+func TestVirtualDevicePoolAcquireSpillsToFreeDevice(t *testing.T) {
+	flex := fakeHDHRDevice(t, 1, "4.1")
+	prime := fakeHDHRDevice(t, 1, "4.1")
+
+	pool := newVirtualDevicePool([]string{flex.URL, prime.URL})
+	if _, err := pool.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh error: %v", err)
+	}
+
+	first, releaseFirst, err := pool.Acquire("4.1")
+	if err != nil || first != flex.URL+"/auto/v4.1" {
+		t.Fatalf("Expected first stream on the first device, got %q, %v", first, err)
+	}
+	second, releaseSecond, err := pool.Acquire("4.1")
+	if err != nil || second != prime.URL+"/auto/v4.1" {
+		t.Fatalf("Expected second stream on the second device, got %q, %v", second, err)
+	}
+	if _, _, err := pool.Acquire("4.1"); !errors.Is(err, ErrNoTunerAvailable) {
+		t.Errorf("Expected ErrNoTunerAvailable with every tuner busy, got %v", err)
+	}
+	if _, _, err := pool.Acquire("9.9"); !errors.Is(err, errChannelNotInPool) {
+		t.Errorf("Expected errChannelNotInPool for unknown channel, got %v", err)
+	}
+
+	releaseFirst()
+	releaseFirst() // releasing twice must not free a second tuner
+	if again, _, err := pool.Acquire("4.1"); err != nil || again != flex.URL+"/auto/v4.1" {
+		t.Errorf("Expected released tuner to be reused, got %q, %v", again, err)
+	}
+	releaseSecond()
+
+	for _, m := range pool.Stats() {
+		if m.TunersInUse > m.TunerCount {
+			t.Errorf("Device %s over-allocated: %+v", m.Addr, m)
+		}
+	}
+}
+
+func TestVirtualDevicePoolSkipsUnreachableMember(t *testing.T) {
+	flex := fakeHDHRDevice(t, 4, "2.1")
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	pool := newVirtualDevicePool([]string{down.URL, flex.URL})
+	lineup, err := pool.Refresh(context.Background())
+	if err != nil {
+		t.Fatalf("Expected partial refresh to succeed, got %v", err)
+	}
+	if len(lineup) != 1 || pool.TunerCount() != 4 {
+		t.Errorf("Expected only the reachable device pooled, got %d channels / %d tuners", len(lineup), pool.TunerCount())
+	}
+
+	all := newVirtualDevicePool([]string{down.URL})
+	if _, err := all.Refresh(context.Background()); err == nil {
+		t.Error("Expected an error when no device is reachable")
+	}
+}
+
+func TestAutoStreamVirtualDevice(t *testing.T) {
+	flex := fakeHDHRDevice(t, 1, "4.1")
+	store := newConfigStore(DefaultConfig(), "")
+	router := &backendRouter{name: "AppProxy", store: store}
+	if err := router.useBackends([]BackendConfig{{Type: backendTypeHDHR, Devices: []string{flex.URL}, VirtualDevice: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.startBackends(context.Background()); err != nil {
+		t.Fatalf("startBackends error: %v", err)
+	}
+	pool := router.backends[0].Backend.(*hdhrBackend).pool
+
+	server := NewHDHREndpointServer(store, router)
+	if n := server.tunerStates.GetTunerCount(); n != 1 {
+		t.Fatalf("Expected tuner states sized to the pool, got %d", n)
+	}
+
+	_, release, _ := pool.Acquire("4.1")
+	req := httptest.NewRequest("GET", "/auto/v4.1", nil)
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("X-HDHomeRun-Error") != "805 All Tuners In Use" {
+		t.Errorf("Expected 805 while the pooled tuner is busy, got %d %q", w.Code, w.Header().Get("X-HDHomeRun-Error"))
+	}
+	release()
+
+	w = httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/auto/v4.1", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 once the tuner is free, got %d", w.Code)
+	}
+	waitForIdleTuners(t, server)
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"reflect"
 	"time"
 )
 
@@ -19,6 +20,12 @@ type webServer struct {
 	router statsProvider
 }
 
+// lineupInvalidator is implemented by backendRouter; it drops the lineups
+// it holds so they are fetched again at the next request
+type lineupInvalidator interface {
+	InvalidateLineups()
+}
+
 func newWebServer(store *configStore, router statsProvider) *webServer {
 	return &webServer{store: store, router: router}
 }
@@ -128,16 +135,32 @@ func (ws *webServer) handleConfig(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(map[string]string{"error": "invalid config: hdhomerun_port and tcp_port must be non-zero"}) //nolint:errcheck
 			return
 		}
+		if _, err := buildBackendChain(newCfg.Backends, nil); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid config: " + err.Error()}) //nolint:errcheck
+			return
+		}
+		if _, err := compileChannelRules(newCfg.ChannelRules); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid config: " + err.Error()}) //nolint:errcheck
+			return
+		}
 		// Preserve webui credentials if the POST body didn't include them,
 		// preventing accidental lockout when saving unrelated settings.
 		if newCfg.WebUI.Addr == "" && newCfg.WebUI.User == "" && newCfg.WebUI.Pass == "" {
 			newCfg.WebUI = ws.store.Get().WebUI
 		}
+		oldRules := ws.store.Get().ChannelRules
 		if err := ws.store.Set(&newCfg); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()}) //nolint:errcheck
 			return
 		}
+		// Lineups are held with the old rules applied; drop them so the new
+		// rules apply at the next lineup request rather than the next refresh
+		if inv, ok := ws.router.(lineupInvalidator); ok && (len(oldRules) > 0 || len(newCfg.ChannelRules) > 0) && !reflect.DeepEqual(oldRules, newCfg.ChannelRules) {
+			inv.InvalidateLineups()
+		}
 		json.NewEncoder(w).Encode(map[string]bool{"ok": true}) //nolint:errcheck
 	case http.MethodGet:
 		json.NewEncoder(w).Encode(configResponse{ //nolint:errcheck
@@ -178,6 +178,75 @@ func TestWebServerPostConfigInvalid(t *testing.T) {
 	}
 }
 
+func TestWebServerPostConfigInvalidBackend(t *testing.T) {
+	_, srv := makeTestServer(t)
+	body := `{"hdhomerun_port": 65001, "tcp_port": 65001, "backends": [{"type": "hdhr"}]}`
+	req, _ := http.NewRequest("POST", srv.URL+"/api/config", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("testuser", "testpass")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an hdhr backend without devices, got %d", resp.StatusCode)
+	}
+}
+
+func TestWebServerPostConfigInvalidChannelRule(t *testing.T) {
+	_, srv := makeTestServer(t)
+	body := `{"hdhomerun_port": 65001, "tcp_port": 65001, "channel_rules": [{"match": "(", "hide": true}]}`
+	req, _ := http.NewRequest("POST", srv.URL+"/api/config", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("testuser", "testpass")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for a channel rule with an invalid regex, got %d", resp.StatusCode)
+	}
+}
+
+// invalidatingStatsProvider records whether the lineups it holds were dropped
+type invalidatingStatsProvider struct {
+	mockStatsProvider
+	invalidated int
+}
+
+func (m *invalidatingStatsProvider) InvalidateLineups() { m.invalidated++ }
+
+func TestWebServerPostConfigInvalidatesLineups(t *testing.T) {
+	cfg := DefaultConfig()
+	router := &invalidatingStatsProvider{}
+	srv := httptest.NewServer(newWebServer(newConfigStore(cfg, ""), router).handler())
+	defer srv.Close()
+	post := func(c *Config) {
+		body, _ := json.Marshal(c)
+		req, _ := http.NewRequest("POST", srv.URL+"/api/config", strings.NewReader(string(body)))
+		req.SetBasicAuth(cfg.WebUI.User, cfg.WebUI.Pass)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	unchanged := *cfg
+	unchanged.Debug = true
+	post(&unchanged)
+	if router.invalidated != 0 {
+		t.Error("Expected lineups kept when the channel rules didn't change")
+	}
+
+	changed := unchanged
+	changed.ChannelRules = []ChannelRule{{Channels: []string{"5"}, Hide: true}}
+	post(&changed)
+	if router.invalidated != 1 {
+		t.Errorf("Expected lineups dropped once after a channel rule change, got %d", router.invalidated)
+	}
+}
+
 func TestWebServerLogsWithEntry(t *testing.T) {
 	resetLogRingBuf()
 	appendLogEntry(logEntry{
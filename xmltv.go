@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultXMLTVRefreshSeconds is how long the aggregated guide is served
+// before its sources are refetched when xmltv.refresh_seconds is unset
+const DefaultXMLTVRefreshSeconds = 3600
+
+// xmltvFetchTimeout bounds fetching one guide source
+const xmltvFetchTimeout = 60 * time.Second
+
+// XMLTVSource is one guide in the xmltv.sources list
+type XMLTVSource struct {
+	URL     string `json:"url"`               // http(s) URL or file path; .gz guides are decompressed
+	Backend string `json:"backend,omitempty"` // Backend whose channel numbers, tvg-ids and names the guide uses; empty matches any
+}
+
+// guideProvider is implemented by backends that publish an XMLTV guide for
+// their own channels
+type guideProvider interface {
+	// GuideURL returns the guide's URL, or "" if there is none
+	GuideURL() string
+}
+
+// xmltvProvider is implemented by backendRouter; it builds the guide
+// HDHREndpointServer serves from /xmltv.xml
+type xmltvProvider interface {
+	XMLTV(ctx context.Context) ([]byte, error)
+}
+
+// xmltvDoc is an XMLTV document. Channels and programmes keep their content
+// as raw XML so only the channel IDs are rewritten.
+type xmltvDoc struct {
+	XMLName    xml.Name       `xml:"tv"`
+	Attrs      []xml.Attr     `xml:",any,attr"`
+	Channels   []xmltvElement `xml:"channel"`
+	Programmes []xmltvElement `xml:"programme"`
+}
+
+// xmltvElement is a <channel> or <programme> element
+type xmltvElement struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+// attr returns the value of the named attribute
+func (e *xmltvElement) attr(name string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// setAttr replaces the value of the named attribute
+func (e *xmltvElement) setAttr(name, value string) {
+	for i := range e.Attrs {
+		if e.Attrs[i].Name.Local == name {
+			e.Attrs[i].Value = value
+		}
+	}
+}
+
+// displayNames returns a <channel>'s display-name values
+func (e *xmltvElement) displayNames() []string {
+	var names struct {
+		Names []string `xml:"display-name"`
+	}
+	xml.Unmarshal([]byte("<channel>"+e.Inner+"</channel>"), &names) //nolint:errcheck
+	return names.Names
+}
+
+// guideIndex maps what a guide may identify a channel by to the GuideNumber
+// we serve it as. Keys are prefixed by kind: "num:" a GuideNumber the
+// backend published, "id:" an XMLTV ID the backend gave, "name:" a
+// lowercased GuideName.
+type guideIndex map[string]string
+
+// add records key unless an earlier channel already claimed it
+func (gi guideIndex) add(key, guideNumber string) {
+	if _, ok := gi[key]; !ok {
+		gi[key] = guideNumber
+	}
+}
+
+// lookup finds the GuideNumber for a guide <channel>, trying its ID and then
+// its display names
+func (gi guideIndex) lookup(ch *xmltvElement) (string, bool) {
+	id := ch.attr("id")
+	keys := []string{"id:" + id, "num:" + id}
+	for _, name := range ch.displayNames() {
+		name = strings.TrimSpace(name)
+		keys = append(keys, "num:"+name, "name:"+strings.ToLower(name))
+	}
+	for _, k := range keys {
+		if n, ok := gi[k]; ok {
+			return n, true
+		}
+	}
+	return "", false
+}
+
+// guideSource is a guide to fetch and the backend whose channels it describes
+type guideSource struct {
+	url     string
+	backend string // "" for any
+}
+
+// guideSources lists the guides the backends publish, in priority order,
+// followed by the configured ones
+func (br *backendRouter) guideSources() []guideSource {
+	var sources []guideSource
+	for _, b := range br.backends {
+		if gp, ok := b.Backend.(guideProvider); ok {
+			if url := gp.GuideURL(); url != "" {
+				sources = append(sources, guideSource{url: url, backend: b.Name()})
+			}
+		}
+	}
+	if br.store != nil {
+		for _, s := range br.store.Get().XMLTV.Sources {
+			if s.URL != "" {
+				sources = append(sources, guideSource{url: s.URL, backend: s.Backend})
+			}
+		}
+	}
+	return sources
+}
+
+// fetchMissingLineups fetches the lineup of any backend the router holds none
+// for yet, so guides are matched against the numbering lineup.json serves
+// without polling the backends that syncs and lineup requests keep current
+func (br *backendRouter) fetchMissingLineups(ctx context.Context) {
+	for _, b := range br.backends {
+		br.routesMu.Lock()
+		_, ok := br.lineups[b.Backend]
+		br.routesMu.Unlock()
+		if ok {
+			continue
+		}
+		if _, err := br.refreshLineup(ctx, b.Backend, b.syncer); err != nil {
+			slog.Warn("Lineup unavailable for guide matching", "backend", b.Name(), "err", err)
+		}
+	}
+}
+
+// guideIndexFor returns the index for a guide describing backend's channels,
+// or every backend's when backend is empty, from the lineups the router holds
+func (br *backendRouter) guideIndexFor(backend string) guideIndex {
+	br.routesMu.Lock()
+	defer br.routesMu.Unlock()
+
+	index := make(guideIndex)
+	if backend == "" {
+		for _, b := range br.backends {
+			for n := range br.routes[b.Backend] {
+				index.add("num:"+n, n)
+			}
+		}
+	}
+	for _, b := range br.backends {
+		if backend != "" && b.Name() != backend {
+			continue
+		}
+		for k, n := range br.guides[b.Backend] {
+			index.add(k, n)
+		}
+	}
+	return index
+}
+
+// XMLTV fetches every guide source and merges them into one XMLTV document
+// whose channel IDs are the GuideNumbers in our lineup. Guide channels that
+// aren't in the lineup are dropped, and when several guides describe the
+// same channel the first source's listings are used. An error is returned
+// only if every source failed.
+func (br *backendRouter) XMLTV(ctx context.Context) ([]byte, error) {
+	br.fetchMissingLineups(ctx)
+
+	out := xmltvDoc{Attrs: []xml.Attr{{Name: xml.Name{Local: "generator-info-name"}, Value: "hdhomerun_proxy_go"}}}
+	owner := make(map[string]int) // GuideNumber -> index of the source whose listings are used
+	client := &http.Client{Timeout: xmltvFetchTimeout}
+	var errs []string
+	answered := false
+
+	for i, src := range br.guideSources() {
+		doc, err := fetchXMLTV(ctx, client, src.url)
+		if err != nil {
+			slog.Warn("XMLTV source unavailable", "url", src.url, "err", err)
+			errs = append(errs, fmt.Sprintf("%s: %v", src.url, err))
+			continue
+		}
+		answered = true
+
+		index := br.guideIndexFor(src.backend)
+		ids := make(map[string]string) // guide channel ID -> GuideNumber, for channels this source owns
+		for _, ch := range doc.Channels {
+			n, ok := index.lookup(&ch)
+			if !ok {
+				continue
+			}
+			if first, taken := owner[n]; taken && first != i {
+				continue
+			}
+			owner[n] = i
+			ids[ch.attr("id")] = n
+			ch.setAttr("id", n)
+			out.Channels = append(out.Channels, ch)
+		}
+		for _, p := range doc.Programmes {
+			n, ok := ids[p.attr("channel")]
+			if !ok {
+				continue
+			}
+			p.setAttr("channel", n)
+			out.Programmes = append(out.Programmes, p)
+		}
+		slog.Debug("XMLTV source merged", "url", src.url, "backend", src.backend, "channels", len(ids))
+	}
+
+	if !answered && len(errs) > 0 {
+		return nil, fmt.Errorf("no XMLTV source available: %s", strings.Join(errs, "; "))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fetchXMLTV reads and parses a guide from a URL or file, decompressing it if gzipped
+func fetchXMLTV(ctx context.Context, client *http.Client, source string) (*xmltvDoc, error) {
+	rc, err := openPathOrURL(ctx, client, source)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var r io.Reader = bufio.NewReader(rc)
+	if magic, _ := r.(*bufio.Reader).Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var doc xmltvDoc
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid XMLTV: %w", err)
+	}
+	return &doc, nil
+}
+
+// guideCache holds the most recently built guide so every /xmltv.xml
+// request doesn't refetch the sources
+type guideCache struct {
+	mu        sync.Mutex
+	data      []byte
+	fetchedAt time.Time
+}
+
+// get returns the cached guide, rebuilding it once it is older than ttl.
+// If the rebuild fails, the stale guide is returned alongside the error.
+func (gc *guideCache) get(ctx context.Context, source xmltvProvider, ttl time.Duration) ([]byte, error) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if !gc.fetchedAt.IsZero() && time.Since(gc.fetchedAt) < ttl {
+		return gc.data, nil
+	}
+
+	data, err := source.XMLTV(ctx)
+	if err != nil {
+		return gc.data, err
+	}
+	gc.data = data
+	gc.fetchedAt = time.Now()
+	return gc.data, nil
+}
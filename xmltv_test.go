@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const tunarrGuide = `<?xml version="1.0" encoding="UTF-8"?>
+<tv generator-info-name="tunarr">
+  <channel id="5"><display-name>Movies</display-name></channel>
+  <channel id="6"><display-name>Not In Lineup</display-name></channel>
+  <programme start="20260101000000 +0000" stop="20260101010000 +0000" channel="5"><title>Heat</title></programme>
+  <programme start="20260101000000 +0000" stop="20260101010000 +0000" channel="6"><title>Dropped</title></programme>
+</tv>`
+
+const otaGuide = `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="wxyz.us"><display-name>5</display-name><display-name>WXYZ</display-name></channel>
+  <channel id="movies.other"><display-name>Movies</display-name></channel>
+  <programme start="20260101000000 +0000" stop="20260101003000 +0000" channel="wxyz.us"><title lang="en">Local News</title></programme>
+  <programme start="20260101000000 +0000" stop="20260101003000 +0000" channel="movies.other"><title>Duplicate listing</title></programme>
+</tv>`
+
+// guideBackend is a fakeBackend that publishes an XMLTV guide
+type guideBackend struct {
+	fakeBackend
+	guideURL string
+}
+
+func (g *guideBackend) GuideURL() string { return g.guideURL }
+
+func TestBackendRouterXMLTV(t *testing.T) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(otaGuide)) //nolint:errcheck
+	gz.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tunarr.xml":
+			w.Write([]byte(tunarrGuide)) //nolint:errcheck
+		case "/ota.xml.gz":
+			w.Write(gzipped.Bytes()) //nolint:errcheck
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ota := &fakeBackend{name: "antenna", healthy: true, lineup: []TunarrLineupItem{{GuideNumber: "5", GuideName: "WXYZ"}}}
+	tunarr := &guideBackend{
+		fakeBackend: fakeBackend{name: "tunarr", healthy: true, lineup: []TunarrLineupItem{{GuideNumber: "5", GuideName: "Movies"}}},
+		guideURL:    srv.URL + "/tunarr.xml",
+	}
+	cfg := DefaultConfig()
+	cfg.ChannelRules = []ChannelRule{{Backend: "tunarr", Offset: 1000}}
+	cfg.XMLTV.Sources = []XMLTVSource{{URL: srv.URL + "/ota.xml.gz"}, {URL: srv.URL + "/missing.xml"}}
+	br := &backendRouter{name: "AppProxy", store: newConfigStore(cfg, "")}
+	br.backends = []routedBackend{
+		{Backend: ota, priority: 0, fallback: backendFallbackNext},
+		{Backend: tunarr, priority: 1, fallback: backendFallbackNext},
+	}
+
+	data, err := br.XMLTV(context.Background())
+	if err != nil {
+		t.Fatalf("XMLTV error: %v", err)
+	}
+	var doc xmltvDoc
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Failed to parse merged guide: %v\n%s", err, data)
+	}
+
+	var ids []string
+	for _, ch := range doc.Channels {
+		ids = append(ids, ch.attr("id"))
+	}
+	if strings.Join(ids, ",") != "1005,5" {
+		t.Errorf("Expected Tunarr's 5 renumbered to 1005 and the OTA channel as 5, got %v", ids)
+	}
+
+	titles := map[string]string{}
+	for _, p := range doc.Programmes {
+		titles[p.attr("channel")] += p.Inner
+	}
+	if !strings.Contains(titles["1005"], "Heat") || strings.Contains(titles["1005"], "Duplicate") {
+		t.Errorf("Expected 1005's listings from Tunarr's guide only, got %q", titles["1005"])
+	}
+	if !strings.Contains(titles["5"], `<title lang="en">Local News</title>`) {
+		t.Errorf("Expected the OTA listing to keep its content, got %q", titles["5"])
+	}
+	if strings.Contains(string(data), "Dropped") {
+		t.Error("Expected listings for channels outside the lineup to be dropped")
+	}
+}
+
+func TestXMLTVEndpointCaches(t *testing.T) {
+	calls := 0
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(tunarrGuide)) //nolint:errcheck
+	}))
+	defer src.Close()
+
+	cfg := DefaultConfig()
+	cfg.XMLTV.Sources = []XMLTVSource{{URL: src.URL}}
+	br := fakeChain([]*fakeBackend{{name: "tunarr", healthy: true, lineup: []TunarrLineupItem{{GuideNumber: "5", GuideName: "Movies"}}}})
+	br.store = newConfigStore(cfg, "")
+	handler := NewHDHREndpointServer(br.store, br).Handler()
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/xmltv.xml", nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<channel id="5">`) {
+			t.Fatalf("Expected the guide, got %d %q", w.Code, w.Body.String())
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected the guide to be served from cache, fetched %d times", calls)
+	}
+}
+
+func TestXMLTVUsesStoredLineups(t *testing.T) {
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(tunarrGuide)) //nolint:errcheck
+	}))
+	defer src.Close()
+
+	cfg := DefaultConfig()
+	cfg.XMLTV.Sources = []XMLTVSource{{URL: src.URL}}
+	tunarr := &fakeBackend{name: "tunarr", healthy: true, lineup: []TunarrLineupItem{{GuideNumber: "5", GuideName: "Movies"}}}
+	br := fakeChain([]*fakeBackend{tunarr})
+	br.store = newConfigStore(cfg, "")
+
+	for i := 0; i < 2; i++ {
+		data, err := br.XMLTV(context.Background())
+		if err != nil || !strings.Contains(string(data), `<channel id="5">`) {
+			t.Fatalf("Expected the guide, got %q, %v", data, err)
+		}
+	}
+	if tunarr.fetches != 1 {
+		t.Errorf("Expected the lineup fetched once and then reused, fetched %d times", tunarr.fetches)
+	}
+}